@@ -6,74 +6,231 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // cookies are stored in a 3 part (value + timestamp + signature) to enforce that the values are as originally set.
-// additionally, the 'value' is encrypted so it's opaque to the browser
+// additionally, the 'value' is encrypted so it's opaque to the browser.
+// Cookies with an explicit expiry have 4 parts (value + issue timestamp + expiry timestamp + signature).
 
-// Validate ensures a cookie is properly signed
+// DefaultClockSkew is how far the clocks of the servers signing and
+// validating a cookie may disagree
+const DefaultClockSkew = 5 * time.Minute
+
+// Hash is the hash function of the HMAC signing a cookie
+type Hash string
+
+// Hashes of cookie signatures. Earlier versions signed cookies with SHA1.
+const (
+	SHA1   Hash = "sha1"
+	SHA256 Hash = "sha256"
+)
+
+// Hashes are the hashes cookies can be signed with
+var Hashes = []Hash{SHA1, SHA256}
+
+func (h Hash) new() func() hash.Hash {
+	switch h {
+	case SHA1:
+		return sha1.New
+	case SHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+// size returns the length of the signatures of h, 0 if h is unknown
+func (h Hash) size() int {
+	switch h {
+	case SHA1:
+		return sha1.Size
+	case SHA256:
+		return sha256.Size
+	}
+	return 0
+}
+
+// macPool pools the HMACs of a hash keyed with a seed, as creating one
+// allocates its hashes and padded keys for every cookie signed or checked
+type macPool struct {
+	hash Hash
+	seed string
+	sync.Pool
+}
+
+// mac is a pooled HMAC with a buffer for what it signs and its signature
+type mac struct {
+	hash.Hash
+	buf []byte
+}
+
+var (
+	// macPools holds a []*macPool, replaced under macPoolsMu when a pool
+	// is added, so finding the pool of a seed doesn't lock. Seeds are few,
+	// the cookie secrets a proxy is configured with.
+	macPools   atomic.Value
+	macPoolsMu sync.Mutex
+)
+
+// macs returns the pool of HMACs of hash keyed with seed
+func macs(hash Hash, seed string) *sync.Pool {
+	pools, _ := macPools.Load().([]*macPool)
+	for _, p := range pools {
+		if p.hash == hash && p.seed == seed {
+			return &p.Pool
+		}
+	}
+	macPoolsMu.Lock()
+	defer macPoolsMu.Unlock()
+	pools, _ = macPools.Load().([]*macPool)
+	for _, p := range pools {
+		if p.hash == hash && p.seed == seed {
+			return &p.Pool
+		}
+	}
+	p := &macPool{hash: hash, seed: seed}
+	p.New = func() interface{} { return &mac{Hash: hmac.New(hash.new(), []byte(seed))} }
+	macPools.Store(append(pools[:len(pools):len(pools)], p))
+	return &p.Pool
+}
+
+// sum returns the signature of args, in the buffer of m, so only valid until
+// m is signing again
+func (m *mac) sum(args ...string) []byte {
+	m.Reset()
+	m.buf = m.buf[:0]
+	for _, arg := range args {
+		m.buf = append(m.buf, arg...)
+	}
+	m.Write(m.buf)
+	m.buf = m.Sum(m.buf[:0])
+	return m.buf
+}
+
+// Validate ensures a cookie is properly signed, with any of the Hashes
 func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value string, t time.Time, ok bool) {
-	// value, timestamp, sig
+	return ValidateHashes(cookie, seed, expiration, Hashes...)
+}
+
+// ValidateHashes ensures a cookie is properly signed with one of hashes
+func ValidateHashes(cookie *http.Cookie, seed string, expiration time.Duration, hashes ...Hash) (value string, t time.Time, ok bool) {
+	v := Check(cookie, seed, expiration, DefaultClockSkew, time.Now(), hashes...)
+	return v.Value, v.Issued, v.OK
+}
+
+// Validation is the outcome of Check
+type Validation struct {
+	Value  string
+	Issued time.Time
+	// Ahead is how far Issued is ahead of the clock of the validating
+	// server, 0 if it isn't
+	Ahead time.Duration
+	// OK is set for a properly signed cookie issued and not yet expired
+	// within the clock skew
+	OK bool
+}
+
+// Check validates a cookie signed with one of hashes at now. The browser
+// doesn't send back the expiry of the cookie, so the cookie must have been
+// issued less than expiration ago, and before its own expiry if it has one.
+// The clock of the server which issued it may be up to skew ahead or behind
+// now.
+func Check(cookie *http.Cookie, seed string, expiration, skew time.Duration, now time.Time, hashes ...Hash) (v Validation) {
+	// value, timestamp[, expiry], sig
 	parts := strings.Split(cookie.Value, "|")
-	if len(parts) != 3 {
+	var signed bool
+	switch len(parts) {
+	case 3:
+		signed = checkSignature(parts[2], hashes, seed, cookie.Name, parts[0], parts[1])
+	case 4:
+		signed = checkSignature(parts[3], hashes, seed, cookie.Name, parts[0], parts[1], "|", parts[2])
+	}
+	if !signed {
+		return
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
 		return
 	}
-	sig := cookieSignature(seed, cookie.Name, parts[0], parts[1])
-	if checkHmac(parts[2], sig) {
-		ts, err := strconv.Atoi(parts[1])
+	v.Issued = time.Unix(ts, 0)
+	expires := v.Issued.Add(expiration)
+	if len(parts) == 4 {
+		ts, err := strconv.ParseInt(parts[2], 10, 64)
 		if err != nil {
 			return
 		}
-		// The expiration timestamp set when the cookie was created
-		// isn't sent back by the browser. Hence, we check whether the
-		// creation timestamp stored in the cookie falls within the
-		// window defined by (Now()-expiration, Now()].
-		t = time.Unix(int64(ts), 0)
-		if t.After(time.Now().Add(expiration*-1)) && t.Before(time.Now().Add(time.Minute*5)) {
-			// it's a valid cookie. now get the contents
-			rawValue, err := base64.URLEncoding.DecodeString(parts[0])
-			if err == nil {
-				value = string(rawValue)
-				ok = true
-				return
-			}
+		if e := time.Unix(ts, 0); e.Before(expires) {
+			expires = e
 		}
 	}
+	if v.Issued.After(now) {
+		v.Ahead = v.Issued.Sub(now)
+	}
+	if v.Ahead > skew || !now.Before(expires.Add(skew)) {
+		return
+	}
+	rawValue, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return
+	}
+	v.Value, v.OK = string(rawValue), true
 	return
 }
 
-// SignedValue returns a cookie that is signed and can later be checked with Validate
+// SignedValue returns a cookie that is signed with SHA256 and can later be checked with Validate
 func SignedValue(seed string, key string, value string, now time.Time) string {
+	return SignedValueHash(SHA256, seed, key, value, now)
+}
+
+// SignedValueHash returns a cookie that is signed with h and can later be checked with Validate
+func SignedValueHash(h Hash, seed string, key string, value string, now time.Time) string {
 	encodedValue := base64.URLEncoding.EncodeToString([]byte(value))
 	timeStr := fmt.Sprintf("%d", now.Unix())
-	sig := cookieSignature(seed, key, encodedValue, timeStr)
+	sig := base64.URLEncoding.EncodeToString(cookieSignature(h, seed, key, encodedValue, timeStr))
 	cookieVal := fmt.Sprintf("%s|%s|%s", encodedValue, timeStr, sig)
 	return cookieVal
 }
 
-func cookieSignature(args ...string) string {
-	h := hmac.New(sha1.New, []byte(args[0]))
-	for _, arg := range args[1:] {
-		h.Write([]byte(arg))
-	}
-	var b []byte
-	b = h.Sum(b)
-	return base64.URLEncoding.EncodeToString(b)
+// SignedValueExpiring returns a cookie that is signed with h, carrying its
+// expiry as well as when it was issued, which Check honours even if it is
+// given a longer expiration
+func SignedValueExpiring(h Hash, seed string, key string, value string, now, expires time.Time) string {
+	encodedValue := base64.URLEncoding.EncodeToString([]byte(value))
+	timeStr := fmt.Sprintf("%d|%d", now.Unix(), expires.Unix())
+	sig := base64.URLEncoding.EncodeToString(cookieSignature(h, seed, key, encodedValue, timeStr))
+	return fmt.Sprintf("%s|%s|%s", encodedValue, timeStr, sig)
+}
+
+func cookieSignature(hash Hash, seed string, args ...string) []byte {
+	pool := macs(hash, seed)
+	m := pool.Get().(*mac)
+	defer pool.Put(m)
+	return append([]byte(nil), m.sum(args...)...)
 }
 
-func checkHmac(input, expected string) bool {
-	inputMAC, err1 := base64.URLEncoding.DecodeString(input)
-	if err1 == nil {
-		expectedMAC, err2 := base64.URLEncoding.DecodeString(expected)
-		if err2 == nil {
-			return hmac.Equal(inputMAC, expectedMAC)
+// checkSignature reports whether input is the signature of args with any of
+// hashes, told apart by their length, comparing in constant time
+func checkSignature(input string, hashes []Hash, seed string, args ...string) bool {
+	inputMAC, err := base64.URLEncoding.DecodeString(input)
+	if err != nil {
+		return false
+	}
+	for _, h := range hashes {
+		if size := h.size(); size != 0 && size == len(inputMAC) {
+			pool := macs(h, seed)
+			m := pool.Get().(*mac)
+			defer pool.Put(m)
+			return hmac.Equal(inputMAC, m.sum(args...))
 		}
 	}
 	return false
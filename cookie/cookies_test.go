@@ -1,8 +1,13 @@
 package cookie
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncodeAndDecodeAccessToken(t *testing.T) {
@@ -61,3 +66,101 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 		t.Errorf("token %+v does not match decode value %+v", token, decoded)
 	}
 }
+
+func TestSignedValue(t *testing.T) {
+	const seed = "secret"
+	c := &http.Cookie{Name: "_ldap_proxy", Value: SignedValue(seed, "_ldap_proxy", "michael", time.Now())}
+	parts := strings.Split(c.Value, "|")
+	if sig, err := base64.URLEncoding.DecodeString(parts[2]); err != nil || len(sig) != sha256.Size {
+		t.Fatalf("not signed with sha256: %q", c.Value)
+	}
+	if value, _, ok := Validate(c, seed, time.Hour); !ok || value != "michael" {
+		t.Errorf("unexpected result %q %v", value, ok)
+	}
+	if _, _, ok := Validate(c, "other secret", time.Hour); ok {
+		t.Error("validated with the wrong secret")
+	}
+	if _, _, ok := Validate(&http.Cookie{Name: "other", Value: c.Value}, seed, time.Hour); ok {
+		t.Error("validated under another name")
+	}
+
+	c.Value = strings.Join([]string{base64.URLEncoding.EncodeToString([]byte("admin")), parts[1], parts[2]}, "|")
+	if _, _, ok := Validate(c, seed, time.Hour); ok {
+		t.Error("validated a changed value")
+	}
+}
+
+func TestValidateHashes(t *testing.T) {
+	const seed = "secret"
+	legacy := &http.Cookie{Name: "_ldap_proxy", Value: SignedValueHash(SHA1, seed, "_ldap_proxy", "michael", time.Now())}
+	if value, _, ok := Validate(legacy, seed, time.Hour); !ok || value != "michael" {
+		t.Errorf("sha1 cookie not validated: %q %v", value, ok)
+	}
+	if _, _, ok := ValidateHashes(legacy, seed, time.Hour, SHA256); ok {
+		t.Error("sha1 cookie validated without accepting sha1")
+	}
+
+	c := &http.Cookie{Name: "_ldap_proxy", Value: SignedValue(seed, "_ldap_proxy", "michael", time.Now())}
+	if _, _, ok := ValidateHashes(c, seed, time.Hour, SHA1); ok {
+		t.Error("sha256 cookie validated accepting only sha1")
+	}
+	if _, _, ok := ValidateHashes(c, seed, time.Hour, SHA256, SHA1); !ok {
+		t.Error("sha256 cookie not validated")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const seed = "secret"
+	now := time.Unix(1700000000, 0)
+	check := func(value string, at time.Time) Validation {
+		return Check(&http.Cookie{Name: "_ldap_proxy", Value: value}, seed, time.Hour, time.Minute, at, SHA256)
+	}
+
+	expiring := SignedValueExpiring(SHA256, seed, "_ldap_proxy", "michael", now, now.Add(10*time.Minute))
+	if v := check(expiring, now.Add(9*time.Minute)); !v.OK || v.Value != "michael" || !v.Issued.Equal(now) {
+		t.Errorf("expected the cookie to be valid before its expiry, got %+v", v)
+	}
+	// the expiry is honoured within the skew, even though the expiration is
+	// longer
+	if v := check(expiring, now.Add(10*time.Minute+30*time.Second)); !v.OK {
+		t.Errorf("expected the cookie to be valid within the skew, got %+v", v)
+	}
+	if v := check(expiring, now.Add(12*time.Minute)); v.OK {
+		t.Errorf("expected the cookie to have expired, got %+v", v)
+	}
+
+	// issued by a server whose clock is ahead
+	if v := check(expiring, now.Add(-30*time.Second)); !v.OK || v.Ahead != 30*time.Second {
+		t.Errorf("expected the cookie to be valid 30s ahead, got %+v", v)
+	}
+	if v := check(expiring, now.Add(-2*time.Minute)); v.OK || v.Ahead != 2*time.Minute {
+		t.Errorf("expected the cookie to be rejected 2m ahead, got %+v", v)
+	}
+
+	// cookies without an expiry last the expiration
+	legacy := SignedValueHash(SHA256, seed, "_ldap_proxy", "michael", now)
+	if v := check(legacy, now.Add(59*time.Minute)); !v.OK {
+		t.Errorf("expected the cookie without an expiry to be valid, got %+v", v)
+	}
+	if v := check(legacy, now.Add(62*time.Minute)); v.OK {
+		t.Errorf("expected the cookie without an expiry to have expired, got %+v", v)
+	}
+
+	// the expiry is signed
+	parts := strings.Split(expiring, "|")
+	parts[2] = strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+	if v := check(strings.Join(parts, "|"), now); v.OK {
+		t.Error("validated a changed expiry")
+	}
+}
+
+func BenchmarkCheck(b *testing.B) {
+	now := time.Now()
+	c := &http.Cookie{Name: "_ldap_proxy", Value: SignedValueExpiring(SHA256, "seed", "_ldap_proxy", "session", now, now.Add(time.Hour))}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if !Check(c, "seed", time.Hour, DefaultClockSkew, now, Hashes...).OK {
+			b.Fatal("expected the cookie to be valid")
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skybet/ldap_proxy/proxy"
+)
+
+// exportAccess implements the export-access subcommand, printing who has
+// access to each upstream in format
+func exportAccess(opts *proxy.Options, format string) int {
+	if format != proxy.AccessExportJSON && format != proxy.AccessExportCSV {
+		fmt.Fprintf(os.Stderr, "export-access: -format must be %s or %s\n", proxy.AccessExportJSON, proxy.AccessExportCSV)
+		return 2
+	}
+	e, err := proxy.ExportAccess(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export-access: %s\n", err)
+		return 1
+	}
+	if format == proxy.AccessExportCSV {
+		err = e.WriteCSV(os.Stdout)
+	} else {
+		err = e.WriteJSON(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export-access: %s\n", err)
+		return 1
+	}
+	for _, g := range e.Grants {
+		if g.Error != "" {
+			// the export is incomplete
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,178 @@
+package geoip
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Types of the values of the data section
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+// maxDepth bounds the maps, arrays and pointers a value may be nested in, so
+// a pointer to itself can't recurse forever
+const maxDepth = 512
+
+// decoder decodes the values of a data section, or of the metadata, whose
+// pointers are offsets into it
+type decoder []byte
+
+// decode returns the value at offset and the offset after it
+func (d decoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeAt(offset, 0)
+}
+
+// decodeAt decodes the value at offset, nested depth deep
+func (d decoder) decodeAt(offset, depth uint) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("invalid MaxMind DB: values nested more than %d deep", maxDepth)
+	}
+	ctrl, offset, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	typ, size := uint(ctrl[0]>>5), uint(ctrl[0]&0x1f)
+	if typ == typePointer {
+		return d.decodePointer(size, offset, depth)
+	}
+	if typ == typeExtended {
+		b, next, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ, offset = 7+uint(b[0]), next
+	}
+	if size >= 29 {
+		b, next, err := d.bytes(offset, size-28)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset = next
+		switch n := uintOf(b); size {
+		case 29:
+			size = 29 + uint(n)
+		case 30:
+			size = 285 + uint(n)
+		default:
+			size = 65821 + uint(n)
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("invalid MaxMind DB: map key %v isn't a string", k)
+			}
+			if m[key], offset, err = d.decodeAt(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			if a[i], offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	b, next, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errInvalid
+		}
+		return math.Float64frombits(uintOf(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errInvalid
+		}
+		return float64(math.Float32frombits(uint32(uintOf(b)))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errInvalid
+		}
+		return uintOf(b), next, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errInvalid
+		}
+		return int64(int32(uint32(uintOf(b)))), next, nil
+	}
+	return nil, 0, fmt.Errorf("invalid MaxMind DB: unsupported data type %d", typ)
+}
+
+// decodePointer decodes the value a pointer, whose size bits are size and
+// whose bytes start at offset, points to
+func (d decoder) decodePointer(size, offset, depth uint) (interface{}, uint, error) {
+	n := size>>3 + 1
+	b, next, err := d.bytes(offset, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := uint(uintOf(b))
+	switch n {
+	case 1:
+		p |= (size & 7) << 8
+	case 2:
+		p = ((size&7)<<16 | p) + 2048
+	case 3:
+		p = ((size&7)<<24 | p) + 526336
+	}
+	v, _, err := d.decodeAt(p, depth+1)
+	return v, next, err
+}
+
+// bytes returns the n bytes at offset and the offset after them
+func (d decoder) bytes(offset, n uint) ([]byte, uint, error) {
+	if offset+n > uint(len(d)) || offset+n < offset {
+		return nil, 0, errInvalid
+	}
+	return d[offset : offset+n], offset + n, nil
+}
+
+// uintOf decodes the big-endian unsigned integer b of up to 8 bytes
+func uintOf(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
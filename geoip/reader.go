@@ -0,0 +1,155 @@
+// Package geoip looks up the countries of client addresses in MaxMind DB
+// files, such as MaxMind's GeoLite2-Country.mmdb or GeoIP2-City.mmdb, for
+// logging and access rules.
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// metadataMarker precedes the metadata at the end of a database
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errInvalid = errors.New("invalid MaxMind DB")
+
+// Reader looks addresses up in a MaxMind DB held in memory. It is safe for
+// concurrent use.
+type Reader struct {
+	// DatabaseType is the type the metadata gives, e.g. GeoLite2-Country
+	DatabaseType string
+
+	tree       []byte
+	data       decoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+// Open reads the database in filename
+func Open(filename string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := New(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return r, nil
+}
+
+// New returns a Reader for the database in buf
+func New(buf []byte) (*Reader, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB (no metadata)")
+	}
+	v, _, err := decoder(buf[i+len(metadataMarker):]).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid
+	}
+	r := &Reader{}
+	r.DatabaseType, _ = metadata["database_type"].(string)
+	r.nodeCount = uintValue(metadata["node_count"])
+	r.recordSize = uintValue(metadata["record_size"])
+	r.ipVersion = uintValue(metadata["ip_version"])
+	switch {
+	case r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	case r.ipVersion != 4 && r.ipVersion != 6:
+		return nil, fmt.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+
+	// the search tree is followed by 16 zero bytes and the data section
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errInvalid
+	}
+	r.tree, r.data = buf[:treeSize], decoder(buf[treeSize+16:i])
+
+	// IPv4 addresses are looked up as ::a.b.c.d in IPv6 databases
+	for bit := 0; bit < 96 && r.ipv4Start < r.nodeCount; bit++ {
+		r.ipv4Start = r.record(r.ipv4Start, 0)
+	}
+	return r, nil
+}
+
+func uintValue(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (r *Reader) record(node, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	b = b[bit*4:]
+	return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+}
+
+// Lookup returns the data the database has for ip, decoded into maps,
+// slices, strings, uint64s, int64s, float64s and bools, or nil if it has
+// none
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node, bits := uint(0), ip.To4()
+	switch {
+	case bits != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+	case bits == nil && r.ipVersion == 4:
+		return nil, fmt.Errorf("can't look up IPv6 address %s in an IPv4 database", ip)
+	case bits == nil:
+		if bits = ip.To16(); bits == nil {
+			return nil, fmt.Errorf("invalid IP address %v", ip)
+		}
+	}
+	for i := uint(0); i < uint(len(bits))*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errInvalid
+	}
+	v, _, err := r.data.decode(node - r.nodeCount - 16)
+	return v, err
+}
+
+// Country returns the ISO 3166-1 code of the country ip is in, e.g. GB, or
+// of the country it is registered in if the database doesn't know where it
+// is. It is empty for addresses the database doesn't have, such as private
+// ones.
+func (r *Reader) Country(ip net.IP) (string, error) {
+	v, err := r.Lookup(ip)
+	if err != nil || v == nil {
+		return "", err
+	}
+	m, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := m[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok && code != "" {
+				return strings.ToUpper(code), nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,213 @@
+package geoip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encoder writes the data section of a test database
+type encoder struct{ bytes.Buffer }
+
+func (e *encoder) control(typ, size int) {
+	if typ > 7 {
+		e.WriteByte(byte(size))
+		e.WriteByte(byte(typ - 7))
+		return
+	}
+	e.WriteByte(byte(typ<<5 | size))
+}
+
+func (e *encoder) string(s string) {
+	e.control(typeString, len(s))
+	e.WriteString(s)
+}
+
+func (e *encoder) uint(typ int, n uint64) {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	e.control(typ, len(b))
+	e.Write(b)
+}
+
+func (e *encoder) pointer(offset int) {
+	e.WriteByte(byte(typePointer<<5 | offset>>8))
+	e.WriteByte(byte(offset))
+}
+
+// testDatabase returns a database with the given record size and IP version
+// placing the networks in the countries they map to
+func testDatabase(t *testing.T, recordSize, ipVersion int, networks map[string]string) []byte {
+	t.Helper()
+	data := &encoder{}
+	countries := map[string]int{}
+	records := map[string]int{}
+	for network, country := range networks {
+		// records point to one map per country, as in MaxMind's databases
+		if _, ok := countries[country]; !ok {
+			countries[country] = data.Len()
+			data.control(typeMap, 1)
+			data.string("iso_code")
+			data.string(country)
+		}
+		records[network] = data.Len()
+		data.control(typeMap, 1)
+		data.string("country")
+		data.pointer(countries[country])
+	}
+
+	type node struct{ next, data [2]int }
+	nodes := []*node{{next: [2]int{-1, -1}, data: [2]int{-1, -1}}}
+	for network, offset := range records {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, ones := []byte(ipNet.IP), 0
+		if len(ip) == net.IPv4len && ipVersion == 6 {
+			ip, ones = append(make([]byte, 12), ip...), 96
+		}
+		bits, _ := ipNet.Mask.Size()
+		ones += bits
+		n := nodes[0]
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i)%8)) & 1
+			if i == ones-1 {
+				n.data[bit] = offset
+				break
+			}
+			if n.next[bit] < 0 {
+				n.next[bit] = len(nodes)
+				nodes = append(nodes, &node{next: [2]int{-1, -1}, data: [2]int{-1, -1}})
+			}
+			n = nodes[n.next[bit]]
+		}
+	}
+
+	db := &bytes.Buffer{}
+	for _, n := range nodes {
+		var records [2]uint32
+		for bit := range records {
+			switch {
+			case n.next[bit] >= 0:
+				records[bit] = uint32(n.next[bit])
+			case n.data[bit] >= 0:
+				records[bit] = uint32(len(nodes) + 16 + n.data[bit])
+			default:
+				records[bit] = uint32(len(nodes))
+			}
+		}
+		l, r := records[0], records[1]
+		switch recordSize {
+		case 24:
+			db.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			db.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>20&0xf0 | r>>24&0x0f), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 32:
+			db.Write([]byte{byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 24), byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.Write(metadataMarker)
+
+	metadata := &encoder{}
+	metadata.control(typeMap, 4)
+	metadata.string("database_type")
+	metadata.string("Test-Country")
+	metadata.string("ip_version")
+	metadata.uint(typeUint16, uint64(ipVersion))
+	metadata.string("node_count")
+	metadata.uint(typeUint32, uint64(len(nodes)))
+	metadata.string("record_size")
+	metadata.uint(typeUint16, uint64(recordSize))
+	db.Write(metadata.Bytes())
+	return db.Bytes()
+}
+
+func TestCountry(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		networks := map[string]string{
+			"81.2.69.0/24":   "GB",
+			"1.0.0.0/8":      "au",
+			"203.0.113.0/28": "CN",
+		}
+		if ipVersion == 6 {
+			networks["2001:db8::/32"] = "DE"
+		}
+		for _, recordSize := range []int{24, 28, 32} {
+			r, err := New(testDatabase(t, recordSize, ipVersion, networks))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.DatabaseType != "Test-Country" {
+				t.Errorf("unexpected database type %q", r.DatabaseType)
+			}
+			expected := map[string]string{
+				"81.2.69.160":  "GB",
+				"1.2.3.4":      "AU",
+				"203.0.113.15": "CN",
+				"203.0.113.16": "",
+				"10.0.0.1":     "",
+			}
+			if ipVersion == 6 {
+				expected["2001:db8::1"] = "DE"
+				expected["::ffff:81.2.69.1"] = "GB"
+				expected["2001:db9::1"] = ""
+			}
+			for ip, country := range expected {
+				if c, err := r.Country(net.ParseIP(ip)); err != nil || c != country {
+					t.Errorf("IPv%d, %d bit records: expected %s to be in %q, got %q %v", ipVersion, recordSize, ip, country, c, err)
+				}
+			}
+			if ipVersion == 4 {
+				if _, err := r.Country(net.ParseIP("2001:db8::1")); err == nil {
+					t.Error("expected an error looking up an IPv6 address in an IPv4 database")
+				}
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	// testdata/Test-Country.mmdb, which the proxy's tests use too, was
+	// written by testDatabase
+	r, err := Open("testdata/Test-Country.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, country := range map[string]string{"81.2.69.1": "GB", "203.0.113.9": "CN", "2001:db8::1": "DE", "192.0.2.1": ""} {
+		if c, _ := r.Country(net.ParseIP(ip)); c != country {
+			t.Errorf("%s: expected %q, got %q", ip, country, c)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "invalid.mmdb")
+	for _, buf := range [][]byte{[]byte("not a database"), append(append([]byte(nil), metadataMarker...), 0xe1, 0x41, 'x', 0x41)} {
+		if err := ioutil.WriteFile(filename, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(filename); err == nil {
+			t.Errorf("%q: expected an error", buf)
+		}
+	}
+}
+
+func TestDecodeSelfPointer(t *testing.T) {
+	// a pointer to itself, and a map whose value points back to the map
+	for _, d := range []decoder{{0x20, 0x00}, {0xe1, 0x41, 'x', 0x20, 0x00}} {
+		if _, _, err := d.decode(0); err == nil {
+			t.Errorf("%x: expected an error", []byte(d))
+		}
+	}
+}
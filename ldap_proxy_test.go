@@ -1,163 +0,0 @@
-package main
-
-import (
-	"io"
-	"io/ioutil"
-	"log"
-	"net"
-	"net/http"
-	"net/http/httptest"
-	"net/url"
-	"testing"
-
-	"github.com/18F/hmacauth"
-)
-
-func init() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-
-}
-
-func TestNewReverseProxy(t *testing.T) {
-	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		hostname, _, _ := net.SplitHostPort(r.Host)
-		w.Write([]byte(hostname))
-	}))
-	defer backend.Close()
-
-	backendURL, _ := url.Parse(backend.URL)
-	backendHostname, backendPort, _ := net.SplitHostPort(backendURL.Host)
-	backendHost := net.JoinHostPort(backendHostname, backendPort)
-	proxyURL, _ := url.Parse(backendURL.Scheme + "://" + backendHost + "/")
-
-	proxyHandler := NewReverseProxy(proxyURL)
-	setProxyUpstreamHostHeader(proxyHandler, proxyURL)
-	frontend := httptest.NewServer(proxyHandler)
-	defer frontend.Close()
-
-	getReq, _ := http.NewRequest("GET", frontend.URL, nil)
-	res, _ := http.DefaultClient.Do(getReq)
-	bodyBytes, _ := ioutil.ReadAll(res.Body)
-	if g, e := string(bodyBytes), backendHostname; g != e {
-		t.Errorf("got body %q; expected %q", g, e)
-	}
-}
-
-func TestEncodedSlashes(t *testing.T) {
-	var seen string
-	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		seen = r.RequestURI
-	}))
-	defer backend.Close()
-
-	b, _ := url.Parse(backend.URL)
-	proxyHandler := NewReverseProxy(b)
-	setProxyDirector(proxyHandler)
-	frontend := httptest.NewServer(proxyHandler)
-	defer frontend.Close()
-
-	f, _ := url.Parse(frontend.URL)
-	encodedPath := "/a%2Fb/?c=1"
-	getReq := &http.Request{URL: &url.URL{Scheme: "http", Host: f.Host, Opaque: encodedPath}}
-	_, err := http.DefaultClient.Do(getReq)
-	if err != nil {
-		t.Fatalf("err %s", err)
-	}
-	if seen != encodedPath {
-		t.Errorf("got bad request %q expected %q", seen, encodedPath)
-	}
-}
-
-type SignatureAuthenticator struct {
-	auth hmacauth.HmacAuth
-}
-
-func (v *SignatureAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) {
-	result, headerSig, computedSig := v.auth.AuthenticateRequest(r)
-	if result == hmacauth.ResultNoSignature {
-		w.Write([]byte("no signature received"))
-	} else if result == hmacauth.ResultMatch {
-		w.Write([]byte("signatures match"))
-	} else if result == hmacauth.ResultMismatch {
-		w.Write([]byte("signatures do not match:" +
-			"\n  received: " + headerSig +
-			"\n  computed: " + computedSig))
-	} else {
-		panic("Unknown result value: " + result.String())
-	}
-}
-
-type SignatureTest struct {
-	opts          *Options
-	upstream      *httptest.Server
-	upstreamHost  string
-	provider      *httptest.Server
-	header        http.Header
-	rw            *httptest.ResponseRecorder
-	authenticator *SignatureAuthenticator
-}
-
-func (st *SignatureTest) Close() {
-	st.provider.Close()
-	st.upstream.Close()
-}
-
-// fakeNetConn simulates an http.Request.Body buffer that will be consumed
-// when it is read by the hmacauth.HmacAuth if not handled properly. See:
-//   https://github.com/18F/hmacauth/pull/4
-type fakeNetConn struct {
-	reqBody string
-}
-
-func (fnc *fakeNetConn) Read(p []byte) (n int, err error) {
-	if bodyLen := len(fnc.reqBody); bodyLen != 0 {
-		copy(p, fnc.reqBody)
-		fnc.reqBody = ""
-		return bodyLen, io.EOF
-	}
-	return 0, io.EOF
-}
-
-func TestSliceContainsString(t *testing.T) {
-	testCases := []struct {
-		desc   string
-		a      []string
-		b      []string
-		expect bool
-	}{
-		{
-			desc:   "happy path",
-			a:      []string{"a", "b", "c"},
-			b:      []string{"b"},
-			expect: true,
-		},
-		{
-			desc:   "happy path case insensitive",
-			a:      []string{"a", "B", "c"},
-			b:      []string{"b"},
-			expect: true,
-		},
-		{
-			desc:   "empty",
-			a:      []string{},
-			b:      []string{},
-			expect: false,
-		},
-		{
-			desc:   "doesn't intersect",
-			a:      []string{"a", "b", "c"},
-			b:      []string{"z"},
-			expect: false,
-		},
-	}
-
-	for _, tC := range testCases {
-		t.Run(tC.desc, func(t *testing.T) {
-			if res := sliceContainsString(tC.a, tC.b); res != tC.expect {
-				t.Errorf("with a %+v and b %+v, expected %+v, got %v", tC.a, tC.b, tC.expect, res)
-			}
-		})
-	}
-}
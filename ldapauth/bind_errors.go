@@ -0,0 +1,68 @@
+package ldapauth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// Reasons a directory rejected a user's bind
+const (
+	BindInvalidCredentials = "invalid_credentials"
+	BindAccountLocked      = "account_locked"
+	BindAccountDisabled    = "account_disabled"
+	BindAccountExpired     = "account_expired"
+	BindPasswordExpired    = "password_expired"
+	BindPasswordMustChange = "password_must_change"
+	BindLogonRestricted    = "logon_restricted"
+)
+
+// adDataCodes maps the data code in the diagnostic message of Active
+// Directory's invalid credentials result to a reason, e.g.
+// "80090308: LdapErr: DSID-0C09030B, comment: AcceptSecurityContext error, data 775, v4563"
+var adDataCodes = map[string]string{
+	"525": BindInvalidCredentials, // user not found
+	"52e": BindInvalidCredentials,
+	"530": BindLogonRestricted, // not permitted to logon at this time
+	"531": BindLogonRestricted, // not permitted to logon at this workstation
+	"532": BindPasswordExpired,
+	"533": BindAccountDisabled,
+	"701": BindAccountExpired,
+	"773": BindPasswordMustChange,
+	"775": BindAccountLocked,
+}
+
+var adDataCodeRegex = regexp.MustCompile(`\bdata ([0-9a-fA-F]+)\b`)
+
+// BindError is a user's bind rejected by the directory for Reason
+type BindError struct {
+	Reason string
+	Err    error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("bind rejected (%s): %v", e.Reason, e.Err)
+}
+
+// Account reports whether the bind was rejected because of the state of the
+// account rather than the password given
+func (e *BindError) Account() bool {
+	return e.Reason != BindInvalidCredentials
+}
+
+// bindFailure returns a *BindError for a bind rejected with invalid
+// credentials, and err unchanged for any other failure
+func bindFailure(err error) error {
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return err
+	}
+	reason := BindInvalidCredentials
+	if m := adDataCodeRegex.FindStringSubmatch(err.(*ldap.Error).Err.Error()); m != nil {
+		if r, ok := adDataCodes[strings.ToLower(m[1])]; ok {
+			reason = r
+		}
+	}
+	return &BindError{Reason: reason, Err: err}
+}
@@ -0,0 +1,32 @@
+package ldapauth
+
+import (
+	"errors"
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestBindFailure(t *testing.T) {
+	for diagnostic, expected := range map[string]string{
+		"80090308: LdapErr: DSID-0C09030B, comment: AcceptSecurityContext error, data 775, v4563": BindAccountLocked,
+		"80090308: LdapErr: DSID-0C09030B, comment: AcceptSecurityContext error, data 533, v4563": BindAccountDisabled,
+		"80090308: LdapErr: DSID-0C09030B, comment: AcceptSecurityContext error, data 52e, v4563": BindInvalidCredentials,
+		"80090308: LdapErr: DSID-0C09030B, comment: AcceptSecurityContext error, data 999, v4563": BindInvalidCredentials,
+		"": BindInvalidCredentials,
+	} {
+		err := bindFailure(ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New(diagnostic)))
+		be, ok := err.(*BindError)
+		if !ok || be.Reason != expected {
+			t.Errorf("%q: expected %s got %v", diagnostic, expected, err)
+		}
+		if ok && be.Account() != (expected != BindInvalidCredentials) {
+			t.Errorf("%q: unexpected Account() %v", diagnostic, be.Account())
+		}
+	}
+
+	err := ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset"))
+	if bindFailure(err) != err {
+		t.Errorf("expected other errors unchanged")
+	}
+}
@@ -0,0 +1,126 @@
+package ldapauth
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerDiscoverySRV finds the directory servers from SRV records
+const ServerDiscoverySRV = "srv"
+
+// SRVDiscovery finds the directory servers of Domain from its _ldap._tcp SRV
+// records, as published for Active Directory domains
+type SRVDiscovery struct {
+	Domain string
+
+	// lookup resolves SRV records, net.LookupSRV outside tests
+	lookup func(service, proto, name string) (string, []*net.SRV, error)
+	// intn returns a random number in [0, n) for weighted selection
+	intn func(n int) int
+
+	mu      sync.RWMutex
+	records []*net.SRV
+}
+
+// NewSRVDiscovery returns a discovery of the servers of domain, which is
+// resolved on first use and on every Refresh
+func NewSRVDiscovery(domain string) *SRVDiscovery {
+	return &SRVDiscovery{Domain: domain, lookup: net.LookupSRV, intn: rand.Intn}
+}
+
+// Refresh resolves the SRV records, keeping the previous servers if they
+// can't be resolved
+func (d *SRVDiscovery) Refresh() error {
+	_, records, err := d.lookup("ldap", "tcp", d.Domain)
+	if err != nil {
+		return fmt.Errorf("resolving _ldap._tcp.%s: %v", d.Domain, err)
+	}
+	// a lone record with target "." says the service isn't available
+	if len(records) == 0 || len(records) == 1 && records[0].Target == "." {
+		return fmt.Errorf("no ldap servers in _ldap._tcp.%s", d.Domain)
+	}
+
+	d.mu.Lock()
+	d.records = records
+	d.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the records immediately and then every interval until stop
+// is closed. Failed refreshes are logged.
+func (d *SRVDiscovery) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Refresh(); err != nil {
+			log.Printf("Error discovering ldap servers: %+v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Addresses returns the host:port of every server in the order they should
+// be tried: by ascending priority, then a weighted random order among
+// servers of the same priority (RFC 2782)
+func (d *SRVDiscovery) Addresses() ([]string, error) {
+	d.mu.RLock()
+	loaded := d.records != nil
+	d.mu.RUnlock()
+	if !loaded {
+		if err := d.Refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.RLock()
+	records := append([]*net.SRV(nil), d.records...)
+	d.mu.RUnlock()
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+
+	addrs := make([]string, 0, len(records))
+	for len(records) > 0 {
+		n := 1
+		for n < len(records) && records[n].Priority == records[0].Priority {
+			n++
+		}
+		for group := records[:n]; len(group) > 0; {
+			i := d.pick(group)
+			host := strings.TrimSuffix(group[i].Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(group[i].Port))))
+			group = append(group[:i], group[i+1:]...)
+		}
+		records = records[n:]
+	}
+	return addrs, nil
+}
+
+// pick chooses one of records with a probability proportional to its weight.
+// Records of weight 0 are only chosen once no others are left.
+func (d *SRVDiscovery) pick(records []*net.SRV) int {
+	total := 0
+	for _, r := range records {
+		total += int(r.Weight)
+	}
+	if total == 0 {
+		return d.intn(len(records))
+	}
+	n := d.intn(total)
+	for i, r := range records {
+		if n < int(r.Weight) {
+			return i
+		}
+		n -= int(r.Weight)
+	}
+	return len(records) - 1
+}
@@ -0,0 +1,81 @@
+package ldapauth
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func testDiscovery(records []*net.SRV, err error) *SRVDiscovery {
+	d := NewSRVDiscovery("corp.example.com")
+	d.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		if service != "ldap" || proto != "tcp" || name != "corp.example.com" {
+			return "", nil, errors.New("unexpected lookup")
+		}
+		return "", records, err
+	}
+	return d
+}
+
+func TestSRVDiscoveryAddresses(t *testing.T) {
+	d := testDiscovery([]*net.SRV{
+		{Target: "backup.corp.example.com.", Port: 389, Priority: 10, Weight: 0},
+		{Target: "dc1.corp.example.com.", Port: 389, Priority: 0, Weight: 100},
+		{Target: "fd00::1", Port: 3268, Priority: 0, Weight: 50},
+	}, nil)
+	// always draw the lowest number, picking the first remaining record
+	d.intn = func(n int) int { return 0 }
+
+	addrs, err := d.Addresses()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected := []string{"dc1.corp.example.com:389", "[fd00::1]:3268", "backup.corp.example.com:389"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("expected %v got %v", expected, addrs)
+	}
+
+	// the highest draw falls in the weight of the last record
+	d.intn = func(n int) int { return n - 1 }
+	addrs, _ = d.Addresses()
+	if addrs[0] != "[fd00::1]:3268" || addrs[2] != "backup.corp.example.com:389" {
+		t.Errorf("unexpected order %v", addrs)
+	}
+}
+
+func TestSRVDiscoveryKeepsServersOnFailure(t *testing.T) {
+	records := []*net.SRV{{Target: "dc1.corp.example.com.", Port: 389}}
+	d := testDiscovery(records, nil)
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	d.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, errors.New("no such host")
+	}
+	if err := d.Refresh(); err == nil {
+		t.Error("expected error")
+	}
+	if addrs, err := d.Addresses(); err != nil || len(addrs) != 1 {
+		t.Errorf("expected previous servers, got %v %v", addrs, err)
+	}
+}
+
+func TestSRVDiscoveryNoService(t *testing.T) {
+	d := testDiscovery([]*net.SRV{{Target: ".", Port: 0}}, nil)
+	if _, err := d.Addresses(); err == nil {
+		t.Error("expected error for a domain without the service")
+	}
+}
+
+func TestConfigAddresses(t *testing.T) {
+	for host, expected := range map[string]string{
+		"ldap.internal": "ldap.internal:389",
+		"fd00::389":     "[fd00::389]:389",
+	} {
+		addrs, err := (&Config{Host: host, Port: 389}).addresses()
+		if err != nil || len(addrs) != 1 || addrs[0] != expected {
+			t.Errorf("%s: expected %s got %v %v", host, expected, addrs, err)
+		}
+	}
+}
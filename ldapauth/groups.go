@@ -0,0 +1,142 @@
+package ldapauth
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// Modes for comparing the configured ldap-groups against the groups returned
+// by the directory
+const (
+	GroupMatchCN    = "cn"
+	GroupMatchDN    = "dn"
+	GroupMatchRegex = "regex"
+)
+
+var groupMatchModes = []string{GroupMatchCN, GroupMatchDN, GroupMatchRegex}
+
+// GroupMatcher decides whether a user's groups satisfy the required groups
+type GroupMatcher struct {
+	Mode    string
+	Groups  []string
+	regexes []*regexp.Regexp
+}
+
+// NewGroupMatcher normalizes the required groups for mode, compiling them when
+// mode is regex
+func NewGroupMatcher(mode string, groups []string) (*GroupMatcher, error) {
+	m := &GroupMatcher{Mode: mode}
+	switch mode {
+	case GroupMatchCN:
+		for _, g := range groups {
+			if cn := cnOfDN(g); cn != "" {
+				log.Printf("ldap-group-match=cn: using cn %q of configured group %q", cn, g)
+				g = cn
+			}
+			m.Groups = append(m.Groups, g)
+		}
+	case GroupMatchDN:
+		for _, g := range groups {
+			if _, err := ldap.ParseDN(g); err != nil || !strings.Contains(g, "=") {
+				return nil, fmt.Errorf("ldap group %q is not a valid DN for ldap-group-match=dn", g)
+			}
+			m.Groups = append(m.Groups, normalizeDN(g))
+		}
+	case GroupMatchRegex:
+		for _, g := range groups {
+			r, err := regexp.Compile("(?i)" + g)
+			if err != nil {
+				return nil, fmt.Errorf("error compiling ldap group regex=%q %s", g, err)
+			}
+			m.Groups = append(m.Groups, g)
+			m.regexes = append(m.regexes, r)
+		}
+	default:
+		return nil, fmt.Errorf("invalid ldap-group-match %q (must be one of %s)", mode, strings.Join(groupMatchModes, ", "))
+	}
+	return m, nil
+}
+
+// Value returns the identifier of a group entry in the form the required
+// groups are compared against: its cn in cn mode, its normalized DN otherwise
+func (m *GroupMatcher) Value(entry *ldap.Entry) string {
+	if m.Mode == GroupMatchCN {
+		return entry.GetAttributeValue("cn")
+	}
+	return normalizeDN(entry.DN)
+}
+
+// Match returns the first of the user's groups which satisfies a required group
+func (m *GroupMatcher) Match(userGroups []string) (string, bool) {
+	for _, ug := range userGroups {
+		if m.Mode == GroupMatchRegex {
+			for _, r := range m.regexes {
+				if r.MatchString(ug) {
+					return ug, true
+				}
+			}
+			continue
+		}
+		if sliceContainsString(m.Groups, []string{ug}) {
+			return ug, true
+		}
+	}
+	return "", false
+}
+
+// normalizeDN lowercases the attribute types and values of dn and removes
+// insignificant whitespace so equal DNs compare equal as strings
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	rdns := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attrs := make([]string, 0, len(rdn.Attributes))
+		for _, a := range rdn.Attributes {
+			attrs = append(attrs, strings.ToLower(a.Type)+"="+strings.ToLower(a.Value))
+		}
+		rdns = append(rdns, strings.Join(attrs, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// CanonicalDN returns dn as ldap-group-match=dn compares it: with its
+// attribute types and values lowercased and without insignificant whitespace
+func CanonicalDN(dn string) string {
+	return normalizeDN(dn)
+}
+
+// cnOfDN returns the value of the leading cn of dn, or "" if dn isn't a DN
+func cnOfDN(dn string) string {
+	if !strings.Contains(dn, "=") {
+		return ""
+	}
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, a := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(a.Type, "cn") {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// sliceContainsString returns true if a and b contains any common string ignoring case
+func sliceContainsString(a, b []string) bool {
+	for _, aItem := range a {
+		for _, bItem := range b {
+			if strings.ToLower(aItem) == strings.ToLower(bItem) {
+				return true
+			}
+		}
+	}
+	return false
+}
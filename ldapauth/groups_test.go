@@ -0,0 +1,139 @@
+package ldapauth
+
+import (
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestGroupMatcher(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		mode       string
+		groups     []string
+		userGroups []string
+		expect     bool
+	}{
+		{
+			desc:       "cn",
+			mode:       GroupMatchCN,
+			groups:     []string{"Admins"},
+			userGroups: []string{"users", "admins"},
+			expect:     true,
+		},
+		{
+			desc:       "cn configured as dn",
+			mode:       GroupMatchCN,
+			groups:     []string{"CN=Admins,OU=Groups,DC=example,DC=com"},
+			userGroups: []string{"admins"},
+			expect:     true,
+		},
+		{
+			desc:       "cn mismatch",
+			mode:       GroupMatchCN,
+			groups:     []string{"admins"},
+			userGroups: []string{"users"},
+			expect:     false,
+		},
+		{
+			desc:       "dn",
+			mode:       GroupMatchDN,
+			groups:     []string{"CN=Admins, OU=Groups, DC=example, DC=com"},
+			userGroups: []string{normalizeDN("cn=admins,ou=groups,dc=example,dc=com")},
+			expect:     true,
+		},
+		{
+			desc:       "dn in other ou",
+			mode:       GroupMatchDN,
+			groups:     []string{"cn=admins,ou=groups,dc=example,dc=com"},
+			userGroups: []string{normalizeDN("cn=admins,ou=legacy,dc=example,dc=com")},
+			expect:     false,
+		},
+		{
+			desc:       "regex",
+			mode:       GroupMatchRegex,
+			groups:     []string{"^cn=[^,]+,ou=engineering,"},
+			userGroups: []string{normalizeDN("CN=Backend,OU=Engineering,DC=example,DC=com")},
+			expect:     true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			m, err := NewGroupMatcher(tC.mode, tC.groups)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if _, ok := m.Match(tC.userGroups); ok != tC.expect {
+				t.Errorf("with groups %+v and user groups %+v, expected %v, got %v", m.Groups, tC.userGroups, tC.expect, ok)
+			}
+		})
+	}
+}
+
+func TestGroupMatcherValue(t *testing.T) {
+	entry := ldap.NewEntry("CN=Admins,OU=Groups,DC=example,DC=com", map[string][]string{"cn": {"Admins"}})
+
+	cn, _ := NewGroupMatcher(GroupMatchCN, nil)
+	if v := cn.Value(entry); v != "Admins" {
+		t.Errorf("unexpected cn value %q", v)
+	}
+	dn, _ := NewGroupMatcher(GroupMatchDN, nil)
+	if v := dn.Value(entry); v != "cn=admins,ou=groups,dc=example,dc=com" {
+		t.Errorf("unexpected dn value %q", v)
+	}
+}
+
+func TestGroupMatcherInvalid(t *testing.T) {
+	if _, err := NewGroupMatcher("uid", nil); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+	if _, err := NewGroupMatcher(GroupMatchDN, []string{"admins"}); err == nil {
+		t.Error("expected error for group which isn't a DN")
+	}
+	if _, err := NewGroupMatcher(GroupMatchRegex, []string{"(admins"}); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestSliceContainsString(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		a      []string
+		b      []string
+		expect bool
+	}{
+		{
+			desc:   "happy path",
+			a:      []string{"a", "b", "c"},
+			b:      []string{"b"},
+			expect: true,
+		},
+		{
+			desc:   "happy path case insensitive",
+			a:      []string{"a", "B", "c"},
+			b:      []string{"b"},
+			expect: true,
+		},
+		{
+			desc:   "empty",
+			a:      []string{},
+			b:      []string{},
+			expect: false,
+		},
+		{
+			desc:   "doesn't intersect",
+			a:      []string{"a", "b", "c"},
+			b:      []string{"z"},
+			expect: false,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if res := sliceContainsString(tC.a, tC.b); res != tC.expect {
+				t.Errorf("with a %+v and b %+v, expected %+v, got %v", tC.a, tC.b, tC.expect, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+// Package ldapauth authenticates users and resolves their groups against an
+// LDAP directory.
+package ldapauth
+
+// original work imported from https://github.com/jtblin/go-ldap-client (thank you)
+// code is slightly changed
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// maxReconnects is how many times a search is retried on a new connection
+// after the directory closed the one it was made on
+const maxReconnects = 2
+
+var connectionMetrics = expvar.NewMap("ldap_connections")
+
+// Config contains needed information to make ldap queries
+type Config struct {
+	Attributes         []string
+	Base               string
+	BindDN             string
+	BindPassword       string
+	GroupFilter        string // e.g. "(memberUid=%s)"
+	Host               string
+	ServerName         string
+	UserFilter         string // e.g. "(uid=%s)"
+	GroupNameFilter    string // e.g. "(&(objectClass=group)(cn=%s))"
+	MemberFilter       string // e.g. "(memberOf=%s)"
+	Port               int
+	InsecureSkipVerify bool
+	UseTLS             bool
+	ClientCertificates []tls.Certificate // Adding client certificates
+
+	// BindPasswordFile is re-read when the directory rejects BindPassword,
+	// so the service account password can be rotated without a restart
+	BindPasswordFile string
+	mu               sync.RWMutex
+
+	// Discovery, when set, finds the servers to connect to instead of Host
+	// and Port
+	Discovery *SRVDiscovery
+
+	// Retries and RetryBackoff are how operations run with Retry are
+	// retried after transient errors
+	Retries      int
+	RetryBackoff time.Duration
+
+	// SlowThreshold, when set, is how long binds and searches may take
+	// before a warning is logged
+	SlowThreshold time.Duration
+
+	// MemberAttribute, when set, is the attribute of a group listing its
+	// direct members, e.g. "member", which GetMembersOfGroup reads instead
+	// of searching with MemberFilter
+	MemberAttribute string
+}
+
+// addresses returns the servers to try connecting to, in order
+func (lc *Config) addresses() ([]string, error) {
+	if lc.Discovery == nil {
+		return []string{net.JoinHostPort(lc.Host, strconv.Itoa(lc.Port))}, nil
+	}
+	return lc.Discovery.Addresses()
+}
+
+func (lc *Config) bindPassword() string {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.BindPassword
+}
+
+// ReloadBindPassword reads BindPassword from BindPasswordFile, reporting
+// whether it changed
+func (lc *Config) ReloadBindPassword() (bool, error) {
+	b, err := ioutil.ReadFile(lc.BindPasswordFile)
+	if err != nil {
+		return false, err
+	}
+	password := strings.TrimRight(string(b), "\r\n")
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	changed := password != lc.BindPassword
+	lc.BindPassword = password
+	return changed, nil
+}
+
+// Client contains an LDAP connection
+type Client struct {
+	conn *ldap.Conn
+	cfg  *Config
+	addr string // of the server conn is to
+}
+
+// NewClient creates a connection to the ldap backend, trying each of its
+// servers in turn.
+func NewClient(lc *Config) (*Client, error) {
+	addrs, err := lc.addresses()
+	if err != nil {
+		log.Printf("Unable to find LDAP Server: %+v", err)
+		return &Client{}, err
+	}
+	var l *ldap.Conn
+	var addr string
+	for _, addr = range addrs {
+		if l, err = ldap.Dial("tcp", addr); err == nil {
+			break
+		}
+		log.Printf("Unable to connect to LDAP Server %s: %+v", addr, err)
+	}
+	if err != nil {
+		return &Client{}, err
+	}
+
+	if lc.UseTLS {
+		err = l.StartTLS(&tls.Config{InsecureSkipVerify: lc.InsecureSkipVerify})
+		if err != nil {
+			log.Printf("Unable to connect to LDAP Server with TLS: %+v", err)
+		}
+	}
+
+	conn := Client{
+		conn: l,
+		cfg:  lc,
+		addr: addr,
+	}
+
+	return &conn, err
+}
+
+// Close ldap connection
+func (c *Client) Close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Authenticate authenticates the user against the ldap backend.
+func (c *Client) Authenticate(username, password string) (bool, map[string]string, error) {
+	if username == "" || password == "" {
+		return false, nil, errors.New("invalid user or password")
+	}
+
+	entry, err := c.LookupUser(username)
+	if err != nil {
+		return false, nil, err
+	}
+
+	userDN := entry.DN
+	user := map[string]string{
+		"dn": userDN,
+	}
+	for _, attr := range c.cfg.Attributes {
+		user[attr] = entry.GetAttributeValue(attr)
+	}
+
+	// Bind as the user to verify their password
+	err = c.timed(OpBind, userDN, func() error { return c.conn.Bind(userDN, password) })
+	if err != nil {
+		return false, user, bindFailure(err)
+	}
+
+	// Rebind as the read only user for any further queries
+	if err := c.bindServiceAccount(); err != nil {
+		return false, user, err
+	}
+
+	return true, user, nil
+}
+
+// LookupUser binds as the read only user and searches for username with
+// UserFilter, returning its entry with the configured Attributes.
+func (c *Client) LookupUser(username string) (*ldap.Entry, error) {
+	// First bind with a read only user
+	if err := c.bindServiceAccount(); err != nil {
+		return nil, err
+	}
+
+	attributes := append(c.cfg.Attributes, "dn")
+	// Search for the given username
+	searchRequest := ldap.NewSearchRequest(
+		c.cfg.Base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(c.cfg.UserFilter, username),
+		attributes,
+		nil,
+	)
+
+	sr, err := c.search(OpUserSearch, searchRequest, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sr.Entries) < 1 {
+		return nil, errors.New("User does not exist")
+	}
+
+	if len(sr.Entries) > 1 {
+		return nil, errors.New("Too many entries returned")
+	}
+	return sr.Entries[0], nil
+}
+
+// bindServiceAccount binds as the read only user, if one is configured. When
+// the directory rejects the password it is reloaded from BindPasswordFile and
+// the bind retried once.
+func (c *Client) bindServiceAccount() error {
+	password := c.cfg.bindPassword()
+	if c.cfg.BindDN == "" || password == "" {
+		return nil
+	}
+	err := c.bind(c.cfg.BindDN, password)
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) || c.cfg.BindPasswordFile == "" {
+		return err
+	}
+
+	changed, rerr := c.cfg.ReloadBindPassword()
+	if rerr != nil {
+		log.Printf("Bind as %s rejected and reloading %s failed: %+v", c.cfg.BindDN, c.cfg.BindPasswordFile, rerr)
+		return err
+	}
+	if !changed {
+		log.Printf("Bind as %s rejected; password in %s is unchanged", c.cfg.BindDN, c.cfg.BindPasswordFile)
+		return err
+	}
+	log.Printf("Bind as %s rejected; retrying with the password reloaded from %s", c.cfg.BindDN, c.cfg.BindPasswordFile)
+	return c.bind(c.cfg.BindDN, c.cfg.bindPassword())
+}
+
+func (c *Client) bind(dn, password string) error {
+	return c.timed(OpBind, dn, func() error { return c.conn.Bind(dn, password) })
+}
+
+// GetGroupsOfUser returns the group for a user.
+func (c *Client) GetGroupsOfUser(username string) ([]string, error) {
+	entries, err := c.GetGroupEntriesOfUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	for _, entry := range entries {
+		groups = append(groups, entry.GetAttributeValue("cn"))
+	}
+
+	return groups, nil
+}
+
+// GetGroupEntriesOfUser returns the group entries for a user, including their DN.
+func (c *Client) GetGroupEntriesOfUser(username string) ([]*ldap.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		c.cfg.Base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(c.cfg.GroupFilter, username),
+		[]string{"cn"}, // can it be something else than "cn"?
+		nil,
+	)
+
+	sr, err := c.search(OpGroupSearch, searchRequest, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return sr.Entries, nil
+}
+
+// GetGroupDN returns the DN of the group named cn.
+func (c *Client) GetGroupDN(cn string) (string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		c.cfg.Base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(c.cfg.GroupNameFilter, ldap.EscapeFilter(cn)),
+		[]string{"dn"},
+		nil,
+	)
+
+	sr, err := c.search(OpGroupSearch, searchRequest, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(sr.Entries) != 1 {
+		return "", fmt.Errorf("found %d groups named %q", len(sr.Entries), cn)
+	}
+	return sr.Entries[0].DN, nil
+}
+
+// GetMembersOfGroup returns the DNs of the users in a group.
+func (c *Client) GetMembersOfGroup(groupDN string) ([]string, error) {
+	if c.cfg.MemberAttribute != "" {
+		return c.rangedValues(OpGroupSearch, groupDN, c.cfg.MemberAttribute)
+	}
+	searchRequest := ldap.NewSearchRequest(
+		c.cfg.Base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(c.cfg.MemberFilter, ldap.EscapeFilter(groupDN)),
+		[]string{"dn"},
+		nil,
+	)
+
+	sr, err := c.search(OpGroupSearch, searchRequest, 500)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(sr.Entries))
+	for _, entry := range sr.Entries {
+		members = append(members, entry.DN)
+	}
+	return members, nil
+}
+
+// search runs req, the operation op, in pages of pagingSize entries unless
+// it is 0. Searches don't change anything, so when the directory has closed
+// the connection, e.g. because it was idle, they are made again on a new
+// one, bound as the read only user, at most maxReconnects times.
+func (c *Client) search(op string, req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	for attempt := 0; ; attempt++ {
+		var sr *ldap.SearchResult
+		err := c.timed(op, req.Filter, func() (err error) {
+			if pagingSize > 0 {
+				sr, err = c.conn.SearchWithPaging(req, pagingSize)
+			} else {
+				sr, err = c.conn.Search(req)
+			}
+			return err
+		})
+		if err == nil || !isConnectionError(err) || attempt >= maxReconnects {
+			return sr, err
+		}
+		log.Printf("LDAP connection lost during search (%+v); reconnecting", err)
+		connectionMetrics.Add("reconnects", 1)
+		if rerr := c.reconnect(); rerr != nil {
+			log.Printf("LDAP reconnect failed: %+v", rerr)
+			connectionMetrics.Add("reconnect_failures", 1)
+			return nil, err
+		}
+	}
+}
+
+// reconnect replaces the connection of c with a new one bound as the read
+// only user
+func (c *Client) reconnect() error {
+	c.Close()
+	client, err := NewClient(c.cfg)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	c.conn = client.conn
+	return c.bindServiceAccount()
+}
+
+// CheckBind connects to the directory and binds as the read only user, if
+// one is configured, reporting any error.
+func CheckBind(lc *Config) error {
+	c, err := NewClient(lc)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.bindServiceAccount()
+}
@@ -0,0 +1,37 @@
+package ldapauth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReloadBindPassword(t *testing.T) {
+	f, err := ioutil.TempFile("", "test_bind_password_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("first\n")
+	f.Close()
+
+	cfg := &Config{BindPasswordFile: f.Name()}
+	if changed, err := cfg.ReloadBindPassword(); err != nil || !changed {
+		t.Fatalf("expected changed password, got %v %+v", changed, err)
+	}
+	if cfg.bindPassword() != "first" {
+		t.Errorf("unexpected password %q", cfg.bindPassword())
+	}
+
+	if changed, _ := cfg.ReloadBindPassword(); changed {
+		t.Error("expected unchanged password")
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("second"), 0600)
+	if changed, _ := cfg.ReloadBindPassword(); !changed {
+		t.Error("expected changed password")
+	}
+	if cfg.bindPassword() != "second" {
+		t.Errorf("unexpected password %q", cfg.bindPassword())
+	}
+}
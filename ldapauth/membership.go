@@ -0,0 +1,137 @@
+package ldapauth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// MembershipCache holds the members of the required groups, resolved from
+// the directory in the background, so a user's groups can be found without
+// a search at sign-in.
+type MembershipCache struct {
+	Matcher *GroupMatcher
+
+	// lookup returns the DNs of the members of a required group
+	lookup func(group string) ([]string, error)
+
+	mu      sync.RWMutex
+	members map[string][]string
+}
+
+// NewMembershipCache returns an empty cache of the members of m's groups,
+// looked up in the directory described by cfg. Only cn and dn matching are
+// supported, as regexes can't be resolved to a set of groups.
+func NewMembershipCache(cfg *Config, m *GroupMatcher) (*MembershipCache, error) {
+	if m.Mode == GroupMatchRegex {
+		return nil, errors.New("group membership caching is not supported with ldap-group-match=regex")
+	}
+	c := &MembershipCache{Matcher: m}
+	c.lookup = func(group string) ([]string, error) {
+		return cfg.GroupMembers(m.Mode, group)
+	}
+	return c, nil
+}
+
+// GroupMembers returns the DNs of the members of group, named as in the
+// ldap-group-match mode, binding as the service account. Only cn and dn
+// groups can be resolved.
+func (lc *Config) GroupMembers(mode, group string) ([]string, error) {
+	if mode == GroupMatchRegex {
+		return nil, errors.New("the members of ldap-group-match=regex groups can't be resolved")
+	}
+	client, err := NewClient(lc)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	if err := client.bindServiceAccount(); err != nil {
+		return nil, err
+	}
+
+	dn := group
+	if mode == GroupMatchCN {
+		if dn, err = client.GetGroupDN(group); err != nil {
+			return nil, err
+		}
+	}
+	return client.GetMembersOfGroup(dn)
+}
+
+// UserGroups returns the groups of username, named as m compares them,
+// binding as the service account
+func (lc *Config) UserGroups(m *GroupMatcher, username string) ([]string, error) {
+	client, err := NewClient(lc)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	user, err := client.LookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := client.GetGroupEntriesOfUser(user.DN)
+	if err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, entry := range entries {
+		groups = append(groups, m.Value(entry))
+	}
+	return groups, nil
+}
+
+// Refresh resolves the members of every required group, replacing the cached
+// members only if all of them could be resolved
+func (c *MembershipCache) Refresh() error {
+	members := make(map[string][]string)
+	count := 0
+	for _, group := range c.Matcher.Groups {
+		dns, err := c.lookup(group)
+		if err != nil {
+			return fmt.Errorf("resolving members of %q: %v", group, err)
+		}
+		for _, dn := range dns {
+			dn = normalizeDN(dn)
+			members[dn] = append(members[dn], group)
+		}
+		count += len(dns)
+	}
+
+	c.mu.Lock()
+	c.members = members
+	c.mu.Unlock()
+	log.Printf("cached %d members of %d ldap groups", count, len(c.Matcher.Groups))
+	return nil
+}
+
+// Run refreshes the cache immediately and then every interval until stop is
+// closed. Failed refreshes are logged and the previous members kept.
+func (c *MembershipCache) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Refresh(); err != nil {
+			log.Printf("Error refreshing ldap group membership cache: %+v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Groups returns the required groups userDN is a member of, in the form
+// Matcher compares them. ok is false until the cache has been loaded.
+func (c *MembershipCache) Groups(userDN string) (groups []string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.members == nil {
+		return nil, false
+	}
+	groups = []string{}
+	return append(groups, c.members[normalizeDN(userDN)]...), true
+}
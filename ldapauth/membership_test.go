@@ -0,0 +1,61 @@
+package ldapauth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMembershipCache(t *testing.T) {
+	m, err := NewGroupMatcher(GroupMatchCN, []string{"admins", "devs"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	c := &MembershipCache{Matcher: m}
+	fail := false
+	c.lookup = func(group string) ([]string, error) {
+		if fail {
+			return nil, errors.New("directory unavailable")
+		}
+		switch group {
+		case "admins":
+			return []string{"CN=Michael,OU=Users,DC=example,DC=com"}, nil
+		case "devs":
+			return []string{"cn=michael,ou=users,dc=example,dc=com", "cn=jane,ou=users,dc=example,dc=com"}, nil
+		}
+		return nil, nil
+	}
+
+	if _, ok := c.Groups("cn=michael,ou=users,dc=example,dc=com"); ok {
+		t.Error("expected cache not to be loaded before Refresh")
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	groups, ok := c.Groups("cn=Michael, ou=Users, dc=example, dc=com")
+	if !ok || !reflect.DeepEqual(groups, []string{"admins", "devs"}) {
+		t.Errorf("unexpected groups %v %v", groups, ok)
+	}
+	if groups, ok := c.Groups("cn=bob,ou=users,dc=example,dc=com"); !ok || len(groups) != 0 {
+		t.Errorf("expected no groups for non member, got %v %v", groups, ok)
+	}
+
+	fail = true
+	if err := c.Refresh(); err == nil {
+		t.Error("expected refresh error")
+	}
+	if groups, _ := c.Groups("cn=jane,ou=users,dc=example,dc=com"); !reflect.DeepEqual(groups, []string{"devs"}) {
+		t.Errorf("expected previous members to be kept, got %v", groups)
+	}
+}
+
+func TestMembershipCacheRejectsRegex(t *testing.T) {
+	m, err := NewGroupMatcher(GroupMatchRegex, []string{"^admins$"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if _, err := NewMembershipCache(&Config{}, m); err == nil {
+		t.Error("expected error for regex matching")
+	}
+}
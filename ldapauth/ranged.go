@@ -0,0 +1,75 @@
+package ldapauth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// rangedValues returns every value of the attribute attr of the entry dn.
+// Active Directory returns at most MaxValRange (1500 by default) values of
+// an attribute at once, named e.g. member;range=0-1499, and the rest only
+// when asked for member;range=1500-* and so on, until a range ending in *.
+func (c *Client) rangedValues(op, dn, attr string) ([]string, error) {
+	var values []string
+	name := attr
+	for {
+		req := ldap.NewSearchRequest(
+			dn,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{name},
+			nil,
+		)
+		sr, err := c.search(op, req, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(sr.Entries) != 1 {
+			return nil, fmt.Errorf("found %d entries for %s", len(sr.Entries), dn)
+		}
+		a, next, err := rangedAttribute(sr.Entries[0], attr)
+		if err != nil || a == nil {
+			return values, err
+		}
+		values = append(values, a.Values...)
+		if next < 0 {
+			return values, nil
+		}
+		name = fmt.Sprintf("%s;range=%d-*", attr, next)
+	}
+}
+
+// rangedAttribute returns attr of e, either whole or a range of its values,
+// and the index of the first value of the next range, or -1 if there are no
+// more
+func rangedAttribute(e *ldap.Entry, attr string) (*ldap.EntryAttribute, int, error) {
+	prefix := strings.ToLower(attr) + ";range="
+	for _, a := range e.Attributes {
+		if strings.EqualFold(a.Name, attr) {
+			return a, -1, nil
+		}
+		if !strings.HasPrefix(strings.ToLower(a.Name), prefix) {
+			continue
+		}
+		bounds := strings.SplitN(a.Name[len(prefix):], "-", 2)
+		if len(bounds) != 2 {
+			return nil, 0, fmt.Errorf("invalid range %q", a.Name)
+		}
+		if bounds[1] == "*" {
+			return a, -1, nil
+		}
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid range %q", a.Name)
+		}
+		high, err := strconv.Atoi(bounds[1])
+		if err != nil || high < low {
+			return nil, 0, fmt.Errorf("invalid range %q", a.Name)
+		}
+		return a, high + 1, nil
+	}
+	return nil, -1, nil
+}
@@ -0,0 +1,31 @@
+package ldapauth
+
+import (
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestRangedAttribute(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		next  int
+		found bool
+		err   bool
+	}{
+		{"member", -1, true, false},
+		{"Member", -1, true, false},
+		{"member;range=0-1499", 1500, true, false},
+		{"member;range=1500-*", -1, true, false},
+		{"memberOf", -1, false, false},
+		{"member;range=10-5", 0, false, true},
+		{"member;range=0", 0, false, true},
+		{"member;range=a-b", 0, false, true},
+	} {
+		e := ldap.NewEntry("cn=staff", map[string][]string{c.name: {"uid=michael"}})
+		a, next, err := rangedAttribute(e, "member")
+		if (err != nil) != c.err || (a != nil) != c.found || next != c.next {
+			t.Errorf("%s: unexpected %v %d %v", c.name, a, next, err)
+		}
+	}
+}
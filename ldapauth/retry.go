@@ -0,0 +1,57 @@
+package ldapauth
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// sleep waits between retries; tests replace it
+var sleep = time.Sleep
+
+// IsTransient reports whether err is a failure to reach the directory, or
+// the directory being too busy to answer, rather than an answer, so trying
+// again may succeed
+func IsTransient(err error) bool {
+	if isConnectionError(err) {
+		return true
+	}
+	if e, ok := err.(*ldap.Error); ok {
+		switch e.ResultCode {
+		case ldap.LDAPResultBusy, ldap.LDAPResultUnavailable:
+			return true
+		}
+	}
+	return false
+}
+
+// isConnectionError reports whether err is the connection to the directory
+// failing rather than an answer from it. The ldap package reports the
+// directory closing the connection while a request waits for its response
+// as a plain error.
+func isConnectionError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || err != nil && strings.HasPrefix(err.Error(), "unable to read LDAP response packet")
+}
+
+// Retry runs op until it succeeds or fails with an error which isn't
+// transient, at most Retries more times, waiting RetryBackoff before the
+// first retry and twice as long before each one after. Each attempt tries
+// the servers in turn again.
+func (lc *Config) Retry(op func() error) error {
+	backoff := lc.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !IsTransient(err) || attempt >= lc.Retries {
+			return err
+		}
+		log.Printf("LDAP operation failed (%+v); retrying in %s", err, backoff)
+		sleep(backoff)
+		backoff *= 2
+	}
+}
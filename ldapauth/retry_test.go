@@ -0,0 +1,59 @@
+package ldapauth
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestIsTransient(t *testing.T) {
+	for err, expected := range map[error]bool{
+		ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused")):   true,
+		ldap.NewError(ldap.LDAPResultBusy, errors.New("busy")):               true,
+		errors.New("unable to read LDAP response packet: unexpected EOF"):    true,
+		ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("nope")): false,
+		&net.DNSError{Err: "timeout", IsTimeout: true}:                       true,
+		&BindError{Reason: BindAccountLocked}:                                false,
+		errors.New("invalid user or password"):                               false,
+	} {
+		if IsTransient(err) != expected {
+			t.Errorf("%v: expected %v", err, expected)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var waits []time.Duration
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { sleep = time.Sleep }()
+
+	lc := &Config{Retries: 2, RetryBackoff: 100 * time.Millisecond}
+	down := ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+
+	attempts := 0
+	err := lc.Retry(func() error {
+		attempts++
+		return down
+	})
+	if err != down || attempts != 3 {
+		t.Errorf("expected 3 attempts ending in %v, got %d and %v", down, attempts, err)
+	}
+	if len(waits) != 2 || waits[0] != 100*time.Millisecond || waits[1] != 200*time.Millisecond {
+		t.Errorf("expected a doubling backoff, got %v", waits)
+	}
+
+	attempts = 0
+	err = lc.Retry(func() error {
+		attempts++
+		if attempts == 1 {
+			return down
+		}
+		return &BindError{Reason: BindInvalidCredentials}
+	})
+	if _, ok := err.(*BindError); !ok || attempts != 2 {
+		t.Errorf("expected a rejected bind not to be retried, got %d attempts and %v", attempts, err)
+	}
+}
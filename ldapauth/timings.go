@@ -0,0 +1,108 @@
+package ldapauth
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of timed directory operations
+const (
+	OpBind        = "bind"
+	OpUserSearch  = "user_search"
+	OpGroupSearch = "group_search"
+)
+
+// timingBounds are the upper bounds of the buckets operations are counted in
+var timingBounds = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+var timings = map[string]*Histogram{
+	OpBind:        {},
+	OpUserSearch:  {},
+	OpGroupSearch: {},
+}
+
+func init() {
+	m := expvar.NewMap("ldap_timings")
+	for op, h := range timings {
+		m.Set(op, h)
+	}
+}
+
+// Histogram counts how long operations took in the buckets of timingBounds.
+// As an expvar it is {"count": n, "sum": seconds, "buckets": {"0.005": n,
+// ..., "+Inf": n}}, each bucket counting the operations which took at most
+// its bound in seconds, as Prometheus histograms do.
+type Histogram struct {
+	mu     sync.Mutex
+	counts [len(timingBounds) + 1]int64 // by bucket, the last for those over every bound
+	sum    time.Duration
+}
+
+// Observe counts an operation which took d
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(timingBounds) && d > timingBounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += d
+}
+
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var b bytes.Buffer
+	var count int64
+	b.WriteString(`"buckets": {`)
+	for i, n := range h.counts {
+		count += n
+		bound := "+Inf"
+		if i < len(timingBounds) {
+			bound = strconv.FormatFloat(timingBounds[i].Seconds(), 'f', -1, 64)
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q: %d", bound, count)
+	}
+	b.WriteString("}")
+	return fmt.Sprintf(`{"count": %d, "sum": %v, %s}`, count, h.sum.Seconds(), b.String())
+}
+
+// Timing returns the histogram of the durations of op, one of OpBind,
+// OpUserSearch and OpGroupSearch
+func Timing(op string) *Histogram {
+	return timings[op]
+}
+
+// timed runs fn, the operation op of c described by what, counting how long
+// it took and logging a warning when that was over the SlowThreshold
+func (c *Client) timed(op, what string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	d := time.Since(start)
+	timings[op].Observe(d)
+	if c.cfg.SlowThreshold > 0 && d > c.cfg.SlowThreshold {
+		log.Printf("WARNING - slow LDAP %s taking %s (over %s) on %s: %s", op, d, c.cfg.SlowThreshold, c.addr, what)
+	}
+	return err
+}
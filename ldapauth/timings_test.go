@@ -0,0 +1,75 @@
+package ldapauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func timingCount(t *testing.T, op string) int64 {
+	var v struct{ Count int64 }
+	if err := json.Unmarshal([]byte(Timing(op).String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v.Count
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{}
+	for _, d := range []time.Duration{time.Millisecond, 5 * time.Millisecond, 300 * time.Millisecond, time.Minute} {
+		h.Observe(d)
+	}
+	var v struct {
+		Count   int64
+		Sum     float64
+		Buckets map[string]int64
+	}
+	if err := json.Unmarshal([]byte(h.String()), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", h, err)
+	}
+	if v.Count != 4 || v.Sum < 60.3 || v.Sum > 60.31 {
+		t.Errorf("unexpected count and sum in %s", h)
+	}
+	for bound, expected := range map[string]int64{"0.005": 2, "0.25": 2, "0.5": 3, "10": 3, "+Inf": 4} {
+		if n := v.Buckets[bound]; n != expected {
+			t.Errorf("expected %d operations of at most %s seconds, got %d", expected, bound, n)
+		}
+	}
+}
+
+func TestTimedSlowWarning(t *testing.T) {
+	out := &bytes.Buffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	before := timingCount(t, OpGroupSearch)
+	c := &Client{cfg: &Config{SlowThreshold: time.Millisecond}, addr: "ldap.example.com:389"}
+	c.timed(OpGroupSearch, "(cn=staff)", func() error { return nil })
+	if out.Len() != 0 {
+		t.Errorf("expected no warning for a fast search, got %q", out)
+	}
+	c.timed(OpGroupSearch, "(cn=staff)", func() error {
+		time.Sleep(2 * time.Millisecond)
+		return nil
+	})
+	if line := out.String(); !strings.Contains(line, "slow LDAP group_search") || !strings.Contains(line, "on ldap.example.com:389: (cn=staff)") {
+		t.Errorf("unexpected warning %q", line)
+	}
+	if n := timingCount(t, OpGroupSearch) - before; n != 2 {
+		t.Errorf("expected both searches to be counted, got %d", n)
+	}
+
+	out.Reset()
+	c.cfg.SlowThreshold = 0
+	c.timed(OpBind, "cn=ldap_proxy", func() error {
+		time.Sleep(2 * time.Millisecond)
+		return nil
+	})
+	if out.Len() != 0 {
+		t.Errorf("expected no warnings without a threshold, got %q", out)
+	}
+}
@@ -0,0 +1,146 @@
+// Package ldaptest runs an in-process LDAP directory holding fixture users
+// and groups, so sign-ins, group checks and whole ldap_proxy configurations
+// can be tested without a real directory.
+package ldaptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Directory is the content of a test directory. Its entries are laid out as
+// in Active Directory, which ldap_proxy's default filters expect: users are
+// uid=<uid>,ou=people,<base dn> with objectClass User and groups are
+// cn=<cn>,ou=groups,<base dn> with objectClass group, linked by member and
+// memberOf.
+type Directory struct {
+	BaseDN string `json:"base_dn"`
+
+	// BindDN and BindPassword are the service account, if binds as it are
+	// to be accepted
+	BindDN       string `json:"bind_dn,omitempty"`
+	BindPassword string `json:"bind_password,omitempty"`
+
+	Users  []*User  `json:"users"`
+	Groups []*Group `json:"groups,omitempty"`
+}
+
+// User is a user of a Directory
+type User struct {
+	UID      string `json:"uid"`
+	Password string `json:"password"`
+	CN       string `json:"cn,omitempty"` // defaults to UID
+	Mail     string `json:"mail,omitempty"`
+
+	// Groups are the cns of the groups the user is a direct member of
+	Groups []string `json:"groups,omitempty"`
+
+	// Attributes are any other attributes of the user entry, such as
+	// sessionTimeout
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Group is a group of a Directory
+type Group struct {
+	CN string `json:"cn"`
+
+	// Groups are the cns of the groups this group is a member of, for
+	// testing nested membership
+	Groups []string `json:"groups,omitempty"`
+}
+
+// LoadDirectory reads a Directory from a JSON file
+func LoadDirectory(filename string) (*Directory, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	d := &Directory{}
+	if err := json.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("invalid directory %s: %v", filename, err)
+	}
+	return d, nil
+}
+
+// UserDN returns the DN of the user uid
+func (d *Directory) UserDN(uid string) string {
+	return fmt.Sprintf("uid=%s,ou=people,%s", uid, d.BaseDN)
+}
+
+// GroupDN returns the DN of the group cn
+func (d *Directory) GroupDN(cn string) string {
+	return fmt.Sprintf("cn=%s,ou=groups,%s", cn, d.BaseDN)
+}
+
+// entry is an object of the directory as searches see it
+type entry struct {
+	dn       string
+	password string
+	attrs    map[string][]string // by lowercase attribute name
+	names    map[string]string   // the attribute names as written, by lowercase name
+}
+
+func (e *entry) add(name string, values ...string) {
+	key := strings.ToLower(name)
+	if _, ok := e.names[key]; !ok {
+		e.names[key] = name
+	}
+	e.attrs[key] = append(e.attrs[key], values...)
+}
+
+func newEntry(dn string) *entry {
+	return &entry{dn: dn, attrs: make(map[string][]string), names: make(map[string]string)}
+}
+
+// entries builds the directory's objects
+func (d *Directory) entries() ([]*entry, error) {
+	var entries []*entry
+	groups := make(map[string]*entry)
+	for _, g := range d.Groups {
+		e := newEntry(d.GroupDN(g.CN))
+		e.add("objectClass", "top", "group")
+		e.add("cn", g.CN)
+		groups[strings.ToLower(g.CN)] = e
+		entries = append(entries, e)
+	}
+	link := func(member *entry, cns []string) error {
+		for _, cn := range cns {
+			g, ok := groups[strings.ToLower(cn)]
+			if !ok {
+				return fmt.Errorf("%s is a member of unknown group %q", member.dn, cn)
+			}
+			g.add("member", member.dn)
+			member.add("memberOf", g.dn)
+		}
+		return nil
+	}
+	for _, g := range d.Groups {
+		if err := link(groups[strings.ToLower(g.CN)], g.Groups); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range d.Users {
+		e := newEntry(d.UserDN(u.UID))
+		e.password = u.Password
+		e.add("objectClass", "top", "person", "User")
+		e.add("uid", u.UID)
+		cn := u.CN
+		if cn == "" {
+			cn = u.UID
+		}
+		e.add("cn", cn)
+		if u.Mail != "" {
+			e.add("mail", u.Mail)
+		}
+		for name, value := range u.Attributes {
+			e.add(name, value)
+		}
+		if err := link(e, u.Groups); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,475 @@
+package ldaptest
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// LDAP operations and result codes the server knows
+const (
+	opBindRequest            = 0
+	opBindResponse           = 1
+	opUnbindRequest          = 2
+	opSearchRequest          = 3
+	opSearchResultEntry      = 4
+	opSearchResultDone       = 5
+	opExtendedRequest        = 23
+	opExtendedResponse       = 24
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+	resultUnwillingToPerform = 53
+)
+
+// Search filter choices, as tagged in a SearchRequest
+const (
+	filterAnd             = 0
+	filterOr              = 1
+	filterNot             = 2
+	filterEqualityMatch   = 3
+	filterSubstrings      = 4
+	filterGreaterOrEqual  = 5
+	filterLessOrEqual     = 6
+	filterPresent         = 7
+	filterApproxMatch     = 8
+	filterExtensibleMatch = 9
+)
+
+// matchingRuleInChain is Active Directory's LDAP_MATCHING_RULE_IN_CHAIN,
+// matching member and memberOf through nested groups
+const matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// Server is an LDAP server for a Directory listening on a local port. It
+// answers simple binds and searches, which is all ldap_proxy uses; StartTLS
+// and writes are refused.
+type Server struct {
+	Directory *Directory
+	Addr      string // host:port the server listens on
+
+	// MaxValRange, when set, is how many values of an attribute are
+	// returned at once, the rest being left to ranged retrieval as in
+	// Active Directory
+	MaxValRange int
+
+	listener net.Listener
+	mu       sync.Mutex
+	entries  []*entry
+	binds    int
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a Server for d on a random port of 127.0.0.1
+func NewServer(d *Directory) (*Server, error) {
+	entries, err := d.entries()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Directory: d, Addr: l.Addr().String(), listener: l, entries: entries, conns: make(map[net.Conn]bool)}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Host and Port are where the server listens, as the ldap-server-host and
+// ldap-server-port options take them
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Binds returns the number of bind requests the server answered
+func (s *Server) Binds() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.binds
+}
+
+// SetPassword changes the password of the user uid, e.g. to test sessions
+// of users whose password changed
+func (s *Server) SetPassword(uid, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dn := s.Directory.UserDN(uid)
+	for _, e := range s.entries {
+		if strings.EqualFold(e.dn, dn) {
+			e.password = password
+			return nil
+		}
+	}
+	return errors.New("no such user " + uid)
+}
+
+// DropConnections closes the open connections, as directories do with idle
+// ones, while leaving the server listening for new ones
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server and closes its connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+	for {
+		packet, err := ber.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			log.Printf("ldaptest: malformed message")
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case opBindRequest:
+			responses = []*ber.Packet{s.bind(op)}
+		case opUnbindRequest:
+			return
+		case opSearchRequest:
+			responses = s.search(op)
+		case opExtendedRequest:
+			responses = []*ber.Packet{result(opExtendedResponse, resultUnwillingToPerform, "extended operations are not supported")}
+		default:
+			log.Printf("ldaptest: unsupported operation %d", op.Tag)
+			return
+		}
+		for _, r := range responses {
+			message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			message.AppendChild(r)
+			if _, err := c.Write(message.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// result encodes an LDAPResult of the operation op
+func result(op ber.Tag, code int, message string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "diagnosticMessage"))
+	return p
+}
+
+// bind answers a simple bind as a user, the service account or anonymously
+func (s *Server) bind(op *ber.Packet) *ber.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.binds++
+	if len(op.Children) < 3 || op.Children[2].Tag != 0 {
+		return result(opBindResponse, resultProtocolError, "only simple binds are supported")
+	}
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	if dn == "" && password == "" {
+		return result(opBindResponse, resultSuccess, "")
+	}
+	if d := s.Directory; d.BindDN != "" && strings.EqualFold(dn, d.BindDN) {
+		if password == d.BindPassword {
+			return result(opBindResponse, resultSuccess, "")
+		}
+		return result(opBindResponse, resultInvalidCredentials, "invalid credentials")
+	}
+	for _, e := range s.entries {
+		if e.password != "" && strings.EqualFold(e.dn, dn) && e.password == password {
+			return result(opBindResponse, resultSuccess, "")
+		}
+	}
+	return result(opBindResponse, resultInvalidCredentials, "invalid credentials")
+}
+
+// search returns the entries matching a search request, followed by its
+// result
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{result(opSearchResultDone, resultProtocolError, "malformed search request")}
+	}
+	base, _ := op.Children[0].Value.(string)
+	scope, _ := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		if name, ok := a.Value.(string); ok {
+			attrs = append(attrs, name)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.EqualFold(base, s.Directory.BaseDN) && s.entry(base) == nil {
+		return []*ber.Packet{result(opSearchResultDone, resultNoSuchObject, "no such object")}
+	}
+	var responses []*ber.Packet
+	for _, e := range s.entries {
+		if inScope(e.dn, base, scope) && s.match(e, filter) {
+			responses = append(responses, encodeEntry(e, attrs, s.MaxValRange))
+		}
+	}
+	return append(responses, result(opSearchResultDone, resultSuccess, ""))
+}
+
+func (s *Server) entry(dn string) *entry {
+	for _, e := range s.entries {
+		if strings.EqualFold(e.dn, dn) {
+			return e
+		}
+	}
+	return nil
+}
+
+// inScope reports whether dn is within scope (0 base, 1 one level, 2 whole
+// subtree) of base
+func inScope(dn, base string, scope int64) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	switch scope {
+	case 0:
+		return dn == base
+	case 1:
+		i := strings.Index(dn, ",")
+		return i >= 0 && dn[i+1:] == base
+	default:
+		return dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+// encodeEntry encodes e with the attributes attrs, all of them if none, each
+// with at most maxValRange values unless it is 0. Attributes may be asked for
+// as e.g. member;range=1500-*, for the values from the 1500th.
+func encodeEntry(e *entry, attrs []string, maxValRange int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, opSearchResultEntry, nil, "Search Result Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	var keys []string
+	lows := make(map[string]int)
+	if len(attrs) == 0 || contains(attrs, "*") {
+		for k := range e.names {
+			keys = append(keys, k)
+		}
+	} else {
+		for _, a := range attrs {
+			k := strings.ToLower(a)
+			if i := strings.Index(k, ";range="); i >= 0 {
+				lows[k[:i]], _ = strconv.Atoi(strings.SplitN(k[i+len(";range="):], "-", 2)[0])
+				k = k[:i]
+			}
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		values, ok := e.attrs[k]
+		if !ok {
+			continue
+		}
+		name := e.names[k]
+		if low, ranged := lows[k]; ranged || (maxValRange > 0 && len(values) > maxValRange) {
+			if low > len(values) {
+				low = len(values)
+			}
+			values = values[low:]
+			high := "*"
+			if maxValRange > 0 && len(values) > maxValRange {
+				values = values[:maxValRange]
+				high = strconv.Itoa(low + maxValRange - 1)
+			}
+			name = fmt.Sprintf("%s;range=%d-%s", name, low, high)
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "partialAttribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	p.AppendChild(list)
+	return p
+}
+
+// match evaluates a search filter against e. Values are compared case
+// insensitively, as the directory's attributes all are.
+func (s *Server) match(e *entry, f *ber.Packet) bool {
+	switch f.Tag {
+	case filterAnd:
+		for _, c := range f.Children {
+			if !s.match(e, c) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, c := range f.Children {
+			if s.match(e, c) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return len(f.Children) == 1 && !s.match(e, f.Children[0])
+	case filterEqualityMatch, filterApproxMatch, filterGreaterOrEqual, filterLessOrEqual:
+		if len(f.Children) != 2 {
+			return false
+		}
+		name, value := f.Children[0].Data.String(), strings.ToLower(f.Children[1].Data.String())
+		for _, v := range e.attrs[strings.ToLower(name)] {
+			v = strings.ToLower(v)
+			switch {
+			case f.Tag == filterGreaterOrEqual && v >= value,
+				f.Tag == filterLessOrEqual && v <= value,
+				v == value:
+				return true
+			}
+		}
+		return false
+	case filterPresent:
+		return len(e.attrs[strings.ToLower(f.Data.String())]) > 0
+	case filterSubstrings:
+		if len(f.Children) != 2 {
+			return false
+		}
+		for _, v := range e.attrs[strings.ToLower(f.Children[0].Data.String())] {
+			if matchSubstrings(strings.ToLower(v), f.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	case filterExtensibleMatch:
+		return s.matchExtensible(e, f)
+	}
+	return false
+}
+
+// matchSubstrings matches v against the initial (0), any (1) and final (2)
+// parts of a substrings filter
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+	for _, p := range parts {
+		part := strings.ToLower(p.Data.String())
+		switch p.Tag {
+		case 0:
+			if !strings.HasPrefix(v, part) {
+				return false
+			}
+			v = v[len(part):]
+		case 1:
+			i := strings.Index(v, part)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(part):]
+		case 2:
+			if !strings.HasSuffix(v, part) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchExtensible evaluates an extensible match, supporting equality and
+// matchingRuleInChain
+func (s *Server) matchExtensible(e *entry, f *ber.Packet) bool {
+	var rule, name, value string
+	for _, c := range f.Children {
+		switch c.Tag {
+		case 1:
+			rule = c.Data.String()
+		case 2:
+			name = strings.ToLower(c.Data.String())
+		case 3:
+			value = c.Data.String()
+		}
+	}
+	switch rule {
+	case "":
+		for _, v := range e.attrs[name] {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case matchingRuleInChain:
+		return s.inChain(e, name, value, map[string]bool{})
+	}
+	return false
+}
+
+// inChain reports whether dn can be reached from e by following the DNs in
+// its attribute name, e.g. whether a group has dn as a member directly or
+// through the groups it has as members
+func (s *Server) inChain(e *entry, name, dn string, seen map[string]bool) bool {
+	seen[strings.ToLower(e.dn)] = true
+	for _, v := range e.attrs[name] {
+		if strings.EqualFold(v, dn) {
+			return true
+		}
+		if next := s.entry(v); next != nil && !seen[strings.ToLower(v)] && s.inChain(next, name, dn, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
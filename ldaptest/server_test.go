@@ -0,0 +1,219 @@
+package ldaptest
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+func testDirectory() *Directory {
+	return &Directory{
+		BaseDN:       "dc=example,dc=com",
+		BindDN:       "cn=ldap_proxy,dc=example,dc=com",
+		BindPassword: "bind-secret",
+		Users: []*User{
+			{UID: "michael", Password: "secret", Mail: "michael@example.com", Groups: []string{"staff", "ops"}},
+			{UID: "anna", Password: "hunter2", Groups: []string{"staff"}},
+		},
+		Groups: []*Group{{CN: "staff"}, {CN: "ops", Groups: []string{"engineering"}}, {CN: "engineering"}},
+	}
+}
+
+func testConfig(s *Server) *ldapauth.Config {
+	return &ldapauth.Config{
+		Base:            s.Directory.BaseDN,
+		Host:            s.Host(),
+		Port:            s.Port(),
+		BindDN:          s.Directory.BindDN,
+		BindPassword:    s.Directory.BindPassword,
+		UserFilter:      "(&(objectClass=User)(uid=%s))",
+		GroupFilter:     "(&(objectClass=group)(member:1.2.840.113556.1.4.1941:=%s))",
+		GroupNameFilter: "(&(objectClass=group)(cn=%s))",
+		MemberFilter:    "(&(objectClass=User)(memberOf:1.2.840.113556.1.4.1941:=%s))",
+		Attributes:      []string{"mail", "cn"},
+	}
+}
+
+func testClient(t *testing.T, s *Server) *ldapauth.Client {
+	c, err := ldapauth.NewClient(testConfig(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestServerAuthenticate(t *testing.T) {
+	s, err := NewServer(testDirectory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := testClient(t, s)
+	defer c.Close()
+
+	ok, user, err := c.Authenticate("michael", "secret")
+	if !ok || err != nil || user["dn"] != "uid=michael,ou=people,dc=example,dc=com" || user["mail"] != "michael@example.com" {
+		t.Errorf("unexpected result %v %+v %v", ok, user, err)
+	}
+	if ok, _, err := c.Authenticate("michael", "wrong"); ok || err == nil {
+		t.Error("expected a wrong password to be rejected")
+	}
+	if _, _, err := c.Authenticate("nobody", "secret"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("expected an unknown user, got %v", err)
+	}
+
+	s.SetPassword("anna", "changed")
+	if ok, _, _ := c.Authenticate("anna", "changed"); !ok {
+		t.Error("expected the changed password to be accepted")
+	}
+	if s.Binds() == 0 {
+		t.Error("expected the binds to be counted")
+	}
+}
+
+func TestServerGroups(t *testing.T) {
+	s, err := NewServer(testDirectory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := testClient(t, s)
+	defer c.Close()
+	if _, err := c.LookupUser("michael"); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := c.GetGroupsOfUser("uid=michael,ou=people,dc=example,dc=com")
+	sort.Strings(groups)
+	if err != nil || strings.Join(groups, ",") != "engineering,ops,staff" {
+		t.Errorf("expected nested groups, got %v %v", groups, err)
+	}
+	dn, err := c.GetGroupDN("Engineering")
+	if err != nil || dn != "cn=engineering,ou=groups,dc=example,dc=com" {
+		t.Fatalf("unexpected group %q %v", dn, err)
+	}
+	members, err := c.GetMembersOfGroup(dn)
+	if err != nil || len(members) != 1 || members[0] != "uid=michael,ou=people,dc=example,dc=com" {
+		t.Errorf("unexpected members %v %v", members, err)
+	}
+}
+
+func TestServerRangedMembers(t *testing.T) {
+	d := testDirectory()
+	for _, uid := range []string{"a", "b", "c", "d", "e"} {
+		d.Users = append(d.Users, &User{UID: uid, Password: "secret", Groups: []string{"staff"}})
+	}
+	s, err := NewServer(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.MaxValRange = 3
+	cfg := testConfig(s)
+	cfg.MemberAttribute = "member"
+	c, err := ldapauth.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.LookupUser("michael"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 7 members are returned as member;range=0-2, 3-5 and 6-*
+	members, err := c.GetMembersOfGroup(d.GroupDN("staff"))
+	if err != nil || len(members) != 7 || members[0] != d.UserDN("michael") || members[6] != d.UserDN("e") {
+		t.Errorf("expected every member, got %v %v", members, err)
+	}
+	if members, err = c.GetMembersOfGroup(d.GroupDN("engineering")); err != nil || len(members) != 1 || members[0] != d.GroupDN("ops") {
+		t.Errorf("expected the direct member, got %v %v", members, err)
+	}
+
+	// and as a whole when within the limit
+	s.MaxValRange = 0
+	if members, err = c.GetMembersOfGroup(d.GroupDN("staff")); err != nil || len(members) != 7 {
+		t.Errorf("expected every member, got %v %v", members, err)
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	s, err := NewServer(testDirectory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := testClient(t, s)
+	defer c.Close()
+	if _, err := c.LookupUser("michael"); err != nil {
+		t.Fatal(err)
+	}
+	reconnects := func() int64 {
+		if v, ok := expvar.Get("ldap_connections").(*expvar.Map).Get("reconnects").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := reconnects()
+
+	// the directory closes the connection while it's idle
+	s.DropConnections()
+	groups, err := c.GetGroupsOfUser("uid=michael,ou=people,dc=example,dc=com")
+	if err != nil || len(groups) != 3 {
+		t.Fatalf("expected the search to succeed on a new connection, got %v %v", groups, err)
+	}
+	if n := reconnects() - before; n != 1 {
+		t.Errorf("expected 1 reconnect, got %d", n)
+	}
+
+	// a directory which can't be reached again fails the search
+	s.DropConnections()
+	s.Close()
+	if _, err := c.GetGroupDN("staff"); err == nil {
+		t.Error("expected an error once the directory is gone")
+	}
+}
+
+func TestServerUserGroups(t *testing.T) {
+	s, err := NewServer(testDirectory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m, err := ldapauth.NewGroupMatcher(ldapauth.GroupMatchCN, []string{"engineering"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := testConfig(s).UserGroups(m, "michael")
+	sort.Strings(groups)
+	if err != nil || strings.Join(groups, ",") != "engineering,ops,staff" {
+		t.Errorf("expected michael's groups, got %v %v", groups, err)
+	}
+	if _, err := testConfig(s).UserGroups(m, "nobody"); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+}
+
+func TestLoadDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldaptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "directory.json")
+	ioutil.WriteFile(filename, []byte(`{"base_dn": "dc=example,dc=com", "users": [{"uid": "michael", "password": "secret", "groups": ["admins"]}]}`), 0600)
+
+	d, err := LoadDirectory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(d); err == nil || !strings.Contains(err.Error(), `unknown group "admins"`) {
+		t.Errorf("expected an error for the undefined group, got %v", err)
+	}
+}
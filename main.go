@@ -6,61 +6,183 @@ import (
 	"log"
 	"os"
 	"runtime"
-	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/mreiferson/go-options"
+	"github.com/skybet/ldap_proxy/proxy"
 )
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	flagSet := flag.NewFlagSet("ldap_proxy", flag.ExitOnError)
 
-	emailDomains := StringArray{}
-	upstreams := StringArray{}
-	skipAuthRegex := StringArray{}
-	skipAuthIPs := StringArray{}
-	ldapGroups := StringArray{}
+	emailDomains := proxy.StringArray{}
+	upstreams := proxy.StringArray{}
+	skipAuthRegex := proxy.StringArray{}
+	skipAuthRules := proxy.StringArray{}
+	skipAuthIPs := proxy.StringArray{}
+	ldapGroups := proxy.StringArray{}
+	corsOrigins := proxy.StringArray{}
+	authzAttributes := proxy.StringArray{}
+	corsMethods := proxy.StringArray{}
+	corsHeaders := proxy.StringArray{}
+	authenticators := proxy.StringArray{}
+	trustedProxies := proxy.StringArray{}
+	prefixAliases := proxy.StringArray{}
+	adminUsers := proxy.StringArray{}
+	authResponseHeaders := proxy.StringArray{}
+	loginNormalize := proxy.StringArray{}
+	ldapRealms := proxy.StringArray{}
+	accessLogRedactParams := proxy.StringArray{}
+	sessionExpireGroups := proxy.StringArray{}
+	http1OnlyClients := proxy.StringArray{}
+	deferGroupsRequire := proxy.StringArray{}
+	signInDenyAgents := proxy.StringArray{}
+	signInKnownAgents := proxy.StringArray{}
 
 	config := flagSet.String("config", "", "path to config file")
 	showVersion := flagSet.Bool("version", false, "print version string")
+	checkConfig := flagSet.Bool("check-config", false, "validate the configuration, the files it refers to and the LDAP service account bind, then exit")
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
 	flagSet.String("tls-cert", "", "path to certificate file")
 	flagSet.String("tls-key", "", "path to private key file")
 	flagSet.String("cipher-suites", "", "cipher suites (comma separated)")
+	flagSet.String("tls-min-version", "1.2", "lowest TLS version the HTTPS listener accepts: 1.2 or 1.3")
+	flagSet.String("tls-max-version", "1.3", "highest TLS version the HTTPS listener accepts: 1.2 or 1.3")
+	flagSet.String("tls-curve-preferences", "", "key exchange curves of the HTTPS listener in order of preference (comma separated): X25519, P256, P384, P521")
+	flagSet.Bool("disable-http2", false, "offer only HTTP/1.1 to HTTPS clients")
+	flagSet.Var(&http1OnlyClients, "http1-only-client", "IP or CIDR range of HTTPS clients offered only HTTP/1.1, for those mishandling HTTP/2 (may be given multiple times)")
+	flagSet.String("max-header-size", "1M", "largest request header accepted from clients, e.g. 64K; larger ones get 431 Request Header Fields Too Large")
+	flagSet.Duration("read-header-timeout", 10*time.Second, "time clients have to send a request's header before the connection is closed; 0 to wait indefinitely")
+	flagSet.Int("max-request-cookies", 180, "most cookies a request may carry, more get 431 Request Header Fields Too Large and are logged; 0 for any number")
 
 	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
+	flagSet.Var(&authResponseHeaders, "auth-response-header", "Header-Name:field response header to set from the user, email, groups, previous_sign_in_at, previous_sign_in_ip or failed_sign_ins of the session instead of those of -set-xauthrequest and -auth-endpoint-basic, or none (may be given multiple times)")
 	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
+	flagSet.String("upstreams-file", "", "JSON file of further upstreams, {\"upstreams\": [...]}, reloaded when it changes")
+	flagSet.String("upstreams-consul-url", "", "Consul KV URL (e.g. http://127.0.0.1:8500/v1/kv/ldap_proxy/upstreams) of further upstreams, watched for changes")
+	flagSet.String("upstreams-consul-token", "", "ACL token for -upstreams-consul-url")
+	flagSet.String("large-response-size", "", "log and count upstream responses larger than this (e.g. 512M) in the upstream_responses expvar; disabled if empty")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.String("user-header-name", "X-Forwarded-User", "request header passing the user to upstreams, empty to not pass it")
+	flagSet.String("email-header-name", "X-Forwarded-Email", "request header passing the email to upstreams, empty to not pass it")
+	flagSet.String("groups-header-name", "", "request header passing the comma separated groups to upstreams, e.g. X-Forwarded-Groups; not passed unless set")
+	flagSet.String("dn-header-name", "", "request header passing the canonical DN of directory users to upstreams, e.g. X-Forwarded-User-DN; not passed unless set")
+	flagSet.String("identity-header-mode", "plain", "how the user, email, groups and DN headers are passed to upstreams: plain, encrypt (AES-GCM with -identity-header-key) or hmac (only their HMAC-SHA256 with -identity-header-key)")
+	flagSet.String("identity-header-key", "", "key encrypting or signing the identity headers of -identity-header-mode, 16, 24 or 32 bytes or their base64 encoding to encrypt them")
+	flagSet.String("instance-name", "", "name of this instance in -instance-header and -instance-query-param (default the hostname)")
+	flagSet.String("instance-header", "", "header naming this instance and its version, e.g. X-LAP-Instance, to trace which replica handled a request; not sent unless set")
+	flagSet.String("instance-header-mode", "both", "where -instance-header is sent: both, upstream (requests to upstreams) or response (responses to clients)")
+	flagSet.String("instance-query-param", "", "query parameter naming this instance added to requests to upstreams; not added unless set")
+	flagSet.Bool("pass-access-token", false, "pass an opaque token identifying the session to upstream in X-Forwarded-Access-Token")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests paths that match (may be given multiple times)")
+	flagSet.Var(&skipAuthRules, "skip-auth-rule", "named rule bypassing authentication, \"<name> <path regex> [methods=GET,HEAD] [description=<URL encoded text>]\", logged with the requests it matches (may be given multiple times)")
 	flagSet.Var(&skipAuthIPs, "skip-auth-ips", "bypass authentication for request hosts that match (may be given multiple times)")
-	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for CORS preflight requests (OPTIONS with Origin and Access-Control-Request-Method)")
+	flagSet.Bool("skip-auth-options", false, "will skip authentication for all OPTIONS requests, not only CORS preflights")
+	flagSet.String("acl-file", "", "file of ordered allow, deny and public rules deciding which requests are let through (replaces the skip-auth options)")
+	flagSet.String("geoip-database", "", "MaxMind DB file, e.g. GeoLite2-Country.mmdb, to look up the countries of clients in for the logs and country ACL conditions")
+	flagSet.Var(&corsOrigins, "cors-allowed-origin", "origin allowed to make cross origin requests, or * for any, which cors-allow-credentials refuses (may be given multiple times)")
+	flagSet.Var(&corsMethods, "cors-allowed-method", "method allowed in cross origin requests (may be given multiple times, default GET, HEAD, POST, PUT, PATCH, DELETE)")
+	flagSet.Var(&corsHeaders, "cors-allowed-header", "request header allowed in cross origin requests (may be given multiple times, default any requested header)")
+	flagSet.Bool("cors-allow-credentials", false, "allow cross origin requests to include cookies")
+	flagSet.Duration("cors-max-age", time.Duration(0), "how long browsers may cache preflight responses")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
-	flagSet.String("real-ip-header", "X-Real-IP", "The header which specifies the real IP of the request. Caution: This header may allow a malicious actor to spoof an internal IP, bypassing whitelists. Set to the empty string to ignore")
-	flagSet.String("proxy-ip-header", "X-Forwarded-For", "The header which specifies the real IP of the proxied request. Caution: This header may allow a malicious actor to spoof an internal IP, bypassing whitelists. Set to the empty string to ignore")
+	flagSet.String("real-ip-header", "X-Real-IP", "The header which specifies the real IP of the request, believed only from a -trusted-proxy. Set to the empty string to ignore")
+	flagSet.String("proxy-ip-header", "X-Forwarded-For", "The header which specifies the real IP of the proxied request, of which only the address a -trusted-proxy added is believed. Set to the empty string to ignore")
+	flagSet.Var(&trustedProxies, "trusted-proxy", "IP or CIDR range of a load balancer whose X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port headers are believed for redirects, -cookie-secure-auto and HSTS, and whose -real-ip-header and -proxy-ip-header give the client address (may be given multiple times)")
 
 	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption")
+	flagSet.String("break-glass-file", "", "file of emergency accounts with bcrypt hashes and expiry times, tried before any other authenticator and audited whenever used")
+	flagSet.Var(&authenticators, "authenticator", "identity source to authenticate sign-ins against, tried in the order given: htpasswd, ldap, exec or webhook (may be given multiple times, default htpasswd if configured then ldap)")
+	flagSet.String("auth-exec-command", "", "command run by the exec authenticator; receives the username in $LDAP_PROXY_USERNAME and the password on stdin")
+	flagSet.String("auth-webhook-url", "", "url the webhook authenticator POSTs the credentials to")
+	flagSet.Duration("authenticator-timeout", 10*time.Second, "timeout for the exec and webhook authenticators")
+	flagSet.Var(&loginNormalize, "login-normalize", "rewrite usernames before they are authenticated, in the order given: netbios-domain[=DOMAIN,...] strips DOMAIN\\, upn-suffix[=domain,...] strips @domain, lowercase (may be given multiple times)")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.String("sign-in-banner", "", "usage policy text users must agree to on the sign-in page")
+	flagSet.Bool("landing-page", false, "show signed in users a page at / listing the upstreams they may use")
+	flagSet.Int("sign-in-loop-limit", 0, "show a page explaining sign-in loops to browsers sent to sign in this many times within -sign-in-loop-window; 0 to disable")
+	flagSet.Duration("sign-in-loop-window", time.Minute, "the window of -sign-in-loop-limit")
+	flagSet.Var(&signInDenyAgents, "sign-in-deny-user-agent", "regex of User-Agents refused the sign-in page and sign-ins with 403 Forbidden (may be given multiple times)")
+	flagSet.Var(&signInKnownAgents, "sign-in-known-user-agent", "regex of User-Agents -sign-in-unknown-agent-limit doesn't apply to (may be given multiple times, default ^Mozilla/)")
+	flagSet.Int("sign-in-unknown-agent-limit", 0, "sign-in pages and sign-ins a minute allowed to each client address with an unknown User-Agent; 0 for no limit")
+	flagSet.String("reauth-header", "", "header of upstream responses, e.g. X-LAP-Reauth, which signs the user out and sends them to sign in again when set to true")
 	flagSet.String("proxy-prefix", "/ldap_auth", "the url root path that this proxy should be nested under (e.g. /<ldap_auth>/sign_in)")
+	flagSet.Var(&prefixAliases, "proxy-prefix-alias", "an additional url root path the sign_in, sign_out and auth endpoints are served under, e.g. /oauth2 for oauth2_proxy compatible configs (may be given multiple times)")
+	flagSet.Bool("proxy-prefix-passthrough", false, "pass requests for unknown paths under -proxy-prefix and its aliases to the upstreams instead of responding 404")
 
 	flagSet.String("cookie-name", "_ldap_proxy", "the name of the cookie that the ldap_proxy creates")
 	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
 	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
+	flagSet.Bool("cookie-domain-auto", false, "without -cookie-domain, scope cookies to the registrable domain of the request host (e.g. example.com for wiki.example.com), never to a public suffix")
+	flagSet.String("public-suffix-list", proxy.DefaultPublicSuffixList, "public suffix list (https://publicsuffix.org/) used by -cookie-domain-auto")
+	flagSet.String("login-host", "", "the only host serving the sign-in page, e.g. login.example.com; clients of other hosts under the cookie domain are redirected to it to sign in and back")
+	flagSet.String("cookie-path", "/", "an optional cookie path to scope cookies to (ie: /app/), must cover -proxy-prefix for the auth endpoint to see the cookie")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.String("cookie-signature-hash", "sha256", "hash of the HMAC signing cookies: sha256 or sha1")
+	flagSet.Duration("cookie-clock-skew", 5*time.Minute, "how far the clock of the instance which issued a cookie may be ahead or behind that of the one validating it")
+	flagSet.Bool("cookie-accept-sha1", true, "accept cookies signed with SHA1, as by earlier versions; disable once -cookie-expire has passed since upgrading")
+	flagSet.Bool("cookie-secure-auto", false, "set the secure cookie flag only for HTTPS requests, including those a -trusted-proxy received over HTTPS; overrides -cookie-secure")
+	flagSet.String("session-store", "cookie", "where sessions are kept: \"cookie\" or \"memory\" (in process, the cookie holds only a ticket)")
+	flagSet.Int("session-store-max-entries", 10000, "maximum number of sessions kept by -session-store=memory before the least recently used are evicted")
+	flagSet.Int("max-sessions-per-user", 0, "how many sessions a user may have in a server side -session-store, the oldest being signed out when they sign in again; 0 for no limit")
+	flagSet.Bool("session-bearer", false, "accept the session cookie's value in an Authorization: Bearer header, returned as token by JSON sign-ins, for clients without cookies")
+	flagSet.Var(&sessionExpireGroups, "session-expire-group", "group=duration lifetime of the sessions of the group's members, e.g. contractors=1h, at most -cookie-expire; the shortest of a user's groups applies (may be given multiple times)")
+	flagSet.String("session-expire-attribute", "", "directory attribute of users holding the lifetime of their sessions, as a duration or seconds, overriding -session-expire-group")
 
-	flagSet.Bool("request-logging", true, "Log requests to stdout")
+	flagSet.String("streaming-expiry-policy", "ignore", "what to do with long-lived connections (websockets, long-polling) when their session expires: ignore, terminate or grace")
+	flagSet.Duration("streaming-expiry-grace", time.Duration(0), "how long long-lived connections may continue after their session expires with -streaming-expiry-policy=grace")
+	flagSet.Bool("auth-endpoint-basic", false, "let the auth endpoint validate HTTP Basic credentials against the authenticators when there is no session, returning X-Auth-Request-User, -Email and -Groups")
+	flagSet.Duration("auth-endpoint-basic-cache-ttl", 5*time.Minute, "how long credentials accepted by -auth-endpoint-basic are remembered; 0 to check every request")
+	flagSet.Duration("auth-endpoint-cache-ttl", time.Duration(0), "how long responses of the auth endpoint are remembered for the same cookie, Host, path and client, e.g. 500ms; 0 to disable")
+	flagSet.Var(&adminUsers, "admin-user", "user allowed to list and change the skip-auth rules at <proxy-prefix>/admin/skip-auth (may be given multiple times)")
+	flagSet.Bool("admin-persist-config", false, "save skip-auth rule changes made at <proxy-prefix>/admin/skip-auth to the -config file")
+	flagSet.Duration("share-link-max-ttl", time.Duration(0), "let signed in users create share links to upstream paths at <proxy-prefix>/share, valid for at most this long; 0 to disable")
+	flagSet.Duration("bypass-token-max-ttl", time.Duration(0), "let -admin-users mint tokens for a path and method at <proxy-prefix>/admin/bypass-token, e.g. for synthetic monitoring, valid for at most this long; 0 to disable")
+	flagSet.Bool("notify-new-device", false, "email users when they sign in from an IP address and browser they haven't signed in from before")
+	flagSet.String("notify-known-devices-file", "", "file the devices users signed in from are kept in for -notify-new-device, so they survive restarts")
+	flagSet.String("smtp-address", "", "host:port of the SMTP server -notify-new-device sends through")
+	flagSet.String("smtp-from", "", "the From address of -notify-new-device emails")
+	flagSet.String("smtp-username", "", "username to authenticate to the SMTP server with, if it requires it")
+	flagSet.String("smtp-password", "", "password of -smtp-username")
+	flagSet.Bool("record-last-sign-in", false, "remember each user's last sign-in so sessions can show the previous one at <proxy-prefix>/userinfo and in -auth-response-header")
+	flagSet.String("last-sign-in-file", "", "file -record-last-sign-in keeps the last sign-ins in, so they survive restarts")
+	flagSet.Bool("warn-failed-sign-ins", false, "tell users who sign in after failed sign-ins with their username how many there were before redirecting them (requires -record-last-sign-in)")
+	flagSet.String("event-webhook-url", "", "URL sign-ins, failed sign-ins, lockouts, sign-outs and revoked sessions are posted to as JSON")
+	flagSet.String("event-webhook-secret", "", "key of the HMAC-SHA256 of event webhook request bodies sent as LAP-Webhook-Signature (required with -event-webhook-url)")
+	flagSet.String("authz-webhook-url", "", "URL asked whether each authenticated request may be made, with the user, groups, method and path posted as JSON")
+	flagSet.String("authz-webhook-secret", "", "key of the HMAC-SHA256 of authorization webhook request bodies sent as LAP-Webhook-Signature (required with -authz-webhook-url)")
+	flagSet.Duration("authz-webhook-timeout", 2*time.Second, "how long to wait for the authorization webhook's decision")
+	flagSet.Duration("authz-webhook-cache-ttl", 30*time.Second, "how long the authorization webhook's decisions are remembered; 0 to ask for every request")
+	flagSet.Bool("authz-webhook-fail-open", false, "allow requests when the authorization webhook can't be asked, instead of denying them")
+	flagSet.String("authz-webhook-format", "ldap_proxy", "the format of authorization webhook requests and responses: ldap_proxy, or opa for the data API of an Open Policy Agent server")
+	flagSet.Var(&authzAttributes, "authz-webhook-attribute", "LDAP attribute of users read at sign-in, kept in the session and posted to the authorization webhook as one of its attributes (may be given multiple times)")
+	flagSet.String("authz-rego-dir", "", "directory of Rego policies evaluated in process instead of asking an authorization webhook, reloaded when they change")
+	flagSet.String("authz-rego-query", "data.ldap_proxy.allow", "the Rego query deciding each authenticated request, with the request as its input")
+
+	flagSet.Bool("request-logging", true, "Log requests to the access-log-target")
+	flagSet.String("log-target", "stderr", "where the operational and audit logs are written: stderr, stdout, a file path, syslog:// for the local syslog daemon, or syslog://<host>[:<port>] (udp) or syslog+tcp://<host>[:<port>] for a remote one")
+	flagSet.String("audit-log-target", "", "where the audit log is written, in the form of -log-target (default the -log-target)")
+	flagSet.String("access-log-target", "stdout", "where requests are logged, in the form of -log-target")
+	flagSet.Float64("access-log-sample-rate", 1, "fraction of requests logged, from 0 to 1; responses with status 400 or above are always logged")
+	flagSet.Bool("access-log-redact-query", false, "replace the values of all query parameters in the request log with REDACTED")
+	flagSet.Var(&accessLogRedactParams, "access-log-redact-param", "query parameter whose value is replaced with REDACTED in the request log, e.g. token (may be given multiple times)")
+	flagSet.String("debug-address", "", "<localhost addr>:<port> to serve pprof profiles at /debug/pprof/ and expvar counters at /debug/vars on; disabled if empty")
+	flagSet.Bool("graceful-upgrade", false, "on SIGUSR2 start the executable again, handing it the listening sockets, and exit once the requests in progress are done; on SIGHUP do so once the changed configuration has been checked")
+	flagSet.Duration("upgrade-drain-timeout", time.Hour, "how long the process upgraded from waits for requests in progress, including websockets and streams, before exiting")
 
 	flagSet.String("login-url", "", "Authentication endpoint")
 
@@ -69,59 +191,108 @@ func main() {
 	// TODO I don't know how LDAP works
 	flagSet.String("ldap-server-host", "localhost", "Hostname of LDAP server")
 	flagSet.Int("ldap-server-port", 389, "Port of LDAP server")
+	flagSet.String("ldap-server-discovery", "", "set to \"srv\" to find the LDAP servers from the _ldap._tcp SRV records of -ldap-server-host, a domain, instead of connecting to it")
+	flagSet.Duration("ldap-server-discovery-refresh", 5*time.Minute, "how often the SRV records of -ldap-server-discovery are re-resolved")
+	flagSet.Int("ldap-retries", 2, "how many more times a sign-in is tried when the LDAP servers can't be reached or are busy")
+	flagSet.Duration("ldap-retry-backoff", 250*time.Millisecond, "how long to wait before the first retry of -ldap-retries, doubled for each one after")
+	flagSet.Duration("ldap-slow-query-threshold", 0, "log a warning for LDAP binds and searches taking longer than this; disabled if 0")
+	flagSet.Int("ldap-max-concurrent-binds", 0, "how many sign-ins may be checked against the directory at once; 0 for no limit")
+	flagSet.Duration("ldap-bind-queue-timeout", 5*time.Second, "how long a sign-in over -ldap-max-concurrent-binds waits for another to finish before being turned away")
+	flagSet.Bool("ldap-defer-groups", false, "sign users in straight after their bind and look up their groups in the background; requires a server side -session-store")
+	flagSet.Var(&deferGroupsRequire, "ldap-defer-groups-require-regex", "regex of paths whose requests wait for the groups of a -ldap-defer-groups sign-in (may be given multiple times)")
+	flagSet.Bool("ldap-canonical-username", false, "give directory users' sessions their uid exactly as the directory has it as the username, instead of the username they signed in with")
 	flagSet.Bool("ldap-tls", true, "Use TLS when communicating with the LDAP server")
 	flagSet.String("ldap-scope-name", "LDAP", "Name of LDAP scope")
 	flagSet.String("ldap-base-dn", "", "Base DN for LDAP bind")
 	flagSet.String("ldap-bind-dn", "", "Bind DN for LDAP bind")
 	flagSet.String("ldap-bind-dn-password", "", "Bind DN password for LDAP bind")
+	flagSet.String("ldap-bind-dn-password-file", "", "File containing the bind DN password, re-read when the password is rejected")
 	flagSet.Var(&ldapGroups, "ldap-groups", "Groups a user must be in")
+	flagSet.String("ldap-group-match", "cn", "How ldap-groups are compared with the user's groups: cn, dn (full DN) or regex (matched against the full DN)")
+	flagSet.Duration("ldap-group-cache-refresh", time.Duration(0), "resolve the members of ldap-groups at startup and then this often, so sign-ins check the cached membership instead of searching the user's groups; 0 to disable")
+	flagSet.String("ldap-group-member-attribute", "", "attribute of a group listing its direct members, e.g. member, read to resolve the members of ldap-groups instead of searching for users whose memberOf includes the group or a group nested in it")
+	flagSet.Var(&ldapRealms, "ldap-realm", "another directory users may sign in against, as \"name key=value ...\", selected by request Host or on the sign-in page (may be given multiple times)")
 
-	flagSet.Parse(os.Args[1:])
+	args := os.Args[1:]
+	var verifyUsername, exportFormat *string
+	if len(args) > 0 && args[0] == "verify-user" {
+		args = args[1:]
+		verifyUsername = flagSet.String("username", "", "the user to look up with verify-user")
+	}
+	if len(args) > 0 && args[0] == "export-access" {
+		args = args[1:]
+		exportFormat = flagSet.String("format", "json", "the format of export-access: json or csv")
+	}
+	flagSet.Parse(args)
 
 	if *showVersion {
-		fmt.Printf("ldap_proxy v%s (built with %s)\n", VERSION, runtime.Version())
+		fmt.Printf("ldap_proxy v%s (built with %s)\n", proxy.VERSION, runtime.Version())
 		return
 	}
 
-	opts := NewOptions()
+	loadOptions := func() (*proxy.Options, error) { return resolveOptions(flagSet, *config) }
+	opts, err := loadOptions()
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	if verifyUsername != nil {
+		os.Exit(verifyUser(opts, *verifyUsername))
+	}
+	if exportFormat != nil {
+		os.Exit(exportAccess(opts, *exportFormat))
+	}
 
-	cfg := make(EnvOptions)
-	if *config != "" {
-		_, err := toml.DecodeFile(*config, &cfg)
-		if err != nil {
-			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
+	if *checkConfig {
+		if err := proxy.CheckConfig(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		fmt.Println("configuration ok")
+		return
 	}
-	cfg.LoadEnvForStruct(opts)
-	options.Resolve(opts, flagSet, cfg)
 
-	err := opts.Validate()
-	if err != nil {
+	if err := proxy.ConfigureLogging(opts); err != nil {
 		log.Printf("%s", err)
 		os.Exit(1)
 	}
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
-	ldapproxy := NewLdapProxy(opts, validator)
-
-	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
-		if len(opts.EmailDomains) > 1 {
-			ldapproxy.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
-		} else if opts.EmailDomains[0] != "*" {
-			ldapproxy.SignInMessage = fmt.Sprintf("Authenticate using %v", opts.EmailDomains[0])
-		}
+	ldapproxy, err := proxy.New(opts)
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
 	}
+	ldapproxy.ConfigFile = *config
 
-	if opts.HtpasswdFile != "" {
-		log.Printf("using htpasswd file %s", opts.HtpasswdFile)
-		ldapproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
-		if err != nil {
-			log.Fatalf("FATAL: unable to open %s %s", opts.HtpasswdFile, err)
-		}
+	accessLog, err := proxy.OpenAccessLog(opts)
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
 	}
+	proxy.ReopenLogsOnSignal()
 
-	s := &Server{
-		Handler: LoggingHandler(os.Stdout, ldapproxy, opts.RequestLogging),
-		Opts:    opts,
+	s := &proxy.Server{
+		Handler:     proxy.AccessLogHandler(accessLog, ldapproxy, opts),
+		Opts:        opts,
+		LoadOptions: loadOptions,
 	}
+	ldapproxy.Reload = s.Reload
 	s.ListenAndServe()
 }
+
+// resolveOptions reads the options from the flags, the environment and the
+// config file, which is read afresh on every call
+func resolveOptions(flagSet *flag.FlagSet, config string) (*proxy.Options, error) {
+	opts := proxy.NewOptions()
+	cfg := make(proxy.EnvOptions)
+	if config != "" {
+		if _, err := toml.DecodeFile(config, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to load config file %s - %s", config, err)
+		}
+	}
+	cfg.LoadEnvForStruct(opts)
+	options.Resolve(opts, flagSet, cfg)
+	if err := proxy.ResolveSecrets(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
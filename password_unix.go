@@ -0,0 +1,38 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPassword prompts for a password on stderr and reads it from stdin,
+// without echoing it if stdin is a terminal
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios); err == nil {
+		noecho := *termios
+		noecho.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &noecho); err != nil {
+			return "", err
+		}
+		defer func() {
+			unix.IoctlSetTermios(fd, ioctlSetTermios, termios)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats of access exports
+const (
+	AccessExportJSON = "json"
+	AccessExportCSV  = "csv"
+)
+
+// Sources of access grants besides acl-file rules
+const (
+	accessSourceLdapGroups     = "ldap-groups"
+	accessSourceSkipAuth       = "skip-auth-regex"
+	accessSourceSkipAuthIP     = "skip-auth-ip"
+	accessSourceHtpasswd       = "htpasswd-file"
+	accessSourceBreakGlass     = "break-glass-file"
+	accessSourceUpstreamGroups = "upstream groups"
+)
+
+// AccessExport is who has access to each upstream, for access reviews
+type AccessExport struct {
+	GeneratedAt time.Time      `json:"generated_at"`
+	Grants      []*AccessGrant `json:"grants"`
+}
+
+// AccessGrant is a rule which can apply to the requests for an upstream,
+// with the members of its group at the time of the export. An empty Group
+// stands for every user who can sign in, or everyone for public rules,
+// except for the accounts of the htpasswd and break-glass files, which are
+// their Members.
+type AccessGrant struct {
+	Path     string   `json:"path"`
+	Upstream string   `json:"upstream"`
+	Source   string   `json:"source"`
+	Action   string   `json:"action"`
+	Group    string   `json:"group"`
+	Members  []string `json:"members"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// ExportAccess returns who has access to each upstream of opts, resolving
+// the members of groups in the directory, without starting the proxy
+func ExportAccess(opts *Options) (*AccessExport, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	cfg := newLdapConfig(opts)
+	if opts.LdapBindDnPasswordFile != "" {
+		if _, err := cfg.ReloadBindPassword(); err != nil {
+			return nil, fmt.Errorf("unable to read %s %s", opts.LdapBindDnPasswordFile, err)
+		}
+	}
+	p := &LdapProxy{
+		upstreams:         opts.proxyURLs,
+		upstreamOptions:   opts.upstreamOptions,
+		LdapConfiguration: cfg,
+		LdapGroups:        opts.LdapGroups,
+		GroupMatcher:      opts.groupMatcher,
+		ACL:               opts.acl,
+		compiledPathRegex: opts.CompiledPathRegex,
+		skipAuthNamed:     opts.skipAuthRules,
+		skipAuthIPs:       opts.skipIPs,
+	}
+	if opts.HtpasswdFile != "" {
+		var err error
+		if p.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile); err != nil {
+			return nil, fmt.Errorf("unable to open %s %s", opts.HtpasswdFile, err)
+		}
+	}
+	p.Authenticators = newAuthenticators(opts, p)
+	return p.exportAccess(), nil
+}
+
+// accountGrants returns the grants of the accounts of the htpasswd and
+// break-glass files for the upstream at path, which sign in without groups
+// and so aren't subject to ldap-groups. Expired break-glass accounts are
+// left out.
+func (p *LdapProxy) accountGrants(path string, u *url.URL) []*AccessGrant {
+	var grants []*AccessGrant
+	if p.HtpasswdFile != nil {
+		g := &AccessGrant{Path: path, Upstream: u.String(), Source: accessSourceHtpasswd, Action: ACLAllow, Members: []string{}}
+		for user := range p.HtpasswdFile.Users {
+			g.Members = append(g.Members, user)
+		}
+		sort.Strings(g.Members)
+		grants = append(grants, g)
+	}
+	for _, a := range p.authenticators() {
+		bg, ok := a.(*BreakGlassAuthenticator)
+		if !ok {
+			continue
+		}
+		g := &AccessGrant{Path: path, Upstream: u.String(), Source: accessSourceBreakGlass, Action: ACLAllow, Members: []string{}}
+		accounts, err := loadBreakGlassFile(bg.File)
+		if err != nil {
+			g.Error = err.Error()
+		}
+		now := time.Now()
+		for user, account := range accounts {
+			if now.Before(account.expires) {
+				g.Members = append(g.Members, user)
+			}
+		}
+		sort.Strings(g.Members)
+		grants = append(grants, g)
+	}
+	return grants
+}
+
+// groupMembers returns the DNs of the members of group in the directory
+func (p *LdapProxy) groupMembers(group string) ([]string, error) {
+	if p.membersOf != nil {
+		return p.membersOf(group)
+	}
+	return p.LdapConfiguration.GroupMembers(p.groupMatcher().Mode, group)
+}
+
+// exportAccess lists the grants of every upstream, looking up the members
+// of each group once
+func (p *LdapProxy) exportAccess() *AccessExport {
+	type resolved struct {
+		members []string
+		err     error
+	}
+	cache := make(map[string]*resolved)
+	grant := func(path string, u *url.URL, source, action, group string) *AccessGrant {
+		g := &AccessGrant{Path: path, Upstream: u.String(), Source: source, Action: action, Group: group, Members: []string{}}
+		if group == "" {
+			return g
+		}
+		r, ok := cache[group]
+		if !ok {
+			r = &resolved{}
+			r.members, r.err = p.groupMembers(group)
+			cache[group] = r
+		}
+		if r.err != nil {
+			g.Error = r.err.Error()
+		} else if r.members != nil {
+			g.Members = r.members
+		}
+		return g
+	}
+
+	p.skipAuthMu.RLock()
+	skipAuth, skipIPs := p.compiledPathRegex, p.skipAuthIPs
+	p.skipAuthMu.RUnlock()
+
+	e := &AccessExport{GeneratedAt: time.Now().UTC(), Grants: []*AccessGrant{}}
+	urls, uos := p.upstreamsWithOptions()
+	for i, u := range urls {
+		path := upstreamPath(u)
+		for _, re := range skipAuth {
+			if pathMayMatch(re, path) {
+				e.Grants = append(e.Grants, grant(path, u, fmt.Sprintf("%s %s", accessSourceSkipAuth, re), ACLPublic, ""))
+			}
+		}
+		for _, r := range p.skipAuthNamed {
+			if pathMayMatch(r.Path, path) {
+				e.Grants = append(e.Grants, grant(path, u, fmt.Sprintf("%s %s", accessSourceSkipAuthRule, r.Name), ACLPublic, ""))
+			}
+		}
+		for _, n := range skipIPs {
+			e.Grants = append(e.Grants, grant(path, u, fmt.Sprintf("%s %s", accessSourceSkipAuthIP, n), ACLPublic, ""))
+		}
+		if p.ACL != nil {
+			for _, r := range p.ACL.Rules {
+				if r.path != nil && !pathMayMatch(r.path, path) {
+					continue
+				}
+				if r.groups == nil {
+					e.Grants = append(e.Grants, grant(path, u, r.String(), r.Action, ""))
+					continue
+				}
+				for _, group := range r.groups.Groups {
+					e.Grants = append(e.Grants, grant(path, u, r.String(), r.Action, group))
+				}
+			}
+		}
+		if len(p.LdapGroups) == 0 {
+			e.Grants = append(e.Grants, grant(path, u, accessSourceLdapGroups, ACLAllow, ""))
+		}
+		for _, group := range p.groupMatcher().Groups {
+			e.Grants = append(e.Grants, grant(path, u, accessSourceLdapGroups, ACLAllow, group))
+		}
+		m := uos[i].groupsMatcher
+		if m == nil {
+			// users without groups are always denied by upstream groups
+			e.Grants = append(e.Grants, p.accountGrants(path, u)...)
+		}
+		// required besides the grants above
+		if m != nil {
+			for _, group := range m.Groups {
+				e.Grants = append(e.Grants, grant(path, u, accessSourceUpstreamGroups, ACLAllow, group))
+			}
+		}
+	}
+	return e
+}
+
+// pathMayMatch reports whether re can match requests for path or any path
+// under it. Patterns which aren't anchored with ^ can match anywhere.
+func pathMayMatch(re *regexp.Regexp, path string) bool {
+	if re.MatchString(path) {
+		return true
+	}
+	src := re.String()
+	if !strings.HasPrefix(src, "^") {
+		return true
+	}
+	anchored, err := regexp.Compile(src[1:])
+	if err != nil {
+		return true
+	}
+	prefix, _ := anchored.LiteralPrefix()
+	return strings.HasPrefix(prefix, path) || strings.HasPrefix(path, prefix)
+}
+
+// WriteCSV writes the grants of e with a row per member, or a row without
+// a member for grants without any
+func (e *AccessExport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "upstream", "source", "action", "group", "member", "error"})
+	for _, g := range e.Grants {
+		members := g.Members
+		if len(members) == 0 {
+			members = []string{""}
+		}
+		for _, m := range members {
+			cw.Write([]string{g.Path, g.Upstream, g.Source, g.Action, g.Group, m, g.Error})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes e as indented JSON
+func (e *AccessExport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(e)
+}
+
+// AdminAccess exports who has access to each upstream, as JSON or, with
+// format=csv in the query, as CSV. Only AdminUsers may use it.
+func (p *LdapProxy) AdminAccess(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if !p.isAdmin(session.User) {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if format != "" && format != AccessExportJSON && format != AccessExportCSV {
+		http.Error(rw, fmt.Sprintf("invalid format %q (must be %s or %s)", format, AccessExportJSON, AccessExportCSV), http.StatusBadRequest)
+		return
+	}
+
+	e := p.exportAccess()
+	p.Auditf(req, "user %q exported upstream access", session.User)
+	if format == AccessExportCSV {
+		rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="access-%s.csv"`, e.GeneratedAt.Format("20060102")))
+		e.WriteCSV(rw)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	e.WriteJSON(rw)
+}
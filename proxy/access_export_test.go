@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func testAccessProxy(t *testing.T) *LdapProxy {
+	f, err := ioutil.TempFile("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("deny group=contractors path=^/grafana/admin\nallow group=ops path=^/wiki/\npublic path=^/status$\n")
+	f.Close()
+
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:3000/grafana/", "file:///srv/docs#/docs/"}
+	o.LdapGroups = []string{"engineers"}
+	o.ACLFile = f.Name()
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	p.membersOf = func(group string) ([]string, error) {
+		switch group {
+		case "engineers":
+			return []string{"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"}, nil
+		case "contractors":
+			return nil, errors.New("found 0 groups named \"contractors\"")
+		}
+		return nil, nil
+	}
+	return p
+}
+
+func TestExportAccess(t *testing.T) {
+	p := testAccessProxy(t)
+	e := p.exportAccess()
+
+	var got []string
+	for _, g := range e.Grants {
+		got = append(got, g.Path+" "+g.Action+" "+g.Group)
+	}
+	expected := []string{
+		"/grafana/ deny contractors",
+		"/grafana/ allow engineers",
+		"/docs/ allow engineers",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected grants %q, got %q", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("expected grant %q, got %q", expected[i], got[i])
+		}
+	}
+
+	if g := e.Grants[0]; g.Error == "" || g.Source != "line 1 (deny group=contractors path=^/grafana/admin)" || g.Upstream != "http://127.0.0.1:3000/grafana/" {
+		t.Errorf("unexpected grant %+v", g)
+	}
+	if g := e.Grants[1]; len(g.Members) != 2 || g.Source != accessSourceLdapGroups || g.Error != "" {
+		t.Errorf("unexpected grant %+v", g)
+	}
+}
+
+func TestExportAccessUpstreamGroups(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:3000/reports/ groups=finance,auditors"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	p.membersOf = func(group string) ([]string, error) {
+		return []string{"uid=" + group + ",ou=people,dc=example,dc=com"}, nil
+	}
+
+	var got []string
+	for _, g := range p.exportAccess().Grants {
+		got = append(got, g.Source+" "+g.Group+" "+strings.Join(g.Members, ","))
+	}
+	expected := []string{
+		"ldap-groups  ",
+		"upstream groups finance uid=finance,ou=people,dc=example,dc=com",
+		"upstream groups auditors uid=auditors,ou=people,dc=example,dc=com",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected grants %q, got %q", expected, got)
+	}
+}
+
+func TestExportAccessAccounts(t *testing.T) {
+	breakGlass := testBreakGlassFile(t,
+		breakGlassLine("oncall", "break-glass", time.Now().Add(time.Hour)),
+		breakGlassLine("former", "break-glass", time.Now().Add(-time.Hour)))
+	defer os.Remove(breakGlass)
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:3000/grafana/", "http://127.0.0.1:3000/reports/ groups=finance"}
+	o.SkipAuthIPs = []string{"10.0.0.0/8"}
+	o.BreakGlassFile = breakGlass
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	p.HtpasswdFile = &HtpasswdFile{Users: map[string]string{"monitor": "{SHA}x", "backup": "{SHA}y"}}
+	p.Authenticators = newAuthenticators(o, p)
+	p.membersOf = func(group string) ([]string, error) { return nil, nil }
+
+	var got []string
+	for _, g := range p.exportAccess().Grants {
+		got = append(got, g.Path+" "+g.Source+" "+g.Action+" "+strings.Join(g.Members, ","))
+	}
+	expected := []string{
+		"/grafana/ skip-auth-ip 10.0.0.0/8 public ",
+		"/grafana/ ldap-groups allow ",
+		"/grafana/ htpasswd-file allow backup,monitor",
+		"/grafana/ break-glass-file allow oncall",
+		"/reports/ skip-auth-ip 10.0.0.0/8 public ",
+		"/reports/ ldap-groups allow ",
+		"/reports/ upstream groups allow ",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected grants %q, got %q", expected, got)
+	}
+}
+
+func TestExportAccessCSV(t *testing.T) {
+	e := testAccessProxy(t).exportAccess()
+	var b bytes.Buffer
+	if err := e.WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a header, a row for the unresolved group and one per member of the others
+	if len(rows) != 6 || rows[0][5] != "member" || rows[1][6] == "" || rows[2][5] != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("unexpected rows %q", rows)
+	}
+}
+
+func TestExportAccessWithoutGroups(t *testing.T) {
+	ap := testAccessProxy(t)
+	p := &LdapProxy{
+		upstreams:         ap.upstreams[:1],
+		upstreamOptions:   ap.upstreamOptions[:1],
+		compiledPathRegex: []*regexp.Regexp{regexp.MustCompile("^/grafana/public/"), regexp.MustCompile("^/ping$")},
+	}
+	e := p.exportAccess()
+	if len(e.Grants) != 2 {
+		t.Fatalf("unexpected grants %+v", e.Grants)
+	}
+	if g := e.Grants[0]; g.Action != ACLPublic || g.Source != "skip-auth-regex ^/grafana/public/" {
+		t.Errorf("unexpected grant %+v", g)
+	}
+	if g := e.Grants[1]; g.Action != ACLAllow || g.Group != "" || len(g.Members) != 0 {
+		t.Errorf("unexpected grant %+v", g)
+	}
+}
+
+func TestPathMayMatch(t *testing.T) {
+	tests := []struct {
+		re, path string
+		expected bool
+	}{
+		{"^/grafana/", "/grafana/", true},
+		{"^/grafana/admin", "/grafana/", true},
+		{"^/graf", "/grafana/", true},
+		{"^/wiki/", "/grafana/", false},
+		{"^/status$", "/grafana/", false},
+		{"/admin", "/grafana/", true},
+	}
+	for _, test := range tests {
+		if got := pathMayMatch(regexp.MustCompile(test.re), test.path); got != test.expected {
+			t.Errorf("pathMayMatch(%q, %q) = %v", test.re, test.path, got)
+		}
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	p := testAccessProxy(t)
+	p.AdminUsers = []string{"admin"}
+	call := func(user, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if user != "" {
+			rw := httptest.NewRecorder()
+			p.SaveSession(rw, req, &session.State{User: user})
+			req.AddCookie(rw.Result().Cookies()[0])
+		}
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := call("michael", "/ldap/admin/access"); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non admin, got %d", rw.Code)
+	}
+	rw := call("admin", "/ldap/admin/access")
+	e := &AccessExport{}
+	if err := json.NewDecoder(rw.Body).Decode(e); err != nil || rw.Code != http.StatusOK || len(e.Grants) != 3 {
+		t.Errorf("unexpected response %d %+v %v", rw.Code, e, err)
+	}
+	rw = call("admin", "/ldap/admin/access?format=csv")
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Errorf("unexpected response %d %q", rw.Code, rw.Header())
+	}
+	if rw := call("admin", "/ldap/admin/access?format=xml"); rw.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", rw.Code)
+	}
+}
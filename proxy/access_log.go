@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/skybet/ldap_proxy/geoip"
+)
+
+// redactedValue replaces the query parameter values kept out of the access
+// log
+const redactedValue = "REDACTED"
+
+var accessLogMetrics = expvar.NewMap("access_log")
+
+// accessLogPolicy decides which requests are logged and what of their URLs.
+// The zero value logs every request as it was made.
+type accessLogPolicy struct {
+	// sampleRate is the fraction of requests with responses below 400 which
+	// are logged; errors always are
+	sampleRate  float64
+	redactQuery bool            // redact every query parameter
+	redact      map[string]bool // lowercase names of parameters to redact
+	geoIP       *geoip.Reader   // adds the client's country to each line when set
+
+	// the client address the country is looked up for, as the ACL takes it
+	realIPHeader, proxyIPHeader string
+	trustedProxies              []*net.IPNet
+}
+
+// AccessLogHandler logs the requests served by h to out as LoggingHandler
+// does, sampling and redacting them as configured in opts
+func AccessLogHandler(out io.Writer, h http.Handler, opts *Options) http.Handler {
+	policy := &accessLogPolicy{
+		sampleRate:     opts.AccessLogSampleRate,
+		redactQuery:    opts.AccessLogRedactQuery,
+		geoIP:          opts.geoIP,
+		realIPHeader:   opts.RealIPHeader,
+		proxyIPHeader:  opts.ProxyIPHeader,
+		trustedProxies: opts.trustedProxies,
+	}
+	for _, p := range opts.AccessLogRedactParams {
+		if policy.redact == nil {
+			policy.redact = make(map[string]bool)
+		}
+		policy.redact[strings.ToLower(p)] = true
+	}
+	return loggingHandler{out, h, opts.RequestLogging, policy}
+}
+
+// sampled reports whether the request which got status is logged
+func (p *accessLogPolicy) sampled(status int) bool {
+	if p == nil || p.sampleRate >= 1 || status >= 400 || rand.Float64() < p.sampleRate {
+		accessLogMetrics.Add("logged", 1)
+		return true
+	}
+	accessLogMetrics.Add("sampled_out", 1)
+	return false
+}
+
+// redactURL replaces the values of the redacted query parameters of u,
+// keeping the order and encoding of the others
+func (p *accessLogPolicy) redactURL(u url.URL) url.URL {
+	if p == nil || u.RawQuery == "" || !p.redactQuery && len(p.redact) == 0 {
+		return u
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		name, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			name = kv[0]
+		}
+		if p.redactQuery || p.redact[strings.ToLower(name)] {
+			params[i] = kv[0] + "=" + redactedValue
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+	return u
+}
+
+// country returns the country field of the line logging req: empty without a
+// geoip-database, else the client's country or - when it's unknown
+func (p *accessLogPolicy) country(req *http.Request) string {
+	if p == nil || p.geoIP == nil {
+		return ""
+	}
+	if country := lookupCountry(p.geoIP, clientIP(req, p.realIPHeader, p.proxyIPHeader, p.trustedProxies)); country != "" {
+		return country
+	}
+	return "-"
+}
+
+func validateAccessLog(o *Options, msgs []string) []string {
+	if o.AccessLogSampleRate < 0 || o.AccessLogSampleRate > 1 {
+		msgs = append(msgs, fmt.Sprintf("access_log_sample_rate (%v) must be between 0 and 1", o.AccessLogSampleRate))
+	}
+	for _, p := range o.AccessLogRedactParams {
+		if p == "" {
+			msgs = append(msgs, "access-log-redact-param must not be empty")
+		}
+	}
+	return msgs
+}
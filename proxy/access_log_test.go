@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogRedactURL(t *testing.T) {
+	p := &accessLogPolicy{redact: map[string]bool{"token": true, "password": true}}
+	testCases := map[string]string{
+		"/api?token=abc&page=2":      "/api?token=REDACTED&page=2",
+		"/api?Token=abc&token=def":   "/api?Token=REDACTED&token=REDACTED",
+		"/login?user=a&pass%77ord=x": "/login?user=a&pass%77ord=REDACTED",
+		"/api?page=2&flag":           "/api?page=2&flag",
+		"/api?token":                 "/api?token=REDACTED",
+		"/no/query":                  "/no/query",
+		"/api?z=1&token=%zz&a=2":     "/api?z=1&token=REDACTED&a=2",
+	}
+	for in, expected := range testCases {
+		u, _ := url.Parse(in)
+		if got := p.redactURL(*u); got.RequestURI() != expected {
+			t.Errorf("redacting %q: expected %q got %q", in, expected, got.RequestURI())
+		}
+	}
+
+	all := &accessLogPolicy{redactQuery: true}
+	u, _ := url.Parse("/api?page=2&sort=name")
+	if got := all.redactURL(*u); got.RequestURI() != "/api?page=REDACTED&sort=REDACTED" {
+		t.Errorf("unexpected %q", got.RequestURI())
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	o := testOptions()
+	o.AccessLogSampleRate = 0
+	o.AccessLogRedactParams = []string{"token"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	h := AccessLogHandler(out, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(rw, req)
+		}
+	}), o)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+	if out.Len() != 0 {
+		t.Errorf("expected a successful request to be sampled out, got %q", out)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing?token=abc", nil))
+	if line := out.String(); !strings.Contains(line, `"/missing?token=REDACTED"`) || !strings.Contains(line, " 404 ") {
+		t.Errorf("expected the failed request to be logged redacted, got %q", line)
+	}
+}
+
+func TestValidateAccessLog(t *testing.T) {
+	o := testOptions()
+	o.AccessLogSampleRate = 1.5
+	if err := o.Validate(); err == nil {
+		t.Error("expected an error for a sample rate over 1")
+	}
+}
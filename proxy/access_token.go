@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// accessTokenHeader carries the session's opaque access token to upstreams
+const accessTokenHeader = "X-Forwarded-Access-Token"
+
+// newAccessToken returns a random opaque token identifying a session, which
+// upstreams can use to correlate requests made with it
+func newAccessToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
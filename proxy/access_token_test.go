@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestPassAccessToken(t *testing.T) {
+	var forwarded string
+	p := &LdapProxy{
+		CookieName:      "_ldap_proxy",
+		CookieSeed:      "secret",
+		CookieExpire:    time.Hour,
+		Validator:       func(string) bool { return true },
+		PassAccessToken: true,
+		serveMux: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			forwarded = req.Header.Get(accessTokenHeader)
+		}),
+	}
+
+	// a session from before pass-access-token was enabled gets a token
+	rw := httptest.NewRecorder()
+	p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael"})
+	req := httptest.NewRequest("GET", "/app/", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	req.Header.Set(accessTokenHeader, "spoofed")
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	if forwarded == "" || forwarded == "spoofed" {
+		t.Fatalf("unexpected token %q", forwarded)
+	}
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected the session to be saved with its token, got %d cookies", len(cookies))
+	}
+
+	// and keeps it
+	first := forwarded
+	req = httptest.NewRequest("GET", "/app/", nil)
+	req.AddCookie(cookies[0])
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	if forwarded != first {
+		t.Errorf("expected the same token %q, got %q", first, forwarded)
+	}
+
+	// requests without a session can't pass one on
+	p.skipAuthIPs, _ = parseCIDRs([]string{"192.0.2.1"}, nil)
+	req = httptest.NewRequest("GET", "/app/", nil)
+	req.Header.Set(accessTokenHeader, "spoofed")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	if forwarded != "" {
+		t.Errorf("expected no token for a request skipping authentication, got %q", forwarded)
+	}
+}
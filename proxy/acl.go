@@ -0,0 +1,396 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// Actions of ACL rules
+const (
+	// ACLAllow lets a signed in user through
+	ACLAllow = "allow"
+	// ACLDeny rejects the request with 403 Forbidden
+	ACLDeny = "deny"
+	// ACLPublic lets the request through without signing in
+	ACLPublic = "public"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ACL is an ordered list of rules deciding which requests are let through.
+// The first rule whose conditions all match a request decides it.
+type ACL struct {
+	Rules []*ACLRule
+}
+
+// ACLRule is a line of an acl-file: an action followed by its conditions
+type ACLRule struct {
+	Line   int
+	Text   string
+	Action string
+
+	nets    []*net.IPNet
+	groups  *ldapauth.GroupMatcher
+	path    *regexp.Regexp
+	methods []string
+	// ISO 3166-1 codes of the countries the client must be in
+	countries []string
+	// minutes past midnight the rule applies from and until, when hasTime
+	from, until int
+	hasTime     bool
+	// days is a bitmask of the weekdays the rule applies on, 0 for every day
+	days uint8
+}
+
+func (r *ACLRule) String() string {
+	return fmt.Sprintf("line %d (%s)", r.Line, r.Text)
+}
+
+// aclRequest is what ACL rules match against
+type aclRequest struct {
+	ip      net.IP
+	country string // of ip, empty when unknown
+	method  string
+	path    string
+	now     time.Time
+	// groups of the signed in user, nil when not signed in or the identity
+	// source has no groups
+	groups        []string
+	authenticated bool
+}
+
+// LoadACL reads the rules in filename, comparing group conditions with the
+// user's groups in mode (see ldap-group-match)
+func LoadACL(filename string, mode string) (*ACL, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := &ACL{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseACLRule(line, mode)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, n, err)
+		}
+		rule.Line = n
+		acl.Rules = append(acl.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseACLRule(line string, mode string) (*ACLRule, error) {
+	fields := strings.Fields(line)
+	r := &ACLRule{Text: strings.Join(fields, " "), Action: fields[0]}
+	switch r.Action {
+	case ACLAllow, ACLDeny, ACLPublic:
+	default:
+		return nil, fmt.Errorf("invalid action %q (must be one of %s, %s, %s)", r.Action, ACLAllow, ACLDeny, ACLPublic)
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid condition %q (expected key=value)", f)
+		}
+		if err := r.set(kv[0], kv[1], mode); err != nil {
+			return nil, err
+		}
+	}
+	if r.Action == ACLPublic && r.groups != nil {
+		return nil, fmt.Errorf("%s rules can't have a group condition", ACLPublic)
+	}
+	return r, nil
+}
+
+func (r *ACLRule) set(key, value string, mode string) error {
+	var err error
+	switch key {
+	case "cidr":
+		var msgs []string
+		if r.nets, msgs = parseCIDRs(strings.Split(value, ","), nil); len(msgs) > 0 {
+			return fmt.Errorf("invalid cidr %q", value)
+		}
+	case "group":
+		r.groups, err = ldapauth.NewGroupMatcher(mode, strings.Split(value, ","))
+	case "path":
+		r.path, err = regexp.Compile(value)
+	case "method":
+		for _, m := range strings.Split(value, ",") {
+			r.methods = append(r.methods, strings.ToUpper(m))
+		}
+	case "time":
+		r.from, r.until, err = parseTimeWindow(value)
+		r.hasTime = true
+	case "days":
+		r.days, err = parseDays(value)
+	case "country":
+		for _, c := range strings.Split(value, ",") {
+			if len(c) != 2 {
+				return fmt.Errorf("invalid country %q (expected a two letter ISO 3166-1 code)", c)
+			}
+			r.countries = append(r.countries, strings.ToUpper(c))
+		}
+	default:
+		return fmt.Errorf("unknown condition %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return nil
+}
+
+// parseTimeWindow parses HH:MM-HH:MM into minutes past midnight. A window
+// ending before it starts runs past midnight.
+func parseTimeWindow(value string) (int, int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return 0, 0, fmt.Errorf("expected HH:MM-HH:MM")
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// parseDays parses a comma separated list of weekdays or ranges of them, e.g.
+// mon-fri,sun
+func parseDays(value string) (uint8, error) {
+	var days uint8
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, last := weekdayIndex(bounds[0]), weekdayIndex(bounds[len(bounds)-1])
+		if first < 0 || last < 0 {
+			return 0, fmt.Errorf("unknown day %q", part)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days |= 1 << uint(d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func weekdayIndex(day string) int {
+	for i, d := range weekdays {
+		if d == day {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchRequest reports whether the conditions of r other than group match req.
+// A deny rule's cidr and country conditions match clients whose address or
+// country is unknown, so a header which isn't an address, or an address the
+// geoip-database doesn't have, can't get a client past it.
+func (r *ACLRule) matchRequest(req *aclRequest) bool {
+	if len(r.nets) > 0 && !containsIP(r.nets, req.ip) && (req.ip != nil || r.Action != ACLDeny) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(req.path) {
+		return false
+	}
+	if len(r.methods) > 0 && !sliceContains(r.methods, req.method) {
+		return false
+	}
+	if len(r.countries) > 0 && !sliceContains(r.countries, req.country) && (req.country != "" || r.Action != ACLDeny) {
+		return false
+	}
+	if r.days != 0 && r.days&(1<<uint(req.now.Weekday())) == 0 {
+		return false
+	}
+	if r.hasTime {
+		m := req.now.Hour()*60 + req.now.Minute()
+		if r.from <= r.until {
+			return m >= r.from && m < r.until
+		}
+		return m >= r.from || m < r.until
+	}
+	return true
+}
+
+// decide returns the rule deciding req. Before the user has signed in, a
+// matching rule with a group condition can't be decided, so there is no
+// decision until they have.
+func (a *ACL) decide(req *aclRequest) (*ACLRule, bool) {
+	if a == nil {
+		return nil, false
+	}
+	for _, r := range a.Rules {
+		if !r.matchRequest(req) {
+			continue
+		}
+		if r.groups != nil {
+			if !req.authenticated {
+				return nil, false
+			}
+			if _, ok := r.groups.Match(req.groups); !ok {
+				continue
+			}
+		}
+		return r, true
+	}
+	return nil, false
+}
+
+// groupsAllowing returns, for a req denied by a rule, the groups of the
+// allow rules before it which match req but for their group condition: the
+// groups which would have let the user through
+func (a *ACL) groupsAllowing(req *aclRequest) []string {
+	if a == nil {
+		return nil
+	}
+	var groups []string
+	for _, r := range a.Rules {
+		if !r.matchRequest(req) {
+			continue
+		}
+		if r.groups != nil {
+			if _, ok := r.groups.Match(req.groups); !ok {
+				if r.Action == ACLAllow {
+					groups = append(groups, r.groups.Groups...)
+				}
+				continue
+			}
+		}
+		if r.Action == ACLDeny {
+			return groups
+		}
+		return nil
+	}
+	return nil
+}
+
+// usesCountries reports whether any rule has a country condition
+func (a *ACL) usesCountries() bool {
+	for _, r := range a.Rules {
+		if len(r.countries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesGroups reports whether any rule has a group condition, so sessions
+// need to keep the user's groups
+func (a *ACL) UsesGroups() bool {
+	if a == nil {
+		return false
+	}
+	for _, r := range a.Rules {
+		if r.groups != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func sliceContains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func validateACL(o *Options, msgs []string) []string {
+	if o.ACLFile == "" {
+		return msgs
+	}
+	if len(o.SkipAuthRegex) > 0 || len(o.SkipAuthRules) > 0 || len(o.SkipAuthIPs) > 0 || o.SkipAuthPreflight || o.SkipAuthOptions {
+		msgs = append(msgs, fmt.Sprintf("skip-auth-regex, skip-auth-rule, skip-auth-ips, skip-auth-preflight and skip-auth-options can't be combined with acl-file; use %s rules instead", ACLPublic))
+	}
+	acl, err := LoadACL(o.ACLFile, o.LdapGroupMatch)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid acl-file: %v", err))
+	}
+	if acl.usesCountries() && o.GeoIPDatabase == "" {
+		msgs = append(msgs, "acl-file country conditions require geoip-database")
+	}
+	o.acl = acl
+	return msgs
+}
+
+func (p *LdapProxy) aclRequest(req *http.Request) *aclRequest {
+	ip := p.clientIP(req)
+	return &aclRequest{
+		ip:      ip,
+		country: lookupCountry(p.geoIP, ip),
+		method:  req.Method,
+		path:    req.URL.Path,
+		now:     time.Now(),
+	}
+}
+
+// aclGroupsAllowing returns the groups the ACL would have let the signed in
+// user of s make req in
+func (p *LdapProxy) aclGroupsAllowing(req *http.Request, s *session.State) []string {
+	ar := p.aclRequest(req)
+	ar.groups = s.Groups
+	ar.authenticated = true
+	return p.ACL.groupsAllowing(ar)
+}
+
+// isPublicRequest reports whether the ACL lets req through without signing in
+func (p *LdapProxy) isPublicRequest(req *http.Request) bool {
+	if p.ACL == nil {
+		return false
+	}
+	r, ok := p.ACL.decide(p.aclRequest(req))
+	return ok && r.Action == ACLPublic
+}
+
+// allowedByACL reports whether the ACL lets the signed in user of s make
+// req. Requests no rule decides are allowed.
+func (p *LdapProxy) allowedByACL(req *http.Request, s *session.State) bool {
+	if p.ACL == nil {
+		return true
+	}
+	ar := p.aclRequest(req)
+	ar.groups = s.Groups
+	ar.authenticated = true
+	r, ok := p.ACL.decide(ar)
+	if !ok || r.Action != ACLDeny {
+		return true
+	}
+	p.Auditf(req, "user %q denied %s %s by acl-file rule %s", s.User, req.Method, req.URL.Path, r)
+	return false
+}
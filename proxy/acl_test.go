@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func testACL(t *testing.T, rules string) *ACL {
+	f, err := ioutil.TempFile("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(rules)
+	f.Close()
+
+	acl, err := LoadACL(f.Name(), ldapauth.GroupMatchCN)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	return acl
+}
+
+func TestACLDecide(t *testing.T) {
+	acl := testACL(t, `
+# health checks
+public path=^/healthz$ method=GET,HEAD
+deny   path=^/admin/ cidr=0.0.0.0/0
+allow  group=admins path=^/reports/
+deny   path=^/reports/ days=sat,sun
+allow  path=^/reports/ time=09:00-17:30
+deny   path=^/reports/
+`)
+	if len(acl.Rules) != 6 || acl.Rules[0].Line != 3 || !acl.UsesGroups() {
+		t.Fatalf("unexpected rules %+v", acl.Rules)
+	}
+
+	monday := time.Date(2018, 11, 26, 10, 0, 0, 0, time.Local)
+	testCases := []struct {
+		req    aclRequest
+		action string
+		line   int
+	}{
+		{aclRequest{method: "GET", path: "/healthz", now: monday}, ACLPublic, 3},
+		{aclRequest{method: "POST", path: "/healthz", now: monday}, "", 0},
+		{aclRequest{ip: net.ParseIP("10.1.2.3"), path: "/admin/users", now: monday}, ACLDeny, 4},
+		// no decision before sign in: the group rule may yet allow it
+		{aclRequest{path: "/reports/1", now: monday}, "", 0},
+		{aclRequest{path: "/reports/1", now: monday.AddDate(0, 0, 5), authenticated: true, groups: []string{"admins"}}, ACLAllow, 5},
+		{aclRequest{path: "/reports/1", now: monday.AddDate(0, 0, 5), authenticated: true}, ACLDeny, 6},
+		{aclRequest{path: "/reports/1", now: monday, authenticated: true, groups: []string{"staff"}}, ACLAllow, 7},
+		{aclRequest{path: "/reports/1", now: monday.Add(8 * time.Hour), authenticated: true}, ACLDeny, 8},
+		{aclRequest{path: "/other", now: monday, authenticated: true}, "", 0},
+	}
+	for i, tc := range testCases {
+		r, ok := acl.decide(&tc.req)
+		if tc.action == "" {
+			if ok {
+				t.Errorf("%d: expected no decision, got %s", i, r)
+			}
+			continue
+		}
+		if !ok || r.Action != tc.action || r.Line != tc.line {
+			t.Errorf("%d: expected %s by line %d, got %v", i, tc.action, tc.line, r)
+		}
+	}
+}
+
+func TestACLUnknownClientAddress(t *testing.T) {
+	p := &LdapProxy{
+		RealIPHeader:   "X-Real-IP",
+		ProxyIPHeader:  "X-Forwarded-For",
+		TrustedProxies: []*net.IPNet{{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}},
+		ACL:            testACL(t, "deny cidr=203.0.113.0/24\npublic cidr=0.0.0.0/0\n"),
+	}
+	for _, tc := range []struct {
+		remoteAddr, realIP, forwardedFor string
+		public                           bool
+	}{
+		{"198.51.100.7:1234", "", "", true},
+		{"203.0.113.7:1234", "", "", false},
+		// only believed from a trusted proxy
+		{"203.0.113.7:1234", "198.51.100.7", "", false},
+		{"10.0.0.1:1234", "198.51.100.7", "", true},
+		{"10.0.0.1:1234", "203.0.113.7", "", false},
+		// the address the trusted proxy added, not those the client sent
+		{"10.0.0.1:1234", "", "198.51.100.7, 203.0.113.7", false},
+		{"10.0.0.1:1234", "", "203.0.113.7, 198.51.100.7", true},
+		// a deny rule matches clients whose address is unknown
+		{"10.0.0.1:1234", "not an address", "", false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if public := p.isPublicRequest(req); public != tc.public {
+			t.Errorf("%s %q %q: expected public %v, got %v", tc.remoteAddr, tc.realIP, tc.forwardedFor, tc.public, public)
+		}
+	}
+}
+
+func TestACLTimeWindowPastMidnight(t *testing.T) {
+	r, err := parseACLRule("deny time=22:00-06:00 days=fri-mon", ldapauth.GroupMatchCN)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	for hour, expected := range map[int]bool{23: true, 3: true, 6: false, 12: false} {
+		now := time.Date(2018, 11, 25, hour, 0, 0, 0, time.Local) // a Sunday
+		if got := r.matchRequest(&aclRequest{now: now}); got != expected {
+			t.Errorf("%02d:00: expected %v got %v", hour, expected, got)
+		}
+	}
+	if r.matchRequest(&aclRequest{now: time.Date(2018, 11, 27, 23, 0, 0, 0, time.Local)}) {
+		t.Error("expected no match on a Tuesday")
+	}
+}
+
+func TestParseACLRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"permit path=/",
+		"allow path",
+		"allow colour=red",
+		"allow path=(",
+		"allow cidr=10.0.0.0/33",
+		"allow time=9-5",
+		"allow days=someday",
+		"public group=admins",
+	} {
+		if _, err := parseACLRule(line, ldapauth.GroupMatchCN); err == nil {
+			t.Errorf("expected error parsing %q", line)
+		}
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	o := testOptions()
+	o.ACLFile = "/nonexistent/acl"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "invalid acl-file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	f, _ := ioutil.TempFile("", "acl")
+	defer os.Remove(f.Name())
+	f.WriteString("public path=^/static/\n")
+	f.Close()
+
+	o = testOptions()
+	o.ACLFile = f.Name()
+	o.SkipAuthRegex = []string{"^/static/"}
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "can't be combined with acl-file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestACLDeniesSignedInUser(t *testing.T) {
+	p := &LdapProxy{
+		CookieName:   "_ldap_proxy",
+		CookieSeed:   "secret",
+		CookieExpire: time.Hour,
+		Validator:    func(string) bool { return true },
+		ACL:          testACL(t, "allow group=admins\ndeny\n"),
+	}
+
+	for _, tc := range []struct {
+		groups   []string
+		expected int
+	}{
+		{[]string{"admins"}, http.StatusAccepted},
+		{[]string{"staff"}, http.StatusForbidden},
+		{nil, http.StatusForbidden},
+	} {
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael", Groups: tc.groups})
+
+		req := httptest.NewRequest("GET", "/ldap/auth", nil)
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		p.AuthenticateOnly(rw, req)
+		if rw.Code != tc.expected {
+			t.Errorf("groups %v: expected %d got %d", tc.groups, tc.expected, rw.Code)
+		}
+	}
+
+	// without a session the user is asked to sign in rather than denied
+	rw := httptest.NewRecorder()
+	p.AuthenticateOnly(rw, httptest.NewRequest("GET", "/ldap/auth", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", rw.Code)
+	}
+}
+
+func TestACLGroupsAllowing(t *testing.T) {
+	acl := testACL(t, `
+allow path=^/reports/ group=finance,auditors
+allow path=^/reports/ group=admins
+deny path=^/reports/
+allow group=staff
+deny
+`)
+	for _, tc := range []struct {
+		path     string
+		groups   []string
+		expected string
+	}{
+		{"/reports/q3", []string{"staff"}, "finance,auditors,admins"},
+		{"/reports/q3", []string{"admins"}, ""},
+		{"/wiki/", nil, "staff"},
+	} {
+		req := &aclRequest{method: "GET", path: tc.path, groups: tc.groups, authenticated: true, now: time.Now()}
+		if groups := strings.Join(acl.groupsAllowing(req), ","); groups != tc.expected {
+			t.Errorf("%s %v: expected %q got %q", tc.path, tc.groups, tc.expected, groups)
+		}
+	}
+}
+
+func TestACLAccessDeniedPage(t *testing.T) {
+	p := testSignInProxy(&bytes.Buffer{})
+	p.ACL = testACL(t, "allow group=admins\ndeny\n")
+	rw := httptest.NewRecorder()
+	p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael", Groups: []string{"staff"}})
+
+	req := httptest.NewRequest("GET", "/dashboards/", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	rw = httptest.NewRecorder()
+	p.Proxy(rw, req)
+	body := rw.Body.String()
+	if rw.Code != http.StatusForbidden || !strings.Contains(body, "<b>michael</b>") || !strings.Contains(body, "members of <b>admins</b>") {
+		t.Errorf("expected the access denied page, got %d %s", rw.Code, body)
+	}
+	if strings.Contains(body, "password") {
+		t.Error("expected the access denied page rather than the sign-in page")
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// skipAuthRules is the JSON form of the skip-auth rules served by
+// AdminSkipAuth, named like the config file keys
+type skipAuthRules struct {
+	Regexes []string `json:"skip_auth_regex"`
+	IPs     []string `json:"skip_auth_ips"`
+}
+
+// skipAuthChange is the body of a POST to AdminSkipAuth adding a rule
+type skipAuthChange struct {
+	Regex string `json:"regex"`
+	IP    string `json:"ip"`
+}
+
+func (p *LdapProxy) isAdmin(user string) bool {
+	for _, u := range p.AdminUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// skipAuthRules returns the current skip-auth rules
+func (p *LdapProxy) skipAuthRules() *skipAuthRules {
+	p.skipAuthMu.RLock()
+	defer p.skipAuthMu.RUnlock()
+	r := &skipAuthRules{Regexes: []string{}, IPs: []string{}}
+	for _, re := range p.compiledPathRegex {
+		r.Regexes = append(r.Regexes, re.String())
+	}
+	for _, n := range p.skipAuthIPs {
+		r.IPs = append(r.IPs, n.String())
+	}
+	return r
+}
+
+// AdminSkipAuth lists the skip-auth rules on GET, adds the regex or ip of a
+// JSON skipAuthChange on POST and removes the regex or ip given in the query
+// on DELETE. Only AdminUsers may use it.
+func (p *LdapProxy) AdminSkipAuth(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if !p.isAdmin(session.User) {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+
+	if p.ACL != nil && req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "skip-auth rules can't be combined with acl-file", http.StatusConflict)
+		return
+	}
+
+	// changes are serialized so the config file ends up with the latest rules
+	p.adminMu.Lock()
+	defer p.adminMu.Unlock()
+
+	var err error
+	var change string
+	switch req.Method {
+	case "GET", "HEAD":
+	case "POST":
+		// requiring JSON makes browsers preflight cross origin requests, so
+		// another site can't make a signed in admin's browser post changes
+		if !isJSONRequest(req) {
+			http.Error(rw, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		c := &skipAuthChange{}
+		if err := json.NewDecoder(req.Body).Decode(c); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		err = p.addSkipAuth(c.Regex, c.IP)
+		change = "added " + describeSkipAuth(c.Regex, c.IP)
+	case "DELETE":
+		regex, ip := req.URL.Query().Get("regex"), req.URL.Query().Get("ip")
+		err = p.removeSkipAuth(regex, ip)
+		change = "removed " + describeSkipAuth(regex, ip)
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rules := p.skipAuthRules()
+	if change != "" {
+		p.Auditf(req, "user %q %s", session.User, change)
+		if err := p.persistSkipAuth(rules); err != nil {
+			log.Printf("failed to persist skip-auth rules to %s: %v", p.ConfigFile, err)
+			http.Error(rw, "rules changed but could not be saved to the config file", http.StatusInternalServerError)
+			return
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(rules)
+}
+
+func describeSkipAuth(regex, ip string) string {
+	if regex != "" {
+		return fmt.Sprintf("skip-auth regex %q", regex)
+	}
+	return fmt.Sprintf("skip-auth ip %q", ip)
+}
+
+func (p *LdapProxy) addSkipAuth(regex, ip string) error {
+	if (regex == "") == (ip == "") {
+		return fmt.Errorf("exactly one of regex and ip must be given")
+	}
+	p.skipAuthMu.Lock()
+	defer p.skipAuthMu.Unlock()
+	if regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %v", regex, err)
+		}
+		p.compiledPathRegex = append(p.compiledPathRegex, re)
+		return nil
+	}
+	nets, msgs := parseCIDRs([]string{ip}, nil)
+	if len(msgs) > 0 {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	p.skipAuthIPs = append(p.skipAuthIPs, nets[0])
+	return nil
+}
+
+func (p *LdapProxy) removeSkipAuth(regex, ip string) error {
+	if (regex == "") == (ip == "") {
+		return fmt.Errorf("exactly one of regex and ip must be given")
+	}
+	p.skipAuthMu.Lock()
+	defer p.skipAuthMu.Unlock()
+	if regex != "" {
+		for i, re := range p.compiledPathRegex {
+			if re.String() == regex {
+				p.compiledPathRegex = append(p.compiledPathRegex[:i:i], p.compiledPathRegex[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("no skip-auth regex %q", regex)
+	}
+	nets, msgs := parseCIDRs([]string{ip}, nil)
+	if len(msgs) > 0 {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	for i, n := range p.skipAuthIPs {
+		if n.String() == nets[0].String() {
+			p.skipAuthIPs = append(p.skipAuthIPs[:i:i], p.skipAuthIPs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no skip-auth ip %q", ip)
+}
+
+// persistSkipAuth saves rules to ConfigFile when PersistSkipAuth is set
+func (p *LdapProxy) persistSkipAuth(rules *skipAuthRules) error {
+	if !p.PersistSkipAuth || p.ConfigFile == "" {
+		return nil
+	}
+	return updateConfigFile(p.ConfigFile, map[string][]string{
+		"skip_auth_regex": rules.Regexes,
+		"skip_auth_ips":   rules.IPs,
+	})
+}
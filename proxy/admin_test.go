@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestAdminSkipAuth(t *testing.T) {
+	cfg, err := ioutil.TempFile("", "ldap_proxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cfg.Name())
+	cfg.WriteString("# skip_auth_regex = []\nskip_auth_regex = [\n  \"^/ping$\",\n]\n")
+	cfg.Close()
+
+	p := &LdapProxy{
+		CookieName:      "_ldap_proxy",
+		CookieSeed:      "secret",
+		CookieExpire:    time.Hour,
+		Validator:       func(string) bool { return true },
+		AdminUsers:      []string{"admin"},
+		ConfigFile:      cfg.Name(),
+		PersistSkipAuth: true,
+	}
+	p.addSkipAuth("^/ping$", "")
+
+	cookies := map[string]*http.Cookie{}
+	for _, user := range []string{"admin", "michael"} {
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: user})
+		cookies[user] = rw.Result().Cookies()[0]
+	}
+	call := func(user, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		if c := cookies[user]; c != nil {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		p.AdminSkipAuth(rw, req)
+		return rw
+	}
+
+	if rw := call("", "GET", "/ldap/admin/skip-auth", ""); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", rw.Code)
+	}
+	if rw := call("michael", "GET", "/ldap/admin/skip-auth", ""); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non admin, got %d", rw.Code)
+	}
+
+	if rw := call("admin", "POST", "/ldap/admin/skip-auth", `{"ip": "10.1.0.0/16"}`); rw.Code != http.StatusOK {
+		t.Fatalf("expected 200 adding an ip, got %d %s", rw.Code, rw.Body)
+	}
+	if !p.IsWhitelistedIP(net.ParseIP("10.1.2.3")) {
+		t.Error("expected the added ip to skip authentication")
+	}
+	if rw := call("admin", "POST", "/ldap/admin/skip-auth", `{"regex": "^/status/"}`); rw.Code != http.StatusOK {
+		t.Fatalf("expected 200 adding a regex, got %d %s", rw.Code, rw.Body)
+	}
+	if rw := call("admin", "DELETE", "/ldap/admin/skip-auth?regex=%5E%2Fping%24", ""); rw.Code != http.StatusOK {
+		t.Fatalf("expected 200 removing a regex, got %d %s", rw.Code, rw.Body)
+	}
+	if p.IsWhitelistedPath("/ping") || !p.IsWhitelistedPath("/status/db") {
+		t.Error("expected /status/ and not /ping to skip authentication")
+	}
+
+	rw := call("admin", "GET", "/ldap/admin/skip-auth", "")
+	rules := &skipAuthRules{}
+	json.NewDecoder(rw.Body).Decode(rules)
+	if len(rules.Regexes) != 1 || rules.Regexes[0] != "^/status/" || len(rules.IPs) != 1 || rules.IPs[0] != "10.1.0.0/16" {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+
+	b, _ := ioutil.ReadFile(cfg.Name())
+	expected := "# skip_auth_regex = []\nskip_auth_regex = [\"^/status/\"]\nskip_auth_ips = [\"10.1.0.0/16\"]\n"
+	if string(b) != expected {
+		t.Errorf("expected config file %q, got %q", expected, b)
+	}
+
+	for _, tc := range []struct{ method, target, body string }{
+		{"POST", "/ldap/admin/skip-auth", `{"regex": "("}`},
+		{"POST", "/ldap/admin/skip-auth", `{"regex": "^/a", "ip": "10.0.0.1"}`},
+		{"DELETE", "/ldap/admin/skip-auth?ip=192.168.0.1", ""},
+	} {
+		if rw := call("admin", tc.method, tc.target, tc.body); rw.Code != http.StatusBadRequest {
+			t.Errorf("%s %s %s: expected 400, got %d", tc.method, tc.target, tc.body, rw.Code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/ldap/admin/skip-auth", strings.NewReader("ip=10.0.0.1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookies["admin"])
+	rw = httptest.NewRecorder()
+	p.AdminSkipAuth(rw, req)
+	if rw.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected form posts to be rejected, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// NewAuditLogger returns the logger used for security relevant events such
+// as sign-ins, kept apart from the operational log so it can be collected
+// separately.
+func NewAuditLogger() *log.Logger {
+	return log.New(os.Stderr, "[audit] ", log.Ldate|log.Ltime|log.LUTC)
+}
+
+// Auditf records an audit event for req
+func (p *LdapProxy) Auditf(req *http.Request, format string, args ...interface{}) {
+	addr := p.getRemoteAddrStr(req)
+	if country := p.country(req); country != "" {
+		addr += " country=" + country
+	}
+	msg := fmt.Sprintf("%s %s", addr, fmt.Sprintf(format, args...))
+	if p.AuditLogger == nil {
+		log.Printf("[audit] %s", msg)
+		return
+	}
+	p.AuditLogger.Print(msg)
+}
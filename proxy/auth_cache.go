@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// authCacheMaxEntries bounds the results remembered by an authCache
+const authCacheMaxEntries = 10000
+
+var authCacheMetrics = expvar.NewMap("auth_cache")
+
+// authCache remembers the responses of the auth endpoint for a moment, so
+// an ingress controller asking about every request of a page doesn't make
+// the proxy decode and check the same cookie each time. Responses are keyed
+// by everything authenticate looks at: the credentials, Host, method, path
+// and client address.
+type authCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*authCacheEntry
+}
+
+type authCacheEntry struct {
+	code    int
+	message string
+	header  http.Header
+	expires time.Time
+}
+
+func newAuthCache(ttl time.Duration) *authCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &authCache{ttl: ttl, entries: make(map[string]*authCacheEntry)}
+}
+
+func (p *LdapProxy) authCacheKey(req *http.Request) string {
+	h := sha256.New()
+	for _, v := range []string{req.Header.Get("Cookie"), req.Header.Get("Authorization"), req.Host, req.Method, req.URL.Path, p.clientIP(req).String()} {
+		h.Write([]byte(v + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *authCache) get(key string) (*authCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		authCacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+	authCacheMetrics.Add("hits", 1)
+	return e, true
+}
+
+// put remembers the response with code, message and header. Responses
+// setting cookies belong to a single request so aren't remembered.
+func (c *authCache) put(key string, code int, message string, header http.Header) {
+	if _, ok := header["Set-Cookie"]; ok {
+		return
+	}
+	e := &authCacheEntry{code: code, message: message, header: make(http.Header), expires: time.Now().Add(c.ttl)}
+	for k, v := range header {
+		e.header[k] = append([]string(nil), v...)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= authCacheMaxEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= authCacheMaxEntries {
+			authCacheMetrics.Add("resets", 1)
+			c.entries = make(map[string]*authCacheEntry)
+		}
+	}
+	c.entries[key] = e
+}
+
+// write replays the response of e
+func (e *authCacheEntry) write(rw http.ResponseWriter) {
+	for k, v := range e.header {
+		rw.Header()[k] = append([]string(nil), v...)
+	}
+	writeAuthResponse(rw, e.code, e.message)
+}
+
+// writeAuthResponse writes a response of the auth endpoint, with message as
+// the body of errors
+func writeAuthResponse(rw http.ResponseWriter, code int, message string) {
+	if message == "" {
+		rw.WriteHeader(code)
+		return
+	}
+	http.Error(rw, message, code)
+}
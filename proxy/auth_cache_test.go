@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestAuthCache(t *testing.T) {
+	o := testOptions()
+	o.AuthEndpointCacheTTL = time.Minute
+	o.SetXAuthRequest = true
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael", Email: "michael@example.com"})
+	cookie := rw.Result().Cookies()[0]
+
+	auth := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(cookie)
+		rw := httptest.NewRecorder()
+		p.AuthenticateOnly(rw, req)
+		return rw
+	}
+	if rw := auth("/ldap/auth"); rw.Code != http.StatusAccepted || rw.Header().Get("X-Auth-Request-User") != "michael" {
+		t.Fatalf("unexpected response %d %q", rw.Code, rw.Header())
+	}
+
+	// the remembered response doesn't consult the validator again
+	p.Validator = func(string) bool { return false }
+	if rw := auth("/ldap/auth"); rw.Code != http.StatusAccepted || rw.Header().Get("X-Auth-Request-User") != "michael" {
+		t.Errorf("expected the remembered response, got %d %q", rw.Code, rw.Header())
+	}
+	if rw := auth("/ldap/auth?other"); rw.Code != http.StatusAccepted {
+		t.Errorf("expected the query to be ignored, got %d", rw.Code)
+	}
+	if rw := auth("/other/auth"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected another path to be checked, got %d", rw.Code)
+	}
+
+	for _, e := range p.authCache.entries {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	if rw := auth("/ldap/auth"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected an expired response to be checked again, got %d", rw.Code)
+	}
+}
+
+func TestAuthCacheSkipsCookies(t *testing.T) {
+	c := newAuthCache(time.Minute)
+	h := http.Header{}
+	h.Set("Set-Cookie", "_ldap_proxy=; Max-Age=0")
+	c.put("key", http.StatusUnauthorized, "unauthorized request", h)
+	if _, ok := c.get("key"); ok {
+		t.Error("remembered a response setting a cookie")
+	}
+	if newAuthCache(0) != nil {
+		t.Error("expected no cache without a ttl")
+	}
+}
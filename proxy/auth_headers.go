@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// Session fields which auth-response-header can set headers from
+const (
+	AuthHeaderUser   = "user"
+	AuthHeaderEmail  = "email"
+	AuthHeaderGroups = "groups"
+
+	// the user's sign-in before the session's, with record-last-sign-in
+	AuthHeaderPreviousSignInAt = "previous_sign_in_at"
+	AuthHeaderPreviousSignInIP = "previous_sign_in_ip"
+	// the failed sign-ins between the two, left out if there were none
+	AuthHeaderFailedSignIns = "failed_sign_ins"
+)
+
+// authResponseHeadersNone is the auth-response-header value setting no
+// headers at all
+const authResponseHeadersNone = "none"
+
+// authResponseHeader is a response header set for authenticated requests
+// from a field of their session
+type authResponseHeader struct {
+	name  string
+	field string
+}
+
+var (
+	// xAuthRequestHeaders are set with set-xauthrequest
+	xAuthRequestHeaders = []*authResponseHeader{
+		{"X-Auth-Request-User", AuthHeaderUser},
+		{"X-Auth-Request-Email", AuthHeaderEmail},
+	}
+	// basicAuthResponseHeaders are set for requests authenticated by
+	// auth-endpoint-basic
+	basicAuthResponseHeaders = []*authResponseHeader{
+		{"X-Auth-Request-User", AuthHeaderUser},
+		{"X-Auth-Request-Email", AuthHeaderEmail},
+		{"X-Auth-Request-Groups", AuthHeaderGroups},
+	}
+)
+
+// parseAuthResponseHeaders parses Header-Name:field specs. The single spec
+// none disables the headers, giving an empty, non-nil list.
+func parseAuthResponseHeaders(specs []string) ([]*authResponseHeader, error) {
+	headers := []*authResponseHeader{}
+	if len(specs) == 1 && specs[0] == authResponseHeadersNone {
+		return headers, nil
+	}
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, ":", 2)
+		if len(kv) != 2 || !validHeaderName(kv[0]) {
+			return nil, fmt.Errorf("invalid auth-response-header %q (expected Header-Name:field)", spec)
+		}
+		switch kv[1] {
+		case AuthHeaderUser, AuthHeaderEmail, AuthHeaderGroups, AuthHeaderPreviousSignInAt, AuthHeaderPreviousSignInIP, AuthHeaderFailedSignIns:
+		default:
+			return nil, fmt.Errorf("invalid auth-response-header %q (field must be one of %s, %s, %s, %s, %s, %s)", spec, AuthHeaderUser, AuthHeaderEmail, AuthHeaderGroups, AuthHeaderPreviousSignInAt, AuthHeaderPreviousSignInIP, AuthHeaderFailedSignIns)
+		}
+		headers = append(headers, &authResponseHeader{textproto.CanonicalMIMEHeaderKey(kv[0]), kv[1]})
+	}
+	return headers, nil
+}
+
+func validateAuthResponseHeaders(o *Options, msgs []string) []string {
+	if len(o.AuthResponseHeaders) == 0 {
+		return msgs
+	}
+	headers, err := parseAuthResponseHeaders(o.AuthResponseHeaders)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.authHeaders = headers
+	return msgs
+}
+
+// authHeadersUseGroups reports whether any of headers is set from the user's
+// groups, so sessions need to keep them
+func authHeadersUseGroups(headers []*authResponseHeader) bool {
+	for _, h := range headers {
+		if h.field == AuthHeaderGroups {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionAuthHeaders returns the headers set for requests with a session:
+// those of auth-response-header, else those of set-xauthrequest
+func (p *LdapProxy) sessionAuthHeaders() []*authResponseHeader {
+	if p.authHeaders != nil {
+		return p.authHeaders
+	}
+	if p.SetXAuthRequest {
+		return xAuthRequestHeaders
+	}
+	return nil
+}
+
+// basicAuthHeaders returns the headers set for requests authenticated by
+// auth-endpoint-basic
+func (p *LdapProxy) basicAuthHeaders() []*authResponseHeader {
+	if p.authHeaders != nil {
+		return p.authHeaders
+	}
+	return basicAuthResponseHeaders
+}
+
+// setAuthResponseHeaders sets headers from s on rw, leaving out those whose
+// field is empty
+func setAuthResponseHeaders(rw http.ResponseWriter, s *session.State, headers []*authResponseHeader) {
+	for _, h := range headers {
+		var v string
+		switch h.field {
+		case AuthHeaderUser:
+			v = s.User
+		case AuthHeaderEmail:
+			v = s.Email
+		case AuthHeaderGroups:
+			v = strings.Join(s.Groups, ",")
+		case AuthHeaderPreviousSignInAt:
+			if !s.PreviousSignInAt.IsZero() {
+				v = s.PreviousSignInAt.UTC().Format(time.RFC3339)
+			}
+		case AuthHeaderPreviousSignInIP:
+			v = s.PreviousSignInIP
+		case AuthHeaderFailedSignIns:
+			if s.FailedSignIns > 0 {
+				v = strconv.Itoa(s.FailedSignIns)
+			}
+		}
+		if v != "" {
+			rw.Header().Set(h.name, v)
+		}
+	}
+}
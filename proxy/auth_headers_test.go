@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestParseAuthResponseHeaders(t *testing.T) {
+	o := testOptions()
+	o.AuthResponseHeaders = []string{"x-user:user", "X-Groups:groups"}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(o.authHeaders) != 2 || o.authHeaders[0].name != "X-User" || !authHeadersUseGroups(o.authHeaders) {
+		t.Errorf("unexpected headers %+v", o.authHeaders)
+	}
+
+	o = testOptions()
+	o.AuthResponseHeaders = []string{authResponseHeadersNone}
+	if err := o.Validate(); err != nil || o.authHeaders == nil || len(o.authHeaders) != 0 {
+		t.Errorf("expected none to give an empty list, got %+v %v", o.authHeaders, err)
+	}
+
+	for _, spec := range []string{"X-User", ":user", "X User:user", "X-User:password"} {
+		o := testOptions()
+		o.AuthResponseHeaders = []string{spec}
+		if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "invalid auth-response-header") {
+			t.Errorf("%q: unexpected error %v", spec, err)
+		}
+	}
+}
+
+func TestAuthResponseHeaders(t *testing.T) {
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "michael", password: "secret", groups: []string{"ops", "qa"}})
+	p.CookieExpire = time.Hour
+	p.authHeaders, _ = parseAuthResponseHeaders([]string{"X-User:user", "X-Email:email", "X-Groups:groups"})
+
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader("username=michael&password=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	p.SignIn(rw, req)
+	if rw.Code != http.StatusFound {
+		t.Fatalf("expected sign in to succeed, got %d", rw.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/ldap/auth", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	rw = httptest.NewRecorder()
+	p.AuthenticateOnly(rw, req)
+	h := rw.Header()
+	if h.Get("X-User") != "michael" || h.Get("X-Groups") != "ops,qa" {
+		t.Errorf("unexpected headers %+v", h)
+	}
+	if _, ok := h["X-Email"]; ok {
+		t.Error("expected no header for an empty email")
+	}
+	if h.Get("X-Auth-Request-User") != "" {
+		t.Error("expected auth-response-header to replace the X-Auth-Request headers")
+	}
+}
+
+func TestAuthResponseHeadersNoneForBasic(t *testing.T) {
+	p := &LdapProxy{
+		CookieName:        "_ldap_proxy",
+		Validator:         func(string) bool { return true },
+		Authenticators:    []Authenticator{&staticAuthenticator{user: "michael", password: "secret"}},
+		AuthEndpointBasic: true,
+		basicAuthCache:    newBasicAuthCache("secret", time.Minute),
+		authHeaders:       []*authResponseHeader{},
+	}
+	req := httptest.NewRequest("GET", "/ldap/auth", nil)
+	req.SetBasicAuth("michael", "secret")
+	rw := httptest.NewRecorder()
+	p.AuthenticateOnly(rw, req)
+	if rw.Code != http.StatusAccepted || rw.Header().Get("X-Auth-Request-User") != "" {
+		t.Errorf("expected 202 without identity headers, got %d %+v", rw.Code, rw.Header())
+	}
+}
+
+func TestAuthResponseHeadersPreviousSignIn(t *testing.T) {
+	headers, err := parseAuthResponseHeaders([]string{"X-Last-Sign-In:previous_sign_in_at", "X-Last-Sign-In-IP:previous_sign_in_ip", "X-Failed-Sign-Ins:failed_sign_ins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	setAuthResponseHeaders(rw, &session.State{User: "michael"}, headers)
+	if len(rw.Header()) != 0 {
+		t.Errorf("expected no headers without a previous sign-in, got %+v", rw.Header())
+	}
+
+	s := &session.State{User: "michael", PreviousSignInAt: time.Date(2026, 10, 12, 8, 30, 0, 0, time.UTC), PreviousSignInIP: "10.1.2.3", FailedSignIns: 2}
+	setAuthResponseHeaders(rw, s, headers)
+	if h := rw.Header(); h.Get("X-Last-Sign-In") != "2026-10-12T08:30:00Z" || h.Get("X-Last-Sign-In-Ip") != "10.1.2.3" || h.Get("X-Failed-Sign-Ins") != "2" {
+		t.Errorf("unexpected headers %+v", h)
+	}
+}
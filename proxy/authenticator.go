@@ -0,0 +1,442 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator which knows the user
+// but rejected the password, or doesn't know the user at all
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrDirectoryUnavailable is returned by an Authenticator which couldn't
+// reach its identity source to check the credentials
+var ErrDirectoryUnavailable = errors.New("directory temporarily unavailable")
+
+// Identity is a user verified by an Authenticator
+type Identity struct {
+	User  string
+	Email string
+	DN    string
+	// Mail is the mail attribute of directory users, which notifications
+	// are sent to when there is no Email
+	Mail string
+	// Attributes are those read from the entries of directory users
+	Attributes map[string]string
+
+	// BreakGlassExpiresOn is when the break-glass account of this identity
+	// stops working, zero for other accounts
+	BreakGlassExpiresOn time.Time
+
+	// SessionExpire is how long the sessions of directory users with a
+	// session-expire-attribute last, zero for everyone else
+	SessionExpire time.Duration
+
+	// GroupsDeferred is set for directory users signing in with
+	// -ldap-defer-groups whose groups are still to be looked up
+	GroupsDeferred bool
+}
+
+// Authenticator verifies a username and password against an identity source.
+// The returned groups are nil if the source has no notion of groups, in which
+// case ldap-groups is not enforced for the user.
+type Authenticator interface {
+	Authenticate(username, password string) (*Identity, []string, error)
+}
+
+// Names of the authenticators selectable with -authenticator
+const (
+	AuthenticatorHtpasswd = "htpasswd"
+	AuthenticatorLDAP     = "ldap"
+	AuthenticatorExec     = "exec"
+	AuthenticatorWebhook  = "webhook"
+)
+
+var authenticatorNames = []string{AuthenticatorHtpasswd, AuthenticatorLDAP, AuthenticatorExec, AuthenticatorWebhook}
+
+// HtpasswdAuthenticator authenticates users from a htpasswd file
+type HtpasswdAuthenticator struct {
+	File *HtpasswdFile
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	if !a.File.Validate(username, password) {
+		return nil, nil, ErrInvalidCredentials
+	}
+	return &Identity{User: username}, nil, nil
+}
+
+// LDAPAuthenticator authenticates users with a bind against the directory and
+// resolves their groups in the form Groups compares them, from Membership
+// once it is loaded
+type LDAPAuthenticator struct {
+	Config     *ldapauth.Config
+	Groups     *ldapauth.GroupMatcher
+	Membership *ldapauth.MembershipCache
+	// ExpireAttribute is the attribute of users holding the lifetime of
+	// their sessions, if any
+	ExpireAttribute string
+	// LoginAttribute, when set, is the attribute of users whose value
+	// replaces the username they signed in with, so that usernames differing
+	// only in case get the same sessions
+	LoginAttribute string
+}
+
+// Authenticate retries binds failing because the directory is unreachable
+// as the Config says, returning ErrDirectoryUnavailable when the retries are
+// exhausted
+func (a *LDAPAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	return a.authenticateRetrying(username, password, false)
+}
+
+// AuthenticateDeferred is Authenticate without the group search, leaving
+// the groups to be looked up with LookupGroups unless Membership has them
+func (a *LDAPAuthenticator) AuthenticateDeferred(username, password string) (*Identity, []string, error) {
+	return a.authenticateRetrying(username, password, true)
+}
+
+func (a *LDAPAuthenticator) authenticateRetrying(username, password string, deferGroups bool) (*Identity, []string, error) {
+	var identity *Identity
+	var groups []string
+	err := a.Config.Retry(func() (err error) {
+		identity, groups, err = a.authenticate(username, password, deferGroups)
+		return err
+	})
+	if ldapauth.IsTransient(err) {
+		log.Printf("LDAP unavailable authenticating user %s: %+v", username, err)
+		return nil, nil, ErrDirectoryUnavailable
+	}
+	return identity, groups, err
+}
+
+func (a *LDAPAuthenticator) authenticate(username, password string, deferGroups bool) (*Identity, []string, error) {
+	ldapClient, err := ldapauth.NewClient(a.Config)
+	defer ldapClient.Close()
+	if err != nil {
+		log.Printf("failed to open LDAP Connection: %+v", err)
+		return nil, nil, err
+	}
+
+	ok, attributes, err := ldapClient.Authenticate(username, password)
+	if be, isBindErr := err.(*ldapauth.BindError); isBindErr && !be.Account() {
+		return nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrInvalidCredentials
+	}
+
+	identity := &Identity{User: username, DN: attributes["dn"], Mail: attributes["mail"], Attributes: attributes}
+	if v := attributes[a.LoginAttribute]; a.LoginAttribute != "" && v != "" {
+		identity.User = v
+	}
+	if v := attributes[a.ExpireAttribute]; a.ExpireAttribute != "" && v != "" {
+		if identity.SessionExpire, err = parseSessionExpire(v); err != nil {
+			log.Printf("ignoring %s of user %s: %v", a.ExpireAttribute, username, err)
+		}
+	}
+	if a.Membership != nil {
+		if groups, ok := a.Membership.Groups(attributes["dn"]); ok {
+			return identity, groups, nil
+		}
+	}
+	if deferGroups {
+		identity.GroupsDeferred = true
+		return identity, nil, nil
+	}
+	groups, err := a.groupsOf(ldapClient, attributes["dn"])
+	if err != nil {
+		log.Printf("Error getting groups for user %s: %+v", username, err)
+	}
+	return identity, groups, nil
+}
+
+// LookupGroups looks up the groups of username as the service account, for
+// sign-ins made with AuthenticateDeferred
+func (a *LDAPAuthenticator) LookupGroups(username string) ([]string, error) {
+	var groups []string
+	err := a.Config.Retry(func() error {
+		ldapClient, err := ldapauth.NewClient(a.Config)
+		defer ldapClient.Close()
+		if err != nil {
+			return err
+		}
+		entry, err := ldapClient.LookupUser(username)
+		if err != nil {
+			return err
+		}
+		if a.Membership != nil {
+			var ok bool
+			if groups, ok = a.Membership.Groups(entry.DN); ok {
+				return nil
+			}
+		}
+		groups, err = a.groupsOf(ldapClient, entry.DN)
+		return err
+	})
+	return groups, err
+}
+
+// groupsOf returns the groups of the user dn, empty if they can't be found
+func (a *LDAPAuthenticator) groupsOf(ldapClient *ldapauth.Client, dn string) ([]string, error) {
+	groups := []string{}
+	entries, err := ldapClient.GetGroupEntriesOfUser(dn)
+	if err != nil {
+		return groups, err
+	}
+	for _, entry := range entries {
+		groups = append(groups, a.Groups.Value(entry))
+	}
+	return groups, nil
+}
+
+// authResponse is the optional result of the exec and webhook authenticators
+type authResponse struct {
+	User   string   `json:"user"`
+	Email  string   `json:"email"`
+	Groups []string `json:"groups"`
+}
+
+func (r *authResponse) identity(username string) (*Identity, []string) {
+	identity := &Identity{User: username, Email: r.Email}
+	if r.User != "" {
+		identity.User = r.User
+	}
+	groups := r.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return identity, groups
+}
+
+// ExecAuthenticator runs a command to authenticate users. The username is
+// passed in the LDAP_PROXY_USERNAME environment variable and the password on
+// stdin. Exit status 0 authenticates the user; stdout may contain an authResponse
+// JSON document or one group per line.
+type ExecAuthenticator struct {
+	Command []string
+	Timeout time.Duration
+}
+
+func (a *ExecAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, a.Command[0], a.Command[1:]...)
+	cmd.Env = append(os.Environ(), "LDAP_PROXY_USERNAME="+username)
+	cmd.Stdin = strings.NewReader(password + "\n")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		return nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("running %s: %v", a.Command[0], err)
+	}
+
+	resp := &authResponse{}
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 && out[0] == '{' {
+		if err := json.Unmarshal(out, resp); err != nil {
+			return nil, nil, fmt.Errorf("invalid output from %s: %v", a.Command[0], err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			if g := strings.TrimSpace(scanner.Text()); g != "" {
+				resp.Groups = append(resp.Groups, g)
+			}
+		}
+	}
+	identity, groups := resp.identity(username)
+	return identity, groups, nil
+}
+
+// WebhookAuthenticator POSTs {"username": ..., "password": ...} to URL. A 200
+// response authenticates the user and may contain an authResponse JSON
+// document; 401 and 403 reject the credentials.
+type WebhookAuthenticator struct {
+	URL    string
+	Client *http.Client
+}
+
+func (a *WebhookAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := a.Client.Post(a.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, nil, ErrInvalidCredentials
+	default:
+		return nil, nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, a.URL)
+	}
+
+	r := &authResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("invalid response from %s: %v", a.URL, err)
+	}
+	identity, groups := r.identity(username)
+	return identity, groups, nil
+}
+
+// newAuthenticators builds the authenticator chain selected in opts. Without
+// an explicit selection the htpasswd file (if any) is tried before LDAP.
+func newAuthenticators(opts *Options, p *LdapProxy) []Authenticator {
+	var chain []Authenticator
+	if opts.BreakGlassFile != "" {
+		// first, so the directory being down can't delay them
+		chain = append(chain, &BreakGlassAuthenticator{File: opts.BreakGlassFile})
+	}
+	names := opts.Authenticators
+	if len(names) == 0 {
+		return append(chain, p.defaultAuthenticators()...)
+	}
+
+	for _, name := range names {
+		switch name {
+		case AuthenticatorHtpasswd:
+			chain = append(chain, &HtpasswdAuthenticator{File: p.HtpasswdFile})
+		case AuthenticatorLDAP:
+			chain = append(chain, &LDAPAuthenticator{Config: p.LdapConfiguration, Groups: p.groupMatcher(), Membership: p.GroupMembership, ExpireAttribute: p.sessionExpireAttr, LoginAttribute: p.ldapLoginAttr})
+		case AuthenticatorExec:
+			chain = append(chain, &ExecAuthenticator{Command: strings.Fields(opts.AuthExecCommand), Timeout: opts.AuthenticatorTimeout})
+		case AuthenticatorWebhook:
+			chain = append(chain, &WebhookAuthenticator{URL: opts.AuthWebhookURL, Client: &http.Client{Timeout: opts.AuthenticatorTimeout}})
+		}
+	}
+	return chain
+}
+
+func (p *LdapProxy) defaultAuthenticators() []Authenticator {
+	var chain []Authenticator
+	if p.HtpasswdFile != nil {
+		chain = append(chain, &HtpasswdAuthenticator{File: p.HtpasswdFile})
+	}
+	return append(chain, &LDAPAuthenticator{Config: p.LdapConfiguration, Groups: p.groupMatcher(), Membership: p.GroupMembership, ExpireAttribute: p.sessionExpireAttr, LoginAttribute: p.ldapLoginAttr})
+}
+
+// authenticators returns the configured chain, or the default chain for
+// proxies built without New
+func (p *LdapProxy) authenticators() []Authenticator {
+	if len(p.Authenticators) > 0 {
+		return p.Authenticators
+	}
+	return p.defaultAuthenticators()
+}
+
+// authenticateUser tries each authenticator in turn, with the directory of
+// realm, returning the first identity which authenticates. Otherwise the
+// error is ErrInvalidCredentials, the *ldapauth.BindError of a directory
+// which rejected the user because of the state of their account, e.g.
+// locked out, which ends the search, or ErrDirectoryUnavailable or
+// ErrSignInBusy if an authenticator couldn't check the credentials. With
+// deferGroups the groups of directory users may be left to look up later.
+func (p *LdapProxy) authenticateUser(realm *Realm, username, password string, deferGroups bool) (*Identity, []string, error) {
+	if username == "" {
+		return nil, nil, ErrInvalidCredentials
+	}
+	failure := ErrInvalidCredentials
+	for _, a := range p.realmAuthenticators(realm) {
+		identity, groups, err := p.authenticateWith(a, username, password, deferGroups)
+		if err == nil {
+			log.Printf("authenticated %q via %s", identity.User, authenticatorName(a))
+			return identity, groups, nil
+		}
+		if be, ok := err.(*ldapauth.BindError); ok && be.Account() {
+			log.Printf("account problem for user %s via %s: %s", username, authenticatorName(a), be.Reason)
+			return nil, nil, be
+		}
+		if err == ErrDirectoryUnavailable || err == ErrSignInBusy {
+			failure = err
+			continue
+		}
+		if err != ErrInvalidCredentials {
+			log.Printf("Error authenticating user %s via %s: %+v", username, authenticatorName(a), err)
+		}
+	}
+	return nil, nil, failure
+}
+
+// authenticateWith checks the credentials with a, within the bindLimit for
+// LDAPAuthenticators, leaving their group search for later if deferGroups
+// is set
+func (p *LdapProxy) authenticateWith(a Authenticator, username, password string, deferGroups bool) (*Identity, []string, error) {
+	if l, ok := a.(*LDAPAuthenticator); ok {
+		if !p.bindLimit.acquire() {
+			log.Printf("too many concurrent sign-ins to check user %s via %s", username, AuthenticatorLDAP)
+			return nil, nil, ErrSignInBusy
+		}
+		defer p.bindLimit.release()
+		if deferGroups {
+			return l.AuthenticateDeferred(username, password)
+		}
+	}
+	return a.Authenticate(username, password)
+}
+
+func authenticatorName(a Authenticator) string {
+	switch a.(type) {
+	case *HtpasswdAuthenticator:
+		return AuthenticatorHtpasswd
+	case *LDAPAuthenticator:
+		return AuthenticatorLDAP
+	case *ExecAuthenticator:
+		return AuthenticatorExec
+	case *WebhookAuthenticator:
+		return AuthenticatorWebhook
+	case *BreakGlassAuthenticator:
+		return AuthenticatorBreakGlass
+	}
+	return fmt.Sprintf("%T", a)
+}
+
+func validateAuthenticators(o *Options, msgs []string) []string {
+	for _, name := range o.Authenticators {
+		switch name {
+		case AuthenticatorLDAP:
+		case AuthenticatorHtpasswd:
+			if o.HtpasswdFile == "" {
+				msgs = append(msgs, "authenticator htpasswd requires htpasswd-file")
+			}
+		case AuthenticatorExec:
+			if strings.TrimSpace(o.AuthExecCommand) == "" {
+				msgs = append(msgs, "authenticator exec requires auth-exec-command")
+			}
+		case AuthenticatorWebhook:
+			if o.AuthWebhookURL == "" {
+				msgs = append(msgs, "authenticator webhook requires auth-webhook-url")
+			}
+		default:
+			msgs = append(msgs, fmt.Sprintf("invalid authenticator %q (must be one of %s)", name, strings.Join(authenticatorNames, ", ")))
+		}
+	}
+	if o.AuthenticatorTimeout <= 0 {
+		msgs = append(msgs, fmt.Sprintf("authenticator_timeout (%s) must be positive", o.AuthenticatorTimeout))
+	}
+	return msgs
+}
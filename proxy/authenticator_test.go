@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type staticAuthenticator struct {
+	user, password string
+	groups         []string
+}
+
+func (a *staticAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	if username != a.user || password != a.password {
+		return nil, nil, ErrInvalidCredentials
+	}
+	return &Identity{User: username}, a.groups, nil
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	h, _ := NewHtpasswd(bytes.NewBufferString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"))
+	a := &HtpasswdAuthenticator{File: h}
+
+	identity, groups, err := a.Authenticate("testuser", "asdf")
+	if err != nil || identity.User != "testuser" || groups != nil {
+		t.Errorf("unexpected result %+v %+v %+v", identity, groups, err)
+	}
+	if _, _, err := a.Authenticate("testuser", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %+v", err)
+	}
+}
+
+func TestExecAuthenticator(t *testing.T) {
+	script, err := ioutil.TempFile("", "test_auth_exec_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+	script.WriteString("#!/bin/sh\nread password\n[ \"$LDAP_PROXY_USERNAME:$password\" = \"michael:secret\" ] || exit 1\necho admins\necho users\n")
+	script.Close()
+	os.Chmod(script.Name(), 0700)
+
+	a := &ExecAuthenticator{Command: []string{script.Name()}, Timeout: 5 * time.Second}
+	identity, groups, err := a.Authenticate("michael", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if identity.User != "michael" || !reflect.DeepEqual(groups, []string{"admins", "users"}) {
+		t.Errorf("unexpected result %+v %+v", identity, groups)
+	}
+	if _, _, err := a.Authenticate("michael", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %+v", err)
+	}
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var creds map[string]string
+		json.NewDecoder(r.Body).Decode(&creds)
+		if creds["username"] != "michael" || creds["password"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"email": "michael@example.com", "groups": ["admins"]}`))
+	}))
+	defer backend.Close()
+
+	a := &WebhookAuthenticator{URL: backend.URL, Client: http.DefaultClient}
+	identity, groups, err := a.Authenticate("michael", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if identity.Email != "michael@example.com" || !reflect.DeepEqual(groups, []string{"admins"}) {
+		t.Errorf("unexpected result %+v %+v", identity, groups)
+	}
+	if _, _, err := a.Authenticate("michael", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %+v", err)
+	}
+}
+
+func TestAuthenticatorChain(t *testing.T) {
+	p := &LdapProxy{Authenticators: []Authenticator{
+		&staticAuthenticator{user: "local", password: "one"},
+		&staticAuthenticator{user: "michael", password: "two", groups: []string{"admins"}},
+	}}
+
+	identity, groups, err := p.authenticateUser(nil, "michael", "two", false)
+	if err != nil || identity.User != "michael" || !reflect.DeepEqual(groups, []string{"admins"}) {
+		t.Errorf("unexpected result %+v %+v %v", identity, groups, err)
+	}
+	if _, _, err := p.authenticateUser(nil, "michael", "one", false); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// RegoPolicy decides authorization webhook requests in process, evaluating
+// Query against the Rego policies and JSON or YAML data documents of Dir,
+// with the request as the input document, within Timeout
+type RegoPolicy struct {
+	Dir     string
+	Query   string
+	Timeout time.Duration
+
+	mu    sync.RWMutex
+	query rego.PreparedEvalQuery
+}
+
+// LoadRegoPolicy compiles the policies of dir for query
+func LoadRegoPolicy(dir, query string, timeout time.Duration) (*RegoPolicy, error) {
+	p := &RegoPolicy{Dir: dir, Query: query, Timeout: timeout}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// load compiles the policies of Dir again, keeping the previous ones if
+// they don't compile
+func (p *RegoPolicy) load() error {
+	q, err := rego.New(rego.Query(p.Query), rego.Load([]string{p.Dir}, nil)).PrepareForEval(context.Background())
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.query = q
+	p.mu.Unlock()
+	log.Printf("loaded rego policies from %s", p.Dir)
+	return nil
+}
+
+// eval decides the authorization webhook request body as an OPA server
+// would with -authz-webhook-format=opa
+func (p *RegoPolicy) eval(body []byte) (*authzDecision, error) {
+	var input interface{}
+	if err := json.Unmarshal(body, &input); err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	q := p.query
+	p.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	rs, err := q.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, err
+	}
+	var result json.RawMessage
+	if len(rs) > 0 && len(rs[0].Expressions) > 0 {
+		if result, err = json.Marshal(rs[0].Expressions[0].Value); err != nil {
+			return nil, err
+		}
+	}
+	d := &authzDecision{}
+	if err := decodePolicyResult(result, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// watch reloads the policies as the files of Dir change, calling onUpdate
+// once they compile
+func (p *RegoPolicy) watch(onUpdate func()) {
+	WatchForUpdates(p.Dir, nil, func() {
+		if err := p.load(); err != nil {
+			log.Printf("keeping the previous rego policies: %v", err)
+			return
+		}
+		onUpdate()
+	})
+}
+
+func validateAuthzRego(o *Options, msgs []string) []string {
+	if o.AuthzRegoDir == "" {
+		return msgs
+	}
+	if o.AuthzWebhookURL != "" {
+		return append(msgs, "authz-rego-dir can't be combined with authz-webhook-url")
+	}
+	if o.AuthzWebhookTimeout <= 0 {
+		return msgs
+	}
+	p, err := LoadRegoPolicy(o.AuthzRegoDir, o.AuthzRegoQuery, o.AuthzWebhookTimeout)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid authz-rego-dir: %v", err))
+	}
+	o.regoPolicy = p
+	return msgs
+}
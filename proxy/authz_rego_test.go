@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRegoPolicy = `package ldap_proxy
+
+default allow = false
+
+allow {
+	input.groups[_] == "ops"
+	startswith(input.path, "/deploy/")
+}
+
+decision = {"allow": true, "headers": {"X-Deploy-Role": "approver"}} {
+	allow
+}
+`
+
+func testRegoProxy(t *testing.T, dir string, configure func(*Options)) (*LdapProxy, *bytes.Buffer) {
+	o := testOptions()
+	o.AuthzRegoDir = dir
+	if configure != nil {
+		configure(o)
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	audit := &bytes.Buffer{}
+	p := &LdapProxy{
+		CookieName:   "_ldap_proxy",
+		CookieSeed:   "secret",
+		CookieExpire: time.Hour,
+		Validator:    func(string) bool { return true },
+		AuditLogger:  log.New(audit, "", 0),
+		Authz:        newAuthzWebhook(o),
+	}
+	return p, audit
+}
+
+func writeRegoPolicy(t *testing.T, dir, policy string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, "policy.rego"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegoPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRegoPolicy(t, dir, testRegoPolicy)
+
+	p, audit := testRegoProxy(t, dir, nil)
+	if rw := authzAuthenticate(p, "/deploy/app"); rw.Code != 202 {
+		t.Errorf("allowed request got %d", rw.Code)
+	}
+	if rw := authzAuthenticate(p, "/admin/"); rw.Code != 403 {
+		t.Errorf("denied request got %d", rw.Code)
+	}
+	if !strings.Contains(audit.String(), `user "michael" denied GET /admin/ by the authorization webhook`) {
+		t.Errorf("denial not audited: %q", audit.String())
+	}
+
+	p, _ = testRegoProxy(t, dir, func(o *Options) { o.AuthzRegoQuery = "data.ldap_proxy.decision" })
+	rw := authzAuthenticate(p, "/deploy/app")
+	if rw.Code != 202 || rw.Header().Get("X-Deploy-Role") != "approver" {
+		t.Errorf("decision object got %d with headers %v", rw.Code, rw.Header())
+	}
+	if rw := authzAuthenticate(p, "/admin/"); rw.Code != 403 {
+		t.Errorf("undefined decision got %d", rw.Code)
+	}
+
+	p, audit = testRegoProxy(t, dir, func(o *Options) { o.AuthzRegoQuery = "data.ldap_proxy.missing" })
+	if rw := authzAuthenticate(p, "/deploy/app"); rw.Code != 403 {
+		t.Errorf("undefined rule got %d", rw.Code)
+	}
+	if !strings.Contains(audit.String(), "(policy result undefined)") {
+		t.Errorf("undefined rule not audited: %q", audit.String())
+	}
+}
+
+func TestRegoPolicyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRegoPolicy(t, dir, testRegoPolicy)
+
+	p, _ := testRegoProxy(t, dir, nil)
+	if rw := authzAuthenticate(p, "/admin/"); rw.Code != 403 {
+		t.Fatalf("denied request got %d", rw.Code)
+	}
+
+	// a policy which doesn't compile is logged and the previous one kept
+	writeRegoPolicy(t, dir, "package ldap_proxy\n\nallow {\n")
+	time.Sleep(200 * time.Millisecond)
+	if rw := authzAuthenticate(p, "/deploy/app"); rw.Code != 202 {
+		t.Errorf("previous policy not kept, got %d", rw.Code)
+	}
+
+	// the decisions of the previous policy are forgotten
+	writeRegoPolicy(t, dir, "package ldap_proxy\n\nallow {\n\tinput.path == \"/admin/\"\n}\n")
+	code := 0
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if code = authzAuthenticate(p, "/admin/").Code; code == 202 {
+			break
+		}
+	}
+	if code != 202 {
+		t.Errorf("policy change not picked up, got %d", code)
+	}
+	if rw := authzAuthenticate(p, "/deploy/app"); rw.Code != 403 {
+		t.Errorf("cached decision of the previous policy kept, got %d", rw.Code)
+	}
+}
+
+func TestValidateAuthzRego(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRegoPolicy(t, dir, testRegoPolicy)
+	invalid, err := ioutil.TempDir("", "rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(invalid)
+	writeRegoPolicy(t, invalid, "package ldap_proxy\n\nallow {\n")
+
+	for _, tc := range []struct {
+		configure func(*Options)
+		err       string
+	}{
+		{func(o *Options) { o.AuthzRegoDir = dir }, ""},
+		{func(o *Options) { o.AuthzRegoDir, o.AuthzWebhookAttrs = dir, []string{"department"} }, ""},
+		{func(o *Options) { o.AuthzRegoDir, o.AuthzWebhookURL = dir, "https://authz.example.com/" }, "authz-rego-dir can't be combined with authz-webhook-url"},
+		{func(o *Options) { o.AuthzRegoDir = invalid }, "invalid authz-rego-dir"},
+		{func(o *Options) { o.AuthzRegoDir, o.AuthzRegoQuery = dir, "data.ldap_proxy[" }, "invalid authz-rego-dir"},
+		{func(o *Options) { o.AuthzWebhookAttrs = []string{"department"} }, "authz-webhook-attribute requires authz-webhook-url or authz-rego-dir"},
+	} {
+		o := testOptions()
+		tc.configure(o)
+		err := o.Validate()
+		if tc.err == "" && err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("expected %q, got %v", tc.err, err)
+		}
+	}
+}
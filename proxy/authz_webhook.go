@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// authzWebhookMaxEntries bounds the decisions the authorization webhook
+// cache holds; when they are exceeded the expired ones are dropped, and all
+// of them if none had expired
+const authzWebhookMaxEntries = 10000
+
+var authzWebhookMetrics = expvar.NewMap("authz_webhook")
+
+// Authorization webhook formats selectable with -authz-webhook-format: the
+// proxy's own, or that of the data API of an OPA server, which takes the
+// request as the input document and answers with the policy's result
+const (
+	AuthzFormatProxy = "ldap_proxy"
+	AuthzFormatOPA   = "opa"
+)
+
+// authzRequest is the JSON body of an authorization webhook request
+type authzRequest struct {
+	User   string   `json:"user"`
+	Email  string   `json:"email,omitempty"`
+	Groups []string `json:"groups"`
+	Method string   `json:"method"`
+	Host   string   `json:"host"`
+	Path   string   `json:"path"`
+	IP     string   `json:"ip,omitempty"`
+
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// authzDecision is the JSON body of an authorization webhook response
+type authzDecision struct {
+	Allow   bool              `json:"allow"`
+	Reason  string            `json:"reason,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	expires time.Time
+}
+
+// AuthzWebhook asks URL, or evaluates Policy, whether authenticated users may
+// make their requests, after the acl-file allowed them, remembering its
+// decisions for CacheTTL. When it can't be asked, requests are allowed if
+// FailOpen is set and denied otherwise.
+type AuthzWebhook struct {
+	URL      string
+	Policy   *RegoPolicy
+	Secret   []byte
+	Client   *http.Client
+	CacheTTL time.Duration
+	FailOpen bool
+	Format   string
+	// Attributes are the directory attributes of users kept in their
+	// sessions to be posted
+	Attributes []string
+
+	mu    sync.Mutex
+	cache map[string]*authzDecision
+}
+
+// newAuthzWebhook returns the AuthzWebhook configured in opts, or nil if
+// there is none
+func newAuthzWebhook(opts *Options) *AuthzWebhook {
+	if opts.AuthzWebhookURL == "" && opts.regoPolicy == nil {
+		return nil
+	}
+	w := &AuthzWebhook{
+		URL:        opts.AuthzWebhookURL,
+		Policy:     opts.regoPolicy,
+		Client:     &http.Client{Timeout: opts.AuthzWebhookTimeout},
+		CacheTTL:   opts.AuthzWebhookCacheTTL,
+		FailOpen:   opts.AuthzWebhookFailOpen,
+		Format:     opts.AuthzWebhookFormat,
+		Attributes: opts.AuthzWebhookAttrs,
+		cache:      make(map[string]*authzDecision),
+	}
+	if opts.AuthzWebhookSecret != "" {
+		w.Secret = []byte(opts.AuthzWebhookSecret)
+	}
+	if w.Policy != nil {
+		w.Policy.watch(w.clearCache)
+	}
+	return w
+}
+
+// clearCache forgets the decisions made, e.g. by policies since replaced
+func (w *AuthzWebhook) clearCache() {
+	w.mu.Lock()
+	w.cache = make(map[string]*authzDecision)
+	w.mu.Unlock()
+}
+
+// decide returns the decision on ar, from the cache if it was made within
+// CacheTTL
+func (w *AuthzWebhook) decide(ar *authzRequest) (*authzDecision, error) {
+	body, err := json.Marshal(ar)
+	if err != nil {
+		return nil, err
+	}
+	key := string(body)
+	now := time.Now()
+	w.mu.Lock()
+	d, ok := w.cache[key]
+	w.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		authzWebhookMetrics.Add("cache_hits", 1)
+		return d, nil
+	}
+
+	if d, err = w.send(body); err != nil {
+		return nil, err
+	}
+	if w.CacheTTL > 0 {
+		d.expires = now.Add(w.CacheTTL)
+		w.mu.Lock()
+		if len(w.cache) >= authzWebhookMaxEntries {
+			for k, e := range w.cache {
+				if !now.Before(e.expires) {
+					delete(w.cache, k)
+				}
+			}
+			if len(w.cache) >= authzWebhookMaxEntries {
+				w.cache = make(map[string]*authzDecision)
+			}
+		}
+		w.cache[key] = d
+		w.mu.Unlock()
+	}
+	return d, nil
+}
+
+func (w *AuthzWebhook) send(body []byte) (*authzDecision, error) {
+	if w.Policy != nil {
+		return w.Policy.eval(body)
+	}
+	if w.Format == AuthzFormatOPA {
+		body = append(append([]byte(`{"input":`), body...), '}')
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ldap_proxy/"+VERSION)
+	if w.Secret != nil {
+		req.Header.Set(eventWebhookSignatureHeader, webhookSignature(w.Secret, body))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	d := &authzDecision{}
+	if w.Format == AuthzFormatOPA {
+		if err := decodeOPAResult(io.LimitReader(resp.Body, 1<<16), d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(d); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return d, nil
+}
+
+// decodeOPAResult decodes into d the result of an OPA data API response,
+// either whether the request is allowed or an object like an authzDecision.
+// A policy which doesn't define the result denies the request.
+func decodeOPAResult(r io.Reader, d *authzDecision) error {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return decodePolicyResult(resp.Result, d)
+}
+
+// decodePolicyResult decodes into d the result of a policy, empty if it is
+// undefined
+func decodePolicyResult(result json.RawMessage, d *authzDecision) error {
+	if len(result) == 0 {
+		d.Reason = "policy result undefined"
+		return nil
+	}
+	if err := json.Unmarshal(result, &d.Allow); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(result, d); err != nil {
+		return fmt.Errorf("invalid policy result %s", result)
+	}
+	return nil
+}
+
+// userAttributes returns the Attributes of identity to keep in its session,
+// nil if the directory has none of them
+func (w *AuthzWebhook) userAttributes(identity *Identity) map[string]string {
+	var attrs map[string]string
+	for _, name := range w.Attributes {
+		if v := identity.Attributes[name]; v != "" {
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			attrs[name] = v
+		}
+	}
+	return attrs
+}
+
+// askAuthzWebhook asks the authorization webhook whether s may make req
+func (p *LdapProxy) askAuthzWebhook(req *http.Request, s *session.State) (*authzDecision, error) {
+	ar := &authzRequest{
+		User:   s.User,
+		Email:  s.Email,
+		Groups: s.Groups,
+		Method: req.Method,
+		Host:   requestHost(req, p.TrustedProxies),
+		Path:   req.URL.Path,
+
+		Attributes: s.Attributes,
+	}
+	if ar.Groups == nil {
+		ar.Groups = []string{}
+	}
+	if ip := p.clientIP(req); ip != nil {
+		ar.IP = ip.String()
+	}
+	return p.Authz.decide(ar)
+}
+
+// authorizedByWebhook asks the authorization webhook, if there is one,
+// whether s may make req, adding the headers it returns for an allowed
+// request to req and to the response, as for -auth-response-header
+func (p *LdapProxy) authorizedByWebhook(rw http.ResponseWriter, req *http.Request, s *session.State) bool {
+	w := p.Authz
+	if w == nil {
+		return true
+	}
+	d, err := p.askAuthzWebhook(req, s)
+	if err != nil {
+		authzWebhookMetrics.Add("errors", 1)
+		log.Printf("authorization webhook failed for %q %s %s: %v", s.User, req.Method, req.URL.Path, err)
+		if w.FailOpen {
+			return true
+		}
+		p.Auditf(req, "user %q denied %s %s: authorization webhook failed", s.User, req.Method, req.URL.Path)
+		return false
+	}
+	if !d.Allow {
+		authzWebhookMetrics.Add("denied", 1)
+		reason := ""
+		if d.Reason != "" {
+			reason = fmt.Sprintf(" (%s)", d.Reason)
+		}
+		p.Auditf(req, "user %q denied %s %s by the authorization webhook%s", s.User, req.Method, req.URL.Path, reason)
+		return false
+	}
+	authzWebhookMetrics.Add("allowed", 1)
+	for name, value := range d.Headers {
+		req.Header.Set(name, value)
+		rw.Header().Set(name, value)
+	}
+	return true
+}
+
+func validateAuthzWebhook(o *Options, msgs []string) []string {
+	if o.AuthzWebhookURL == "" && o.AuthzRegoDir == "" {
+		if len(o.AuthzWebhookAttrs) > 0 {
+			msgs = append(msgs, "authz-webhook-attribute requires authz-webhook-url or authz-rego-dir")
+		}
+		return msgs
+	}
+	if o.AuthzWebhookURL != "" {
+		u, err := url.Parse(o.AuthzWebhookURL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid authz-webhook-url %q (must be an http or https URL)", o.AuthzWebhookURL))
+		}
+		if o.AuthzWebhookSecret == "" {
+			msgs = append(msgs, "authz-webhook-url requires authz-webhook-secret, so the webhook can tell the requests are the proxy's")
+		}
+		if o.AuthzWebhookFormat != AuthzFormatProxy && o.AuthzWebhookFormat != AuthzFormatOPA {
+			msgs = append(msgs, fmt.Sprintf("invalid authz-webhook-format %q (must be %s or %s)", o.AuthzWebhookFormat, AuthzFormatProxy, AuthzFormatOPA))
+		}
+	}
+	if o.AuthzWebhookTimeout <= 0 {
+		msgs = append(msgs, fmt.Sprintf("authz_webhook_timeout (%s) must be positive", o.AuthzWebhookTimeout))
+	}
+	if o.AuthzWebhookCacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("authz_webhook_cache_ttl (%s) must not be negative", o.AuthzWebhookCacheTTL))
+	}
+	return msgs
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func testAuthzProxy(t *testing.T, handler http.HandlerFunc, configure func(*Options)) (*LdapProxy, *bytes.Buffer, func()) {
+	s := httptest.NewServer(handler)
+	o := testOptions()
+	o.AuthzWebhookURL = s.URL
+	o.AuthzWebhookSecret = "hook-secret"
+	if configure != nil {
+		configure(o)
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	audit := &bytes.Buffer{}
+	p := &LdapProxy{
+		CookieName:   "_ldap_proxy",
+		CookieSeed:   "secret",
+		CookieExpire: time.Hour,
+		Validator:    func(string) bool { return true },
+		AuditLogger:  log.New(audit, "", 0),
+		Authz:        newAuthzWebhook(o),
+	}
+	return p, audit, s.Close
+}
+
+func authzAuthenticate(p *LdapProxy, path string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael", Groups: []string{"ops"}})
+	req := httptest.NewRequest("GET", path, nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	rw = httptest.NewRecorder()
+	p.AuthenticateOnly(rw, req)
+	return rw
+}
+
+func TestAuthzWebhook(t *testing.T) {
+	var asked []*authzRequest
+	var signature string
+	p, audit, stop := testAuthzProxy(t, func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		ar := &authzRequest{}
+		if err := json.Unmarshal(body, ar); err != nil {
+			t.Errorf("invalid request %q", body)
+		}
+		asked = append(asked, ar)
+		signature = req.Header.Get(eventWebhookSignatureHeader)
+		if strings.HasPrefix(ar.Path, "/admin") {
+			rw.Write([]byte(`{"allow": false, "reason": "change freeze"}`))
+			return
+		}
+		rw.Write([]byte(`{"allow": true, "headers": {"X-Deploy-Role": "approver"}}`))
+	}, nil)
+	defer stop()
+
+	rw := authzAuthenticate(p, "/deploy")
+	if rw.Code != http.StatusAccepted || rw.Header().Get("X-Deploy-Role") != "approver" {
+		t.Errorf("expected the request allowed with the header, got %d %v", rw.Code, rw.Header())
+	}
+	if len(asked) != 1 || asked[0].User != "michael" || asked[0].Method != "GET" || asked[0].Path != "/deploy" || len(asked[0].Groups) != 1 || asked[0].Groups[0] != "ops" {
+		t.Errorf("unexpected request %+v", asked)
+	}
+	if !strings.HasPrefix(signature, "sha256=") {
+		t.Errorf("expected a signed request, got %q", signature)
+	}
+
+	// the decision is remembered
+	if rw = authzAuthenticate(p, "/deploy"); rw.Code != http.StatusAccepted || len(asked) != 1 {
+		t.Errorf("expected a cached decision, got %d after %d requests", rw.Code, len(asked))
+	}
+
+	if rw = authzAuthenticate(p, "/admin"); rw.Code != http.StatusForbidden || rw.Header().Get("X-Deploy-Role") != "" {
+		t.Errorf("expected the request denied, got %d %v", rw.Code, rw.Header())
+	}
+	if !strings.Contains(audit.String(), `user "michael" denied GET /admin by the authorization webhook (change freeze)`) {
+		t.Errorf("expected the denial to be audited, got %q", audit)
+	}
+}
+
+func TestAuthzWebhookFailure(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		asked := 0
+		p, _, stop := testAuthzProxy(t, func(rw http.ResponseWriter, req *http.Request) {
+			asked++
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+		}, func(o *Options) { o.AuthzWebhookFailOpen = failOpen })
+
+		expected := http.StatusForbidden
+		if failOpen {
+			expected = http.StatusAccepted
+		}
+		for i := 0; i < 2; i++ {
+			if rw := authzAuthenticate(p, "/"); rw.Code != expected {
+				t.Errorf("fail open %v: expected %d, got %d", failOpen, expected, rw.Code)
+			}
+		}
+		if asked != 2 {
+			t.Errorf("fail open %v: expected failures not to be cached, got %d requests", failOpen, asked)
+		}
+		stop()
+	}
+}
+
+func TestAuthzWebhookClientIP(t *testing.T) {
+	var asked *authzRequest
+	p, _, stop := testAuthzProxy(t, func(rw http.ResponseWriter, req *http.Request) {
+		asked = &authzRequest{}
+		json.NewDecoder(req.Body).Decode(asked)
+		rw.Write([]byte(`{"allow": true}`))
+	}, nil)
+	defer stop()
+	p.RealIPHeader, p.ProxyIPHeader = "X-Real-IP", "X-Forwarded-For"
+	p.TrustedProxies = testTrustedProxies(t)
+
+	req := httptest.NewRequest("GET", "/deploy", nil)
+	req.RemoteAddr = "192.0.2.1:52814"
+	req.Header.Set("X-Real-IP", "10.0.0.5")
+	if _, err := p.askAuthzWebhook(req, &session.State{User: "michael"}); err != nil {
+		t.Fatal(err)
+	}
+	if asked == nil || asked.IP != "192.0.2.1" {
+		t.Errorf("expected the address of the untrusted peer, got %+v", asked)
+	}
+	other := httptest.NewRequest("GET", "/deploy", nil)
+	other.RemoteAddr = "198.51.100.7:52814"
+	if p.authCacheKey(req) == p.authCacheKey(other) {
+		t.Error("expected the cache key to depend on the client address")
+	}
+	spoofed := httptest.NewRequest("GET", "/deploy", nil)
+	spoofed.RemoteAddr = "192.0.2.1:40000"
+	spoofed.Header.Set("X-Forwarded-For", "10.0.0.6")
+	if p.authCacheKey(req) != p.authCacheKey(spoofed) {
+		t.Error("expected the cache key not to depend on headers an untrusted peer sent")
+	}
+}
+
+func TestAuthzWebhookAttributes(t *testing.T) {
+	var asked *authzRequest
+	p, _, stop := testAuthzProxy(t, func(rw http.ResponseWriter, req *http.Request) {
+		asked = &authzRequest{}
+		json.NewDecoder(req.Body).Decode(asked)
+		rw.Write([]byte(`{"allow": true}`))
+	}, func(o *Options) { o.AuthzWebhookAttrs = []string{"department", "title"} })
+	defer stop()
+
+	identity := &Identity{User: "michael", Attributes: map[string]string{"dn": "uid=michael,ou=people,dc=example,dc=com", "department": "Payments", "title": ""}}
+	s := &session.State{User: "michael", Attributes: p.Authz.userAttributes(identity)}
+	if len(s.Attributes) != 1 || s.Attributes["department"] != "Payments" {
+		t.Fatalf("expected only the attributes the directory has, got %v", s.Attributes)
+	}
+	if _, err := p.askAuthzWebhook(httptest.NewRequest("GET", "/deploy", nil), s); err != nil {
+		t.Fatal(err)
+	}
+	if asked == nil || len(asked.Attributes) != 1 || asked.Attributes["department"] != "Payments" {
+		t.Errorf("expected the attributes to be posted, got %+v", asked)
+	}
+	if p.Authz.userAttributes(&Identity{User: "htpasswd-user"}) != nil {
+		t.Error("expected no attributes for users outside the directory")
+	}
+}
+
+func TestValidateAuthzWebhook(t *testing.T) {
+	o := testOptions()
+	o.AuthzWebhookAttrs = []string{"department"}
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "authz-webhook-attribute requires authz-webhook-url") {
+		t.Errorf("expected attributes to require a webhook, got %v", err)
+	}
+
+	for _, configure := range []func(*Options){
+		func(o *Options) { o.AuthzWebhookURL = "ftp://authz.example.com/" },
+		func(o *Options) { o.AuthzWebhookTimeout = 0 },
+		func(o *Options) { o.AuthzWebhookCacheTTL = -time.Second },
+		func(o *Options) { o.AuthzWebhookFormat = "rego" },
+		func(o *Options) { o.AuthzWebhookSecret = "" },
+	} {
+		o := testOptions()
+		o.AuthzWebhookURL = "https://authz.example.com/"
+		o.AuthzWebhookSecret = "hook-secret"
+		configure(o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+	}
+}
+
+func TestAuthzWebhookOPA(t *testing.T) {
+	p, audit, stop := testAuthzProxy(t, func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Input *authzRequest `json:"input"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Input == nil {
+			t.Errorf("expected the request as the input document, got %v", err)
+			return
+		}
+		switch body.Input.Path {
+		case "/bool":
+			rw.Write([]byte(`{"result": true}`))
+		case "/object":
+			rw.Write([]byte(`{"result": {"allow": true, "headers": {"X-Role": "admin"}}}`))
+		case "/undefined":
+			rw.Write([]byte(`{}`))
+		default:
+			rw.Write([]byte(`{"result": "allow"}`))
+		}
+	}, func(o *Options) { o.AuthzWebhookFormat = AuthzFormatOPA })
+	defer stop()
+
+	for path, expected := range map[string]int{
+		"/bool":      http.StatusAccepted,
+		"/object":    http.StatusAccepted,
+		"/undefined": http.StatusForbidden,
+		"/invalid":   http.StatusForbidden,
+	} {
+		rw := authzAuthenticate(p, path)
+		if rw.Code != expected {
+			t.Errorf("%s: expected %d, got %d", path, expected, rw.Code)
+		}
+		if path == "/object" && rw.Header().Get("X-Role") != "admin" {
+			t.Errorf("expected the result's headers, got %v", rw.Header())
+		}
+	}
+	if !strings.Contains(audit.String(), "GET /undefined by the authorization webhook (policy result undefined)") {
+		t.Errorf("expected the undefined result to be audited, got %q", audit)
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// basicAuthCacheMaxEntries bounds the credentials remembered by a
+// basicAuthCache
+const basicAuthCacheMaxEntries = 10000
+
+// basicAuthCache remembers credentials the authenticators accepted for a
+// while, so API clients sending Basic credentials with every request don't
+// cause a directory bind each time. Entries are keyed by an HMAC of the
+// credentials so passwords aren't kept in memory.
+type basicAuthCache struct {
+	secret  string
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*basicAuthEntry
+}
+
+type basicAuthEntry struct {
+	identity *Identity
+	groups   []string
+	expires  time.Time
+}
+
+func newBasicAuthCache(secret string, ttl time.Duration) *basicAuthCache {
+	return &basicAuthCache{secret: secret, ttl: ttl, entries: make(map[string]*basicAuthEntry)}
+}
+
+func (c *basicAuthCache) key(username, password string) string {
+	h := hmac.New(sha256.New, []byte(c.secret))
+	h.Write([]byte(username + "\x00" + password))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *basicAuthCache) get(username, password string) (*Identity, []string, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[c.key(username, password)]
+	if !ok || time.Now().After(e.expires) {
+		return nil, nil, false
+	}
+	return e.identity, e.groups, true
+}
+
+func (c *basicAuthCache) put(username, password string, identity *Identity, groups []string) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= basicAuthCacheMaxEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= basicAuthCacheMaxEntries {
+			c.entries = make(map[string]*basicAuthEntry)
+		}
+	}
+	c.entries[c.key(username, password)] = &basicAuthEntry{identity, groups, now.Add(c.ttl)}
+}
+
+// authenticateBasic validates the Basic credentials of req against the
+// authenticators, as a sign-in would, and sets the identity headers. It
+// returns the same statuses as authenticate.
+func (p *LdapProxy) authenticateBasic(rw http.ResponseWriter, req *http.Request) (int, *session.State) {
+	username, password, ok := req.BasicAuth()
+	if !ok || username == "" {
+		return http.StatusForbidden, nil
+	}
+	username = p.normalizeLogin(username)
+	realm := p.hostRealm(req)
+	// the same credentials may be valid in another realm
+	cacheUser := username
+	if realm != nil {
+		cacheUser = realm.Name + "\x00" + username
+	}
+	identity, groups, cached := p.basicAuthCache.get(cacheUser, password)
+	if !cached {
+		var err error
+		identity, groups, err = p.authenticateUser(realm, username, password, false)
+		if err != nil {
+			p.signInFailure(req, username, err)
+			return http.StatusForbidden, nil
+		}
+		if !p.inRequiredGroups(realm, identity.User, groups) {
+			return http.StatusForbidden, nil
+		}
+		p.basicAuthCache.put(cacheUser, password, identity, groups)
+	}
+	if !identity.BreakGlassExpiresOn.IsZero() {
+		if !time.Now().Before(identity.BreakGlassExpiresOn) {
+			return http.StatusForbidden, nil
+		}
+		p.auditBreakGlass(req, identity)
+	}
+	if identity.Email != "" && !p.Validator(identity.Email) {
+		return http.StatusForbidden, nil
+	}
+
+	s := &session.State{User: identity.User, Email: identity.Email, Groups: groups, Realm: realmName(realm)}
+	if p.identityHeaders().dn != "" && identity.DN != "" {
+		s.DN = ldapauth.CanonicalDN(identity.DN)
+	}
+	if p.Authz != nil {
+		s.Attributes = p.Authz.userAttributes(identity)
+	}
+	if !p.allowedByACL(req, s) {
+		return http.StatusForbidden, s
+	}
+	setAuthResponseHeaders(rw, s, p.basicAuthHeaders())
+	return http.StatusAccepted, s
+}
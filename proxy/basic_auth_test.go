@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// countingAuthenticator counts the credentials checks reaching it
+type countingAuthenticator struct {
+	staticAuthenticator
+	calls int
+}
+
+func (a *countingAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	a.calls++
+	return a.staticAuthenticator.Authenticate(username, password)
+}
+
+func TestAuthEndpointBasic(t *testing.T) {
+	a := &countingAuthenticator{staticAuthenticator: staticAuthenticator{user: "michael", password: "secret", groups: []string{"api", "ops"}}}
+	p := &LdapProxy{
+		CookieName:        "_ldap_proxy",
+		Validator:         func(string) bool { return true },
+		Authenticators:    []Authenticator{a},
+		LdapGroups:        []string{"api"},
+		AuthEndpointBasic: true,
+		basicAuthCache:    newBasicAuthCache("secret", time.Minute),
+	}
+
+	auth := func(user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/ldap/auth", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		rw := httptest.NewRecorder()
+		p.AuthenticateOnly(rw, req)
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		rw := auth("michael", "secret")
+		if rw.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", rw.Code)
+		}
+		if rw.Header().Get("X-Auth-Request-User") != "michael" || rw.Header().Get("X-Auth-Request-Groups") != "api,ops" {
+			t.Errorf("unexpected identity headers %+v", rw.Header())
+		}
+	}
+	if a.calls != 1 {
+		t.Errorf("expected the second request to be served from the cache, got %d checks", a.calls)
+	}
+
+	if rw := auth("michael", "wrong"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong password, got %d", rw.Code)
+	}
+	if rw := auth("", ""); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", rw.Code)
+	}
+
+	p.LdapGroups = []string{"admins"}
+	p.basicAuthCache = newBasicAuthCache("secret", time.Minute)
+	if rw := auth("michael", "secret"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a user outside ldap-groups, got %d", rw.Code)
+	}
+
+	p.AuthEndpointBasic = false
+	p.LdapGroups = nil
+	if rw := auth("michael", "secret"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with auth-endpoint-basic disabled, got %d", rw.Code)
+	}
+}
+
+func TestBasicAuthCacheExpiry(t *testing.T) {
+	c := newBasicAuthCache("secret", time.Minute)
+	c.put("michael", "secret", &Identity{User: "michael"}, nil)
+	if _, _, ok := c.get("michael", "other"); ok {
+		t.Error("expected a different password to miss the cache")
+	}
+	c.entries[c.key("michael", "secret")].expires = time.Now().Add(-time.Second)
+	if _, _, ok := c.get("michael", "secret"); ok {
+		t.Error("expected an expired entry to miss the cache")
+	}
+
+	var disabled *basicAuthCache
+	disabled.put("michael", "secret", &Identity{User: "michael"}, nil)
+	if _, _, ok := disabled.get("michael", "secret"); ok {
+		t.Error("expected a nil cache to remember nothing")
+	}
+}
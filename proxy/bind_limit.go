@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// ErrSignInBusy is returned for a sign-in which waited too long for one of
+// the ldap-max-concurrent-binds to become free
+var ErrSignInBusy = errors.New("too many concurrent sign-ins")
+
+var bindLimitMetrics = expvar.NewMap("ldap_bind_limit")
+
+// bindLimiter bounds the sign-ins checked against the directory at once, so
+// a burst of them can't open a connection each. Sign-ins over the limit
+// queue for up to timeout.
+type bindLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newBindLimiter(max int, timeout time.Duration) *bindLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &bindLimiter{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// acquire reports whether a bind may go ahead, waiting for a free slot if
+// need be. Every successful acquire must be followed by a release.
+func (l *bindLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		bindLimitMetrics.Add("active", 1)
+		return true
+	default:
+	}
+
+	bindLimitMetrics.Add("waiting", 1)
+	defer bindLimitMetrics.Add("waiting", -1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		bindLimitMetrics.Add("active", 1)
+		return true
+	case <-timer.C:
+		bindLimitMetrics.Add("rejected", 1)
+		return false
+	}
+}
+
+func (l *bindLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+	bindLimitMetrics.Add("active", -1)
+}
+
+func validateBindLimit(o *Options, msgs []string) []string {
+	if o.LdapMaxConcurrentBinds < 0 {
+		msgs = append(msgs, fmt.Sprintf("ldap_max_concurrent_binds (%d) must not be negative", o.LdapMaxConcurrentBinds))
+	}
+	if o.LdapBindQueueTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("ldap_bind_queue_timeout (%s) must not be negative", o.LdapBindQueueTimeout))
+	}
+	return msgs
+}
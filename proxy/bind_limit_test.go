@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBindLimiter(t *testing.T) {
+	l := newBindLimiter(1, 20*time.Millisecond)
+	if !l.acquire() {
+		t.Fatal("expected a free slot")
+	}
+	if l.acquire() {
+		t.Fatal("expected the second bind to time out")
+	}
+
+	acquired := make(chan bool)
+	l.timeout = time.Second
+	go func() { acquired <- l.acquire() }()
+	time.Sleep(10 * time.Millisecond)
+	l.release()
+	if !<-acquired {
+		t.Error("expected a queued bind to get the released slot")
+	}
+
+	var unlimited *bindLimiter
+	if !unlimited.acquire() {
+		t.Error("expected no limit without ldap-max-concurrent-binds")
+	}
+	unlimited.release()
+}
+
+func TestSignInBusy(t *testing.T) {
+	audit := &bytes.Buffer{}
+	local := &staticAuthenticator{user: "local", password: "secret"}
+	p := testSignInProxy(audit, local, &LDAPAuthenticator{})
+	p.bindLimit = newBindLimiter(1, time.Millisecond)
+	p.bindLimit.acquire()
+
+	rw, resp := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	if rw.Code != http.StatusServiceUnavailable || resp.Error != SignInBusy || resp.Message == "" {
+		t.Errorf("unexpected response %d %+v", rw.Code, resp)
+	}
+
+	// authenticators before the directory aren't limited
+	if rw, resp := signInJSON(p, `{"username": "local", "password": "secret"}`); rw.Code != http.StatusOK {
+		t.Errorf("unexpected response %d %+v", rw.Code, resp)
+	}
+
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(url.Values{"username": {"michael"}, "password": {"secret"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw = httptest.NewRecorder()
+	p.SignIn(rw, req)
+	if rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), "Too many sign-ins") {
+		t.Errorf("unexpected sign-in page %d %s", rw.Code, rw.Body)
+	}
+}
+
+func TestValidateBindLimit(t *testing.T) {
+	o := testOptions()
+	o.LdapMaxConcurrentBinds = -1
+	if err := o.Validate(); err == nil {
+		t.Error("expected an error for a negative ldap-max-concurrent-binds")
+	}
+}
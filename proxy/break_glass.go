@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthenticatorBreakGlass names the BreakGlassAuthenticator in logs. It isn't
+// selectable with -authenticator: with a break-glass-file it is always tried
+// first.
+const AuthenticatorBreakGlass = "break-glass"
+
+// breakGlassAccount is an emergency account usable until expires
+type breakGlassAccount struct {
+	hash    []byte
+	expires time.Time
+}
+
+// loadBreakGlassFile reads lines of
+//
+//	username bcrypt-hash expiry
+//
+// where expiry is an RFC 3339 timestamp. Blank lines and lines starting with
+// # are ignored.
+func loadBreakGlassFile(filename string) (map[string]*breakGlassAccount, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	accounts := make(map[string]*breakGlassAccount)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s line %d: expected username, bcrypt hash and expiry", filename, n)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid bcrypt hash: %v", filename, n, err)
+		}
+		expires, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid expiry (expected RFC 3339, e.g. 2018-12-01T18:00:00Z): %v", filename, n, err)
+		}
+		accounts[fields[0]] = &breakGlassAccount{hash: []byte(fields[1]), expires: expires}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// BreakGlassAuthenticator authenticates the emergency accounts of a
+// break-glass-file. It needs nothing but the file, so the accounts keep
+// working when the directory is down. The file is read at every sign-in, so
+// accounts can be added or removed without a restart.
+type BreakGlassAuthenticator struct {
+	File string
+}
+
+func (a *BreakGlassAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	accounts, err := loadBreakGlassFile(a.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	account, ok := accounts[username]
+	if !ok || bcrypt.CompareHashAndPassword(account.hash, []byte(password)) != nil {
+		return nil, nil, ErrInvalidCredentials
+	}
+	if !time.Now().Before(account.expires) {
+		log.Printf("WARNING: rejected sign-in of break-glass account %q, which expired at %s", username, account.expires.UTC().Format(time.RFC3339))
+		return nil, nil, ErrInvalidCredentials
+	}
+	return &Identity{User: username, BreakGlassExpiresOn: account.expires}, nil, nil
+}
+
+// auditBreakGlass loudly records the use of a break-glass account
+func (p *LdapProxy) auditBreakGlass(req *http.Request, identity *Identity) {
+	expires := identity.BreakGlassExpiresOn.UTC().Format(time.RFC3339)
+	log.Printf("WARNING: BREAK-GLASS account %q used from %s (expires %s)", identity.User, p.getRemoteAddrStr(req), expires)
+	p.Auditf(req, "BREAK-GLASS account %q used for %s %s (expires %s)", identity.User, req.Method, req.URL.Path, expires)
+}
+
+func validateBreakGlass(o *Options, msgs []string) []string {
+	if o.BreakGlassFile == "" {
+		return msgs
+	}
+	accounts, err := loadBreakGlassFile(o.BreakGlassFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid break-glass-file: %v", err))
+	}
+	for user, account := range accounts {
+		if !time.Now().Before(account.expires) {
+			log.Printf("break-glass account %q in %s expired at %s", user, o.BreakGlassFile, account.expires.UTC().Format(time.RFC3339))
+		}
+	}
+	return msgs
+}
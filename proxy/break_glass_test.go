@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testBreakGlassFile(t *testing.T, lines ...string) string {
+	f, err := ioutil.TempFile("", "break-glass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("# emergency accounts\n" + strings.Join(lines, "\n") + "\n")
+	f.Close()
+	return f.Name()
+}
+
+func breakGlassLine(user, password string, expires time.Time) string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	return fmt.Sprintf("%s %s %s", user, hash, expires.Format(time.RFC3339))
+}
+
+func TestBreakGlassAuthenticator(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	filename := testBreakGlassFile(t,
+		breakGlassLine("oncall", "break-glass", expires),
+		breakGlassLine("former", "break-glass", time.Now().Add(-time.Hour)))
+	defer os.Remove(filename)
+	a := &BreakGlassAuthenticator{File: filename}
+
+	identity, groups, err := a.Authenticate("oncall", "break-glass")
+	if err != nil || identity.User != "oncall" || groups != nil || !identity.BreakGlassExpiresOn.Equal(expires) {
+		t.Errorf("unexpected result %+v %+v %+v", identity, groups, err)
+	}
+	for _, creds := range [][2]string{{"oncall", "wrong"}, {"former", "break-glass"}, {"nobody", "break-glass"}} {
+		if _, _, err := a.Authenticate(creds[0], creds[1]); err != ErrInvalidCredentials {
+			t.Errorf("%s: expected ErrInvalidCredentials, got %+v", creds[0], err)
+		}
+	}
+}
+
+func TestBreakGlassSignIn(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	filename := testBreakGlassFile(t, breakGlassLine("oncall", "break-glass", expires))
+	defer os.Remove(filename)
+
+	audit := &bytes.Buffer{}
+	p := testSignInProxy(audit)
+	o := testOptions()
+	o.BreakGlassFile = filename
+	p.Authenticators = newAuthenticators(o, p)
+	if _, ok := p.Authenticators[0].(*BreakGlassAuthenticator); !ok {
+		t.Fatalf("expected the break-glass accounts first, got %+v", p.Authenticators)
+	}
+	p.AuditLogger = log.New(audit, "", 0)
+
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(url.Values{"username": {"oncall"}, "password": {"break-glass"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	p.SignIn(rw, req)
+	if rw.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", rw.Code)
+	}
+	if !strings.Contains(audit.String(), `BREAK-GLASS account "oncall" used`) {
+		t.Errorf("expected the sign-in to be audited, got %q", audit.String())
+	}
+
+	// the session ends when the account expires
+	s, _, err := p.LoadCookiedSession(cookieRequest(rw))
+	if err != nil || !s.ExpiresOn.Equal(expires) {
+		t.Errorf("expected the session to expire at %s, got %+v %v", expires, s, err)
+	}
+}
+
+func cookieRequest(rw *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestValidateBreakGlassFile(t *testing.T) {
+	filename := testBreakGlassFile(t, "oncall notahash 2018-12-01T18:00:00Z")
+	defer os.Remove(filename)
+
+	o := testOptions()
+	o.BreakGlassFile = filename
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "invalid break-glass-file") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bypassTokenHeader carries a bypass token minted at BypassTokenPath
+const bypassTokenHeader = "X-Lap-Bypass-Token"
+
+// bypassClaims are what a bypass token grants: requests with Method for
+// exactly Path, without signing in, until Expires. Name says who the token
+// is for, e.g. a monitoring check.
+type bypassClaims struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Method  string `json:"method"`
+	Expires int64  `json:"exp"`
+}
+
+// bypassTokenRequest is the body of a POST to AdminBypassToken
+type bypassTokenRequest struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Method string `json:"method"`
+	TTL    string `json:"ttl"`
+}
+
+// bypassSignature is the HMAC of the encoded claims of a bypass token, kept
+// apart from share link signatures
+func bypassSignature(secret, claims string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "bypass\n%s", claims)
+	return h.Sum(nil)
+}
+
+// signBypassToken returns the token of c: its URL safe base64 JSON and
+// signature, separated by a dot
+func signBypassToken(secret string, c *bypassClaims) string {
+	b, _ := json.Marshal(c)
+	claims := base64.RawURLEncoding.EncodeToString(b)
+	return claims + "." + base64.RawURLEncoding.EncodeToString(bypassSignature(secret, claims))
+}
+
+// parseBypassToken returns the claims of token if it is signed with secret
+// and hasn't expired at now
+func parseBypassToken(secret, token string, now time.Time) (*bypassClaims, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, errors.New("malformed bypass token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, bypassSignature(secret, token[:i])) {
+		return nil, errors.New("invalid bypass token signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return nil, err
+	}
+	c := &bypassClaims{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if !now.Before(time.Unix(c.Expires, 0)) {
+		return nil, errors.New("bypass token expired")
+	}
+	return c, nil
+}
+
+// AdminBypassToken mints a bypass token for the name, path and method of a
+// JSON bypassTokenRequest on POST, valid for its ttl, at most, and by
+// default, BypassTokenMaxTTL. Only AdminUsers may use it.
+func (p *LdapProxy) AdminBypassToken(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if !p.isAdmin(session.User) {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// as for AdminSkipAuth, so another site can't make a signed in admin's
+	// browser mint tokens
+	if !isJSONRequest(req) {
+		http.Error(rw, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	r := &bypassTokenRequest{}
+	if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+		http.Error(rw, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if r.Name == "" {
+		http.Error(rw, "name is required", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(r.Path, "/") || strings.HasPrefix(r.Path, "//") || p.isReservedPath(r.Path) {
+		http.Error(rw, "path must be an upstream path", http.StatusBadRequest)
+		return
+	}
+	method := strings.ToUpper(r.Method)
+	if method == "" {
+		method = "GET"
+	}
+	ttl := p.BypassTokenMaxTTL
+	if r.TTL != "" {
+		d, err := time.ParseDuration(r.TTL)
+		if err != nil || d <= 0 {
+			http.Error(rw, fmt.Sprintf("invalid ttl %q", r.TTL), http.StatusBadRequest)
+			return
+		}
+		if d < ttl {
+			ttl = d
+		}
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token := signBypassToken(p.CookieSeed, &bypassClaims{Name: r.Name, Path: r.Path, Method: method, Expires: expires.Unix()})
+	p.Auditf(req, "user %q minted bypass token %q for %s %s until %s", session.User, r.Name, method, r.Path, expires.UTC().Format(time.RFC3339))
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]string{
+		"token":   token,
+		"header":  bypassTokenHeader,
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// bypassTokenName returns the name of the bypass token req carries if it
+// grants req
+func (p *LdapProxy) bypassTokenName(req *http.Request) (string, bool) {
+	token := req.Header.Get(bypassTokenHeader)
+	if p.BypassTokenMaxTTL <= 0 || token == "" {
+		return "", false
+	}
+	c, err := parseBypassToken(p.CookieSeed, token, time.Now())
+	if err != nil || c.Method != req.Method || c.Path != req.URL.Path {
+		return "", false
+	}
+	return c.Name, true
+}
+
+// proxyBypassed proxies a request granted by the bypass token named name,
+// which the access log records it as made by
+func (p *LdapProxy) proxyBypassed(rw http.ResponseWriter, req *http.Request, name string) {
+	req.Header.Del(bypassTokenHeader)
+	p.setIdentityHeaders(req, "", "", "", nil)
+	rw.Header().Set(authInfoHeader, "bypass-token:"+name)
+	p.serveMux.ServeHTTP(rw, req)
+}
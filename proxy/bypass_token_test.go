@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestParseBypassToken(t *testing.T) {
+	now := time.Now()
+	c := &bypassClaims{Name: "pingdom", Path: "/health", Method: "GET", Expires: now.Add(time.Hour).Unix()}
+	token := signBypassToken("secret", c)
+	if got, err := parseBypassToken("secret", token, now); err != nil || *got != *c {
+		t.Errorf("expected %+v, got %+v %v", c, got, err)
+	}
+	if _, err := parseBypassToken("secret", token, now.Add(2*time.Hour)); err == nil {
+		t.Error("expected the token to expire")
+	}
+	if _, err := parseBypassToken("other", token, now); err == nil {
+		t.Error("expected a token signed with another secret to be refused")
+	}
+	// a share link signature of the same secret doesn't sign tokens
+	forged := token[:strings.IndexByte(token, '.')+1] + shareSignature("secret", "example.com", "/health", "pingdom", c.Expires)
+	if _, err := parseBypassToken("secret", forged, now); err == nil {
+		t.Error("expected a forged token to be refused")
+	}
+}
+
+func TestBypassToken(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req
+	}))
+	defer upstream.Close()
+	o := testOptions()
+	o.Upstreams = []string{upstream.URL + "/"}
+	o.AdminUsers = []string{"admin"}
+	o.BypassTokenMaxTTL = time.Hour
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	mint := func(user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/ldap/admin/bypass-token", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, req, &session.State{User: user})
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+	if rw := mint("alice", `{"name": "pingdom", "path": "/health"}`); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non admin, got %d", rw.Code)
+	}
+	for _, body := range []string{`{"path": "/health"}`, `{"name": "pingdom", "path": "/ldap/sign_in"}`, `{"name": "pingdom", "path": "/health", "ttl": "soon"}`} {
+		if rw := mint("admin", body); rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rw.Code)
+		}
+	}
+	rw := mint("admin", `{"name": "pingdom", "path": "/health", "method": "post", "ttl": "48h"}`)
+	var minted map[string]string
+	if err := json.NewDecoder(rw.Body).Decode(&minted); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %v", rw.Code, err)
+	}
+	if expires, _ := time.Parse(time.RFC3339, minted["expires"]); expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expected the ttl to be capped by bypass-token-max-ttl, got %s", minted["expires"])
+	}
+
+	for _, tC := range []struct {
+		method, path string
+		code         int
+	}{
+		{"POST", "/health", http.StatusOK},
+		{"GET", "/health", http.StatusForbidden},
+		{"POST", "/health/other", http.StatusForbidden},
+	} {
+		got = nil
+		req := httptest.NewRequest(tC.method, tC.path, nil)
+		req.Header.Set(minted["header"], minted["token"])
+		req.Header.Set("X-Forwarded-User", "forged")
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		if rw.Code != tC.code {
+			t.Errorf("%s %s: expected %d, got %d", tC.method, tC.path, tC.code, rw.Code)
+		}
+		if got != nil && (got.Header.Get(bypassTokenHeader) != "" || got.Header.Get("X-Forwarded-User") != "") {
+			t.Errorf("expected the token and user headers to be removed, got %+v", got.Header)
+		}
+		if tC.code == http.StatusOK && rw.Header().Get(authInfoHeader) != "bypass-token:pingdom" {
+			t.Errorf("expected the access log to name the token, got %q", rw.Header().Get(authInfoHeader))
+		}
+	}
+
+	o = testOptions()
+	o.BypassTokenMaxTTL = time.Hour
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "requires admin-user") {
+		t.Errorf("expected bypass tokens to require admin users, got %v", err)
+	}
+}
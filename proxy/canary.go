@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+type sessionContextKey struct{}
+
+// withSession attaches the session a request is made with to its context,
+// for handlers routing on it
+func withSession(req *http.Request, s *session.State) *http.Request {
+	if s == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, s))
+}
+
+func sessionFromContext(ctx context.Context) *session.State {
+	s, _ := ctx.Value(sessionContextKey{}).(*session.State)
+	return s
+}
+
+// canaryRouter sends requests of users in any of groups to the canary
+// upstream and all others to the stable one
+type canaryRouter struct {
+	groups *ldapauth.GroupMatcher
+	canary http.Handler
+	stable http.Handler
+}
+
+func (c *canaryRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if s := sessionFromContext(req.Context()); s != nil {
+		if _, ok := c.groups.Match(s.Groups); ok {
+			c.canary.ServeHTTP(rw, req)
+			return
+		}
+	}
+	c.stable.ServeHTTP(rw, req)
+}
+
+// validateCanaries compiles the canary_groups and groups of upstreams,
+// comparing them with the user's groups as ldap-groups are
+func validateCanaries(o *Options, msgs []string) []string {
+	msgs = compileCanaries(o.LdapGroupMatch, o.proxyURLs, o.upstreamOptions, msgs)
+	return compileUpstreamGroups(o.LdapGroupMatch, o.proxyURLs, o.upstreamOptions, msgs)
+}
+
+// compileCanaries compiles the canary_groups of the upstreams urls, whose
+// options are uos, with groupMatch
+func compileCanaries(groupMatch string, urls []*url.URL, uos []*UpstreamOptions, msgs []string) []string {
+	for i, uo := range uos {
+		if uo.Canary == nil {
+			continue
+		}
+		if s := urls[i].Scheme; s != "http" && s != "https" {
+			msgs = append(msgs, fmt.Sprintf("upstream=%q: canary is only supported for http and https upstreams", urls[i]))
+			continue
+		}
+		m, err := ldapauth.NewGroupMatcher(groupMatch, uo.CanaryGroups)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream=%q: invalid canary_groups: %v", urls[i], err))
+			continue
+		}
+		uo.canaryMatcher = m
+	}
+	return msgs
+}
+
+// routesByGroup reports whether any upstream routes or is restricted on the
+// user's groups, so sessions need to keep them
+func (o *Options) routesByGroup() bool {
+	for _, uo := range o.upstreamOptions {
+		if uo.Canary != nil || uo.Groups != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestCanaryRouter(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/app/ canary=http://127.0.0.1:8081 canary_groups=engineers,qa"}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !o.routesByGroup() || o.upstreamOptions[0].canaryMatcher == nil {
+		t.Fatal("expected the canary to be set up")
+	}
+
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name))
+		})
+	}
+	router := &canaryRouter{groups: o.upstreamOptions[0].canaryMatcher, canary: handler("canary"), stable: handler("stable")}
+
+	for _, tc := range []struct {
+		session  *session.State
+		expected string
+	}{
+		{&session.State{User: "michael", Groups: []string{"staff", "QA"}}, "canary"},
+		{&session.State{User: "michael", Groups: []string{"staff"}}, "stable"},
+		{&session.State{User: "michael"}, "stable"},
+		{nil, "stable"},
+	} {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, withSession(httptest.NewRequest("GET", "/app/", nil), tc.session))
+		if rw.Body.String() != tc.expected {
+			t.Errorf("%+v: expected %s got %s", tc.session, tc.expected, rw.Body)
+		}
+	}
+}
+
+func TestParseUpstreamCanary(t *testing.T) {
+	for _, spec := range []string{
+		"http://a/ canary=http://b/",
+		"http://a/ canary_groups=engineers",
+		"http://a/ canary=http://b/staging/ canary_groups=engineers",
+		"http://a/ canary=b:3000 canary_groups=engineers",
+	} {
+		if _, _, err := parseUpstream(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+
+	o := testOptions()
+	o.Upstreams = []string{"file:///var/www/#/static/ canary=http://b/ canary_groups=engineers"}
+	if err := o.Validate(); err == nil {
+		t.Error("expected a canary for a file upstream to be rejected")
+	}
+}
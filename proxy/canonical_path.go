@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// cleanPath returns the canonical form of p, as http.ServeMux does: rooted,
+// without . and .. elements or repeated slashes, and keeping a trailing
+// slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// canonicalPath returns the path req should be redirected to before an
+// upstream serves it, and whether that is another path. Upstreams mounted
+// at a path ending in / serve everything under it, so requests for the path
+// without the slash are redirected to it; those mounted at a path without a
+// trailing slash serve only that path, so when nothing serves the path with
+// a trailing slash it is redirected to the path without. Paths are cleaned
+// first.
+func (p *LdapProxy) canonicalPath(req *http.Request) (string, bool) {
+	canonical := cleanPath(req.URL.Path)
+	pattern := p.upstreamPattern(req, canonical)
+	switch {
+	case pattern == canonical+"/":
+		canonical = pattern
+	case pattern == "" && canonical != "/" && strings.HasSuffix(canonical, "/"):
+		if exact := strings.TrimSuffix(canonical, "/"); p.upstreamPattern(req, exact) == exact {
+			canonical = exact
+		}
+	}
+	return canonical, canonical != req.URL.Path
+}
+
+// upstreamPattern returns the path of the upstream which serves requests
+// like req for path, or the slash terminated path an upstream is mounted at
+// which path lacks the trailing slash of
+func (p *LdapProxy) upstreamPattern(req *http.Request, path string) string {
+	r := *req
+	u := *req.URL
+	u.Path, u.RawPath = path, ""
+	r.URL = &u
+	_, pattern := p.upstreamHandler(&r)
+	return pattern
+}
+
+// serveUpstream passes req to the upstream serving its path, after
+// redirecting it to its canonical path if need be. Redirects of requests
+// other than GET and HEAD keep their method and body.
+func (p *LdapProxy) serveUpstream(rw http.ResponseWriter, req *http.Request) {
+	if canonical, ok := p.canonicalPath(req); ok {
+		code := http.StatusMovedPermanently
+		if req.Method != "GET" && req.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+		u := &url.URL{Path: canonical, RawQuery: req.URL.RawQuery}
+		http.Redirect(rw, req, p.redirectURL(req, u.String()), code)
+		return
+	}
+	p.serveMux.ServeHTTP(rw, p.instance.upstreamRequest(req))
+}
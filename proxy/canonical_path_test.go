@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestCleanPath(t *testing.T) {
+	for p, expected := range map[string]string{
+		"":           "/",
+		"app":        "/app",
+		"/app/":      "/app/",
+		"//app//x/":  "/app/x/",
+		"/app/../x":  "/x",
+		"/app/./x/.": "/app/x",
+	} {
+		if cleaned := cleanPath(p); cleaned != expected {
+			t.Errorf("%q: expected %q, got %q", p, expected, cleaned)
+		}
+	}
+}
+
+func TestCanonicalPathRedirects(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/app/", "static://200/healthz", "static://200/status", "static://200/status/"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	for _, c := range []struct {
+		method, uri string
+		code        int
+		location    string
+	}{
+		{"GET", "/app?q=1", http.StatusMovedPermanently, "/app/?q=1"},
+		{"POST", "/app", http.StatusPermanentRedirect, "/app/"},
+		{"GET", "/healthz/", http.StatusMovedPermanently, "/healthz"},
+		{"GET", "/healthz", http.StatusOK, ""},
+		{"GET", "/status/", http.StatusOK, ""},
+		{"GET", "/x/../app//reports", http.StatusMovedPermanently, "/app/reports"},
+		{"GET", "/unknown/", http.StatusNotFound, ""},
+	} {
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael"})
+		req := httptest.NewRequest(c.method, c.uri, nil)
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		p.Proxy(rw, req)
+		if rw.Code != c.code || rw.Header().Get("Location") != c.location {
+			t.Errorf("%s %s: expected %d %q, got %d %q", c.method, c.uri, c.code, c.location, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+
+	// unauthenticated requests get the sign-in page, not the redirect
+	rw := httptest.NewRecorder()
+	p.Proxy(rw, httptest.NewRequest("GET", "/app", nil))
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("expected the sign-in page, got %d", rw.Code)
+	}
+}
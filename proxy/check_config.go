@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// CheckConfig validates opts as New does, then checks the files and LDAP
+// server they refer to, without starting anything. Every problem found is
+// reported in the returned error.
+func CheckConfig(opts *Options) error {
+	msgs := opts.validate()
+
+	if opts.HtpasswdFile != "" {
+		if _, err := NewHtpasswdFromFile(opts.HtpasswdFile); err != nil {
+			msgs = append(msgs, fmt.Sprintf("unable to open htpasswd-file %s %s", opts.HtpasswdFile, err))
+		}
+	}
+	if opts.AuthenticatedEmailsFile != "" {
+		if f, err := os.Open(opts.AuthenticatedEmailsFile); err != nil {
+			msgs = append(msgs, fmt.Sprintf("unable to open authenticated-emails-file %s", err))
+		} else {
+			f.Close()
+		}
+	}
+	if dir := opts.CustomTemplatesDir; dir != "" {
+		if _, err := parseTemplates(dir, opts.ProxyPrefix); err != nil {
+			msgs = append(msgs, fmt.Sprintf("failed parsing custom templates %s", err))
+		}
+	}
+
+	if usesLDAP(opts) {
+		msgs = checkLdapBind(opts, "", msgs)
+		for _, r := range opts.realms {
+			msgs = checkLdapBind(r.opts, fmt.Sprintf("ldap-realm %s: ", r.name), msgs)
+		}
+	}
+
+	return configError(msgs)
+}
+
+// checkLdapBind binds to the directory of opts with its service account,
+// prefixing the problems found with prefix
+func checkLdapBind(opts *Options, prefix string, msgs []string) []string {
+	cfg := newLdapConfig(opts)
+	if opts.LdapBindDnPasswordFile != "" {
+		if _, err := cfg.ReloadBindPassword(); err != nil {
+			msgs = append(msgs, fmt.Sprintf("%sunable to read ldap-bind-dn-password-file %s", prefix, err))
+		}
+	}
+	if err := ldapauth.CheckBind(cfg); err != nil {
+		msgs = append(msgs, fmt.Sprintf("%sldap bind to %s as %q failed: %s", prefix, ldapServer(opts), opts.LdapBindDn, err))
+	}
+	return msgs
+}
+
+// usesLDAP reports whether sign-ins are checked against the directory
+func usesLDAP(opts *Options) bool {
+	if len(opts.Authenticators) == 0 {
+		return true
+	}
+	for _, name := range opts.Authenticators {
+		if name == AuthenticatorLDAP {
+			return true
+		}
+	}
+	return false
+}
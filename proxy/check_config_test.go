@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	// find a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	o := testOptions()
+	o.HtpasswdFile = "/nonexistent/htpasswd"
+	o.SkipAuthRegex = []string{"("}
+	o.LdapServerHost = "127.0.0.1"
+	o.LdapServerPort = port
+	o.LdapTLS = false
+
+	err = CheckConfig(o)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, expected := range []string{
+		"error compiling regex=\"(\"",
+		"unable to open htpasswd-file /nonexistent/htpasswd",
+		"ldap bind to 127.0.0.1:",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err)
+		}
+	}
+}
+
+func TestCheckConfigSkipsLDAP(t *testing.T) {
+	o := testOptions()
+	o.Authenticators = []string{"exec"}
+	o.AuthExecCommand = "/bin/true"
+	if err := CheckConfig(o); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
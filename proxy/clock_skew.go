@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// clockSkewWarning is how far ahead of this server's clock a cookie must
+// have been issued to be logged. Cookies hold whole seconds, so those of an
+// instance whose clock is a fraction of a second ahead appear a second
+// ahead.
+const clockSkewWarning = 2 * time.Second
+
+// clockSkewLog logs cookies issued ahead of this server's clock, at most
+// once a minute
+type clockSkewLog struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (l *clockSkewLog) warn(now time.Time, name string, ahead, skew time.Duration, accepted bool) {
+	l.mu.Lock()
+	if now.Sub(l.last) < time.Minute {
+		l.mu.Unlock()
+		return
+	}
+	l.last = now
+	l.mu.Unlock()
+	if accepted {
+		log.Printf("cookie %s was issued %s ahead of this server's clock; check the clocks of the instances sharing it are synchronised", name, ahead.Round(time.Second))
+	} else {
+		log.Printf("rejected cookie %s issued %s ahead of this server's clock, more than the cookie-clock-skew of %s; check the clocks of the instances sharing it are synchronised", name, ahead.Round(time.Second), skew)
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieClockSkew(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	o := testOptions()
+	o.CookieClockSkew = time.Minute
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	logged.Reset()
+
+	validate := func(ahead time.Duration) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(p.MakeSessionCookie(req, "michael", time.Hour, time.Now().Add(ahead)))
+		c, _ := p.sessionCookie(req)
+		_, _, ok := p.validateCookie(c, time.Hour)
+		return ok
+	}
+
+	if !validate(0) || logged.Len() != 0 {
+		t.Errorf("expected a cookie issued now to be accepted quietly, logged %q", logged.String())
+	}
+	if !validate(30 * time.Second) {
+		t.Error("expected a cookie issued within the skew to be accepted")
+	}
+	if !strings.Contains(logged.String(), "cookie _ldap_proxy was issued") || !strings.Contains(logged.String(), "ahead of this server's clock") {
+		t.Errorf("expected the skew to be logged, got %q", logged.String())
+	}
+
+	// the warnings are limited to one a minute
+	logged.Reset()
+	if validate(2*time.Minute) || logged.Len() != 0 {
+		t.Errorf("expected a cookie issued beyond the skew to be rejected without another warning, logged %q", logged.String())
+	}
+	p.clockSkew.last = time.Time{}
+	if validate(2*time.Minute) || !strings.Contains(logged.String(), "rejected cookie _ldap_proxy issued") {
+		t.Errorf("expected the rejection to be logged, got %q", logged.String())
+	}
+}
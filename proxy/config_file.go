@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// updateConfigFile sets top level array keys of the TOML config file at path,
+// replacing their existing assignments and keeping the rest of the file,
+// comments included, as it is. Keys not yet in the file are added before its
+// first table.
+func updateConfigFile(path string, values map[string][]string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	for key, v := range values {
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(map[string][]string{key: v}); err != nil {
+			return err
+		}
+		lines = setConfigKey(lines, key, buf.String())
+	}
+	return writeFileAtomic(path, []byte(strings.Join(lines, "")))
+}
+
+// setConfigKey replaces the top level assignment of key in lines with
+// assignment, which ends in a newline
+func setConfigKey(lines []string, key, assignment string) []string {
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			// the first table: key isn't assigned at the top level
+			return append(lines[:i:i], append([]string{assignment}, lines[i:]...)...)
+		}
+		if !assignsKey(trimmed, key) {
+			continue
+		}
+		end := i + assignmentLines(lines[i:])
+		return append(lines[:i:i], append([]string{assignment}, lines[end:]...)...)
+	}
+	if n := len(lines); n > 0 && lines[n-1] != "" && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += "\n"
+	}
+	return append(lines, assignment)
+}
+
+func assignsKey(line, key string) bool {
+	if !strings.HasPrefix(line, key) {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(line[len(key):]), "=")
+}
+
+// assignmentLines returns how many of lines an assignment starting at the
+// first of them spans, following arrays across lines while ignoring brackets
+// in strings and comments
+func assignmentLines(lines []string) int {
+	depth := 0
+	var quote byte
+	for n, line := range lines {
+	scan:
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case quote != 0:
+				if c == '\\' && quote == '"' {
+					i++
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '"' || c == '\'':
+				quote = c
+			case c == '#':
+				break scan
+			case c == '[':
+				depth++
+			case c == ']':
+				depth--
+			}
+		}
+		if depth <= 0 {
+			return n + 1
+		}
+	}
+	return len(lines)
+}
+
+// writeFileAtomic replaces path with data, keeping its permissions, such that
+// readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(info.Mode()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetConfigKey(t *testing.T) {
+	testCases := []struct {
+		in, expected string
+	}{
+		// appended when missing, keeping comments
+		{"# comment\nupstreams = [\"http://127.0.0.1:8080/\"]", "# comment\nupstreams = [\"http://127.0.0.1:8080/\"]\nkey = [\"new\"]\n"},
+		// inserted before the first table
+		{"a = 1\n[table]\nkey = [\"other\"]\n", "a = 1\nkey = [\"new\"]\n[table]\nkey = [\"other\"]\n"},
+		// multi line arrays, with brackets in strings and comments
+		{"key = [\n  \"/ba[rz]/\", # ]\n  \"]\",\n]\nafter = true\n", "key = [\"new\"]\nafter = true\n"},
+		// other keys sharing a prefix are left alone
+		{"key_other = []\nkey = []\n", "key_other = []\nkey = [\"new\"]\n"},
+	}
+	for _, tc := range testCases {
+		lines := setConfigKey(strings.SplitAfter(tc.in, "\n"), "key", "key = [\"new\"]\n")
+		if got := strings.Join(lines, ""); got != tc.expected {
+			t.Errorf("updating %q: expected %q got %q", tc.in, tc.expected, got)
+		}
+	}
+}
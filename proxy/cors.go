@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// CORSPolicy describes which cross origin requests browsers may make to the
+// proxied applications
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// NewCORSPolicy returns the policy configured in opts, or nil when no origins
+// are allowed
+func NewCORSPolicy(opts *Options) *CORSPolicy {
+	if len(opts.CORSAllowedOrigins) == 0 {
+		return nil
+	}
+	methods := opts.CORSAllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	return &CORSPolicy{
+		AllowedOrigins:   opts.CORSAllowedOrigins,
+		AllowedMethods:   methods,
+		AllowedHeaders:   opts.CORSAllowedHeaders,
+		AllowCredentials: opts.CORSAllowCredentials,
+		MaxAge:           opts.CORSMaxAge,
+	}
+}
+
+// IsAllowedOrigin reports whether origin may make cross origin requests
+func (c *CORSPolicy) IsAllowedOrigin(origin string) bool {
+	return c.allowOrigin(origin) != ""
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin for origin: origin
+// itself if it is listed, * if any origin is allowed, otherwise ""
+func (c *CORSPolicy) allowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	allow := ""
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+		if o == "*" {
+			allow = "*"
+		}
+	}
+	return allow
+}
+
+// Handle adds the CORS response headers for requests from allowed origins.
+// It returns true if req was a preflight request which has been answered.
+// Every response varies by Origin, so caches don't hand the response to a
+// disallowed origin, which lacks the headers, to an allowed one.
+func (c *CORSPolicy) Handle(rw http.ResponseWriter, req *http.Request) bool {
+	h := rw.Header()
+	h.Add("Vary", "Origin")
+	allow := c.allowOrigin(req.Header.Get("Origin"))
+	if allow == "" {
+		return false
+	}
+
+	h.Set("Access-Control-Allow-Origin", allow)
+	// browsers never send credentials to a wildcard, which validateCORS
+	// refuses together with cors-allow-credentials
+	if c.AllowCredentials && allow != "*" {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !isPreflightRequest(req) {
+		return false
+	}
+
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	if len(c.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(c.MaxAge.Seconds())))
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// corsResponseHeaders are the headers of actual responses Handle sets
+var corsResponseHeaders = []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials"}
+
+// dropUpstreamCORS is the response modifier of upstreams behind a CORS
+// policy. Handle already set the policy's headers on the response writer,
+// for the proxy's own pages as well, to which the reverse proxy adds the
+// upstream's headers, so the upstream's copies are deleted to leave browsers
+// a single Access-Control-Allow-Origin.
+func dropUpstreamCORS(resp *http.Response) error {
+	for _, name := range corsResponseHeaders {
+		resp.Header.Del(name)
+	}
+	return nil
+}
+
+// isPreflightRequest reports whether req is a CORS preflight: an OPTIONS
+// request from a browser asking whether it may make a cross origin request,
+// rather than one for the upstream itself
+func isPreflightRequest(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
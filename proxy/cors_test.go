@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	c := &CORSPolicy{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   defaultCORSMethods,
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	req := httptest.NewRequest("OPTIONS", "/api/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "X-Requested-With")
+	rw := httptest.NewRecorder()
+
+	if !c.Handle(rw, req) {
+		t.Fatal("expected preflight to be handled")
+	}
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, rw.Code)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, HEAD, POST, PUT, PATCH, DELETE",
+		"Access-Control-Allow-Headers":     "X-Requested-With",
+		"Access-Control-Max-Age":           "600",
+	}
+	for k, v := range expected {
+		if got := rw.Header().Get(k); got != v {
+			t.Errorf("expected %s %q, got %q", k, v, got)
+		}
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	c := &CORSPolicy{AllowedOrigins: []string{"*"}, AllowedMethods: defaultCORSMethods}
+
+	req := httptest.NewRequest("GET", "/api/", nil)
+	req.Header.Set("Origin", "https://other.example.com")
+	rw := httptest.NewRecorder()
+
+	if c.Handle(rw, req) {
+		t.Fatal("expected actual request not to be answered")
+	}
+	if got := rw.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+	}
+	if got := rw.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("unexpected Access-Control-Allow-Credentials %q", got)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	c := &CORSPolicy{AllowedOrigins: []string{"https://app.example.com"}, AllowedMethods: defaultCORSMethods}
+
+	req := httptest.NewRequest("OPTIONS", "/api/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rw := httptest.NewRecorder()
+
+	if c.Handle(rw, req) {
+		t.Fatal("expected preflight from disallowed origin not to be handled")
+	}
+	if got := rw.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+	}
+}
+
+func TestCORSUpstreamHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}))
+	defer upstream.Close()
+	o := testOptions()
+	o.Upstreams = []string{upstream.URL + "/"}
+	o.SkipAuthRegex = []string{"^/api/"}
+	o.CORSAllowedOrigins = []string{"https://app.example.com"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	get := func(origin string) http.Header {
+		req := httptest.NewRequest("GET", "/api/", nil)
+		req.Header.Set("Origin", origin)
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw.Header()
+	}
+
+	h := get("https://app.example.com")
+	if v := h["Access-Control-Allow-Origin"]; len(v) != 1 || v[0] != "https://app.example.com" {
+		t.Errorf("expected only the policy's Access-Control-Allow-Origin, got %q", v)
+	}
+	if v := h["Access-Control-Allow-Credentials"]; len(v) != 0 {
+		t.Errorf("expected the upstream's Access-Control-Allow-Credentials to be dropped, got %q", v)
+	}
+	h = get("https://evil.example.com")
+	if h.Get("Vary") != "Origin" || h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected a disallowed origin's response to vary by Origin without CORS headers, got %v", h)
+	}
+}
+
+func TestSkipAuthPreflight(t *testing.T) {
+	preflight := func() *http.Request {
+		req := httptest.NewRequest("OPTIONS", "/api/", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		return req
+	}
+	if !isPreflightRequest(preflight()) {
+		t.Error("expected a preflight")
+	}
+
+	plain := httptest.NewRequest("OPTIONS", "/api/", nil)
+	originOnly := httptest.NewRequest("OPTIONS", "/api/", nil)
+	originOnly.Header.Set("Origin", "https://app.example.com")
+	get := preflight()
+	get.Method = "GET"
+
+	p := &LdapProxy{skipAuthPreflight: true}
+	for name, tc := range map[string]struct {
+		req      *http.Request
+		expected bool
+	}{
+		"preflight":           {preflight(), true},
+		"plain OPTIONS":       {plain, false},
+		"OPTIONS with Origin": {originOnly, false},
+		"GET":                 {get, false},
+	} {
+		if got := p.IsWhitelistedRequest(tc.req); got != tc.expected {
+			t.Errorf("skip-auth-preflight, %s: expected %v, got %v", name, tc.expected, got)
+		}
+	}
+
+	p = &LdapProxy{skipAuthOptions: true}
+	if !p.IsWhitelistedRequest(plain) || !p.IsWhitelistedRequest(preflight()) || p.IsWhitelistedRequest(get) {
+		t.Error("expected skip-auth-options to let every OPTIONS request through, and only those")
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// NewDebugHandler serves net/http/pprof profiles under /debug/pprof/ and
+// expvar counters at /debug/vars
+func NewDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// ServeDebug serves NewDebugHandler on Opts.DebugAddress
+func (s *Server) ServeDebug() {
+	s.serveDebug(s.listenDebug())
+}
+
+func (s *Server) listenDebug() net.Listener {
+	listener, err := s.listen("tcp", s.Opts.DebugAddress)
+	if err != nil {
+		log.Fatalf("FATAL: listen (debug, %s) failed - %s", s.Opts.DebugAddress, err)
+	}
+	log.Printf("Debug: listening on %s", listener.Addr())
+	return listener
+}
+
+func (s *Server) serveDebug(listener net.Listener) {
+	server := &http.Server{Handler: NewDebugHandler()}
+	if err := s.serve(server, listener); err != nil {
+		log.Printf("ERROR: debug http.Serve() - %s", err)
+	}
+}
+
+func validateDebugAddress(o *Options, msgs []string) []string {
+	if o.DebugAddress == "" {
+		return msgs
+	}
+	host, _, err := net.SplitHostPort(o.DebugAddress)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid debug_address %q: %s", o.DebugAddress, err))
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return append(msgs, fmt.Sprintf("debug_address %q must be a loopback address", o.DebugAddress))
+	}
+	return msgs
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	h := NewDebugHandler()
+	for _, path := range []string{"/debug/vars", "/debug/pprof/"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", path, rw.Code)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/debug/vars", nil))
+	if !strings.Contains(rw.Body.String(), "memstats") {
+		t.Errorf("expected memstats in expvar output, got %q", rw.Body.String())
+	}
+}
+
+func TestValidateDebugAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:6060", "localhost:6060", "[::1]:6060"} {
+		o := testOptions()
+		o.DebugAddress = addr
+		if err := o.Validate(); err != nil {
+			t.Errorf("%s: unexpected error: %+v", addr, err)
+		}
+	}
+
+	o := testOptions()
+	o.DebugAddress = ":6060"
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  debug_address \":6060\" must be a loopback address" {
+		t.Error("unexpected error", err)
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// deferredGroupsWait bounds how long a request for a path matching
+// ldap-defer-groups-require-regex waits for the groups of its session, and
+// deferredGroupsPoll how often the SessionStore is checked for them
+const (
+	deferredGroupsWait = 10 * time.Second
+	deferredGroupsPoll = 50 * time.Millisecond
+)
+
+// requiresGroups reports whether req may only be decided once the groups of
+// a deferred sign-in are known
+func (p *LdapProxy) requiresGroups(req *http.Request) bool {
+	for _, r := range p.groupsRequired {
+		if r.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitGroups returns s once its groups have been looked up, reloading it
+// from the SessionStore, or nil if the sign-in was ended meanwhile, e.g.
+// because the groups don't satisfy ldap-groups
+func (p *LdapProxy) awaitGroups(s *session.State) (*session.State, error) {
+	deadline := time.Now().Add(deferredGroupsWait)
+	for s.GroupsPending {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for the groups of %q", s.User)
+		}
+		time.Sleep(deferredGroupsPoll)
+		stored, err := p.SessionStore.Load(s.Ticket)
+		if err == session.ErrSessionNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		stored.CookieExpiresOn = s.CookieExpiresOn
+		s = stored
+	}
+	return s, nil
+}
+
+// resolveGroups looks up the groups of the user of s, signed in with
+// ldap-defer-groups, and saves them into the stored session, or ends it if
+// they don't satisfy ldap-groups. A failed lookup leaves the user without
+// groups, as it does for sign-ins which aren't deferred.
+func (p *LdapProxy) resolveGroups(req *http.Request, s *session.State) {
+	realm := p.realmNamed(s.Realm)
+	var groups []string
+	for _, a := range p.realmAuthenticators(realm) {
+		if l, ok := a.(*LDAPAuthenticator); ok {
+			var err error
+			if groups, err = l.LookupGroups(s.User); err != nil {
+				log.Printf("Error getting groups for user %s: %+v", s.User, err)
+				groups = []string{}
+			}
+			break
+		}
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+
+	if !p.inRequiredGroups(realm, s.User, groups) {
+		p.Auditf(req, "user %q signed out: not in the required groups", s.User)
+		p.postSignInFailure(req, s.User, SignInNotInGroup)
+		if err := p.SessionStore.Clear(s.Ticket); err != nil {
+			log.Printf("failed to end session of %q: %v", s.User, err)
+		}
+		return
+	}
+	stored, err := p.SessionStore.Load(s.Ticket)
+	if err != nil {
+		// signed out meanwhile
+		return
+	}
+	stored.GroupsPending = false
+	if p.sessionKeepsGroups() {
+		stored.Groups = groups
+	}
+	if expire := p.sessionExpire(&Identity{}, groups); expire > 0 {
+		if expiresOn := stored.CreatedAt.Add(expire); stored.ExpiresOn.IsZero() || expiresOn.Before(stored.ExpiresOn) {
+			stored.ExpiresOn = expiresOn
+		}
+	}
+	if _, err := p.SessionStore.Save(stored); err != nil {
+		log.Printf("failed to save the groups of %q: %v", s.User, err)
+	}
+}
+
+// realmNamed returns the realm called name, nil for the default directory
+func (p *LdapProxy) realmNamed(name string) *Realm {
+	for _, r := range p.Realms {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func validateDeferredGroups(o *Options, msgs []string) []string {
+	o.groupsRequired = nil
+	for _, r := range o.LdapDeferGroupsRequire {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling ldap-defer-groups-require-regex %q %s", r, err))
+			continue
+		}
+		o.groupsRequired = append(o.groupsRequired, re)
+	}
+	if len(o.LdapDeferGroupsRequire) > 0 && !o.LdapDeferGroups {
+		msgs = append(msgs, "ldap-defer-groups-require-regex requires ldap-defer-groups")
+	}
+	if o.LdapDeferGroups && o.SessionStore == SessionStoreCookie {
+		msgs = append(msgs, "ldap-defer-groups requires a server side session-store")
+	}
+	return msgs
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timings of the Consul upstreams source. Blocking queries return when the
+// key changes or after consulWait; failed ones are retried after
+// consulRetry.
+const (
+	consulWait  = 5 * time.Minute
+	consulRetry = 10 * time.Second
+)
+
+// upstreamsDocument is the JSON of an upstreams-file or Consul key: upstream
+// specs as -upstream takes them
+type upstreamsDocument struct {
+	Upstreams []string `json:"upstreams"`
+}
+
+// DynamicUpstreams serves the upstreams given in the options followed by
+// those of an upstreams-file or Consul key, which are replaced whenever the
+// source changes. A change which doesn't validate is logged and the
+// previous upstreams are kept.
+type DynamicUpstreams struct {
+	opts      *Options
+	forbidden forbiddenFunc // responds to users not in an upstream's groups
+
+	mu      sync.RWMutex
+	mux     http.Handler
+	urls    []*url.URL
+	options []*UpstreamOptions
+	byGroup bool
+}
+
+func (d *DynamicUpstreams) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	d.mu.RLock()
+	mux := d.mux
+	d.mu.RUnlock()
+	mux.ServeHTTP(rw, req)
+}
+
+// URLs returns the upstreams being served
+func (d *DynamicUpstreams) URLs() []*url.URL {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.urls
+}
+
+// Upstreams returns the upstreams being served with their options
+func (d *DynamicUpstreams) Upstreams() ([]*url.URL, []*UpstreamOptions) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.urls, d.options
+}
+
+// routesByGroup reports whether any of the upstreams has a canary or groups
+func (d *DynamicUpstreams) routesByGroup() bool {
+	if d == nil {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.byGroup
+}
+
+// Load replaces the upstreams of the source with specs
+func (d *DynamicUpstreams) Load(specs []string) error {
+	urls, uos, msgs := parseUpstreams(specs, nil)
+	msgs = compileCanaries(d.opts.LdapGroupMatch, urls, uos, msgs)
+	msgs = compileUpstreamGroups(d.opts.LdapGroupMatch, urls, uos, msgs)
+	if len(msgs) > 0 {
+		return configError(msgs)
+	}
+	urls = append(append([]*url.URL{}, d.opts.proxyURLs...), urls...)
+	uos = append(append([]*UpstreamOptions{}, d.opts.upstreamOptions...), uos...)
+
+	paths := make(map[string]*url.URL)
+	for _, u := range urls {
+		path := upstreamPath(u)
+		if other, ok := paths[path]; ok {
+			return fmt.Errorf("upstreams %s and %s are both mounted at %s", other, u, path)
+		}
+		paths[path] = u
+	}
+	mux, byGroup := http.NewServeMux(), false
+	for i, u := range urls {
+		path, handler := upstreamSchemes[u.Scheme].Handler(u, d.opts, uos[i])
+		mux.Handle(path, restrictGroups(uos[i], allowMethods(uos[i].Methods, handler), d.forbidden))
+		byGroup = byGroup || uos[i].Canary != nil || uos[i].Groups != nil
+	}
+
+	d.mu.Lock()
+	d.mux, d.urls, d.options, d.byGroup = mux, urls, uos, byGroup
+	d.mu.Unlock()
+	log.Printf("loaded %d upstreams", len(urls))
+	return nil
+}
+
+// newDynamicUpstreams loads the upstreams of the upstreams-file or Consul key
+// of opts and keeps them up to date in the background
+func newDynamicUpstreams(opts *Options, forbidden forbiddenFunc) (*DynamicUpstreams, error) {
+	d := &DynamicUpstreams{opts: opts, forbidden: forbidden}
+	if opts.UpstreamsFile != "" {
+		if err := d.loadFile(opts.UpstreamsFile); err != nil {
+			return nil, err
+		}
+		WatchForUpdates(opts.UpstreamsFile, nil, func() {
+			if err := d.loadFile(opts.UpstreamsFile); err != nil {
+				log.Printf("keeping the previous upstreams: %v", err)
+			}
+		})
+		return d, nil
+	}
+	c := &consulUpstreams{URL: opts.UpstreamsConsulURL, Token: opts.UpstreamsConsulToken, Client: &http.Client{Timeout: consulWait + 30*time.Second}}
+	specs, err := c.fetch(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading upstreams from %s: %v", c.URL, err)
+	}
+	if err := d.Load(specs); err != nil {
+		return nil, fmt.Errorf("upstreams from %s: %v", c.URL, err)
+	}
+	go c.watch(d)
+	return d, nil
+}
+
+func (d *DynamicUpstreams) loadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	specs, err := decodeUpstreams(f)
+	if err != nil {
+		return fmt.Errorf("invalid upstreams-file %s: %v", filename, err)
+	}
+	if err := d.Load(specs); err != nil {
+		return fmt.Errorf("upstreams-file %s: %v", filename, err)
+	}
+	return nil
+}
+
+func decodeUpstreams(r io.Reader) ([]string, error) {
+	doc := &upstreamsDocument{}
+	if err := json.NewDecoder(r).Decode(doc); err != nil {
+		return nil, err
+	}
+	return doc.Upstreams, nil
+}
+
+// consulUpstreams reads the upstreams from a key of Consul's KV store, whose
+// HTTP API URL, e.g. http://127.0.0.1:8500/v1/kv/ldap_proxy/upstreams,
+// holds an upstreamsDocument. A missing key holds no upstreams.
+type consulUpstreams struct {
+	URL    string
+	Token  string
+	Client *http.Client
+
+	index uint64
+}
+
+// fetch returns the upstreams once the key's index differs from index
+func (c *consulUpstreams) fetch(index uint64) ([]string, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("raw", "")
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait.String())
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if i, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64); err == nil {
+		c.index = i
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return decodeUpstreams(resp.Body)
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	return nil, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// watch loads the upstreams into d whenever the key changes
+func (c *consulUpstreams) watch(d *DynamicUpstreams) {
+	for {
+		index := c.index
+		specs, err := c.fetch(index)
+		if err != nil {
+			log.Printf("reading upstreams from %s: %v", c.URL, err)
+			time.Sleep(consulRetry)
+			continue
+		}
+		if c.index == index {
+			// the wait elapsed without a change
+			continue
+		}
+		if err := d.Load(specs); err != nil {
+			log.Printf("keeping the previous upstreams: upstreams from %s: %v", c.URL, err)
+		}
+	}
+}
+
+func validateDynamicUpstreams(o *Options, msgs []string) []string {
+	if o.UpstreamsFile != "" && o.UpstreamsConsulURL != "" {
+		msgs = append(msgs, "only one of upstreams-file and upstreams-consul-url may be set")
+	}
+	if o.UpstreamsConsulURL != "" {
+		u, err := url.Parse(o.UpstreamsConsulURL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid upstreams-consul-url %q (must be an http or https URL)", o.UpstreamsConsulURL))
+		}
+	}
+	return msgs
+}
+
+// upstreamURLs returns the upstreams being served
+func (p *LdapProxy) upstreamURLs() []*url.URL {
+	if p.dynamic != nil {
+		return p.dynamic.URLs()
+	}
+	return p.upstreams
+}
+
+// upstreamsWithOptions returns the upstreams being served and their options
+func (p *LdapProxy) upstreamsWithOptions() ([]*url.URL, []*UpstreamOptions) {
+	if p.dynamic != nil {
+		return p.dynamic.Upstreams()
+	}
+	return p.upstreams, p.upstreamOptions
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testDynamicUpstreams(t *testing.T) *DynamicUpstreams {
+	o := testOptions()
+	o.Upstreams = []string{"static://200/ping"}
+	o.UpstreamsFile = "upstreams.json"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &DynamicUpstreams{opts: o}
+}
+
+func dynamicStatus(d *DynamicUpstreams, path string) int {
+	rw := httptest.NewRecorder()
+	d.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+	return rw.Code
+}
+
+func TestDynamicUpstreamsLoad(t *testing.T) {
+	d := testDynamicUpstreams(t)
+	if err := d.Load([]string{"static://503/reports/"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := dynamicStatus(d, "/reports/x"); code != 503 {
+		t.Errorf("reports: got %d, want 503", code)
+	}
+	if code := dynamicStatus(d, "/ping"); code != 200 {
+		t.Errorf("static upstream: got %d, want 200", code)
+	}
+
+	if err := d.Load([]string{"static://204/grafana/"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := dynamicStatus(d, "/reports/x"); code != 404 {
+		t.Errorf("removed upstream: got %d, want 404", code)
+	}
+	if code := dynamicStatus(d, "/grafana/"); code != 204 {
+		t.Errorf("added upstream: got %d, want 204", code)
+	}
+	if n := len(d.URLs()); n != 2 {
+		t.Errorf("got %d upstreams, want 2", n)
+	}
+}
+
+func TestDynamicUpstreamsKeepPreviousOnError(t *testing.T) {
+	d := testDynamicUpstreams(t)
+	if err := d.Load([]string{"static://503/reports/"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, specs := range [][]string{
+		{"gopher://reports/"},
+		{"static://200/ping"},
+		{"static://200/a/", "static://204/a/"},
+	} {
+		if err := d.Load(specs); err == nil {
+			t.Errorf("%q: expected an error", specs)
+		}
+	}
+	if code := dynamicStatus(d, "/reports/x"); code != 503 {
+		t.Errorf("got %d, want the previous upstreams", code)
+	}
+}
+
+func TestDynamicUpstreamsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "upstreams.json")
+	d := testDynamicUpstreams(t)
+
+	ioutil.WriteFile(filename, []byte(`{"upstreams": ["static://503/reports/"]}`), 0600)
+	if err := d.loadFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if code := dynamicStatus(d, "/reports/"); code != 503 {
+		t.Errorf("got %d, want 503", code)
+	}
+	ioutil.WriteFile(filename, []byte(`{"upstreams": [`), 0600)
+	if err := d.loadFile(filename); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestConsulUpstreams(t *testing.T) {
+	var queries []string
+	value := `{"upstreams": ["static://503/reports/"]}`
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		queries = append(queries, req.URL.RawQuery)
+		if req.Header.Get("X-Consul-Token") != "token" {
+			http.Error(rw, "ACL not found", 403)
+			return
+		}
+		if value == "" {
+			rw.Header().Set("X-Consul-Index", "8")
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("X-Consul-Index", "7")
+		fmt.Fprint(rw, value)
+	}))
+	defer s.Close()
+
+	c := &consulUpstreams{URL: s.URL + "/v1/kv/ldap_proxy/upstreams", Client: s.Client()}
+	if _, err := c.fetch(0); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got %v, want an error for the missing token", err)
+	}
+	c.Token = "token"
+	specs, err := c.fetch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0] != "static://503/reports/" || c.index != 7 {
+		t.Errorf("got %q at index %d", specs, c.index)
+	}
+	value = ""
+	specs, err = c.fetch(c.index)
+	if err != nil || len(specs) != 0 || c.index != 8 {
+		t.Errorf("missing key: got %q, %v at index %d", specs, err, c.index)
+	}
+	if q := queries[len(queries)-1]; !strings.Contains(q, "index=7") || !strings.Contains(q, "wait=") {
+		t.Errorf("expected a blocking query, got %q", q)
+	}
+}
+
+func TestValidateDynamicUpstreams(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = nil
+	o.UpstreamsConsulURL = "http://127.0.0.1:8500/v1/kv/upstreams"
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, c := range []struct{ file, consul string }{
+		{"upstreams.json", "http://127.0.0.1:8500/v1/kv/upstreams"},
+		{"", "127.0.0.1:8500/v1/kv/upstreams"},
+	} {
+		o := testOptions()
+		o.UpstreamsFile, o.UpstreamsConsulURL = c.file, c.consul
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
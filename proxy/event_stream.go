@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits of the event stream. A subscriber more than eventStreamBuffer
+// events behind misses the events arriving meanwhile; idle streams get a
+// comment every eventStreamKeepAlive so proxies in between keep them open.
+const (
+	eventStreamBuffer    = 64
+	eventStreamKeepAlive = 30 * time.Second
+)
+
+var eventStreamMetrics = expvar.NewMap("event_stream")
+
+// eventStream passes the events of the event webhook on to the
+// AdminUsers watching EventsPath
+type eventStream struct {
+	mu   sync.Mutex
+	subs map[chan *authEvent]bool
+
+	keepAlive time.Duration
+}
+
+// newEventStream returns the event stream of opts, or nil if there are no
+// admin users to watch it
+func newEventStream(opts *Options) *eventStream {
+	if len(opts.AdminUsers) == 0 {
+		return nil
+	}
+	return &eventStream{subs: make(map[chan *authEvent]bool), keepAlive: eventStreamKeepAlive}
+}
+
+func (s *eventStream) subscribe() chan *authEvent {
+	c := make(chan *authEvent, eventStreamBuffer)
+	s.mu.Lock()
+	s.subs[c] = true
+	s.mu.Unlock()
+	eventStreamMetrics.Add("watching", 1)
+	return c
+}
+
+func (s *eventStream) unsubscribe(c chan *authEvent) {
+	s.mu.Lock()
+	delete(s.subs, c)
+	s.mu.Unlock()
+	eventStreamMetrics.Add("watching", -1)
+}
+
+// publish passes e on to every subscriber with room for it
+func (s *eventStream) publish(e *authEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.subs {
+		select {
+		case c <- e:
+		default:
+			eventStreamMetrics.Add("dropped", 1)
+		}
+	}
+}
+
+// AdminEvents streams sign-ins, failed sign-ins, lockouts, sign-outs and
+// revoked sessions as server-sent events, named by their event and with
+// their JSON as data, until the client goes away or the watching session
+// expires. Sessions kept in a SessionStore are checked again with each
+// keep-alive, ending the stream once they are signed out or revoked. Only
+// AdminUsers may use it.
+func (p *LdapProxy) AdminEvents(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if !p.isAdmin(session.User) {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	if req.Method != "GET" {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := p.eventStream.subscribe()
+	defer p.eventStream.unsubscribe(events)
+	var expired <-chan time.Time
+	if expiry := sessionExpiry(session); !expiry.IsZero() {
+		timer := time.NewTimer(time.Until(expiry))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	keepAlive := time.NewTicker(p.eventStream.keepAlive)
+	defer keepAlive.Stop()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	// nginx would otherwise buffer the stream
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprint(rw, ": watching auth events\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case e := <-events:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", e.Event, data)
+		case <-keepAlive.C:
+			if p.SessionStore != nil {
+				if _, err := p.SessionStore.Load(session.Ticket); err != nil {
+					return
+				}
+			}
+			fmt.Fprint(rw, ": keep-alive\n\n")
+		case <-expired:
+			return
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestAdminEvents(t *testing.T) {
+	o := testOptions()
+	o.AdminUsers = []string{"admin"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	p.Authenticators = []Authenticator{&staticAuthenticator{user: "michael", password: "secret"}}
+	s := httptest.NewServer(p)
+	defer s.Close()
+
+	watch := func(user string) *http.Response {
+		req, _ := http.NewRequest("GET", s.URL+"/ldap/admin/events", nil)
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, req, &session.State{User: user})
+		req.AddCookie(rw.Result().Cookies()[0])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := watch("michael"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a non admin, got %d", resp.StatusCode)
+	}
+
+	resp := watch("admin")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- strings.TrimSuffix(line, "\n")
+		}
+	}()
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(time.Second):
+			t.Fatal("no event streamed")
+			return ""
+		}
+	}
+	// subscribed once the stream has started
+	if line := next(); !strings.HasPrefix(line, ":") {
+		t.Fatalf("expected a comment, got %q", line)
+	}
+	next()
+
+	signInJSON(p, `{"username": "michael", "password": "wrong"}`)
+	if line := next(); line != "event: "+EventSignInFailed {
+		t.Errorf("unexpected event line %q", line)
+	}
+	line := next()
+	e := &authEvent{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), e); err != nil || e.User != "michael" || e.Reason != SignInInvalidCredentials {
+		t.Errorf("unexpected data %q %v", line, err)
+	}
+}
+
+func TestAdminEventsSignedOut(t *testing.T) {
+	o := testOptions()
+	o.AdminUsers = []string{"admin"}
+	o.SessionStore = SessionStoreMemory
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	p.eventStream.keepAlive = 10 * time.Millisecond
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/ldap/admin/events", nil)
+	rw := httptest.NewRecorder()
+	s := &session.State{User: "admin"}
+	p.SaveSession(rw, req, s)
+	req.AddCookie(rw.Result().Cookies()[0])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	// kept open while the session is
+	for i := 0; i < 4; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatalf("expected the stream to stay open, got %v", err)
+		}
+	}
+
+	p.SessionStore.Clear(s.Ticket)
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the stream to end, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the stream to end once the session was signed out")
+	}
+}
+
+func TestEventStreamDrops(t *testing.T) {
+	s := &eventStream{subs: make(map[chan *authEvent]bool)}
+	slow := s.subscribe()
+	defer s.unsubscribe(slow)
+	for i := 0; i < eventStreamBuffer+10; i++ {
+		// never blocks on a watcher which isn't keeping up
+		s.publish(&authEvent{Event: EventSignIn})
+	}
+	if len(slow) != eventStreamBuffer {
+		t.Errorf("expected %d buffered events, got %d", eventStreamBuffer, len(slow))
+	}
+	(*eventStream)(nil).publish(&authEvent{Event: EventSignIn})
+}
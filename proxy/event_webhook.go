@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// Events posted to the event webhook
+const (
+	EventSignIn       = "sign_in"
+	EventSignInFailed = "sign_in_failed"
+	EventLockout      = "lockout"
+	EventSignOut      = "sign_out"
+	EventRevoked      = "session_revoked"
+)
+
+// eventWebhookSignatureHeader holds the hex HMAC-SHA256 of the body of event
+// webhook requests, keyed with the event webhook secret
+const eventWebhookSignatureHeader = "LAP-Webhook-Signature"
+
+// Limits of the event webhook. Events arriving while eventWebhookQueue are
+// waiting to be sent are dropped.
+const (
+	eventWebhookQueue   = 256
+	eventWebhookTimeout = 10 * time.Second
+)
+
+// authEvent is the JSON body of an event webhook request
+type authEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	// By is the user who revoked the session of a revoked event
+	By string `json:"by,omitempty"`
+}
+
+// EventWebhook posts sign-ins, failed sign-ins, lockouts and sign-outs to URL
+// as JSON, one request per event, in the order they happened
+type EventWebhook struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+
+	events chan *authEvent
+}
+
+// newEventWebhook returns the EventWebhook configured in opts, sending events
+// in the background, or nil if there is none
+func newEventWebhook(opts *Options) *EventWebhook {
+	if opts.EventWebhookURL == "" {
+		return nil
+	}
+	w := &EventWebhook{
+		URL:    opts.EventWebhookURL,
+		Client: &http.Client{Timeout: eventWebhookTimeout},
+		events: make(chan *authEvent, eventWebhookQueue),
+	}
+	if opts.EventWebhookSecret != "" {
+		w.Secret = []byte(opts.EventWebhookSecret)
+	}
+	go w.run()
+	return w
+}
+
+func (w *EventWebhook) run() {
+	for e := range w.events {
+		if err := w.send(e); err != nil {
+			log.Printf("failed to post %s event of %q to the event webhook: %v", e.Event, e.User, err)
+		}
+	}
+}
+
+// sign returns the value of eventWebhookSignatureHeader for body
+func (w *EventWebhook) sign(body []byte) string {
+	return webhookSignature(w.Secret, body)
+}
+
+// webhookSignature returns the value of eventWebhookSignatureHeader for body
+// sent to a webhook with secret
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *EventWebhook) send(e *authEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ldap_proxy/"+VERSION)
+	if w.Secret != nil {
+		req.Header.Set(eventWebhookSignatureHeader, w.sign(body))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// postEvent queues event of user, made by req, for the event webhook and
+// the event stream
+func (p *LdapProxy) postEvent(req *http.Request, event, user, reason string) {
+	p.sendEvent(req, &authEvent{Event: event, User: user, Reason: reason})
+}
+
+// sendEvent completes e with the time, address and User-Agent of req, which
+// made it, and queues it for the event webhook and the event stream
+func (p *LdapProxy) sendEvent(req *http.Request, e *authEvent) {
+	w := p.Events
+	if w == nil && p.eventStream == nil {
+		return
+	}
+	e.Time, e.UserAgent = time.Now().UTC(), req.UserAgent()
+	if ip := p.clientIP(req); ip != nil {
+		e.IP = ip.String()
+	}
+	p.eventStream.publish(e)
+	if w == nil {
+		return
+	}
+	select {
+	case w.events <- e:
+	default:
+		log.Printf("event webhook queue full; dropped %s event of %q", e.Event, e.User)
+	}
+}
+
+// postSignInFailure posts the failed sign-in of username for reason, as a
+// lockout if the directory reports the account locked
+func (p *LdapProxy) postSignInFailure(req *http.Request, username, reason string) {
+	event := EventSignInFailed
+	if reason == ldapauth.BindAccountLocked {
+		event = EventLockout
+	}
+	p.postEvent(req, event, username, reason)
+}
+
+func validateEventWebhook(o *Options, msgs []string) []string {
+	if o.EventWebhookURL == "" {
+		return msgs
+	}
+	u, err := url.Parse(o.EventWebhookURL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("invalid event-webhook-url %q (must be an http or https URL)", o.EventWebhookURL))
+	}
+	if o.EventWebhookSecret == "" {
+		msgs = append(msgs, "event-webhook-url requires event-webhook-secret, so receivers can tell the events are the proxy's")
+	}
+	return msgs
+}
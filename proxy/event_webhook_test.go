@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+type postedEvent struct {
+	event     *authEvent
+	body      []byte
+	signature string
+}
+
+func testEventWebhook(t *testing.T, secret string) (*EventWebhook, chan *postedEvent, func()) {
+	posted := make(chan *postedEvent, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		e := &authEvent{}
+		if err := json.Unmarshal(body, e); err != nil {
+			t.Errorf("invalid event %q", body)
+		}
+		posted <- &postedEvent{e, body, req.Header.Get(eventWebhookSignatureHeader)}
+	}))
+	o := testOptions()
+	o.EventWebhookURL = s.URL
+	o.EventWebhookSecret = secret
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	w := newEventWebhook(o)
+	return w, posted, func() {
+		close(w.events)
+		s.Close()
+	}
+}
+
+func nextEvent(t *testing.T, posted chan *postedEvent) *postedEvent {
+	select {
+	case e := <-posted:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event posted")
+		return nil
+	}
+}
+
+func TestEventWebhookSignIn(t *testing.T) {
+	w, posted, stop := testEventWebhook(t, "hooksecret")
+	defer stop()
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "michael", password: "secret"})
+	p.Events = w
+
+	signInJSON(p, `{"username": "michael", "password": "wrong"}`)
+	if e := nextEvent(t, posted); e.event.Event != EventSignInFailed || e.event.User != "michael" || e.event.Reason != SignInInvalidCredentials {
+		t.Errorf("unexpected event %+v", e.event)
+	}
+
+	rw, _ := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	e := nextEvent(t, posted)
+	if e.event.Event != EventSignIn || e.event.User != "michael" || e.event.IP != "192.0.2.1" || e.event.Time.IsZero() {
+		t.Errorf("unexpected event %+v", e.event)
+	}
+
+	req := httptest.NewRequest("GET", "/ldap/sign_out", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	p.SignOut(httptest.NewRecorder(), req)
+	if e := nextEvent(t, posted); e.event.Event != EventSignOut || e.event.User != "michael" {
+		t.Errorf("unexpected event %+v", e.event)
+	}
+}
+
+func TestEventWebhookClientIP(t *testing.T) {
+	w, posted, stop := testEventWebhook(t, "hooksecret")
+	defer stop()
+	p := &LdapProxy{Events: w, RealIPHeader: "X-Real-IP", TrustedProxies: testTrustedProxies(t)}
+
+	req := httptest.NewRequest("POST", "/ldap/sign_in", nil)
+	req.Header.Set("X-Real-IP", "10.0.0.5")
+	p.sendEvent(req, &authEvent{Event: EventSignIn, User: "michael"})
+	if e := nextEvent(t, posted); e.event.IP != "192.0.2.1" {
+		t.Errorf("expected the address of the untrusted peer, got %q", e.event.IP)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	p.sendEvent(req, &authEvent{Event: EventSignIn, User: "michael"})
+	if e := nextEvent(t, posted); e.event.IP != "10.0.0.5" {
+		t.Errorf("expected the address a trusted proxy passed on, got %q", e.event.IP)
+	}
+}
+
+type lockedOutAuthenticator struct{}
+
+func (lockedOutAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	return nil, nil, &ldapauth.BindError{Reason: ldapauth.BindAccountLocked}
+}
+
+func TestEventWebhookLockout(t *testing.T) {
+	w, posted, stop := testEventWebhook(t, "hooksecret")
+	defer stop()
+	p := testSignInProxy(&bytes.Buffer{}, lockedOutAuthenticator{})
+	p.Events = w
+
+	signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	e := nextEvent(t, posted)
+	if e.event.Event != EventLockout || e.event.Reason != ldapauth.BindAccountLocked {
+		t.Errorf("unexpected event %+v", e.event)
+	}
+	if e.signature != w.sign(e.body) || !strings.HasPrefix(e.signature, "sha256=") {
+		t.Errorf("unexpected signature %q", e.signature)
+	}
+}
+
+func TestValidateEventWebhook(t *testing.T) {
+	o := testOptions()
+	o.EventWebhookURL = "ftp://siem.example.com/"
+	o.EventWebhookSecret = "hooksecret"
+	err := o.Validate()
+	if err == nil || !strings.Contains(err.Error(), `invalid event-webhook-url "ftp://siem.example.com/"`) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	o = testOptions()
+	o.EventWebhookURL = "https://siem.example.com/"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "event-webhook-url requires event-webhook-secret") {
+		t.Errorf("expected the webhook to require a secret, got %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+)
+
+// expectContinue applies the expect_continue options of o to proxy. Clients
+// sending Expect: 100-continue are answered with 100 Continue when their body
+// is first read, which with the header passed on happens once the upstream
+// answers it, or gives up waiting, so an upstream refusing an upload does so
+// before it is sent. How long that is waited for is up to newUpstreamTransport.
+func expectContinue(proxy *httputil.ReverseProxy, o *UpstreamOptions) {
+	if !o.NoExpectContinue {
+		return
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Del("Expect")
+	}
+}
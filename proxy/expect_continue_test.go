@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCounter is a request body recording whether it was read
+type readCounter struct {
+	*strings.Reader
+	read bool
+}
+
+func (r *readCounter) Read(b []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(b)
+}
+
+func TestExpectContinue(t *testing.T) {
+	expected := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		expected <- req.Header.Get("Expect")
+		if req.Header.Get("Expect") == "" {
+			ioutil.ReadAll(req.Body)
+		}
+		// refuse the upload, without asking for it if that was expected
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	for _, tC := range []struct {
+		options string
+		expect  string
+		read    bool
+	}{
+		{"expect_continue_timeout=10s", "100-continue", false},
+		{"expect_continue=false", "", true},
+	} {
+		_, o, err := parseUpstream(backend.URL + "/ " + tC.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newUpstreamProxy(u, "/", testOptions(), o, nil)
+		body := &readCounter{Reader: strings.NewReader("large upload")}
+		req := httptest.NewRequest("PUT", "/upload", body)
+		req.ContentLength = body.Size()
+		req.Header.Set("Expect", "100-continue")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected the upstream's response, got %d", tC.options, rw.Code)
+		}
+		if got := <-expected; got != tC.expect {
+			t.Errorf("%s: expected the upstream to get Expect %q, got %q", tC.options, tC.expect, got)
+		}
+		if body.read != tC.read {
+			t.Errorf("%s: expected the body read to be %v", tC.options, tC.read)
+		}
+	}
+
+	for _, spec := range []string{"http://a/ expect_continue_timeout=0s", "http://a/ expect_continue_timeout=1", "http://a/ expect_continue=false expect_continue_timeout=1s"} {
+		if _, _, err := parseUpstream(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
+
+func TestMirrorRequestBuffering(t *testing.T) {
+	shadowed := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		shadowed <- req.Method
+	}))
+	defer shadow.Close()
+
+	_, o, err := parseUpstream("http://127.0.0.1:8080/app/ request_buffering=false mirror=" + shadow.URL)
+	if err != nil || !o.NoRequestBuffering {
+		t.Fatalf("unexpected options %+v %v", o, err)
+	}
+	m := newMirror(o.Mirror, o.MirrorPercent, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	m.skipBodies = o.NoRequestBuffering
+	for _, req := range []*http.Request{httptest.NewRequest("POST", "/app/upload", strings.NewReader("payload")), httptest.NewRequest("GET", "/app/", nil)} {
+		rw := httptest.NewRecorder()
+		rw.Header().Set(authInfoHeader, "michael")
+		m.ServeHTTP(rw, req)
+	}
+	select {
+	case got := <-shadowed:
+		if got != "GET" {
+			t.Errorf("expected only the request without a body to be mirrored, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request without a body to be mirrored")
+	}
+	select {
+	case got := <-shadowed:
+		t.Errorf("unexpected mirrored request %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
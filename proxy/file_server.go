@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// fileServer serves a file:// upstream with the file related UpstreamOptions
+// applied
+type fileServer struct {
+	root         http.FileSystem
+	handler      http.Handler
+	index        string
+	noListing    bool
+	contentTypes map[string]string
+}
+
+func newFileServer(prefix string, filesystemPath string, o *UpstreamOptions) http.Handler {
+	var root http.FileSystem = http.Dir(filesystemPath)
+	if o.HideDotfiles {
+		root = dotfileHidingFileSystem{root}
+	}
+	return http.StripPrefix(prefix, &fileServer{
+		root:         root,
+		handler:      http.FileServer(root),
+		index:        o.Index,
+		noListing:    o.NoListing,
+		contentTypes: o.ContentTypes,
+	})
+}
+
+func (f *fileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	upath := req.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+
+	if strings.HasSuffix(upath, "/") && f.isDir(upath) {
+		switch {
+		case f.index != "" && f.isFile(upath+f.index):
+			// http.FileServer only knows about index.html
+			req.URL.Path = upath + f.index
+		case f.noListing && !f.isFile(upath+"index.html"):
+			http.NotFound(rw, req)
+			return
+		}
+	}
+
+	if ctype, ok := f.contentTypes[strings.ToLower(path.Ext(req.URL.Path))]; ok {
+		rw.Header().Set("Content-Type", ctype)
+	}
+	if etag := f.etag(req.URL.Path); etag != "" {
+		// http.FileServer honours If-None-Match and If-Range only when the
+		// response already has an ETag
+		rw.Header().Set("ETag", etag)
+	}
+	f.handler.ServeHTTP(rw, req)
+}
+
+// etag returns a strong ETag for the file served for name, from its size and
+// modification time, or "" for directory listings and missing files
+func (f *fileServer) etag(name string) string {
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	fi := f.stat(name)
+	if fi == nil || fi.IsDir() {
+		return ""
+	}
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (f *fileServer) stat(name string) os.FileInfo {
+	file, err := f.root.Open(path.Clean(name))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	return fi
+}
+
+func (f *fileServer) isDir(name string) bool {
+	fi := f.stat(name)
+	return fi != nil && fi.IsDir()
+}
+
+func (f *fileServer) isFile(name string) bool {
+	fi := f.stat(name)
+	return fi != nil && !fi.IsDir()
+}
+
+// dotfileHidingFileSystem hides files and directories whose name starts with
+// a dot, both from requests and from directory listings
+type dotfileHidingFileSystem struct {
+	http.FileSystem
+}
+
+func containsDotFile(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs dotfileHidingFileSystem) Open(name string) (http.File, error) {
+	if containsDotFile(name) {
+		return nil, os.ErrNotExist
+	}
+	file, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dotfileHidingFile{file}, nil
+}
+
+type dotfileHidingFile struct {
+	http.File
+}
+
+func (f dotfileHidingFile) Readdir(n int) ([]os.FileInfo, error) {
+	files, err := f.File.Readdir(n)
+	visible := files[:0]
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), ".") {
+			visible = append(visible, file)
+		}
+	}
+	return visible, err
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testFileServerDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "test_file_server_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"home.html":          "home",
+		".htpasswd":          "secret",
+		"app.wasm":           "wasm",
+		"docs/page.html":     "page",
+		".git/config":        "config",
+		"empty/.keep":        "",
+		"indexed/index.html": "indexed",
+	} {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFileServerOptions(t *testing.T) {
+	dir := testFileServerDir(t)
+	defer os.RemoveAll(dir)
+
+	_, opts, err := parseUpstream("file://" + dir + "/#/static/ index=home.html listing=false dotfiles=false content_type=.wasm:application/wasm")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	h := newFileServer("/static/", dir, opts)
+
+	testCases := []struct {
+		path        string
+		code        int
+		body        string
+		contentType string
+	}{
+		{"/static/", http.StatusOK, "home", ""},
+		{"/static/docs/page.html", http.StatusOK, "page", ""},
+		{"/static/docs/", http.StatusNotFound, "", ""},
+		{"/static/indexed/", http.StatusOK, "indexed", ""},
+		{"/static/.htpasswd", http.StatusNotFound, "", ""},
+		{"/static/.git/config", http.StatusNotFound, "", ""},
+		{"/static/app.wasm", http.StatusOK, "wasm", "application/wasm"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.path, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest("GET", tC.path, nil))
+			if rw.Code != tC.code {
+				t.Fatalf("expected %d, got %d", tC.code, rw.Code)
+			}
+			if tC.body != "" && rw.Body.String() != tC.body {
+				t.Errorf("expected body %q, got %q", tC.body, rw.Body.String())
+			}
+			if tC.contentType != "" && rw.Header().Get("Content-Type") != tC.contentType {
+				t.Errorf("expected Content-Type %q, got %q", tC.contentType, rw.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestFileServerDefaults(t *testing.T) {
+	dir := testFileServerDir(t)
+	defer os.RemoveAll(dir)
+	h := NewFileServer("/static/", dir)
+
+	for path, code := range map[string]int{
+		"/static/docs/":     http.StatusOK,
+		"/static/.htpasswd": http.StatusOK,
+	} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, rw.Code)
+		}
+	}
+}
+
+func TestFileServerConditionalRequests(t *testing.T) {
+	dir := testFileServerDir(t)
+	defer os.RemoveAll(dir)
+	_, opts, err := parseUpstream("file://" + dir + "/#/static/ index=home.html")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	h := newFileServer("/static/", dir, opts)
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	etag := get("/static/docs/page.html").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+	if rw := get("/static/docs/page.html", "If-None-Match", etag); rw.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching If-None-Match, got %d", rw.Code)
+	}
+	if rw := get("/static/docs/page.html", "Range", "bytes=1-2"); rw.Code != http.StatusPartialContent || rw.Body.String() != "ag" {
+		t.Errorf("expected the range, got %d %q", rw.Code, rw.Body)
+	}
+	if rw := get("/static/docs/page.html", "Range", "bytes=1-2", "If-Range", etag); rw.Code != http.StatusPartialContent {
+		t.Errorf("expected the range for a matching If-Range, got %d", rw.Code)
+	}
+	if rw := get("/static/docs/page.html", "Range", "bytes=1-2", "If-Range", `"stale"`); rw.Code != http.StatusOK || rw.Body.String() != "page" {
+		t.Errorf("expected the whole file for a stale If-Range, got %d %q", rw.Code, rw.Body)
+	}
+	if etag := get("/static/").Header().Get("ETag"); etag == "" {
+		t.Error("expected an ETag for the index")
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isTrustedProxy reports whether req was received from one of trusted, and
+// so whether its X-Forwarded-* headers can be believed
+func isTrustedProxy(req *http.Request, trusted []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, c := range trusted {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making req for decisions the
+// client mustn't be able to sway: realIPHeader and proxyIPHeader are only
+// believed from one of trusted, and of proxyIPHeader only the address the
+// trusted proxy added. It is nil if they don't hold an address.
+func clientIP(req *http.Request, realIPHeader, proxyIPHeader string, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !isTrustedProxy(req, trusted) {
+		return net.ParseIP(host)
+	}
+	if v := req.Header.Get(realIPHeader); v != "" {
+		host = v
+	}
+	if v := req.Header.Get(proxyIPHeader); v != "" {
+		host = strings.TrimSpace(v[strings.LastIndexByte(v, ',')+1:])
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the address of the client making req as the ACL takes it
+func (p *LdapProxy) clientIP(req *http.Request) net.IP {
+	return clientIP(req, p.RealIPHeader, p.ProxyIPHeader, p.TrustedProxies)
+}
+
+// forwardedHeader returns the first value of a X-Forwarded-* header set by a
+// trusted proxy
+func forwardedHeader(req *http.Request, trusted []*net.IPNet, name string) string {
+	v := req.Header.Get(name)
+	if v == "" || !isTrustedProxy(req, trusted) {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(strings.Split(v, ",")[0]))
+}
+
+// requestScheme returns the scheme the client used to make req: https if it
+// arrived over TLS, otherwise X-Forwarded-Proto from a trusted proxy
+func requestScheme(req *http.Request, trusted []*net.IPNet) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	if proto := forwardedHeader(req, trusted, "X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		return proto
+	}
+	return "http"
+}
+
+// requestHost returns the host, and the port if it isn't the default for the
+// scheme, the client used to make req
+func requestHost(req *http.Request, trusted []*net.IPNet) string {
+	host := req.Host
+	if h := forwardedHeader(req, trusted, "X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	port := forwardedHeader(req, trusted, "X-Forwarded-Port")
+	if port == "" {
+		return host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	switch scheme := requestScheme(req, trusted); {
+	case scheme == "https" && port == "443", scheme == "http" && port == "80":
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// redirectURL returns path as an absolute URL on the host and scheme the
+// client used, so redirects survive TLS terminating load balancers. URLs of
+// other hosts, which users signing in on the login-host return to, are
+// returned as they are.
+func (p *LdapProxy) redirectURL(req *http.Request, path string) string {
+	if len(p.TrustedProxies) == 0 || !isLocalRedirect(path) {
+		return path
+	}
+	return requestScheme(req, p.TrustedProxies) + "://" + requestHost(req, p.TrustedProxies) + path
+}
+
+// localRedirect returns uri if it is a path on this host, the path and query
+// of uri if it is an absolute URL of the host the client made req to, as
+// nginx's auth_request setups pass in rd, or / otherwise. The scheme of
+// such URLs is dropped: redirectURL adds the one the client used.
+func (p *LdapProxy) localRedirect(req *http.Request, uri string) string {
+	if isLocalRedirect(uri) {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.User != nil || !strings.EqualFold(u.Host, requestHost(req, p.TrustedProxies)) {
+		return "/"
+	}
+	local := u.RequestURI()
+	if u.Fragment != "" {
+		local += "#" + u.EscapedFragment()
+	}
+	return local
+}
+
+// secureCookie reports whether cookies set in response to req should have
+// the Secure attribute
+func (p *LdapProxy) secureCookie(req *http.Request) bool {
+	if p.CookieSecureAuto {
+		return requestScheme(req, p.TrustedProxies) == "https"
+	}
+	return p.CookieSecure
+}
+
+// ForwardedHSTSMiddleware sets the Strict-Transport-Security header on
+// requests a trusted proxy received over HTTPS
+func ForwardedHSTSMiddleware(trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestScheme(r, trusted) == "https" {
+			w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
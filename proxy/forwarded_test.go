@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testTrustedProxies(t *testing.T) []*net.IPNet {
+	trusted, msgs := parseCIDRs([]string{"10.0.0.0/8"}, nil)
+	if len(msgs) != 0 {
+		t.Fatalf("unexpected errors: %v", msgs)
+	}
+	return trusted
+}
+
+func TestRequestScheme(t *testing.T) {
+	trusted := testTrustedProxies(t)
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		proto      string
+		tls        bool
+		expected   string
+	}{
+		{"plain", "10.0.0.1:1234", "", false, "http"},
+		{"tls", "192.168.0.1:1234", "", true, "https"},
+		{"trusted proxy", "10.0.0.1:1234", "https", false, "https"},
+		{"trusted proxy list", "10.0.0.1:1234", "HTTPS, http", false, "https"},
+		{"untrusted proxy", "192.168.0.1:1234", "https", false, "http"},
+		{"invalid proto", "10.0.0.1:1234", "gopher", false, "http"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tC.remoteAddr
+			req.TLS = nil
+			if tC.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tC.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tC.proto)
+			}
+			if scheme := requestScheme(req, trusted); scheme != tC.expected {
+				t.Errorf("expected %s, got %s", tC.expected, scheme)
+			}
+		})
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	p := &LdapProxy{}
+	req := httptest.NewRequest("GET", "http://internal:4180/ldap/sign_in", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	if u := p.redirectURL(req, "/"); u != "/" {
+		t.Errorf("expected relative redirect without trusted proxies, got %q", u)
+	}
+
+	p.TrustedProxies = testTrustedProxies(t)
+	if u := p.redirectURL(req, "/app"); u != "https://app.example.com/app" {
+		t.Errorf("unexpected redirect %q", u)
+	}
+
+	req.Header.Set("X-Forwarded-Port", "8443")
+	if u := p.redirectURL(req, "/app"); u != "https://app.example.com:8443/app" {
+		t.Errorf("unexpected redirect %q", u)
+	}
+	req.Header.Set("X-Forwarded-Port", "443")
+	if u := p.redirectURL(req, "/app"); u != "https://app.example.com/app" {
+		t.Errorf("unexpected redirect %q", u)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	p := &LdapProxy{TrustedProxies: testTrustedProxies(t)}
+	req := httptest.NewRequest("GET", "http://internal:4180/ldap/sign_in", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	for uri, expected := range map[string]string{
+		"/reports/?a=1":                               "/reports/?a=1",
+		"http://app.example.com/reports/?a=1":         "/reports/?a=1",
+		"https://APP.example.com/reports/#top":        "/reports/#top",
+		"https://app.example.com":                     "/",
+		"https://internal:4180/reports/":              "/",
+		"https://evil.example.com/reports/":           "/",
+		"https://user@app.example.com/reports/":       "/",
+		"javascript://app.example.com/%0aalert(1)":    "/",
+		"https://app.example.com.evil.com/reports/":   "/",
+		"https://app.example.com:8443/other-service/": "/",
+	} {
+		if got := p.localRedirect(req, uri); got != expected {
+			t.Errorf("%q: expected %q, got %q", uri, expected, got)
+		}
+	}
+	if u := p.redirectURL(req, p.localRedirect(req, "http://app.example.com/reports/")); u != "https://app.example.com/reports/" {
+		t.Errorf("expected the redirect to use the scheme the client used, got %q", u)
+	}
+
+	// without trusted proxies only the Host the request was made to is local
+	p.TrustedProxies = nil
+	if got := p.localRedirect(req, "https://app.example.com/reports/"); got != "/" {
+		t.Errorf("expected a forwarded host not to be believed, got %q", got)
+	}
+	if got := p.localRedirect(req, "http://internal:4180/reports/"); got != "/reports/" {
+		t.Errorf("expected the request host to be local, got %q", got)
+	}
+}
+
+func TestForwardedCookieDomain(t *testing.T) {
+	p := &LdapProxy{CookieName: "_ldap_proxy", TrustedProxies: testTrustedProxies(t)}
+	req := httptest.NewRequest("GET", "http://internal:4180/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Host", "app.example.com:8443")
+	if c := p.makeCookie(req, p.CookieName, "v", time.Hour, time.Now()); c.Domain != "app.example.com" {
+		t.Errorf("expected the cookie for the forwarded host, got %q", c.Domain)
+	}
+}
+
+func TestSecureCookieAuto(t *testing.T) {
+	p := &LdapProxy{CookieName: "_ldap_proxy", CookieSecure: true, CookieSecureAuto: true, TrustedProxies: testTrustedProxies(t)}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if c := p.makeCookie(req, p.CookieName, "v", time.Hour, time.Now()); c.Secure {
+		t.Error("expected insecure cookie for http request")
+	}
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if c := p.makeCookie(req, p.CookieName, "v", time.Hour, time.Now()); !c.Secure {
+		t.Error("expected secure cookie for forwarded https request")
+	}
+}
+
+func TestForwardedHSTSMiddleware(t *testing.T) {
+	h := ForwardedHSTSMiddleware(testTrustedProxies(t), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if v := rw.Header().Get("Strict-Transport-Security"); v != "" {
+		t.Errorf("unexpected HSTS header on http request: %q", v)
+	}
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if v := rw.Header().Get("Strict-Transport-Security"); v == "" {
+		t.Error("expected HSTS header on forwarded https request")
+	}
+}
+
+func TestSkipAuthIPsClientIP(t *testing.T) {
+	skipIPs, _ := parseCIDRs([]string{"172.16.0.0/12", "2001:db8::/32"}, nil)
+	p := &LdapProxy{
+		RealIPHeader:   "X-Real-IP",
+		ProxyIPHeader:  "X-Forwarded-For",
+		TrustedProxies: testTrustedProxies(t),
+		skipAuthIPs:    skipIPs,
+	}
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		header     string
+		value      string
+		expected   bool
+	}{
+		{"peer", "172.16.0.1:1234", "", "", true},
+		{"ipv6 peer", "[2001:db8::1]:1234", "", "", true},
+		{"spoofed real ip", "192.0.2.1:1234", "X-Real-IP", "172.16.0.1", false},
+		{"spoofed forwarded for", "192.0.2.1:1234", "X-Forwarded-For", "172.16.0.1", false},
+		{"trusted proxy", "10.0.0.1:1234", "X-Real-IP", "172.16.0.1", true},
+		{"trusted proxy forwarding", "10.0.0.1:1234", "X-Forwarded-For", "172.16.0.1, 192.0.2.1", false},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tC.remoteAddr
+			if tC.header != "" {
+				req.Header.Set(tC.header, tC.value)
+			}
+			if ok := p.IsWhitelistedRequest(req); ok != tC.expected {
+				t.Errorf("expected %v, got %v", tC.expected, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/skybet/ldap_proxy/geoip"
+)
+
+func validateGeoIP(o *Options, msgs []string) []string {
+	if o.GeoIPDatabase == "" {
+		return msgs
+	}
+	r, err := geoip.Open(o.GeoIPDatabase)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid geoip-database: %v", err))
+	}
+	o.geoIP = r
+	return msgs
+}
+
+// country returns the ISO 3166-1 code of the country the client of req is
+// in, empty when it's unknown or there is no geoip-database
+func (p *LdapProxy) country(req *http.Request) string {
+	if p.geoIP == nil {
+		return ""
+	}
+	return lookupCountry(p.geoIP, p.clientIP(req))
+}
+
+// lookupCountry returns the country of ip in r, empty when r is nil or
+// doesn't know it. Addresses the database can't hold, such as IPv6 ones in an
+// IPv4 database, are unknown too.
+func lookupCountry(r *geoip.Reader, ip net.IP) string {
+	if r == nil || ip == nil {
+		return ""
+	}
+	country, _ := r.Country(ip)
+	return country
+}
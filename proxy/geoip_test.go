@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+const testGeoIPDatabase = "../geoip/testdata/Test-Country.mmdb"
+
+func TestValidateGeoIP(t *testing.T) {
+	o := testOptions()
+	o.GeoIPDatabase = testGeoIPDatabase
+	if err := o.Validate(); err != nil || o.geoIP == nil {
+		t.Fatalf("expected the database to be opened, got %v", err)
+	}
+
+	o = testOptions()
+	o.GeoIPDatabase = "/nonexistent/GeoLite2-Country.mmdb"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "invalid geoip-database") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	f, _ := ioutil.TempFile("", "acl")
+	defer os.Remove(f.Name())
+	f.WriteString("deny country=cn,ru\n")
+	f.Close()
+	o = testOptions()
+	o.ACLFile = f.Name()
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "require geoip-database") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	o.GeoIPDatabase = testGeoIPDatabase
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if countries := o.acl.Rules[0].countries; len(countries) != 2 || countries[0] != "CN" {
+		t.Errorf("expected the countries to be upper cased, got %v", countries)
+	}
+	if _, err := parseACLRule("deny country=china", ""); err == nil {
+		t.Error("expected an error for a country which isn't a code")
+	}
+}
+
+func TestGeoIPDeniesCountry(t *testing.T) {
+	o := testOptions()
+	o.GeoIPDatabase = testGeoIPDatabase
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	audit := &bytes.Buffer{}
+	p := &LdapProxy{
+		CookieName:   "_ldap_proxy",
+		CookieSeed:   "secret",
+		CookieExpire: time.Hour,
+		Validator:    func(string) bool { return true },
+		AuditLogger:  log.New(audit, "", 0),
+		ACL:          testACL(t, "deny country=CN\n"),
+		geoIP:        o.geoIP,
+	}
+
+	for addr, expected := range map[string]int{
+		"203.0.113.9:4321": http.StatusForbidden,
+		"81.2.69.160:4321": http.StatusAccepted,
+		// unknown countries can't get past a deny rule
+		"10.0.0.1:4321": http.StatusForbidden,
+	} {
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael"})
+		req := httptest.NewRequest("GET", "/ldap/auth", nil)
+		req.RemoteAddr = addr
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		p.AuthenticateOnly(rw, req)
+		if rw.Code != expected {
+			t.Errorf("%s: expected %d, got %d", addr, expected, rw.Code)
+		}
+	}
+	if line := audit.String(); !strings.Contains(line, "203.0.113.9:4321 country=CN user \"michael\" denied") {
+		t.Errorf("expected the denial to be audited with the country, got %q", line)
+	}
+}
+
+func TestAccessLogCountry(t *testing.T) {
+	o := testOptions()
+	o.GeoIPDatabase = testGeoIPDatabase
+	o.RealIPHeader = "X-Real-IP"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	h := AccessLogHandler(out, http.NotFoundHandler(), o)
+	for _, addr := range []string{"81.2.69.160:4321", "192.0.2.1:4321"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		// the country of the address the ACL decides on, which a client's
+		// own X-Real-IP isn't
+		req.Header.Set("X-Real-IP", "203.0.113.9")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " GB") || !strings.HasSuffix(lines[1], " -") {
+		t.Errorf("expected the lines to end with the country, got %q", lines)
+	}
+
+	out.Reset()
+	AccessLogHandler(out, http.NotFoundHandler(), testOptions()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if fields := strings.Fields(out.String()); len(fields) != 14 {
+		t.Errorf("expected no country field without a geoip-database, got %q", out)
+	}
+}
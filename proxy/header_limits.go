@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var headerLimitMetrics = expvar.NewMap("request_header_limits")
+
+// newHTTPServer returns the server of a listener, serving handler with the
+// header size and read timeout limits of s.Opts
+func (s *Server) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		MaxHeaderBytes:    s.Opts.maxHeaderBytes,
+		ReadHeaderTimeout: s.Opts.ReadHeaderTimeout,
+	}
+}
+
+// requestCookies returns the number of cookies req carries, without parsing
+// them
+func requestCookies(req *http.Request) int {
+	n := 0
+	for _, h := range req.Header["Cookie"] {
+		n += strings.Count(h, ";") + 1
+	}
+	return n
+}
+
+// rejectCookies responds to req with 431 Request Header Fields Too Large and
+// reports true if it carries more than max-request-cookies cookies, each of
+// which would be parsed, and possibly have its signature checked, on the
+// way to finding the session cookie
+func (p *LdapProxy) rejectCookies(rw http.ResponseWriter, req *http.Request) bool {
+	if p.MaxRequestCookies == 0 {
+		return false
+	}
+	n := requestCookies(req)
+	if n <= p.MaxRequestCookies {
+		return false
+	}
+	headerLimitMetrics.Add("too_many_cookies", 1)
+	log.Printf("%s rejecting request with %d cookies (max-request-cookies %d) %s %s", p.getRemoteAddrStr(req), n, p.MaxRequestCookies, req.Method, req.URL.Path)
+	code := http.StatusRequestHeaderFieldsTooLarge
+	http.Error(rw, http.StatusText(code), code)
+	return true
+}
+
+func validateHeaderLimits(o *Options, msgs []string) []string {
+	size, err := parseSize(o.MaxHeaderSize)
+	switch {
+	case err != nil:
+		msgs = append(msgs, fmt.Sprintf("invalid max-header-size: %v", err))
+	case size < 1<<10 || size > 1<<30:
+		msgs = append(msgs, fmt.Sprintf("max-header-size %q must be between 1K and 1G", o.MaxHeaderSize))
+	}
+	o.maxHeaderBytes = int(size)
+	if o.ReadHeaderTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("read_header_timeout (%s) must not be negative", o.ReadHeaderTimeout))
+	}
+	if o.MaxRequestCookies < 0 {
+		msgs = append(msgs, fmt.Sprintf("max_request_cookies (%d) must not be negative", o.MaxRequestCookies))
+	}
+	return msgs
+}
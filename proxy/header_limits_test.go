@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateHeaderLimits(t *testing.T) {
+	o := testOptions()
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if o.maxHeaderBytes != 1<<20 {
+		t.Errorf("expected 1M headers by default, got %d", o.maxHeaderBytes)
+	}
+	for _, configure := range []func(o *Options){
+		func(o *Options) { o.MaxHeaderSize = "lots" },
+		func(o *Options) { o.MaxHeaderSize = "100" },
+		func(o *Options) { o.ReadHeaderTimeout = -time.Second },
+		func(o *Options) { o.MaxRequestCookies = -1 },
+	} {
+		o := testOptions()
+		configure(o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("%s %s %d: expected an error", o.MaxHeaderSize, o.ReadHeaderTimeout, o.MaxRequestCookies)
+		}
+	}
+}
+
+func TestMaxRequestCookies(t *testing.T) {
+	o := testOptions()
+	o.MaxRequestCookies = 3
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	for cookies, code := range map[string]int{
+		"a=1; b=2; c=3":      http.StatusForbidden,
+		"a=1; b=2; c=3; d=4": http.StatusRequestHeaderFieldsTooLarge,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", cookies)
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		if rw.Code != code {
+			t.Errorf("%q: expected %d, got %d", cookies, code, rw.Code)
+		}
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header["Cookie"] = []string{"a=1; b=2", "c=3", "d=4"}
+	if n := requestCookies(req); n != 4 {
+		t.Errorf("expected the cookies of every header to be counted, got %d", n)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	o := testOptions()
+	o.ReadHeaderTimeout = 100 * time.Millisecond
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Opts: o}
+	srv := s.newHTTPServer(http.NotFoundHandler())
+	if srv.MaxHeaderBytes != 1<<20 {
+		t.Errorf("expected the server to accept 1M headers, got %d", srv.MaxHeaderBytes)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if strings.Contains(string(b), "404") {
+		t.Errorf("expected the incomplete request not to be served, got %q", b)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the connection to be closed after the timeout, took %s", elapsed)
+	}
+}
@@ -1,7 +1,8 @@
-package main
+package proxy
 
 import (
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/csv"
 	"io"
@@ -50,7 +51,7 @@ func (h *HtpasswdFile) Validate(user string, password string) bool {
 	if realPassword[:5] == "{SHA}" {
 		d := sha1.New()
 		d.Write([]byte(password))
-		if realPassword[5:] == base64.StdEncoding.EncodeToString(d.Sum(nil)) {
+		if subtle.ConstantTimeCompare([]byte(realPassword[5:]), []byte(base64.StdEncoding.EncodeToString(d.Sum(nil)))) == 1 {
 			return true
 		}
 	} else {
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Server struct {
+	Handler http.Handler
+	Opts    *Options
+	// LoadOptions, if set, reads the configuration afresh for Reload
+	LoadOptions func() (*Options, error)
+	reloadMu    sync.Mutex
+
+	mu        sync.Mutex
+	listeners []*serverListener
+	servers   []*http.Server
+	// inherited are the listeners handed over by the process upgraded from
+	inherited map[string]net.Listener
+	// active counts the requests being served, including those whose
+	// connections were hijacked, e.g. for websockets, which http.Server
+	// doesn't wait for when shutting down
+	active  int64
+	drained chan struct{}
+	// upgraded is set once a new process serves the listeners, which this
+	// one is draining
+	upgradeMu sync.Mutex
+	upgraded  bool
+}
+
+// serverListener is a listener of the Server with the network and address
+// it was asked to listen on, which a new process upgraded to looks it up by
+type serverListener struct {
+	network, addr string
+	net.Listener
+}
+
+func (s *Server) ListenAndServe() {
+	s.drained = make(chan struct{})
+	var err error
+	if s.inherited, err = inheritedListeners(); err != nil {
+		log.Fatalf("FATAL: inheriting listeners failed - %s", err)
+	}
+	if s.Opts.GracefulUpgrade {
+		s.upgradeOnSignal()
+	}
+	if s.Opts.DebugAddress != "" {
+		go s.serveDebug(s.listenDebug())
+	}
+	if s.Opts.TLSKeyFile != "" || s.Opts.TLSCertFile != "" {
+		s.ServeHTTPS()
+	} else {
+		s.ServeHTTP()
+	}
+}
+
+func (s *Server) ServeHTTP() {
+	httpAddress := s.Opts.HTTPAddress
+	scheme := ""
+
+	i := strings.Index(httpAddress, "://")
+	if i > -1 {
+		scheme = httpAddress[0:i]
+	}
+
+	var networkType string
+	switch scheme {
+	case "", "http":
+		networkType = "tcp"
+	default:
+		networkType = scheme
+	}
+
+	slice := strings.SplitN(httpAddress, "//", 2)
+	listenAddr := slice[len(slice)-1]
+
+	listener, err := s.listen(networkType, listenAddr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
+	}
+	log.Printf("HTTP: listening on %s", listenAddr)
+
+	handler := XFrameOptionsMiddleware(s.Handler)
+	if len(s.Opts.trustedProxies) > 0 {
+		handler = ForwardedHSTSMiddleware(s.Opts.trustedProxies, handler)
+	}
+	server := s.newHTTPServer(handler)
+	s.ready()
+	err = s.serve(server, listener)
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		log.Printf("ERROR: http.Serve() - %s", err)
+	}
+
+	log.Printf("HTTP: closing %s", listener.Addr())
+}
+
+func (s *Server) ServeHTTPS() {
+	addr := s.Opts.HTTPSAddress
+	config := tlsServerConfig(s.Opts)
+
+	var err error
+	config.Certificates = make([]tls.Certificate, 1)
+	config.Certificates[0], err = tls.LoadX509KeyPair(s.Opts.TLSCertFile, s.Opts.TLSKeyFile)
+	if err != nil {
+		log.Fatalf("FATAL: loading tls config (%s, %s) failed - %s", s.Opts.TLSCertFile, s.Opts.TLSKeyFile, err)
+	}
+
+	ln, err := s.listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
+	}
+	log.Printf("HTTPS: listening on %s", ln.Addr())
+
+	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
+	srv := s.newHTTPServer(HSTSMiddleware(XFrameOptionsMiddleware(s.Handler)))
+	s.ready()
+	err = s.serve(srv, tlsListener)
+
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		log.Printf("ERROR: https.Serve() - %s", err)
+	}
+
+	log.Printf("HTTPS: closing %s", tlsListener.Addr())
+}
+
+// listen returns the listener inherited for network and addr, or a new one
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ln, ok := s.inherited[network+":"+addr]
+	if ok {
+		delete(s.inherited, network+":"+addr)
+		log.Printf("inherited listener on %s", ln.Addr())
+	} else {
+		var err error
+		if ln, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	s.listeners = append(s.listeners, &serverListener{network: network, addr: addr, Listener: ln})
+	return ln, nil
+}
+
+// serve serves srv on ln until its Shutdown and, if that is the drain after
+// an upgrade, until the requests in progress are done
+func (s *Server) serve(srv *http.Server, ln net.Listener) error {
+	handler := srv.Handler
+	srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&s.active, 1)
+		defer atomic.AddInt64(&s.active, -1)
+		handler.ServeHTTP(rw, req)
+	})
+	s.mu.Lock()
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+
+	err := srv.Serve(ln)
+	if err == http.ErrServerClosed && s.drained != nil {
+		<-s.drained
+		return nil
+	}
+	return err
+}
+
+// drain stops accepting connections and waits up to timeout for the
+// requests in progress to be done
+func (s *Server) drain(timeout time.Duration) {
+	defer close(s.drained)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.mu.Lock()
+	servers := s.servers
+	for _, l := range s.listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			// the socket file is the new process's now
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	wg.Wait()
+	for atomic.LoadInt64(&s.active) > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(drainPoll):
+		}
+	}
+	if n := atomic.LoadInt64(&s.active); n > 0 {
+		log.Printf("upgrade: exiting with %d requests still in progress after %s", n, timeout)
+		return
+	}
+	log.Printf("upgrade: all requests done, exiting")
+}
+
+// drainPoll is how often drain checks whether the requests in progress are
+// done
+const drainPoll = 100 * time.Millisecond
+
+// tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
+// connections. It's used by ListenAndServe and ListenAndServeTLS so
+// dead TCP connections (e.g. closing laptop mid-download) eventually
+// go away.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
+	tc, err := ln.AcceptTCP()
+	if err != nil {
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(3 * time.Minute)
+	return tc, nil
+}
+
+// HSTSMiddleware sets Strict-Transport-Security header
+func HSTSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// XFrameOptionsMiddleware sets X-Frame-Options header
+func XFrameOptionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Frame-Options", "deny")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NoCache sets no cache headers
+func NoCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-control", "no-store")
+		w.Header().Add("Pragma", "no-cache")
+
+		next(w, r)
+	}
+}
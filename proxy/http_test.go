@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// testHTTPSProxy serves a proxy of upstream, skipping authentication, over
+// HTTPS configured by o as ServeHTTPS would
+func testHTTPSProxy(t *testing.T, o *Options, upstream *httptest.Server) (*httptest.Server, *http.Client) {
+	o.Upstreams = []string{upstream.URL + "/"}
+	o.SkipAuthRegex = []string{"^/"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	s := httptest.NewUnstartedServer(HSTSMiddleware(XFrameOptionsMiddleware(AccessLogHandler(ioutil.Discard, p, o))))
+	config := tlsServerConfig(o)
+	s.TLS = config
+	s.StartTLS()
+	// StartTLS sets its certificate on a clone, while ServeHTTPS sets it on
+	// the config GetConfigForClient clones
+	config.Certificates = s.TLS.Certificates
+	client := s.Client()
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	return s, client
+}
+
+func TestHTTP2Streaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 1 {
+			t.Errorf("expected the upstream to be spoken to over HTTP/1, got %s", req.Proto)
+		}
+		if req.URL.Path == "/upload" {
+			body, _ := ioutil.ReadAll(req.Body)
+			rw.Write(body)
+			return
+		}
+		io.WriteString(rw, "first\n")
+		rw.(http.Flusher).Flush()
+		<-release
+		io.WriteString(rw, "second\n")
+	}))
+	defer upstream.Close()
+	s, client := testHTTPSProxy(t, testOptions(), upstream)
+	defer s.Close()
+
+	// a request body of unknown length is streamed up
+	r, w := io.Pipe()
+	go func() {
+		for _, chunk := range []string{"one ", "two ", "three"} {
+			io.WriteString(w, chunk)
+		}
+		w.Close()
+	}()
+	resp, err := client.Post(s.URL+"/upload", "text/plain", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "one two three" {
+		t.Errorf("expected the body echoed over HTTP/2, got %s %q", resp.Proto, body)
+	}
+
+	// and a response body streamed down as the upstream flushes it
+	resp, err = client.Get(s.URL + "/stream")
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	line, err := lines.ReadString('\n')
+	close(release)
+	if err != nil || line != "first\n" {
+		t.Fatalf("expected the first line before the upstream finished, got %q %v", line, err)
+	}
+	if line, _ = lines.ReadString('\n'); line != "second\n" {
+		t.Errorf("expected the second line, got %q", line)
+	}
+	if resp.Header.Get("Strict-Transport-Security") == "" {
+		t.Error("expected HSTS over HTTP/2")
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	for name, o := range map[string]*Options{
+		"default":           testOptions(),
+		"disable-http2":     testOptions(),
+		"http1-only-client": testOptions(),
+		"other client":      testOptions(),
+	} {
+		expected := 1
+		switch name {
+		case "default":
+			expected = 2
+		case "disable-http2":
+			o.DisableHTTP2 = true
+		case "http1-only-client":
+			o.HTTP1OnlyClients = []string{"127.0.0.0/8", "::1"}
+		case "other client":
+			o.HTTP1OnlyClients = []string{"192.0.2.0/24"}
+			expected = 2
+		}
+		s, client := testHTTPSProxy(t, o, upstream)
+		resp, err := client.Get(s.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != expected {
+			t.Errorf("%s: expected HTTP/%d, got %s", name, expected, resp.Proto)
+		}
+		s.Close()
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	s := &Server{Opts: testOptions(), drained: make(chan struct{})}
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hijacked, release := make(chan struct{}), make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(&http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			// like a websocket, which http.Server doesn't wait for
+			c, _, err := rw.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			close(hijacked)
+			<-release
+		})}, ln)
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /socket HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	<-hijacked
+
+	go s.drain(time.Minute)
+	select {
+	case err := <-served:
+		t.Fatalf("expected serving to wait for the hijacked connection, got %v", err)
+	case <-time.After(3 * drainPoll):
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Errorf("expected new connections to be refused while draining")
+	}
+	close(release)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected serving to end once the connection is done")
+	}
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" {
+			http.Error(rw, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		c, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		line, _ := brw.ReadString('\n')
+		io.WriteString(c, "echo "+line)
+	}))
+	defer upstream.Close()
+
+	// through the access log, the response size limit and the reauth-header
+	o := testOptions()
+	o.Upstreams = []string{upstream.URL + "/ max_response_size=1K"}
+	o.ReauthHeader = "X-LAP-Reauth"
+	o.StreamingExpiryPolicy = StreamingExpiryGrace
+	o.StreamingExpiryGrace = time.Minute
+	o.RequestLogging = true
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	// logged once the connection is closed, which the server doesn't wait for
+	logged, out := io.Pipe()
+	s := httptest.NewServer(AccessLogHandler(out, p, o))
+	defer s.Close()
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(logged).ReadString('\n')
+		lines <- line
+		io.Copy(ioutil.Discard, logged)
+	}()
+
+	rw := httptest.NewRecorder()
+	p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael"})
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET /socket HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nCookie: "+rw.Result().Cookies()[0].String()+"\r\n\r\n")
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get(authInfoHeader) != "" || resp.Header.Get(upstreamAddressHeader) != "" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	io.WriteString(c, "ping\n")
+	if line, err := r.ReadString('\n'); line != "echo ping\n" {
+		t.Errorf("expected the upstream's answer, got %q %v", line, err)
+	}
+	c.Close()
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, " - michael [") || !strings.Contains(line, `"/socket" HTTP/1.1 "" 101 `) {
+			t.Errorf("expected the switch to be logged, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the switch to be logged")
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Identity header modes selectable with -identity-header-mode: the values
+// as they are, encrypted with AES-GCM, or only their HMAC-SHA256
+const (
+	IdentityHeaderPlain   = "plain"
+	IdentityHeaderEncrypt = "encrypt"
+	IdentityHeaderHMAC    = "hmac"
+)
+
+var identityHeaderModes = []string{IdentityHeaderPlain, IdentityHeaderEncrypt, IdentityHeaderHMAC}
+
+// identitySealer hides the values of identity headers from whoever sits
+// between the proxy and the upstreams, leaving upstreams with the
+// identity-header-key able to decrypt them, or to compare them with the
+// HMAC of the values they expect
+type identitySealer struct {
+	aead cipher.AEAD
+	key  []byte
+}
+
+// newIdentitySealer returns the identitySealer of mode with key, or nil for
+// plain headers
+func newIdentitySealer(mode string, key []byte) (*identitySealer, error) {
+	switch mode {
+	case IdentityHeaderEncrypt:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return &identitySealer{aead: aead}, nil
+	case IdentityHeaderHMAC:
+		return &identitySealer{key: key}, nil
+	}
+	return nil, nil
+}
+
+// seal returns value as it is passed in the header name: the URL safe
+// base64 of the random nonce followed by the ciphertext, the header name
+// being the additional data so values can't be moved between headers, or of
+// the HMAC of the value
+func (s *identitySealer) seal(name, value string) (string, error) {
+	if s.aead == nil {
+		h := hmac.New(sha256.New, s.key)
+		h.Write([]byte(value))
+		return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to create nonce %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), []byte(name))), nil
+}
+
+// aesKey returns key, or what it is the base64 encoding of, if that is the
+// size of an AES key, or nil otherwise
+func aesKey(key string) []byte {
+	validSize := func(b []byte) bool { return len(b) == 16 || len(b) == 24 || len(b) == 32 }
+	if validSize([]byte(key)) {
+		return []byte(key)
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		if b, err := enc.DecodeString(key); err == nil && validSize(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+func validateIdentityHeaderMode(o *Options, msgs []string) []string {
+	o.identitySealer = nil
+	switch o.IdentityHeaderMode {
+	case IdentityHeaderPlain:
+		return msgs
+	case IdentityHeaderEncrypt, IdentityHeaderHMAC:
+	default:
+		return append(msgs, fmt.Sprintf("invalid identity-header-mode %q (must be one of %s)", o.IdentityHeaderMode, strings.Join(identityHeaderModes, ", ")))
+	}
+	if o.IdentityHeaderKey == "" {
+		return append(msgs, fmt.Sprintf("identity-header-mode %s requires identity-header-key", o.IdentityHeaderMode))
+	}
+	key := []byte(o.IdentityHeaderKey)
+	if o.IdentityHeaderMode == IdentityHeaderEncrypt {
+		key = aesKey(o.IdentityHeaderKey)
+	}
+	if key == nil {
+		msgs = append(msgs, fmt.Sprintf("identity-header-key must be 16, 24 or 32 bytes, or their base64 encoding, to create an AES cipher but is %d bytes", len(o.IdentityHeaderKey)))
+	} else if s, err := newIdentitySealer(o.IdentityHeaderMode, key); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid identity-header-key: %s", err))
+	} else {
+		o.identitySealer = s
+	}
+	if o.PassBasicAuth {
+		msgs = append(msgs, fmt.Sprintf("identity-header-mode %s requires pass-basic-auth=false, which passes the user in the clear", o.IdentityHeaderMode))
+	}
+	return msgs
+}
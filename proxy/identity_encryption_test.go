@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+)
+
+func testSealedHeaders(t *testing.T, mode, key string) *LdapProxy {
+	o := testOptions()
+	o.PassBasicAuth = false
+	o.GroupsHeaderName = "X-Forwarded-Groups"
+	o.IdentityHeaderMode, o.IdentityHeaderKey = mode, key
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewLdapProxy(o, func(string) bool { return true })
+}
+
+func TestIdentityHeaderEncrypt(t *testing.T) {
+	const key = "0123456789abcdef0123456789abcdef"
+	p := testSealedHeaders(t, IdentityHeaderEncrypt, key)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-User", "forged")
+	p.setIdentityHeaders(req, "michael", "michael@example.com", "", []string{"ops", "staff"})
+
+	block, _ := aes.NewCipher([]byte(key))
+	aead, _ := cipher.NewGCM(block)
+	open := func(name string) string {
+		b, err := base64.RawURLEncoding.DecodeString(req.Header.Get(name))
+		if err != nil || len(b) < aead.NonceSize() {
+			t.Fatalf("%s: invalid value %q", name, req.Header.Get(name))
+		}
+		plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return string(plain)
+	}
+	if user, email, groups := open("X-Forwarded-User"), open("X-Forwarded-Email"), open("X-Forwarded-Groups"); user != "michael" || email != "michael@example.com" || groups != "ops,staff" {
+		t.Errorf("unexpected headers %q %q %q", user, email, groups)
+	}
+
+	// a value can't be passed off as another header's
+	b, _ := base64.RawURLEncoding.DecodeString(req.Header.Get("X-Forwarded-Email"))
+	if _, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte("X-Forwarded-User")); err == nil {
+		t.Error("opened the email as the user")
+	}
+	other := httptest.NewRequest("GET", "/", nil)
+	p.setIdentityHeaders(other, "michael", "", "", nil)
+	if other.Header.Get("X-Forwarded-User") == req.Header.Get("X-Forwarded-User") {
+		t.Error("expected a fresh nonce for each request")
+	}
+}
+
+func TestIdentityHeaderHMAC(t *testing.T) {
+	p := testSealedHeaders(t, IdentityHeaderHMAC, "hmac-key")
+	req := httptest.NewRequest("GET", "/", nil)
+	p.setIdentityHeaders(req, "michael", "", "", nil)
+
+	h := hmac.New(sha256.New, []byte("hmac-key"))
+	h.Write([]byte("michael"))
+	if expected := base64.RawURLEncoding.EncodeToString(h.Sum(nil)); req.Header.Get("X-Forwarded-User") != expected {
+		t.Errorf("expected %q got %q", expected, req.Header.Get("X-Forwarded-User"))
+	}
+	if _, ok := req.Header["X-Forwarded-Email"]; ok {
+		t.Error("expected no email header without an email")
+	}
+}
+
+func TestValidateIdentityHeaderMode(t *testing.T) {
+	for _, configure := range []func(*Options){
+		func(o *Options) { o.IdentityHeaderMode = "rot13" },
+		func(o *Options) { o.IdentityHeaderMode = IdentityHeaderHMAC },
+		func(o *Options) { o.IdentityHeaderMode, o.IdentityHeaderKey = IdentityHeaderEncrypt, "short" },
+		func(o *Options) {
+			o.IdentityHeaderMode, o.IdentityHeaderKey = IdentityHeaderHMAC, "hmac-key"
+			o.PassBasicAuth = true
+		},
+	} {
+		o := testOptions()
+		o.PassBasicAuth = false
+		configure(o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+	}
+}
+
+func TestAESKey(t *testing.T) {
+	for key, size := range map[string]int{
+		"0123456789abcdef": 16,
+		"A3Xbr6fu6Al0HkgrP1ztjb+mYiwmxgNPP+XbNsz1WBk=": 32,
+		"A3Xbr6fu6Al0HkgrP1ztjb-mYiwmxgNPP-XbNsz1WBk=": 32,
+		"too short": 0,
+	} {
+		if got := aesKey(key); len(got) != size {
+			t.Errorf("%q: expected a %d byte key, got %d", key, size, len(got))
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// identityHeaders are the names of the request headers passing the signed in
+// user to the upstreams, empty for those which aren't passed
+type identityHeaders struct {
+	user   string
+	email  string
+	groups string
+	dn     string
+}
+
+// defaultIdentityHeaders are passed unless user-header-name,
+// email-header-name, groups-header-name or dn-header-name say otherwise
+var defaultIdentityHeaders = &identityHeaders{user: "X-Forwarded-User", email: "X-Forwarded-Email"}
+
+// validHeaderName reports whether name can be used as a header name
+func validHeaderName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t()<>@,;:\\\"/[]?={}")
+}
+
+func validateIdentityHeaders(o *Options, msgs []string) []string {
+	h := &identityHeaders{}
+	for _, f := range []struct {
+		option string
+		name   string
+		header *string
+	}{
+		{"user-header-name", o.UserHeaderName, &h.user},
+		{"email-header-name", o.EmailHeaderName, &h.email},
+		{"groups-header-name", o.GroupsHeaderName, &h.groups},
+		{"dn-header-name", o.DNHeaderName, &h.dn},
+	} {
+		if f.name == "" {
+			continue
+		}
+		if !validHeaderName(f.name) {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q", f.option, f.name))
+			continue
+		}
+		*f.header = textproto.CanonicalMIMEHeaderKey(f.name)
+	}
+	names := make(map[string]bool)
+	for _, name := range []string{h.user, h.email, h.groups, h.dn} {
+		if name != "" && names[name] {
+			msgs = append(msgs, "user-header-name, email-header-name, groups-header-name and dn-header-name must differ")
+			break
+		}
+		names[name] = true
+	}
+	o.identityHeaders = h
+	return msgs
+}
+
+// signatureHeaders returns the headers request signatures cover: those of
+// signatureHeaders, in the same order, with the identity headers h passes in
+// place of the default ones, and the groups and DN headers last
+func (h *identityHeaders) signatureHeaders() []string {
+	var headers []string
+	for _, name := range signatureHeaders {
+		switch {
+		case name == defaultIdentityHeaders.user && h.user != "":
+			name = h.user
+		case name == defaultIdentityHeaders.email && h.email != "":
+			name = h.email
+		}
+		headers = append(headers, name)
+	}
+	if h.groups != "" {
+		headers = append(headers, h.groups)
+	}
+	if h.dn != "" {
+		headers = append(headers, h.dn)
+	}
+	return headers
+}
+
+// identityHeaders returns the identity headers passed to the upstreams
+func (p *LdapProxy) identityHeaders() *identityHeaders {
+	if p.idHeaders != nil {
+		return p.idHeaders
+	}
+	return defaultIdentityHeaders
+}
+
+// setIdentityHeaders replaces any identity headers of req, which clients
+// mustn't be able to set, with those of user, email and groups, sealed with
+// the identity-header-mode. Empty values are left out.
+func (p *LdapProxy) setIdentityHeaders(req *http.Request, user, email, dn string, groups []string) {
+	h := p.identityHeaders()
+	for _, f := range []struct{ name, value string }{
+		{h.user, user},
+		{h.email, email},
+		{h.groups, strings.Join(groups, ",")},
+		{h.dn, dn},
+	} {
+		if f.name == "" {
+			continue
+		}
+		req.Header.Del(f.name)
+		if f.value == "" {
+			continue
+		}
+		value := f.value
+		if p.idSealer != nil {
+			var err error
+			if value, err = p.idSealer.seal(f.name, value); err != nil {
+				log.Printf("leaving out %s: %v", f.name, err)
+				continue
+			}
+		}
+		req.Header.Set(f.name, value)
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestValidateIdentityHeaders(t *testing.T) {
+	o := testOptions()
+	o.UserHeaderName, o.EmailHeaderName, o.GroupsHeaderName = "X-WEBAUTH-USER", "", "x-webauth-groups"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if h := o.identityHeaders; *h != (identityHeaders{user: "X-Webauth-User", groups: "X-Webauth-Groups"}) {
+		t.Errorf("unexpected headers %+v", h)
+	}
+	if err := testOptions().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	o = testOptions()
+	o.DNHeaderName = "x-forwarded-user"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "must differ") {
+		t.Errorf("expected the DN header to clash with the user header, got %v", err)
+	}
+
+	for _, names := range [][3]string{{"X User", "", ""}, {"X-User", "x-user", ""}, {"X-User", "X-Email", "X-Email"}} {
+		o := testOptions()
+		o.UserHeaderName, o.EmailHeaderName, o.GroupsHeaderName = names[0], names[1], names[2]
+		if err := o.Validate(); err == nil {
+			t.Errorf("%q: expected an error", names)
+		}
+	}
+}
+
+func TestIdentitySignatureHeaders(t *testing.T) {
+	if headers := defaultIdentityHeaders.signatureHeaders(); !reflect.DeepEqual(headers, signatureHeaders) {
+		t.Errorf("expected the default headers to be signed as before, got %v", headers)
+	}
+	h := &identityHeaders{user: "Remote-User", groups: "Remote-Groups"}
+	headers := strings.Join(h.signatureHeaders(), ",")
+	if !strings.Contains(headers, "Authorization,Remote-User,X-Forwarded-Email,") || !strings.HasSuffix(headers, ",Remote-Groups") {
+		t.Errorf("unexpected headers %s", headers)
+	}
+}
+
+func TestPassIdentityHeaders(t *testing.T) {
+	p := &LdapProxy{
+		CookieName:      "_ldap_proxy",
+		CookieSeed:      "secret",
+		CookieExpire:    time.Hour,
+		Validator:       func(string) bool { return true },
+		PassUserHeaders: true,
+		idHeaders:       &identityHeaders{user: "X-Webauth-User", groups: "X-Webauth-Groups"},
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	p.SaveSession(rw, req, &session.State{User: "michael", Email: "michael@example.com", Groups: []string{"ops", "qa"}})
+	req.AddCookie(rw.Result().Cookies()[0])
+	req.Header.Set("X-Webauth-Groups", "admins")
+
+	if status, _ := p.authenticate(httptest.NewRecorder(), req); status != http.StatusAccepted {
+		t.Fatalf("expected the session to be accepted, got %d", status)
+	}
+	if h := req.Header; h.Get("X-Webauth-User") != "michael" || h.Get("X-Webauth-Groups") != "ops,qa" || h.Get("X-Forwarded-User") != "" {
+		t.Errorf("unexpected headers %+v", h)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Webauth-Groups", "admins")
+	p.setIdentityHeaders(req, "shared", "", "", nil)
+	if h := req.Header; h.Get("X-Webauth-User") != "shared" || len(h["X-Webauth-Groups"]) != 0 {
+		t.Errorf("expected the groups a client sent to be removed, got %+v", h)
+	}
+}
+
+func TestSkipAuthIdentityHeaders(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}))
+	defer upstream.Close()
+	o := testOptions()
+	o.Upstreams = []string{upstream.URL + "/"}
+	o.SkipAuthRegex = []string{"^/public/"}
+	o.GroupsHeaderName = "X-Forwarded-Groups"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	req := httptest.NewRequest("GET", "/public/dashboard", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	req.Header.Set("X-Forwarded-Groups", "admins")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || got == nil {
+		t.Fatalf("expected the request to be proxied, got %d", rw.Code)
+	}
+	if got.Get("X-Forwarded-User") != "" || got.Get("X-Forwarded-Groups") != "" {
+		t.Errorf("expected the identity headers the client sent to be removed, got %+v", got)
+	}
+}
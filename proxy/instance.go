@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Instance header modes selectable with -instance-header-mode: where the
+// instance-header is sent
+const (
+	InstanceHeaderBoth     = "both"
+	InstanceHeaderUpstream = "upstream"
+	InstanceHeaderResponse = "response"
+)
+
+var instanceHeaderModes = []string{InstanceHeaderBoth, InstanceHeaderUpstream, InstanceHeaderResponse}
+
+// instanceIdentity names the replica handling a request to its upstream and
+// its client, so requests can be traced to one of several proxies
+type instanceIdentity struct {
+	name string
+	// header, when set, is sent with value, the name and version of the
+	// proxy, to the upstreams and, or, in responses
+	header   string
+	value    string
+	upstream bool
+	response bool
+	// queryParam, when set, is added to the query string of requests to
+	// the upstreams, with the name
+	queryParam string
+}
+
+// setResponseHeader names the instance in the response to a request
+func (i *instanceIdentity) setResponseHeader(rw http.ResponseWriter) {
+	if i != nil && i.response {
+		rw.Header().Set(i.header, i.value)
+	}
+}
+
+// upstreamRequest returns req naming the instance to the upstream, replacing
+// any instance-header the client sent
+func (i *instanceIdentity) upstreamRequest(req *http.Request) *http.Request {
+	if i == nil {
+		return req
+	}
+	if i.upstream {
+		req.Header.Set(i.header, i.value)
+	}
+	if i.queryParam == "" {
+		return req
+	}
+	param := url.QueryEscape(i.queryParam) + "=" + url.QueryEscape(i.name)
+	u := *req.URL
+	r := *req
+	r.URL = &u
+	// the request URI is passed on as it is, so the parameter is appended
+	// to it rather than made part of a re-encoded one
+	switch {
+	case u.RawQuery == "" && !strings.HasSuffix(r.RequestURI, "?"):
+		u.RawQuery = param
+		r.RequestURI += "?" + param
+	case u.RawQuery == "":
+		u.RawQuery, u.ForceQuery = param, false
+		r.RequestURI += param
+	default:
+		u.RawQuery += "&" + param
+		r.RequestURI += "&" + param
+	}
+	return &r
+}
+
+func validateInstance(o *Options, msgs []string) []string {
+	o.instance = nil
+	if o.InstanceHeader == "" && o.InstanceQueryParam == "" {
+		return msgs
+	}
+	i := &instanceIdentity{name: o.InstanceName, queryParam: o.InstanceQueryParam}
+	if i.name == "" {
+		var err error
+		if i.name, err = os.Hostname(); err != nil {
+			return append(msgs, fmt.Sprintf("instance-name is required as the hostname can't be read: %s", err))
+		}
+	}
+	if strings.IndexFunc(i.name, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid instance-name %q", i.name))
+	}
+	if o.InstanceHeader != "" {
+		if !validHeaderName(o.InstanceHeader) {
+			msgs = append(msgs, fmt.Sprintf("invalid instance-header %q", o.InstanceHeader))
+		}
+		i.header = http.CanonicalHeaderKey(o.InstanceHeader)
+		i.value = fmt.Sprintf("%s ldap_proxy/%s", i.name, VERSION)
+		switch o.InstanceHeaderMode {
+		case InstanceHeaderBoth:
+			i.upstream, i.response = true, true
+		case InstanceHeaderUpstream:
+			i.upstream = true
+		case InstanceHeaderResponse:
+			i.response = true
+		default:
+			msgs = append(msgs, fmt.Sprintf("invalid instance-header-mode %q (must be one of %s)", o.InstanceHeaderMode, strings.Join(instanceHeaderModes, ", ")))
+		}
+	}
+	o.instance = i
+	return msgs
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateInstance(t *testing.T) {
+	o := testOptions()
+	if err := o.Validate(); err != nil || o.instance != nil {
+		t.Fatalf("expected no instance identity by default, got %+v %v", o.instance, err)
+	}
+
+	o = testOptions()
+	o.InstanceHeader = "x-lap-instance"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if i := o.instance; i.header != "X-Lap-Instance" || i.value != hostname+" ldap_proxy/"+VERSION || !i.upstream || !i.response {
+		t.Errorf("unexpected instance identity %+v", i)
+	}
+
+	for _, configure := range []func(o *Options){
+		func(o *Options) { o.InstanceHeader = "X Instance" },
+		func(o *Options) { o.InstanceHeader, o.InstanceHeaderMode = "X-Instance", "request" },
+		func(o *Options) { o.InstanceQueryParam, o.InstanceName = "instance", "lap\n1" },
+	} {
+		o := testOptions()
+		configure(o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", o.instance)
+		}
+	}
+}
+
+func TestInstanceIdentity(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req
+	}))
+	defer upstream.Close()
+
+	for _, tC := range []struct {
+		mode               string
+		upstream, response bool
+	}{
+		{InstanceHeaderBoth, true, true},
+		{InstanceHeaderUpstream, true, false},
+		{InstanceHeaderResponse, false, true},
+	} {
+		o := testOptions()
+		o.Upstreams = []string{upstream.URL + "/"}
+		o.SkipAuthRegex = []string{"^/"}
+		o.InstanceName, o.InstanceHeader, o.InstanceHeaderMode = "lap-2", "X-LAP-Instance", tC.mode
+		o.InstanceQueryParam = "lap_instance"
+		if err := o.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		p := NewLdapProxy(o, func(string) bool { return true })
+
+		for uri, expected := range map[string]string{
+			"/a%2Fb":     "/a%2Fb?lap_instance=lap-2",
+			"/a?":        "/a?lap_instance=lap-2",
+			"/a?q=1&r=2": "/a?q=1&r=2&lap_instance=lap-2",
+		} {
+			req := httptest.NewRequest("GET", uri, nil)
+			req.Header.Set("X-LAP-Instance", "forged")
+			rw := httptest.NewRecorder()
+			p.ServeHTTP(rw, req)
+			if got.RequestURI != expected {
+				t.Errorf("%s %s: expected the upstream to get %s, got %s", tC.mode, uri, expected, got.RequestURI)
+			}
+			header := "lap-2 ldap_proxy/" + VERSION
+			if h := got.Header.Get("X-LAP-Instance"); tC.upstream && h != header || !tC.upstream && h != "forged" {
+				t.Errorf("%s: unexpected upstream instance header %q", tC.mode, h)
+			}
+			if h := rw.Header().Get("X-LAP-Instance"); tC.response != (h == header) {
+				t.Errorf("%s: unexpected response instance header %q", tC.mode, h)
+			}
+		}
+	}
+
+	// the proxy's own responses name the instance too
+	o := testOptions()
+	o.InstanceName, o.InstanceHeader = "lap-2", "X-LAP-Instance"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", p.SignInPath, nil))
+	if h := rw.Header().Get("X-LAP-Instance"); !strings.HasPrefix(h, "lap-2 ") {
+		t.Errorf("expected the sign-in page to name the instance, got %q", h)
+	}
+}
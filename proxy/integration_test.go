@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldaptest"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// testIntegration runs the whole proxy against an in-process directory and
+// an upstream echoing the user it receives
+func testIntegration(t *testing.T, configure func(*Options)) (*LdapProxy, func()) {
+	dir, err := ldaptest.NewServer(&ldaptest.Directory{
+		BaseDN:       "dc=example,dc=com",
+		BindDN:       "cn=ldap_proxy,dc=example,dc=com",
+		BindPassword: "bind-secret",
+		Users: []*ldaptest.User{
+			{UID: "michael", Password: "secret", Mail: "michael@example.com", Groups: []string{"ops"}},
+			{UID: "anna", Password: "hunter2", Groups: []string{"sales"}, Attributes: map[string]string{"sessionTimeout": "3600"}},
+		},
+		Groups: []*ldaptest.Group{{CN: "staff"}, {CN: "ops", Groups: []string{"staff"}}, {CN: "sales"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%s %s", req.URL.Path, req.Header.Get("X-Forwarded-User"))
+	}))
+
+	o := testOptions()
+	o.CookieSecret = "0123456789abcdef0123456789abcdef"
+	o.Upstreams = []string{upstream.URL + "/"}
+	o.LdapServerHost, o.LdapServerPort = dir.Host(), dir.Port()
+	o.LdapBaseDn = dir.Directory.BaseDN
+	o.LdapBindDn, o.LdapBindDnPassword = dir.Directory.BindDN, dir.Directory.BindPassword
+	o.LdapGroups = []string{"staff"}
+	o.LdapRetries = 0
+	if configure != nil {
+		configure(o)
+	}
+	p, err := New(o)
+	if err != nil {
+		dir.Close()
+		upstream.Close()
+		t.Fatal(err)
+	}
+	return p, func() {
+		dir.Close()
+		upstream.Close()
+	}
+}
+
+// integrationSignIn signs in through the sign-in form, returning the
+// response
+func integrationSignIn(p *LdapProxy, username, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(url.Values{"username": {username}, "password": {password}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	return rw
+}
+
+func integrationGet(p *LdapProxy, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestIntegrationSignIn(t *testing.T) {
+	p, done := testIntegration(t, nil)
+	defer done()
+
+	rw := integrationSignIn(p, "michael", "secret")
+	if rw.Code != http.StatusFound {
+		t.Fatalf("expected the sign-in to succeed, got %d %s", rw.Code, rw.Body)
+	}
+	cookies := rw.Result().Cookies()
+
+	rw = integrationGet(p, "/reports/", cookies...)
+	if rw.Code != http.StatusOK || rw.Body.String() != "/reports/ michael" {
+		t.Errorf("expected the upstream to get the user, got %d %q", rw.Code, rw.Body)
+	}
+	if rw := integrationGet(p, "/reports/"); rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "password") {
+		t.Errorf("expected the sign-in page without a session, got %d", rw.Code)
+	}
+	if rw := integrationSignIn(p, "michael", "wrong"); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "Invalid Credentials") {
+		t.Errorf("expected a wrong password to be rejected, got %d %s", rw.Code, rw.Body)
+	}
+}
+
+func TestIntegrationRequiredGroups(t *testing.T) {
+	p, done := testIntegration(t, nil)
+	defer done()
+
+	// anna isn't in staff, michael is through ops
+	if rw := integrationSignIn(p, "anna", "hunter2"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected anna to be refused, got %d", rw.Code)
+	}
+	if rw := integrationSignIn(p, "michael", "secret"); rw.Code != http.StatusFound {
+		t.Errorf("expected nested membership to be allowed, got %d", rw.Code)
+	}
+}
+
+func TestIntegrationUpstreamGroups(t *testing.T) {
+	p, done := testIntegration(t, func(o *Options) {
+		o.LdapGroups = nil
+		o.Upstreams = append(o.Upstreams, "static://200/sales/ groups=sales")
+	})
+	defer done()
+
+	rw := integrationSignIn(p, "michael", "secret")
+	if rw.Code != http.StatusFound {
+		t.Fatalf("expected the sign-in to succeed, got %d", rw.Code)
+	}
+	rw = integrationGet(p, "/sales/", rw.Result().Cookies()...)
+	if rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "<b>sales</b>") {
+		t.Errorf("expected the access denied page, got %d %s", rw.Code, rw.Body)
+	}
+
+	rw = integrationSignIn(p, "anna", "hunter2")
+	if rw := integrationGet(p, "/sales/", rw.Result().Cookies()...); rw.Code != http.StatusOK {
+		t.Errorf("expected anna through, got %d", rw.Code)
+	}
+}
+
+func TestIntegrationAuthHeaders(t *testing.T) {
+	p, done := testIntegration(t, func(o *Options) {
+		o.AuthResponseHeaders = []string{"X-User:user", "X-Groups:groups"}
+	})
+	defer done()
+
+	rw := integrationSignIn(p, "michael", "secret")
+	rw = integrationGet(p, "/ldap/auth", rw.Result().Cookies()...)
+	if rw.Code != http.StatusAccepted || rw.Header().Get("X-User") != "michael" || !strings.Contains(rw.Header().Get("X-Groups"), "ops") {
+		t.Errorf("unexpected auth response %d %+v", rw.Code, rw.Header())
+	}
+}
+
+func TestIntegrationCookieRefresh(t *testing.T) {
+	p, done := testIntegration(t, func(o *Options) {
+		o.CookieRefresh = time.Minute
+	})
+	defer done()
+
+	rw := integrationSignIn(p, "michael", "secret")
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	s, _, err := p.LoadCookiedSession(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := session.CookieForSession(s, p.CookieCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := p.MakeSessionCookie(req, value, p.CookieExpire, time.Now().Add(-2*time.Minute))
+
+	rw = integrationGet(p, "/reports/", old)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected the old session to be accepted, got %d", rw.Code)
+	}
+	if refreshed := rw.Result().Cookies(); len(refreshed) == 0 || refreshed[0].Value == old.Value {
+		t.Errorf("expected the session cookie to be refreshed, got %+v", refreshed)
+	}
+}
+
+func TestIntegrationDeferredGroups(t *testing.T) {
+	p, done := testIntegration(t, func(o *Options) {
+		o.SessionStore = SessionStoreMemory
+		o.LdapDeferGroups = true
+		o.LdapDeferGroupsRequire = []string{"^/ops/"}
+		o.Upstreams = append(o.Upstreams, "static://200/ops/ groups=ops")
+	})
+	defer done()
+
+	// the groups of a deferred sign-in are waited for where they matter
+	rw := integrationSignIn(p, "michael", "secret")
+	if rw.Code != http.StatusFound {
+		t.Fatalf("expected the sign-in to succeed, got %d %s", rw.Code, rw.Body)
+	}
+	cookies := rw.Result().Cookies()
+	if rw := integrationGet(p, "/ops/", cookies...); rw.Code != http.StatusOK {
+		t.Errorf("expected michael to be let through once his groups arrived, got %d", rw.Code)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	if s, _, err := p.LoadCookiedSession(req); err != nil || s.GroupsPending || len(s.Groups) != 2 {
+		t.Errorf("expected the groups saved into the session, got %+v %v", s, err)
+	}
+
+	// anna isn't in staff, so her sign-in is ended once that is known
+	rw = integrationSignIn(p, "anna", "hunter2")
+	if rw.Code != http.StatusFound {
+		t.Fatalf("expected the sign-in to be accepted before the groups are known, got %d", rw.Code)
+	}
+	cookies = rw.Result().Cookies()
+	if rw := integrationGet(p, "/ops/", cookies...); rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "password") {
+		t.Errorf("expected anna to be signed out, got %d", rw.Code)
+	}
+	if rw := integrationGet(p, "/reports/", cookies...); rw.Code != http.StatusForbidden {
+		t.Errorf("expected anna's session to be gone, got %d", rw.Code)
+	}
+}
+
+func TestValidateDeferredGroups(t *testing.T) {
+	for _, configure := range []func(*Options){
+		func(o *Options) { o.LdapDeferGroups = true },
+		func(o *Options) { o.LdapDeferGroupsRequire = []string{"^/admin/"} },
+		func(o *Options) {
+			o.LdapDeferGroups, o.SessionStore = true, SessionStoreMemory
+			o.LdapDeferGroupsRequire = []string{"("}
+		},
+	} {
+		o := testOptions()
+		configure(o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+	}
+}
+
+func TestIntegrationCanonicalUsername(t *testing.T) {
+	p, done := testIntegration(t, nil)
+	rw := integrationSignIn(p, "MICHAEL", "secret")
+	if rw := integrationGet(p, "/reports/", rw.Result().Cookies()...); rw.Body.String() != "/reports/ MICHAEL" {
+		t.Errorf("expected the username as typed without ldap-canonical-username, got %q", rw.Body)
+	}
+	done()
+
+	p, done = testIntegration(t, func(o *Options) {
+		o.LdapCanonicalUsername = true
+		o.DNHeaderName = "X-Forwarded-User-DN"
+		o.Upstreams = append(o.Upstreams, "static://echo/echo/")
+	})
+	defer done()
+
+	rw = integrationSignIn(p, "MICHAEL", "secret")
+	if rw.Code != http.StatusFound {
+		t.Fatalf("expected the sign-in to succeed, got %d %s", rw.Code, rw.Body)
+	}
+	cookies := rw.Result().Cookies()
+	if rw := integrationGet(p, "/reports/", cookies...); rw.Body.String() != "/reports/ michael" {
+		t.Errorf("expected the directory's uid as the username, got %q", rw.Body)
+	}
+	if rw := integrationGet(p, "/echo/", cookies...); !strings.Contains(rw.Body.String(), "X-Forwarded-User-Dn: uid=michael,ou=people,dc=example,dc=com\r\n") {
+		t.Errorf("expected the DN to be passed, got %s", rw.Body)
+	}
+}
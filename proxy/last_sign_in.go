@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// signInRecord is when and where a user last signed in, and how many
+// sign-ins with their username, or the other names they signed in with,
+// failed since
+type signInRecord struct {
+	Time   time.Time `json:"time"`
+	IP     string    `json:"ip,omitempty"`
+	Failed int       `json:"failed_sign_ins,omitempty"`
+	Logins []string  `json:"logins,omitempty"`
+}
+
+// LastSignIns remembers each user's latest successful sign-in, so a new
+// session can tell the user about the previous one ("last signed in from
+// ..."), and counts the failed sign-ins after it. The sign-ins are kept in
+// File, if set, which is written in the background as they change, else
+// until the process exits.
+type LastSignIns struct {
+	File string
+	// WarnFailed shows users who sign in after failed attempts a page
+	// saying how many there were before sending them on
+	WarnFailed bool
+
+	mu      sync.Mutex
+	byUser  map[string]*signInRecord
+	byLogin map[string]string // the users other names signed in as
+
+	saveMu  sync.Mutex
+	pending chan struct{}
+}
+
+// newLastSignIns returns the LastSignIns configured in opts, or nil if
+// sign-ins aren't recorded
+func newLastSignIns(opts *Options) *LastSignIns {
+	if !opts.RecordLastSignIn {
+		return nil
+	}
+	l := &LastSignIns{File: opts.LastSignInFile, WarnFailed: opts.WarnFailedSignIns}
+	if err := l.load(); err != nil {
+		log.Printf("failed to read last sign-ins from %s: %v", l.File, err)
+	}
+	return l
+}
+
+// load reads the sign-ins from File and starts saving their changes to it
+func (l *LastSignIns) load() error {
+	l.byUser, l.byLogin = make(map[string]*signInRecord), make(map[string]string)
+	if l.File == "" {
+		return nil
+	}
+	l.pending = make(chan struct{}, 1)
+	go l.saveChanges()
+	b, err := ioutil.ReadFile(l.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &l.byUser); err != nil {
+		return err
+	}
+	for user, r := range l.byUser {
+		for _, login := range r.Logins {
+			l.byLogin[login] = user
+		}
+	}
+	return nil
+}
+
+// changed has the sign-ins saved. l.mu must be held.
+func (l *LastSignIns) changed() {
+	if l.pending == nil {
+		return
+	}
+	select {
+	case l.pending <- struct{}{}:
+	default:
+		// a save is already due, which will include this change
+	}
+}
+
+// saveChanges saves the sign-ins whenever they changed, so their changes
+// made while a save is in progress are saved together after it
+func (l *LastSignIns) saveChanges() {
+	for range l.pending {
+		if err := l.save(); err != nil {
+			log.Printf("failed to save last sign-ins to %s: %v", l.File, err)
+		}
+	}
+}
+
+// save writes the sign-ins to File, replacing it atomically
+func (l *LastSignIns) save() error {
+	if l.File == "" {
+		return nil
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	b, err := json.Marshal(l.byUser)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := l.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.File)
+}
+
+// record replaces user's last sign-in, made as login, with one at t from
+// ip, returning the one it replaced, or nil on the user's first sign-in
+func (l *LastSignIns) record(user, login, ip string, t time.Time) *signInRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	previous := l.byUser[user]
+	r := &signInRecord{Time: t.UTC(), IP: ip}
+	if previous != nil {
+		r.Logins = previous.Logins
+	}
+	if login != "" && login != user && l.byLogin[login] != user {
+		r.Logins = append(r.Logins[:len(r.Logins):len(r.Logins)], login)
+		l.byLogin[login] = user
+	}
+	l.byUser[user] = r
+	l.changed()
+	return previous
+}
+
+// recordFailure counts a failed sign-in as login against the user who
+// signed in as it before. Only users who signed in before are counted, so
+// guessed usernames don't fill the records.
+func (l *LastSignIns) recordFailure(login string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	user := login
+	if u, ok := l.byLogin[login]; ok {
+		user = u
+	}
+	r := l.byUser[user]
+	if r == nil {
+		return
+	}
+	r.Failed++
+	l.changed()
+}
+
+// recordSignIn records the sign-in starting session, keeping the user's
+// previous one, and the failed sign-ins since, in it
+func (p *LdapProxy) recordSignIn(s *session.State) {
+	if p.LastSignIns == nil {
+		return
+	}
+	if previous := p.LastSignIns.record(s.User, s.Login, s.IP, s.CreatedAt); previous != nil {
+		s.PreviousSignInAt, s.PreviousSignInIP = previous.Time, previous.IP
+		s.FailedSignIns = previous.Failed
+	}
+}
+
+// recordSignInFailure counts the sign-in of username which failed for
+// reason against the next sign-in of the user who signed in as username.
+// Sign-ins failing because the directory couldn't be asked say nothing
+// about the password and aren't counted.
+func (p *LdapProxy) recordSignInFailure(username, reason string) {
+	if p.LastSignIns == nil || reason == SignInDirectoryUnavailable || reason == SignInBusy {
+		return
+	}
+	p.LastSignIns.recordFailure(username)
+}
+
+// failedSignInsPage tells the user who started session how many sign-ins
+// failed since their previous one, linking on to redirect
+func (p *LdapProxy) failedSignInsPage(rw http.ResponseWriter, s *session.State, redirect string) {
+	t := struct {
+		Title            string
+		User             string
+		FailedSignIns    int
+		PreviousSignInAt time.Time
+		PreviousSignInIP string
+		Redirect         string
+		ProxyPrefix      string
+	}{
+		Title:            "Failed Sign-in Attempts",
+		User:             s.User,
+		FailedSignIns:    s.FailedSignIns,
+		PreviousSignInAt: s.PreviousSignInAt.UTC(),
+		PreviousSignInIP: s.PreviousSignInIP,
+		Redirect:         redirect,
+		ProxyPrefix:      p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, failedSignInsTemplateName, t)
+}
+
+// userInfo is the JSON served at UserInfoPath
+type userInfo struct {
+	User           string        `json:"user"`
+	Email          string        `json:"email,omitempty"`
+	Groups         []string      `json:"groups,omitempty"`
+	PreviousSignIn *signInRecord `json:"previous_sign_in,omitempty"`
+}
+
+// UserInfo describes the signed in user, with their previous sign-in when
+// record-last-sign-in is set
+func (p *LdapProxy) UserInfo(rw http.ResponseWriter, req *http.Request) {
+	status, s := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	info := &userInfo{User: s.User, Email: s.Email, Groups: s.Groups}
+	if !s.PreviousSignInAt.IsZero() {
+		info.PreviousSignIn = &signInRecord{Time: s.PreviousSignInAt.UTC(), IP: s.PreviousSignInIP, Failed: s.FailedSignIns}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(info)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLastSignInsRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "last_sign_in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &LastSignIns{File: filepath.Join(dir, "last_sign_ins.json")}
+	l.load()
+
+	first := time.Date(2026, 10, 12, 8, 30, 0, 0, time.UTC)
+	if previous := l.record("michael", "", "10.1.2.3", first); previous != nil {
+		t.Errorf("expected no previous sign-in, got %+v", previous)
+	}
+	l.record("michael", "", "10.4.5.6", first.Add(time.Hour))
+	if err := l.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &LastSignIns{File: l.File}
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	previous := reloaded.record("michael", "", "10.7.8.9", first.Add(2*time.Hour))
+	if previous == nil || previous.IP != "10.4.5.6" || !previous.Time.Equal(first.Add(time.Hour)) {
+		t.Errorf("expected the saved sign-in, got %+v", previous)
+	}
+}
+
+func TestLastSignInsFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "last_sign_in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &LastSignIns{File: filepath.Join(dir, "last_sign_ins.json")}
+	l.load()
+
+	first := time.Date(2026, 10, 12, 8, 30, 0, 0, time.UTC)
+	l.recordFailure("michael")
+	l.recordFailure("mallory")
+	l.record("michael", "", "10.1.2.3", first)
+	l.recordFailure("michael")
+	l.recordFailure("michael")
+	if _, ok := l.byUser["mallory"]; ok {
+		t.Error("expected the failures of a user who never signed in not to be recorded")
+	}
+	if err := l.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &LastSignIns{File: l.File}
+	reloaded.load()
+	if previous := reloaded.record("michael", "", "10.4.5.6", first.Add(time.Hour)); previous == nil || previous.Failed != 2 {
+		t.Errorf("expected 2 failures since the first sign-in, got %+v", previous)
+	}
+	if previous := reloaded.record("michael", "", "10.4.5.6", first.Add(2*time.Hour)); previous.Failed != 0 {
+		t.Errorf("expected the failures to be reset by signing in, got %d", previous.Failed)
+	}
+}
+
+func TestLastSignInsLogins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "last_sign_in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &LastSignIns{File: filepath.Join(dir, "last_sign_ins.json")}
+	l.load()
+
+	first := time.Date(2026, 10, 12, 8, 30, 0, 0, time.UTC)
+	l.record("michael", "michael@example.com", "10.1.2.3", first)
+	l.record("michael", "michael@example.com", "10.1.2.3", first.Add(time.Hour))
+	if r := l.byUser["michael"]; len(r.Logins) != 1 {
+		t.Errorf("expected the login to be recorded once, got %+v", r)
+	}
+	l.recordFailure("michael@example.com")
+	if err := l.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &LastSignIns{File: l.File}
+	reloaded.load()
+	reloaded.recordFailure("michael@example.com")
+	if previous := reloaded.record("michael", "", "10.4.5.6", first.Add(2*time.Hour)); previous == nil || previous.Failed != 2 {
+		t.Errorf("expected the failures signing in as michael@example.com to count for michael, got %+v", previous)
+	}
+	if _, ok := reloaded.byUser["michael@example.com"]; ok {
+		t.Error("expected no record of the login")
+	}
+}
+
+func TestWarnFailedSignIns(t *testing.T) {
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "michael", password: "secret"})
+	p.LastSignIns = &LastSignIns{WarnFailed: true}
+	p.LastSignIns.load()
+	signIn := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader("username=michael&password="+password+"&rd=/app/"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		p.SignIn(rw, req)
+		return rw
+	}
+
+	if rw := signIn("secret"); rw.Code != http.StatusFound {
+		t.Fatalf("expected the first sign-in to redirect, got %d", rw.Code)
+	}
+	signIn("guess1")
+	signIn("guess2")
+	rw := signIn("secret")
+	body := rw.Body.String()
+	if rw.Code != http.StatusOK || !strings.Contains(body, "2 failed sign-in attempts") || !strings.Contains(body, `<a href="/app/">Continue</a>`) {
+		t.Errorf("expected the failed sign-ins to be shown, got %d %s", rw.Code, body)
+	}
+	if len(rw.Result().Cookies()) == 0 {
+		t.Error("expected the session to be started")
+	}
+	if rw := signIn("secret"); rw.Code != http.StatusFound {
+		t.Errorf("expected a sign-in without failures to redirect, got %d", rw.Code)
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "michael", password: "secret"})
+	p.LastSignIns = &LastSignIns{}
+	p.LastSignIns.load()
+	userInfo := func(rw *httptest.ResponseRecorder) (int, *userInfo) {
+		req := httptest.NewRequest("GET", "/ldap/userinfo", nil)
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		resp := httptest.NewRecorder()
+		p.UserInfo(resp, req)
+		info := &userInfo{}
+		json.NewDecoder(resp.Body).Decode(info)
+		return resp.Code, info
+	}
+
+	first, _ := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	if code, info := userInfo(first); code != http.StatusOK || info.User != "michael" || info.PreviousSignIn != nil {
+		t.Errorf("first sign-in: got %d %+v", code, info)
+	}
+	second, _ := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	code, info := userInfo(second)
+	if code != http.StatusOK || info.PreviousSignIn == nil || info.PreviousSignIn.IP != "192.0.2.1" {
+		t.Errorf("second sign-in: got %d %+v", code, info)
+	}
+
+	if code, _ := userInfo(httptest.NewRecorder()); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", code)
+	}
+}
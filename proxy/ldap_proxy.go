@@ -0,0 +1,1282 @@
+// Package proxy implements a reverse proxy which authenticates requests with
+// LDAP. It can be embedded in other Go services:
+//
+//	opts := proxy.NewOptions()
+//	// set opts.Upstreams, opts.CookieSecret, opts.LdapServerHost...
+//	p, err := proxy.New(opts)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.ListenAndServe(":4180", p)
+package proxy
+
+import (
+	"context"
+	b64 "encoding/base64"
+
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/18F/hmacauth"
+	"github.com/skybet/ldap_proxy/cookie"
+	"github.com/skybet/ldap_proxy/geoip"
+	"github.com/skybet/ldap_proxy/ldapauth"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+const signatureHeader = "LAP-Signature"
+
+var signatureHeaders = []string{
+	"Content-Length",
+	"Content-Md5",
+	"Content-Type",
+	"Date",
+	"Authorization",
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Access-Token",
+	"Cookie",
+	"Lap-Auth",
+}
+
+// LdapProxy represents a reverse proxy with LDAP auth
+type LdapProxy struct {
+	CookieSeed     string
+	CookieName     string
+	CSRFCookieName string
+	CookieDomain   string
+	CookiePath     string
+	CookieSecure   bool
+	CookieHTTPOnly bool
+	CookieExpire   time.Duration
+	CookieRefresh  time.Duration
+	CookieHash     cookie.Hash   // signs new cookies
+	cookieHashes   []cookie.Hash // are accepted when validating cookies
+	Validator      func(string) bool
+
+	// CookieSecureAuto sets Secure only on cookies for HTTPS requests,
+	// overriding CookieSecure
+	CookieSecureAuto bool
+
+	// CookieClockSkew is how far the clocks of the instances signing and
+	// validating cookies may disagree
+	CookieClockSkew time.Duration
+	clockSkew       clockSkewLog
+
+	// publicSuffixes scope cookies to the registrable domain of the request
+	// host when CookieDomain is empty
+	publicSuffixes *publicSuffixList
+
+	// LoginHost, when set, is the only host the sign-in page is served on;
+	// clients must sign in on it for the others, sharing its session cookie
+	LoginHost string
+
+	// SessionBearer accepts the session cookie's value in an Authorization:
+	// Bearer header, for clients without cookies
+	SessionBearer bool
+
+	// MaxRequestCookies, when not 0, is the most cookies a request may
+	// carry
+	MaxRequestCookies int
+
+	// sessionExpireRules and the users' sessionExpireAttr make some
+	// sessions last less than CookieExpire
+	sessionExpireRules []*sessionExpireRule
+	sessionExpireAttr  string
+
+	// ldapLoginAttr is the attribute of directory users their username is
+	// replaced with at sign-in, if any
+	ldapLoginAttr string
+
+	StreamingExpiryPolicy string
+	StreamingExpiryGrace  time.Duration
+
+	// ShareLinkMaxTTL is the longest a share link may be valid for; 0
+	// disables share links
+	ShareLinkMaxTTL time.Duration
+
+	// BypassTokenMaxTTL is the longest a bypass token minted by AdminUsers
+	// may be valid for; 0 disables bypass tokens
+	BypassTokenMaxTTL time.Duration
+
+	// AuthEndpointBasic makes AuthenticateOnly validate Basic credentials
+	// against the authenticators when there is no session
+	AuthEndpointBasic bool
+	basicAuthCache    *basicAuthCache
+
+	// authCache remembers the responses of AuthenticateOnly for a moment
+	authCache *authCache
+
+	// signInLoops, when set, catches clients sent to sign in over and over
+	signInLoops *signInLoops
+	// signInAgents, when set, refuses the sign-in page to some User-Agents
+	signInAgents *signInAgents
+
+	// reauthHeader, when set, is the header of upstream responses which
+	// signs the user out when set to true
+	reauthHeader string
+
+	// sessionLimit, when set, is how many sessions a user may have
+	// in the SessionStore, the oldest being signed out at sign-in past it
+	sessionLimit int
+
+	// deferGroups signs users in before their groups are looked up, which
+	// requests for paths matching groupsRequired wait for
+	deferGroups    bool
+	groupsRequired []*regexp.Regexp
+
+	// bindLimit bounds the concurrent sign-ins checked by LDAPAuthenticators
+	bindLimit *bindLimiter
+
+	// AdminUsers may change the skip-auth rules at AdminPath. The changes
+	// are saved to ConfigFile if PersistSkipAuth is set.
+	AdminUsers      []string
+	ConfigFile      string
+	PersistSkipAuth bool
+	adminMu         sync.Mutex
+	// Reload, if set, reloads the configuration for AdminUsers at
+	// ReloadPath, returning what changed
+	Reload func() ([]string, error)
+
+	RobotsPath   string
+	PingPath     string
+	SignInPath   string
+	SignOutPath  string
+	AuthOnlyPath string
+	SharePath    string
+	AdminPath    string
+	AccessPath   string
+	SimulatePath string
+	ReloadPath   string
+	BypassPath   string
+	EventsPath   string
+	AssetsPath   string
+	SessionsPath string
+	UserInfoPath string
+
+	ProxyPrefix     string
+	PrefixAliases   []string
+	passPrefix      bool // pass unknown paths under ProxyPrefix to the upstreams rather than responding 404
+	SignInMessage   string
+	SignInBanner    string
+	LandingPage     bool // lists the upstreams the user may use at /
+	HtpasswdFile    *HtpasswdFile
+	Authenticators  []Authenticator
+	loginRules      []*loginRule // rewrite usernames before they are authenticated
+	serveMux        http.Handler
+	upstreams       []*url.URL
+	upstreamOptions []*UpstreamOptions
+	dynamic         *DynamicUpstreams // serves the upstreams instead of serveMux when set
+	SetXAuthRequest bool
+	authHeaders     []*authResponseHeader // replace the headers of SetXAuthRequest and AuthEndpointBasic when set
+	PassBasicAuth   bool
+
+	PassUserHeaders   bool
+	PassAccessToken   bool
+	BasicAuthPassword string
+	idHeaders         *identityHeaders  // pass the user under other names than X-Forwarded-User and X-Forwarded-Email when set
+	idSealer          *identitySealer   // encrypts or hashes the identity headers when set
+	instance          *instanceIdentity // names this instance to upstreams and clients when set
+
+	RealIPHeader   string
+	ProxyIPHeader  string
+	TrustedProxies []*net.IPNet
+	geoIP          *geoip.Reader // looks up the countries of clients when set
+
+	LdapConfiguration *ldapauth.Config
+	LdapScopeName     string
+	LdapGroups        []string
+	GroupMatcher      *ldapauth.GroupMatcher
+	GroupMembership   *ldapauth.MembershipCache
+	Realms            []*Realm
+	membersOf         func(group string) ([]string, error) // replaces the directory in tests
+	groupsOf          func(user string) ([]string, error)  // likewise
+
+	NewDevices        *NewDeviceNotifier
+	LastSignIns       *LastSignIns
+	Events            *EventWebhook
+	eventStream       *eventStream // passes the events on to AdminUsers at EventsPath
+	Authz             *AuthzWebhook
+	CookieCipher      *cookie.Cipher
+	SessionStore      session.Store
+	refreshes         *refreshGroup
+	skipAuthRegex     []string
+	skipAuthNamed     []*SkipAuthRule
+	skipAuthMu        sync.RWMutex // guards skipAuthIPs and compiledPathRegex
+	routesByGroup     bool
+	skipAuthIPs       []*net.IPNet
+	skipAuthPreflight bool
+	skipAuthOptions   bool
+	CORS              *CORSPolicy
+	ACL               *ACL
+	compiledPathRegex []*regexp.Regexp
+	templates         *template.Template
+	assets            http.Handler // the custom templates' assets directory, served at AssetsPath
+	Footer            string
+	AuditLogger       *log.Logger
+}
+
+// New validates opts and returns an LdapProxy ready to serve requests,
+// including the email validator and htpasswd file configured in opts
+func New(opts *Options) (*LdapProxy, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	p := NewLdapProxy(opts, validator)
+	auditLogger, err := newTargetAuditLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+	p.AuditLogger = auditLogger
+
+	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
+		if len(opts.EmailDomains) > 1 {
+			p.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
+		} else if opts.EmailDomains[0] != "*" {
+			p.SignInMessage = fmt.Sprintf("Authenticate using %v", opts.EmailDomains[0])
+		}
+	}
+
+	if opts.HtpasswdFile != "" {
+		log.Printf("using htpasswd file %s", opts.HtpasswdFile)
+		var err error
+		p.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s %s", opts.HtpasswdFile, err)
+		}
+	}
+	if opts.LdapBindDnPasswordFile != "" {
+		if _, err := p.LdapConfiguration.ReloadBindPassword(); err != nil {
+			return nil, fmt.Errorf("unable to read %s %s", opts.LdapBindDnPasswordFile, err)
+		}
+	}
+	if d := p.LdapConfiguration.Discovery; d != nil {
+		go d.Run(opts.LdapServerDiscoveryRefresh, nil)
+	}
+	if opts.LdapGroupCacheRefresh > 0 && len(opts.LdapGroups) > 0 {
+		cache, err := ldapauth.NewMembershipCache(p.LdapConfiguration, p.groupMatcher())
+		if err != nil {
+			return nil, err
+		}
+		p.GroupMembership = cache
+		go cache.Run(opts.LdapGroupCacheRefresh, nil)
+	}
+	for i, r := range p.Realms {
+		ro := opts.realms[i].opts
+		log.Printf("ldap-realm %s: %s base dn %s", r.Name, ldapServer(ro), ro.LdapBaseDn)
+		a := r.Authenticator.(*LDAPAuthenticator)
+		cfg := a.Config
+		if ro.LdapBindDnPasswordFile != "" {
+			if _, err := cfg.ReloadBindPassword(); err != nil {
+				return nil, fmt.Errorf("ldap-realm %s: unable to read %s %s", r.Name, ro.LdapBindDnPasswordFile, err)
+			}
+		}
+		if cfg.Discovery != nil {
+			go cfg.Discovery.Run(ro.LdapServerDiscoveryRefresh, nil)
+		}
+		if ro.LdapGroupCacheRefresh > 0 && len(ro.LdapGroups) > 0 {
+			cache, err := ldapauth.NewMembershipCache(cfg, r.GroupMatcher)
+			if err != nil {
+				return nil, err
+			}
+			a.Membership = cache
+			go cache.Run(ro.LdapGroupCacheRefresh, nil)
+		}
+	}
+	if opts.UpstreamsFile != "" || opts.UpstreamsConsulURL != "" {
+		d, err := newDynamicUpstreams(opts, p.upstreamForbidden)
+		if err != nil {
+			return nil, err
+		}
+		p.serveMux, p.dynamic = d, d
+	}
+	p.Authenticators = newAuthenticators(opts, p)
+	return p, nil
+}
+
+func NewLdapProxy(opts *Options, validator func(string) bool) *LdapProxy {
+	serveMux := http.NewServeMux()
+	for _, u := range opts.CompiledPathRegex {
+		log.Printf("compiled skip-auth-regex => %q", u)
+	}
+	if opts.acl != nil {
+		for _, r := range opts.acl.Rules {
+			log.Printf("acl-file rule %s", r)
+		}
+	}
+
+	domain := opts.CookieDomain
+	if domain == "" && opts.publicSuffixes != nil {
+		domain = "<registrable domain of the request host>"
+	} else if domain == "" {
+		domain = "<default>"
+	}
+	refresh := "disabled"
+	if opts.CookieRefresh != time.Duration(0) {
+		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
+	}
+	secure := fmt.Sprint(opts.CookieSecure)
+	if opts.CookieSecureAuto {
+		secure = "auto"
+	}
+
+	log.Printf("Cookie settings: name:%s secure(https):%s httponly:%v expiry:%s domain:%s path:%s refresh:%s", opts.CookieName, secure, opts.CookieHTTPOnly, opts.CookieExpire, domain, opts.CookiePath, refresh)
+	if !strings.HasPrefix(opts.ProxyPrefix+"/", strings.TrimSuffix(opts.CookiePath, "/")+"/") {
+		log.Printf("Warning: cookie path %q does not cover proxy prefix %q; the session cookie will not be sent to %s/auth", opts.CookiePath, opts.ProxyPrefix, opts.ProxyPrefix)
+	}
+
+	var cipher *cookie.Cipher
+	if opts.CookieRefresh != time.Duration(0) {
+		var err error
+		cipher, err = cookie.NewCipher(secretBytes(opts.CookieSecret))
+		if err != nil {
+			log.Fatal("cookie-secret error: ", err)
+		}
+	}
+
+	ldapCfg := newLdapConfig(opts)
+
+	p := &LdapProxy{
+		CookieName:     opts.CookieName,
+		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
+		CookieSeed:     opts.CookieSecret,
+		CookieDomain:   opts.CookieDomain,
+		CookiePath:     opts.CookiePath,
+		CookieSecure:   opts.CookieSecure,
+		CookieHTTPOnly: opts.CookieHTTPOnly,
+		CookieExpire:   opts.CookieExpire,
+		CookieRefresh:  opts.CookieRefresh,
+		CookieHash:     cookie.Hash(opts.CookieSignatureHash),
+		cookieHashes:   cookieHashes(opts),
+		Validator:      validator,
+
+		CookieSecureAuto: opts.CookieSecureAuto,
+		CookieClockSkew:  opts.CookieClockSkew,
+		publicSuffixes:   opts.publicSuffixes,
+		LoginHost:        opts.LoginHost,
+		SessionBearer:    opts.SessionBearer,
+
+		MaxRequestCookies: opts.MaxRequestCookies,
+
+		sessionExpireRules: opts.expireRules,
+		sessionExpireAttr:  opts.SessionExpireAttribute,
+		ldapLoginAttr:      ldapLoginAttribute(opts),
+
+		StreamingExpiryPolicy: opts.StreamingExpiryPolicy,
+		StreamingExpiryGrace:  opts.StreamingExpiryGrace,
+
+		ShareLinkMaxTTL: opts.ShareLinkMaxTTL,
+
+		BypassTokenMaxTTL: opts.BypassTokenMaxTTL,
+
+		AuthEndpointBasic: opts.AuthEndpointBasic,
+		AdminUsers:        opts.AdminUsers,
+		PersistSkipAuth:   opts.AdminPersistConfig,
+		basicAuthCache:    newBasicAuthCache(opts.CookieSecret, opts.AuthEndpointBasicCacheTTL),
+		authCache:         newAuthCache(opts.AuthEndpointCacheTTL),
+		signInLoops:       newSignInLoops(opts.SignInLoopLimit, opts.SignInLoopWindow),
+		signInAgents:      newSignInAgents(opts),
+		reauthHeader:      opts.ReauthHeader,
+		sessionLimit:      opts.MaxSessionsPerUser,
+		deferGroups:       opts.LdapDeferGroups,
+		groupsRequired:    opts.groupsRequired,
+		bindLimit:         newBindLimiter(opts.LdapMaxConcurrentBinds, opts.LdapBindQueueTimeout),
+
+		RobotsPath:   "/robots.txt",
+		PingPath:     "/ping",
+		SignInPath:   fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
+		SignOutPath:  fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
+		AuthOnlyPath: fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		SharePath:    fmt.Sprintf("%s/share", opts.ProxyPrefix),
+		AdminPath:    fmt.Sprintf("%s/admin/skip-auth", opts.ProxyPrefix),
+		AccessPath:   fmt.Sprintf("%s/admin/access", opts.ProxyPrefix),
+		SimulatePath: fmt.Sprintf("%s/admin/simulate", opts.ProxyPrefix),
+		ReloadPath:   fmt.Sprintf("%s/admin/reload", opts.ProxyPrefix),
+		BypassPath:   fmt.Sprintf("%s/admin/bypass-token", opts.ProxyPrefix),
+		EventsPath:   fmt.Sprintf("%s/admin/events", opts.ProxyPrefix),
+		SessionsPath: fmt.Sprintf("%s/sessions", opts.ProxyPrefix),
+		UserInfoPath: fmt.Sprintf("%s/userinfo", opts.ProxyPrefix),
+		AssetsPath:   fmt.Sprintf("%s/assets/", opts.ProxyPrefix),
+
+		ProxyPrefix:     opts.ProxyPrefix,
+		PrefixAliases:   opts.ProxyPrefixAliases,
+		passPrefix:      opts.ProxyPrefixPassthrough,
+		SignInBanner:    opts.SignInBanner,
+		LandingPage:     opts.LandingPage,
+		loginRules:      opts.loginRules,
+		serveMux:        serveMux,
+		upstreams:       opts.proxyURLs,
+		upstreamOptions: opts.upstreamOptions,
+		SetXAuthRequest: opts.SetXAuthRequest,
+		authHeaders:     opts.authHeaders,
+		PassBasicAuth:   opts.PassBasicAuth,
+
+		PassUserHeaders:   opts.PassUserHeaders,
+		PassAccessToken:   opts.PassAccessToken,
+		BasicAuthPassword: opts.BasicAuthPassword,
+		idHeaders:         opts.identityHeaders,
+		idSealer:          opts.identitySealer,
+		instance:          opts.instance,
+
+		RealIPHeader:   opts.RealIPHeader,
+		ProxyIPHeader:  opts.ProxyIPHeader,
+		TrustedProxies: opts.trustedProxies,
+		geoIP:          opts.geoIP,
+
+		LdapConfiguration: ldapCfg,
+		LdapScopeName:     opts.LdapScopeName,
+		LdapGroups:        opts.LdapGroups,
+		GroupMatcher:      opts.groupMatcher,
+		Realms:            newRealms(opts),
+
+		skipAuthRegex:     opts.SkipAuthRegex,
+		skipAuthNamed:     opts.skipAuthRules,
+		skipAuthIPs:       opts.skipIPs,
+		skipAuthPreflight: opts.SkipAuthPreflight,
+		skipAuthOptions:   opts.SkipAuthOptions,
+		CORS:              NewCORSPolicy(opts),
+		ACL:               opts.acl,
+		routesByGroup:     opts.routesByGroup(),
+		compiledPathRegex: opts.CompiledPathRegex,
+		CookieCipher:      cipher,
+		SessionStore:      newSessionStore(opts),
+		NewDevices:        newDeviceNotifier(opts),
+		LastSignIns:       newLastSignIns(opts),
+		Events:            newEventWebhook(opts),
+		eventStream:       newEventStream(opts),
+		Authz:             newAuthzWebhook(opts),
+		refreshes:         newRefreshGroup(),
+		templates:         loadTemplates(opts.CustomTemplatesDir, opts.ProxyPrefix),
+		assets:            newAssetServer(opts),
+		Footer:            opts.Footer,
+		AuditLogger:       NewAuditLogger(),
+	}
+	for i, u := range opts.proxyURLs {
+		o := opts.upstreamOptions[i]
+		path, handler := upstreamSchemes[u.Scheme].Handler(u, opts, o)
+		serveMux.Handle(path, restrictGroups(o, allowMethods(o.Methods, handler), p.upstreamForbidden))
+	}
+	return p
+}
+
+func newLdapConfig(opts *Options) *ldapauth.Config {
+	cfg := &ldapauth.Config{
+		Base:               opts.LdapBaseDn,
+		Host:               opts.LdapServerHost,
+		Port:               opts.LdapServerPort,
+		UseTLS:             opts.LdapTLS,
+		InsecureSkipVerify: true,
+		BindDN:             opts.LdapBindDn,
+		BindPassword:       opts.LdapBindDnPassword,
+		BindPasswordFile:   opts.LdapBindDnPasswordFile,
+		UserFilter:         "(&(objectClass=User)(uid=%s))",
+		GroupFilter:        "(&(objectClass=group)(member:1.2.840.113556.1.4.1941:=%s))",
+		GroupNameFilter:    "(&(objectClass=group)(cn=%s))",
+		MemberFilter:       "(&(objectClass=User)(memberOf:1.2.840.113556.1.4.1941:=%s))",
+		Attributes:         []string{"mail", "cn"},
+		Retries:            opts.LdapRetries,
+		RetryBackoff:       opts.LdapRetryBackoff,
+		SlowThreshold:      opts.LdapSlowQueryThreshold,
+		MemberAttribute:    opts.LdapGroupMemberAttr,
+	}
+	if opts.SessionExpireAttribute != "" {
+		cfg.Attributes = append(cfg.Attributes, opts.SessionExpireAttribute)
+	}
+	if attr := ldapLoginAttribute(opts); attr != "" {
+		cfg.Attributes = append(cfg.Attributes, attr)
+	}
+	cfg.Attributes = append(cfg.Attributes, opts.AuthzWebhookAttrs...)
+	if opts.LdapServerDiscovery == ldapauth.ServerDiscoverySRV {
+		cfg.Discovery = ldapauth.NewSRVDiscovery(opts.LdapServerHost)
+	}
+	return cfg
+}
+
+// ldapServer describes the LDAP server(s) opts connect to
+func ldapServer(opts *Options) string {
+	if opts.LdapServerDiscovery == ldapauth.ServerDiscoverySRV {
+		return "_ldap._tcp." + opts.LdapServerHost
+	}
+	return net.JoinHostPort(opts.LdapServerHost, strconv.Itoa(opts.LdapServerPort))
+}
+
+func (p *LdapProxy) MakeSessionCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
+	if value != "" {
+		value = p.signCookieValue(p.CookieName, value, now, expiration)
+		if len(value) > 4096 {
+			// Cookies cannot be larger than 4kb
+			log.Printf("WARNING - Cookie Size: %d bytes", len(value))
+		}
+	}
+	return p.makeCookie(req, p.CookieName, value, expiration, now)
+}
+
+func (p *LdapProxy) makeCookie(req *http.Request, name string, value string, expiration time.Duration, now time.Time) *http.Cookie {
+	domain := requestHost(req, p.TrustedProxies)
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		domain = h
+	}
+	if p.CookieDomain != "" && !strings.HasSuffix(domain, p.CookieDomain) {
+		log.Printf("Warning: request host is %q but using configured cookie domain of %q", domain, p.CookieDomain)
+	}
+	domain = p.cookieDomain(domain)
+
+	path := p.CookiePath
+	if path == "" {
+		path = "/"
+	}
+
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   domain,
+		HttpOnly: p.CookieHTTPOnly,
+		Secure:   p.secureCookie(req),
+		Expires:  now.Add(expiration),
+	}
+}
+
+func (p *LdapProxy) RobotsTxt(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "User-agent: *\nDisallow: /")
+}
+
+func (p *LdapProxy) PingPage(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK")
+}
+
+func (p *LdapProxy) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
+	log.Printf("ErrorPage %d %s %s", code, title, message)
+	rw.WriteHeader(code)
+	t := struct {
+		Title       string
+		Message     string
+		ProxyPrefix string
+	}{
+		Title:       fmt.Sprintf("%d %s", code, title),
+		Message:     message,
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, "error.html", t)
+}
+
+// AccessDeniedPage tells the signed in user of s that they may not make the
+// request, and the groups which would let them, if it is down to groups.
+// Sending them back to the sign-in page would only have them sign in again.
+func (p *LdapProxy) AccessDeniedPage(rw http.ResponseWriter, s *session.State, groups []string) {
+	log.Printf("AccessDeniedPage %s (groups %v)", s.User, groups)
+	rw.WriteHeader(http.StatusForbidden)
+	t := struct {
+		Title       string
+		User        string
+		Email       string
+		Groups      []string
+		ProxyPrefix string
+	}{
+		Title:       fmt.Sprintf("%d Permission Denied", http.StatusForbidden),
+		User:        s.User,
+		Email:       s.Email,
+		Groups:      groups,
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, accessDeniedTemplateName, t)
+}
+
+func (p *LdapProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int, failed bool) {
+	if !p.onLoginHost(req) {
+		p.redirectToLoginHost(rw, req)
+		return
+	}
+	reason := ""
+	if failed {
+		reason = SignInInvalidCredentials
+	}
+	p.signInPage(rw, req, code, reason)
+}
+
+// signInPage renders the sign-in page, explaining the reason the previous
+// attempt failed, if any
+func (p *LdapProxy) signInPage(rw http.ResponseWriter, req *http.Request, code int, reason string) {
+	// TODO Basic Auth?
+	p.ClearSessionCookie(rw, req)
+	rw.WriteHeader(code)
+
+	redirectURL := req.URL.RequestURI()
+	var selectedRealm string
+	if p.endpointPath(req.URL.Path) == p.SignInPath {
+		// a failed sign-in keeps the redirect and realm it was given
+		redirectURL, _ = p.GetRedirect(req)
+		selectedRealm = req.FormValue("realm")
+	}
+	if h := req.Header.Get("X-Auth-Request-Redirect"); h != "" {
+		redirectURL = p.localRedirect(req, h)
+	}
+
+	realm := p.hostRealm(req)
+	scopeName, realms := p.LdapScopeName, p.Realms
+	if realm != nil {
+		scopeName, realms = realm.Label, nil
+	}
+
+	t := struct {
+		LdapScopeName  string
+		Realms         []*Realm
+		Realm          string
+		SignInMessage  string
+		Banner         string
+		BannerRejected bool
+		Failed         bool
+		FailureMessage string
+		FailureCode    string
+		UserAgent      string
+		Redirect       string
+		Version        string
+		ProxyPrefix    string
+		Footer         template.HTML
+	}{
+		LdapScopeName:  scopeName,
+		Realms:         realms,
+		Realm:          selectedRealm,
+		SignInMessage:  p.SignInMessage,
+		Banner:         p.SignInBanner,
+		BannerRejected: reason == SignInBannerNotAccepted,
+		Failed:         reason != "" && reason != SignInBannerNotAccepted,
+		FailureMessage: failureMessage(reason),
+		FailureCode:    reason,
+		UserAgent:      req.UserAgent(),
+		Redirect:       p.signRedirect(redirectURL, time.Now()),
+		Version:        VERSION,
+		ProxyPrefix:    p.ProxyPrefix,
+		Footer:         template.HTML(p.Footer),
+	}
+	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
+}
+
+// groupMatcher returns the configured GroupMatcher, defaulting to matching
+// LdapGroups by cn
+func (p *LdapProxy) groupMatcher() *ldapauth.GroupMatcher {
+	if p.GroupMatcher != nil {
+		return p.GroupMatcher
+	}
+	return &ldapauth.GroupMatcher{Mode: ldapauth.GroupMatchCN, Groups: p.LdapGroups}
+}
+
+func (p *LdapProxy) GetRedirect(req *http.Request) (redirect string, err error) {
+	err = req.ParseForm()
+	if err != nil {
+		return
+	}
+
+	// a signed token from the sign-in page, or a plain path, e.g. from
+	// nginx's error_page redirect
+	redirect = req.Form.Get("rd")
+	if uri, ok := p.verifyRedirect(redirect); ok {
+		if p.loginHostReturn(uri) {
+			return uri, nil
+		}
+		redirect = uri
+	}
+	if redirect == "" {
+		redirect = p.landingPath(req)
+	}
+	redirect = p.localRedirect(req, redirect)
+
+	return
+}
+
+func (p *LdapProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
+	isPreflightRequestAllowed := p.skipAuthPreflight && isPreflightRequest(req) || p.skipAuthOptions && req.Method == "OPTIONS"
+	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path) || p.matchingSkipAuthRule(req) != nil || p.IsWhitelistedIP(p.clientIP(req))
+}
+
+func (p *LdapProxy) IsWhitelistedIP(remoteAddr net.IP) (ok bool) {
+	if remoteAddr == nil {
+		return false
+	}
+	p.skipAuthMu.RLock()
+	defer p.skipAuthMu.RUnlock()
+	for _, c := range p.skipAuthIPs {
+		if c.Contains(remoteAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *LdapProxy) IsWhitelistedPath(path string) (ok bool) {
+	p.skipAuthMu.RLock()
+	defer p.skipAuthMu.RUnlock()
+	for _, u := range p.compiledPathRegex {
+		ok = u.MatchString(path)
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+func (p *LdapProxy) getRemoteAddrStr(req *http.Request) (s string) {
+	s = req.RemoteAddr
+	if req.Header.Get(p.RealIPHeader) != "" {
+		s += fmt.Sprintf(" (%q)", req.Header.Get(p.RealIPHeader))
+	}
+	if req.Header.Get(p.ProxyIPHeader) != "" {
+		s += fmt.Sprintf(" (%q)", req.Header.Get(p.ProxyIPHeader))
+	}
+	return
+}
+
+func (p *LdapProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	defer p.recoverPanic(rw, req)
+	p.instance.setResponseHeader(rw)
+	if p.rejectCookies(rw, req) {
+		return
+	}
+	if p.PassAccessToken {
+		// only the proxy may set the token
+		req.Header.Del(accessTokenHeader)
+	}
+	if p.CORS != nil && p.CORS.Handle(rw, req) {
+		return
+	}
+	switch path := p.endpointPath(req.URL.Path); {
+	case path == p.RobotsPath:
+		NoCache(p.RobotsTxt)(rw, req)
+	case path == p.PingPath:
+		NoCache(p.PingPage)(rw, req)
+	case p.assets != nil && strings.HasPrefix(req.URL.Path, p.AssetsPath):
+		p.assets.ServeHTTP(rw, req)
+	case (p.IsWhitelistedRequest(req) || p.isPublicRequest(req)) && !p.isReservedPath(path):
+		if r := p.matchingSkipAuthRule(req); r != nil {
+			rw.Header().Set(skipAuthRuleHeader, r.Name)
+		}
+		// nobody signed in, whatever the client says
+		p.setIdentityHeaders(req, "", "", "", nil)
+		p.serveUpstream(rw, req)
+	case path == p.SignInPath:
+		NoCache(p.SignIn)(rw, req)
+	case path == p.SignOutPath:
+		NoCache(p.SignOut)(rw, req)
+	case path == p.AuthOnlyPath:
+		NoCache(p.AuthenticateOnly)(rw, req)
+	case path == p.SharePath && p.ShareLinkMaxTTL > 0:
+		NoCache(p.ShareLink)(rw, req)
+	case path == p.AdminPath && len(p.AdminUsers) > 0:
+		NoCache(p.AdminSkipAuth)(rw, req)
+	case path == p.AccessPath && len(p.AdminUsers) > 0:
+		NoCache(p.AdminAccess)(rw, req)
+	case path == p.SimulatePath && len(p.AdminUsers) > 0:
+		NoCache(p.AdminSimulate)(rw, req)
+	case path == p.ReloadPath && len(p.AdminUsers) > 0:
+		NoCache(p.AdminReload)(rw, req)
+	case path == p.BypassPath && len(p.AdminUsers) > 0 && p.BypassTokenMaxTTL > 0:
+		NoCache(p.AdminBypassToken)(rw, req)
+	case path == p.EventsPath && p.eventStream != nil:
+		NoCache(p.AdminEvents)(rw, req)
+	case path == p.SessionsPath && p.sessionLister() != nil:
+		NoCache(p.Sessions)(rw, req)
+	case path == p.UserInfoPath:
+		NoCache(p.UserInfo)(rw, req)
+	case p.isReservedPath(path):
+		// including endpoints which are disabled, so upstreams never see
+		// requests meant for the proxy
+		http.NotFound(rw, req)
+	default:
+		p.Proxy(rw, req)
+	}
+}
+
+// isReservedPath reports whether path, as endpointPath returns it, is under
+// ProxyPrefix and so never passed to the upstreams, not even by skip-auth
+// rules. An empty ProxyPrefix mounts the endpoints at the root, which can't
+// be reserved.
+func (p *LdapProxy) isReservedPath(path string) bool {
+	if p.passPrefix || p.ProxyPrefix == "" {
+		return false
+	}
+	return path == p.ProxyPrefix || strings.HasPrefix(path, p.ProxyPrefix+"/")
+}
+
+// endpointPath maps a path under one of PrefixAliases to the same path under
+// ProxyPrefix, so e.g. /oauth2/auth is served as <proxy-prefix>/auth
+func (p *LdapProxy) endpointPath(path string) string {
+	for _, alias := range p.PrefixAliases {
+		if strings.HasPrefix(path, alias+"/") {
+			return p.ProxyPrefix + path[len(alias):]
+		}
+	}
+	return path
+}
+
+// newUpstreamProxy returns the handler proxying requests for path to the
+// http or https upstream u
+func newUpstreamProxy(u *url.URL, path string, opts *Options, o *UpstreamOptions, auth hmacauth.HmacAuth) http.Handler {
+	proxy := NewReverseProxy(u)
+	if !opts.PassHostHeader {
+		setProxyUpstreamHostHeader(proxy, u)
+	} else {
+		setProxyDirector(proxy)
+	}
+	if o.RewriteLocation || o.RewriteHTML {
+		rewriter := &locationRewriter{upstream: u, prefix: path, html: o.RewriteHTML, strip: o.StripPath}
+		proxy.ModifyResponse = rewriter.ModifyResponse
+	}
+	if len(opts.CORSAllowedOrigins) > 0 {
+		modify := proxy.ModifyResponse
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			dropUpstreamCORS(resp)
+			if modify == nil {
+				return nil
+			}
+			return modify(resp)
+		}
+	}
+	if o.NoBuffering {
+		proxy.FlushInterval = -1
+	}
+	expectContinue(proxy, o)
+	proxy.Transport = newUpstreamTransport(o)
+	var handler http.Handler = proxy
+	if o.MaxResponseSize > 0 || opts.largeResponseSize > 0 {
+		handler = &responseLimiter{handler: handler, upstream: u.Host, max: o.MaxResponseSize, large: opts.largeResponseSize}
+	}
+	if m := o.Mirror; m != nil {
+		log.Printf("mirroring %v%% of requests to %q => shadow upstream %q", o.MirrorPercent, path, m)
+		shadow := newMirror(m, o.MirrorPercent, handler)
+		shadow.skipBodies = o.NoRequestBuffering
+		handler = shadow
+	}
+	handler = &UpstreamProxy{u.Host, handler, auth, o.Credentials}
+	if o.StripPath && path != "/" {
+		handler = stripPathPrefix(path, handler)
+	}
+	return handler
+}
+
+func NewReverseProxy(target *url.URL) (proxy *httputil.ReverseProxy) {
+	return httputil.NewSingleHostReverseProxy(target)
+}
+func setProxyUpstreamHostHeader(proxy *httputil.ReverseProxy, target *url.URL) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		// use RequestURI so that we aren't unescaping encoded slashes in the request path
+		req.Host = target.Host
+		req.URL.Opaque = req.RequestURI
+		req.URL.RawQuery = ""
+	}
+}
+func setProxyDirector(proxy *httputil.ReverseProxy) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		// use RequestURI so that we aren't unescaping encoded slashes in the request path
+		req.URL.Opaque = req.RequestURI
+		req.URL.RawQuery = ""
+	}
+}
+func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
+	return newFileServer(path, filesystemPath, &UpstreamOptions{})
+}
+
+func (p *LdapProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
+	if !p.onLoginHost(req) {
+		p.redirectToLoginHost(rw, req)
+		return
+	}
+	if req.Method == "POST" && p.rejectSignInAgent(rw, req) {
+		return
+	}
+	if req.Method == "POST" && isJSONRequest(req) {
+		p.signInJSON(rw, req)
+		return
+	}
+
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+
+	var bannerAcceptedAt time.Time
+	if p.SignInBanner != "" && req.Method == "POST" {
+		if req.FormValue("accept_banner") == "" {
+			p.signInPage(rw, req, http.StatusOK, SignInBannerNotAccepted)
+			return
+		}
+		bannerAcceptedAt = time.Now()
+	}
+
+	if req.Method != "POST" {
+		p.signInPrompt(rw, req, http.StatusOK)
+		return
+	}
+
+	realm, ok := p.signInRealm(req, req.FormValue("realm"))
+	if !ok {
+		p.signInPage(rw, req, http.StatusBadRequest, SignInInvalidRequest)
+		return
+	}
+	session, reason, err := p.signInSession(req, realm, req.FormValue("username"), req.FormValue("password"), bannerAcceptedAt)
+	switch {
+	case err != nil:
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+	case reason == SignInNotInGroup:
+		p.signInPage(rw, req, http.StatusUnauthorized, reason)
+	case reason == SignInDirectoryUnavailable || reason == SignInBusy:
+		p.signInPage(rw, req, http.StatusServiceUnavailable, reason)
+	case reason != "":
+		p.signInPage(rw, req, http.StatusOK, reason)
+	default:
+		p.signInSucceeded(rw, req, session, redirect)
+	}
+}
+
+// signInSession authenticates username and password against realm,
+// returning the session to save or the reason the sign-in failed
+func (p *LdapProxy) signInSession(req *http.Request, realm *Realm, username, password string, bannerAcceptedAt time.Time) (*session.State, string, error) {
+	username = p.normalizeLogin(username)
+	identity, groups, err := p.authenticateUser(realm, username, password, p.deferGroups)
+	if err != nil {
+		reason := p.signInFailure(req, username, err)
+		p.postSignInFailure(req, username, reason)
+		return nil, reason, nil
+	}
+	if !identity.GroupsDeferred && !p.inRequiredGroups(realm, identity.User, groups) {
+		p.postSignInFailure(req, identity.User, SignInNotInGroup)
+		return nil, SignInNotInGroup, nil
+	}
+
+	session := &session.State{User: identity.User, Email: identity.Email, Realm: realmName(realm), BannerAcceptedAt: bannerAcceptedAt}
+	if username != identity.User {
+		session.Login = username
+	}
+	session.GroupsPending = identity.GroupsDeferred
+	if p.sessionKeepsGroups() {
+		session.Groups = groups
+	}
+	if p.identityHeaders().dn != "" && identity.DN != "" {
+		session.DN = ldapauth.CanonicalDN(identity.DN)
+	}
+	if p.Authz != nil {
+		session.Attributes = p.Authz.userAttributes(identity)
+	}
+	if !identity.BreakGlassExpiresOn.IsZero() {
+		p.auditBreakGlass(req, identity)
+		session.ExpiresOn = identity.BreakGlassExpiresOn
+	}
+	if expire := p.sessionExpire(identity, groups); expire > 0 {
+		if expiresOn := time.Now().Add(expire); session.ExpiresOn.IsZero() || expiresOn.Before(session.ExpiresOn) {
+			session.ExpiresOn = expiresOn
+		}
+	}
+	p.notifyNewDevice(req, identity)
+	if p.PassAccessToken {
+		if session.AccessToken, err = newAccessToken(); err != nil {
+			return nil, "", err
+		}
+	}
+	return session, "", nil
+}
+
+// inRequiredGroups reports whether a user with groups satisfies LdapGroups,
+// or the groups of realm if there is one. groups are nil for identity
+// sources without groups, e.g. htpasswd, whose users aren't subject to
+// LdapGroups.
+func (p *LdapProxy) inRequiredGroups(realm *Realm, user string, groups []string) bool {
+	required, matcher := p.LdapGroups, p.groupMatcher()
+	if realm != nil {
+		required, matcher = realm.LdapGroups, realm.GroupMatcher
+	}
+	if len(required) == 0 || groups == nil {
+		return true
+	}
+	if group, ok := matcher.Match(groups); ok {
+		log.Printf("User: %s matched required group %q (ldap-group-match=%s)", user, group, matcher.Mode)
+		return true
+	}
+
+	log.Printf("User: %s is in groups: %+v", user, groups)
+	log.Printf("User: %s is not in groups: %+v (compared by ldap-group-match=%s)", user, matcher.Groups, matcher.Mode)
+	return false
+}
+
+func (p *LdapProxy) signInSucceeded(rw http.ResponseWriter, req *http.Request, session *session.State, redirect string) {
+	p.startSession(rw, req, session)
+	if session.FailedSignIns > 0 && p.LastSignIns.WarnFailed {
+		p.failedSignInsPage(rw, session, p.redirectURL(req, redirect))
+		return
+	}
+	http.Redirect(rw, req, p.redirectURL(req, redirect), http.StatusFound)
+}
+
+// startSession records the sign-in of session's user and saves it
+func (p *LdapProxy) startSession(rw http.ResponseWriter, req *http.Request, session *session.State) {
+	if session.BannerAcceptedAt.IsZero() {
+		p.Auditf(req, "user %q signed in", session.User)
+	} else {
+		p.Auditf(req, "user %q signed in; accepted sign-in banner at %s", session.User, session.BannerAcceptedAt.UTC().Format(time.RFC3339))
+	}
+	p.postEvent(req, EventSignIn, session.User, "")
+	session.CreatedAt = time.Now()
+	if ip := p.clientIP(req); ip != nil {
+		session.IP = ip.String()
+	}
+	session.UserAgent = req.UserAgent()
+	p.recordSignIn(session)
+	if err := p.SaveSession(rw, req, session); err != nil {
+		log.Printf("failed to save session %v", err)
+		return
+	}
+	p.limitSessions(req, session)
+	if session.GroupsPending {
+		go p.resolveGroups(req.Clone(context.Background()), session)
+	}
+}
+
+// sessionKeepsGroups reports whether sessions need the groups of their user
+// for the access policy or to pass them on
+func (p *LdapProxy) sessionKeepsGroups() bool {
+	return p.ACL.UsesGroups() || p.routesByGroup || p.dynamic.routesByGroup() || authHeadersUseGroups(p.sessionAuthHeaders()) || p.identityHeaders().groups != ""
+}
+
+func (p *LdapProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	// TODO not working?
+	if p.Events != nil {
+		if s, _, err := p.LoadCookiedSession(req); err == nil {
+			p.postEvent(req, EventSignOut, s.User, "")
+		}
+	}
+	p.ClearSessionCookie(rw, req)
+	http.Redirect(rw, req, p.redirectURL(req, "/"), http.StatusTemporaryRedirect)
+}
+
+func (p *LdapProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
+	var key string
+	if p.authCache != nil {
+		key = p.authCacheKey(req)
+		if e, ok := p.authCache.get(key); ok {
+			e.write(rw)
+			return
+		}
+	}
+
+	status, session := p.authenticate(rw, req)
+	if status == http.StatusForbidden && session == nil && p.AuthEndpointBasic {
+		status, session = p.authenticateBasic(rw, req)
+	}
+	code, message := http.StatusUnauthorized, "unauthorized request"
+	if status == http.StatusAccepted {
+		code, message = http.StatusAccepted, ""
+	} else if status == http.StatusForbidden && session != nil {
+		code, message = http.StatusForbidden, "forbidden request"
+	}
+	if key != "" && status != http.StatusInternalServerError && (session == nil || !session.GroupsPending) {
+		p.authCache.put(key, code, message, rw.Header())
+	}
+	writeAuthResponse(rw, code, message)
+}
+
+func (p *LdapProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status == http.StatusInternalServerError {
+		p.ErrorPage(rw, http.StatusInternalServerError,
+			"Internal Error", "Internal Error")
+	} else if status == http.StatusForbidden && session != nil {
+		p.AccessDeniedPage(rw, session, p.aclGroupsAllowing(req, session))
+	} else if status == http.StatusForbidden {
+		if user, ok := p.shareLinkUser(req); ok && p.sharedAllowedByACL(req, user) {
+			p.proxyShared(rw, req, user)
+			return
+		}
+		if name, ok := p.bypassTokenName(req); ok {
+			p.proxyBypassed(rw, req, name)
+			return
+		}
+		p.signInPrompt(rw, req, http.StatusForbidden)
+	} else {
+		req, cancel := p.withSessionExpiry(req, session)
+		defer cancel()
+		req = withSession(req, session)
+		if p.LandingPage && req.URL.Path == "/" {
+			NoCache(p.Portal)(rw, req)
+			return
+		}
+		p.serveUpstream(p.reauthWriter(rw, req, session.User), req)
+	}
+}
+
+func (p *LdapProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	status, _ := p.authenticate(rw, req)
+	return status
+}
+
+func (p *LdapProxy) authenticate(rw http.ResponseWriter, req *http.Request) (int, *session.State) {
+	var saveSession, clearSession, revalidated bool
+	remoteAddr := p.getRemoteAddrStr(req)
+
+	session, sessionAge, err := p.LoadCookiedSession(req)
+	if err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+	}
+	if session != nil {
+		session.CookieExpiresOn = time.Now().Add(p.CookieExpire - sessionAge)
+	}
+
+	if session != nil && sessionAge > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
+		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
+		saveSession = true
+	}
+
+	if ok, err := p.RefreshSessionIfNeeded(session); err != nil {
+		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+		clearSession = true
+		session = nil
+	} else if ok {
+		saveSession = true
+		revalidated = true
+	}
+
+	if session != nil && session.IsExpired() {
+		log.Printf("%s removing session. token expired %s", remoteAddr, session)
+		session = nil
+		saveSession = false
+		clearSession = true
+	}
+
+	if p.PassAccessToken && session != nil && session.AccessToken == "" {
+		// sessions from before pass-access-token was enabled
+		if session.AccessToken, err = newAccessToken(); err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+			return http.StatusInternalServerError, nil
+		}
+		saveSession = true
+	}
+
+	if saveSession && !revalidated && session != nil {
+		if !p.ValidateSessionState(session) {
+			log.Printf("%s removing session. error validating %s", remoteAddr, session)
+			saveSession = false
+			session = nil
+			clearSession = true
+		}
+	}
+
+	if r := p.hostRealm(req); session != nil && r != nil && session.Realm != r.Name {
+		log.Printf("%s ignoring session signed in against realm %q for realm %q %s", remoteAddr, session.Realm, r.Name, session)
+		session = nil
+		saveSession = false
+	} else if session != nil && r == nil && session.Realm != "" {
+		log.Printf("%s ignoring session signed in against realm %q for the default directory %v", remoteAddr, session.Realm, session)
+		session = nil
+		saveSession = false
+	}
+
+	if session != nil && session.Email != "" && !p.Validator(session.Email) {
+		log.Printf("%s Permission Denied: removing session %s", remoteAddr, session)
+		session = nil
+		saveSession = false
+		clearSession = true
+	}
+
+	if session != nil && session.GroupsPending && p.requiresGroups(req) {
+		if session, err = p.awaitGroups(session); err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+			return http.StatusInternalServerError, nil
+		}
+		if session == nil {
+			saveSession = false
+			clearSession = true
+		}
+	}
+
+	if saveSession && session != nil {
+		session.CookieExpiresOn = time.Now().Add(p.CookieExpire)
+		err := p.refreshSession(rw, req, session)
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+			return http.StatusInternalServerError, nil
+		}
+	}
+
+	if clearSession {
+		p.ClearSessionCookie(rw, req)
+	}
+
+	if session == nil {
+		session, err = p.CheckBasicAuth(req)
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+		}
+	}
+
+	if session == nil {
+		return http.StatusForbidden, nil
+	}
+
+	if !p.allowedByACL(req, session) || !p.authorizedByWebhook(rw, req, session) {
+		return http.StatusForbidden, session
+	}
+
+	// At this point, the user is authenticated. proxy normally
+	if p.sessionFromBearer(req) {
+		// the session token is for the proxy, not the upstream
+		req.Header.Del("Authorization")
+	}
+	if p.PassBasicAuth {
+		req.SetBasicAuth(session.User, p.BasicAuthPassword)
+	}
+	if p.PassBasicAuth || p.PassUserHeaders {
+		p.setIdentityHeaders(req, session.User, session.Email, session.DN, session.Groups)
+	}
+	if p.PassAccessToken && session.AccessToken != "" {
+		req.Header.Set(accessTokenHeader, session.AccessToken)
+	}
+	setAuthResponseHeaders(rw, session, p.sessionAuthHeaders())
+	if session.Email == "" {
+		rw.Header().Set(authInfoHeader, session.User)
+	} else {
+		rw.Header().Set(authInfoHeader, session.Email)
+	}
+	return http.StatusAccepted, session
+}
+
+func (p *LdapProxy) CheckBasicAuth(req *http.Request) (*session.State, error) {
+	if p.HtpasswdFile == nil {
+		return nil, nil
+	}
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return nil, nil
+	}
+	s := strings.SplitN(auth, " ", 2)
+	if len(s) != 2 || s[0] != "Basic" {
+		return nil, fmt.Errorf("invalid Authorization header %s", req.Header.Get("Authorization"))
+	}
+	b, err := b64.StdEncoding.DecodeString(s[1])
+	if err != nil {
+		return nil, err
+	}
+	pair := strings.SplitN(string(b), ":", 2)
+	if len(pair) != 2 {
+		return nil, fmt.Errorf("invalid format %s", b)
+	}
+	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
+		log.Printf("authenticated %q via basic auth", pair[0])
+		return &session.State{User: pair[0]}, nil
+	}
+	return nil, fmt.Errorf("%s not in HtpasswdFile", pair[0])
+}
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/18F/hmacauth"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func init() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+}
+
+func TestNewReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		hostname, _, _ := net.SplitHostPort(r.Host)
+		w.Write([]byte(hostname))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	backendHostname, backendPort, _ := net.SplitHostPort(backendURL.Host)
+	backendHost := net.JoinHostPort(backendHostname, backendPort)
+	proxyURL, _ := url.Parse(backendURL.Scheme + "://" + backendHost + "/")
+
+	proxyHandler := NewReverseProxy(proxyURL)
+	setProxyUpstreamHostHeader(proxyHandler, proxyURL)
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	getReq, _ := http.NewRequest("GET", frontend.URL, nil)
+	res, _ := http.DefaultClient.Do(getReq)
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if g, e := string(bodyBytes), backendHostname; g != e {
+		t.Errorf("got body %q; expected %q", g, e)
+	}
+}
+
+func TestEncodedSlashes(t *testing.T) {
+	var seen string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		seen = r.RequestURI
+	}))
+	defer backend.Close()
+
+	b, _ := url.Parse(backend.URL)
+	proxyHandler := NewReverseProxy(b)
+	setProxyDirector(proxyHandler)
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	f, _ := url.Parse(frontend.URL)
+	encodedPath := "/a%2Fb/?c=1"
+	getReq := &http.Request{URL: &url.URL{Scheme: "http", Host: f.Host, Opaque: encodedPath}}
+	_, err := http.DefaultClient.Do(getReq)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if seen != encodedPath {
+		t.Errorf("got bad request %q expected %q", seen, encodedPath)
+	}
+}
+
+type SignatureAuthenticator struct {
+	auth hmacauth.HmacAuth
+}
+
+func (v *SignatureAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) {
+	result, headerSig, computedSig := v.auth.AuthenticateRequest(r)
+	if result == hmacauth.ResultNoSignature {
+		w.Write([]byte("no signature received"))
+	} else if result == hmacauth.ResultMatch {
+		w.Write([]byte("signatures match"))
+	} else if result == hmacauth.ResultMismatch {
+		w.Write([]byte("signatures do not match:" +
+			"\n  received: " + headerSig +
+			"\n  computed: " + computedSig))
+	} else {
+		panic("Unknown result value: " + result.String())
+	}
+}
+
+type SignatureTest struct {
+	opts          *Options
+	upstream      *httptest.Server
+	upstreamHost  string
+	provider      *httptest.Server
+	header        http.Header
+	rw            *httptest.ResponseRecorder
+	authenticator *SignatureAuthenticator
+}
+
+func (st *SignatureTest) Close() {
+	st.provider.Close()
+	st.upstream.Close()
+}
+
+// fakeNetConn simulates an http.Request.Body buffer that will be consumed
+// when it is read by the hmacauth.HmacAuth if not handled properly. See:
+//   https://github.com/18F/hmacauth/pull/4
+type fakeNetConn struct {
+	reqBody string
+}
+
+func (fnc *fakeNetConn) Read(p []byte) (n int, err error) {
+	if bodyLen := len(fnc.reqBody); bodyLen != 0 {
+		copy(p, fnc.reqBody)
+		fnc.reqBody = ""
+		return bodyLen, io.EOF
+	}
+	return 0, io.EOF
+}
+
+func TestSignInBannerMustBeAccepted(t *testing.T) {
+	p := &LdapProxy{
+		SignInPath:   "/ldap/sign_in",
+		SignInBanner: "Authorized use only",
+		templates:    getTemplates(),
+	}
+
+	form := url.Values{"username": {"michael"}, "password": {"secret"}}
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	p.SignIn(rw, req)
+
+	body := rw.Body.String()
+	if !strings.Contains(body, "You must accept the usage policy") {
+		t.Errorf("expected banner rejection, got %q", body)
+	}
+	if !strings.Contains(body, "Authorized use only") {
+		t.Errorf("expected banner text, got %q", body)
+	}
+}
+
+func TestMakeCookiePath(t *testing.T) {
+	req := httptest.NewRequest("GET", "/app/", nil)
+
+	p := &LdapProxy{CookieName: "_ldap_proxy"}
+	if c := p.makeCookie(req, p.CookieName, "v", time.Hour, time.Now()); c.Path != "/" {
+		t.Errorf("expected default path /, got %q", c.Path)
+	}
+
+	p.CookiePath = "/app/"
+	if c := p.makeCookie(req, p.CookieName, "v", time.Hour, time.Now()); c.Path != "/app/" {
+		t.Errorf("expected path /app/, got %q", c.Path)
+	}
+}
+
+func TestMemorySessionStoreRevokesOnSignOut(t *testing.T) {
+	p := &LdapProxy{
+		CookieName:   "_ldap_proxy",
+		CookieSeed:   "secret",
+		CookieExpire: time.Hour,
+		SessionStore: session.NewMemoryStore(10, time.Hour),
+	}
+
+	rw := httptest.NewRecorder()
+	if err := p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	c := rw.Result().Cookies()[0]
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	s, _, err := p.LoadCookiedSession(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if s.User != "michael" {
+		t.Errorf("expected user michael, got %q", s.User)
+	}
+
+	p.ClearSessionCookie(httptest.NewRecorder(), req)
+	if _, _, err := p.LoadCookiedSession(req); err != session.ErrSessionNotFound {
+		t.Errorf("expected revoked session, got %v", err)
+	}
+}
+
+func TestProxyPrefixAlias(t *testing.T) {
+	p := &LdapProxy{
+		ProxyPrefix:   "/ldap",
+		PrefixAliases: []string{"/oauth2"},
+		AuthOnlyPath:  "/ldap/auth",
+		CookieName:    "_ldap_proxy",
+	}
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/auth", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected /oauth2/auth to be served as the auth endpoint, got %d", rw.Code)
+	}
+
+	if path := p.endpointPath("/oauth2other/auth"); path != "/oauth2other/auth" {
+		t.Errorf("unexpected endpoint path %q", path)
+	}
+}
+
+func TestProxyPrefixReserved(t *testing.T) {
+	var proxied []string
+	p := &LdapProxy{
+		ProxyPrefix:   "/ldap",
+		PrefixAliases: []string{"/oauth2"},
+		SharePath:     "/ldap/share",
+		CookieName:    "_ldap_proxy",
+		skipAuthIPs:   []*net.IPNet{{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)}},
+		serveMux: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			proxied = append(proxied, req.URL.Path)
+		}),
+	}
+
+	for _, path := range []string{"/ldap", "/ldap/", "/ldap/unknown", "/ldap/share", "/oauth2/callback"} {
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, rw.Code)
+		}
+	}
+	if len(proxied) != 0 {
+		t.Errorf("expected nothing under the prefix to be proxied, got %v", proxied)
+	}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ldapish/", nil))
+
+	p.passPrefix = true
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ldap/unknown", nil))
+	if strings.Join(proxied, " ") != "/ldapish/ /ldap/unknown" {
+		t.Errorf("expected paths outside the prefix, and unknown ones with passthrough, to be proxied, got %v", proxied)
+	}
+}
+
+// benchmarkProxy returns a proxy passing the identity headers to an upstream
+// answering every request itself, and a request signed in as michael
+func benchmarkProxy(b *testing.B) (*LdapProxy, *http.Request) {
+	o := testOptions()
+	o.Upstreams = []string{"static://200/"}
+	o.PassUserHeaders = true
+	if err := o.Validate(); err != nil {
+		b.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	req := httptest.NewRequest("GET", "/app/page?x=1", nil)
+	req.Header.Set("X-Real-IP", "192.0.2.1")
+	rw := httptest.NewRecorder()
+	if err := p.SaveSession(rw, req, &session.State{User: "michael", Email: "michael@example.com", Groups: []string{"ops", "staff"}}); err != nil {
+		b.Fatal(err)
+	}
+	req.AddCookie(rw.Result().Cookies()[0])
+	return p, req
+}
+
+// discardWriter is an http.ResponseWriter keeping only the headers, reset
+// between requests without allocating
+type discardWriter struct {
+	h    http.Header
+	code int
+}
+
+func (w *discardWriter) Header() http.Header         { return w.h }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(code int)        { w.code = code }
+
+func (w *discardWriter) reset() {
+	for k := range w.h {
+		delete(w.h, k)
+	}
+	w.code = 0
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	p, req := benchmarkProxy(b)
+	rw := &discardWriter{h: http.Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw.reset()
+		r := *req
+		r.Header = req.Header.Clone()
+		if p.Authenticate(rw, &r) != http.StatusAccepted {
+			b.Fatal("expected the request to be authenticated")
+		}
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	p, req := benchmarkProxy(b)
+	rw := &discardWriter{h: http.Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw.reset()
+		r := *req
+		r.Header = req.Header.Clone()
+		p.ServeHTTP(rw, &r)
+		if rw.code != http.StatusOK {
+			b.Fatalf("expected the upstream's response, got %d", rw.code)
+		}
+	}
+}
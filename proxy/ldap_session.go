@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/skybet/ldap_proxy/cookie"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// Session stores selectable with -session-store
+const (
+	SessionStoreCookie = "cookie"
+	SessionStoreMemory = "memory"
+)
+
+var sessionStores = []string{SessionStoreCookie, SessionStoreMemory}
+
+// newSessionStore returns the server side store selected in opts, or nil if
+// sessions are kept in the cookie itself
+func newSessionStore(opts *Options) session.Store {
+	switch opts.SessionStore {
+	case SessionStoreMemory:
+		if opts.MaxSessionsPerUser > 0 {
+			log.Printf("keeping sessions in memory (max %d, %d per user)", opts.SessionStoreMaxEntries, opts.MaxSessionsPerUser)
+		} else {
+			log.Printf("keeping sessions in memory (max %d)", opts.SessionStoreMaxEntries)
+		}
+		return session.NewMemoryStore(opts.SessionStoreMaxEntries, opts.CookieExpire)
+	}
+	return nil
+}
+
+// cookieHashes returns the hashes of the cookie signatures accepted with
+// opts: the signing hash, and SHA1 during the transition from it
+func cookieHashes(opts *Options) []cookie.Hash {
+	hashes := []cookie.Hash{cookie.Hash(opts.CookieSignatureHash)}
+	if opts.CookieAcceptSHA1 && hashes[0] != cookie.SHA1 {
+		hashes = append(hashes, cookie.SHA1)
+	}
+	return hashes
+}
+
+// signCookieValue signs value as the cookie name with CookieHash, to expire
+// after expiration. Cookies signed with SHA1 are left without their expiry,
+// as earlier versions expect.
+func (p *LdapProxy) signCookieValue(name, value string, now time.Time, expiration time.Duration) string {
+	h := p.CookieHash
+	if h == "" {
+		h = cookie.SHA256
+	}
+	if h == cookie.SHA1 {
+		return cookie.SignedValueHash(h, p.CookieSeed, name, value, now)
+	}
+	return cookie.SignedValueExpiring(h, p.CookieSeed, name, value, now, now.Add(expiration))
+}
+
+// validateCookie returns the value of c if it was signed with one of the
+// accepted hashes less than expiration ago, and hasn't expired, within
+// CookieClockSkew, warning of cookies issued ahead of this server's clock
+func (p *LdapProxy) validateCookie(c *http.Cookie, expiration time.Duration) (string, time.Time, bool) {
+	hashes := p.cookieHashes
+	if hashes == nil {
+		hashes = cookie.Hashes
+	}
+	now := time.Now()
+	v := cookie.Check(c, p.CookieSeed, expiration, p.CookieClockSkew, now, hashes...)
+	if v.Ahead >= clockSkewWarning {
+		p.clockSkew.warn(now, c.Name, v.Ahead, p.CookieClockSkew, v.OK)
+	}
+	return v.Value, v.Issued, v.OK
+}
+
+func (p *LdapProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) {
+	if p.SessionStore != nil {
+		if c, err := p.sessionCookie(req); err == nil {
+			val, _, ok := p.validateCookie(c, p.CookieExpire)
+			if ticket, isTicket := session.TicketFromCookie(val); ok && isTicket {
+				p.SessionStore.Clear(ticket)
+			}
+		}
+	}
+	http.SetCookie(rw, p.MakeSessionCookie(req, "", time.Hour*-1, time.Now()))
+}
+
+func (p *LdapProxy) SetSessionCookie(rw http.ResponseWriter, req *http.Request, val string) {
+	http.SetCookie(rw, p.MakeSessionCookie(req, val, p.CookieExpire, time.Now()))
+}
+
+func (p *LdapProxy) LoadCookiedSession(req *http.Request) (*session.State, time.Duration, error) {
+	var age time.Duration
+	c, err := p.sessionCookie(req)
+	if err != nil {
+		// always http.ErrNoCookie
+		return nil, age, fmt.Errorf("Cookie %q not present", p.CookieName)
+	}
+	val, timestamp, ok := p.validateCookie(c, p.CookieExpire)
+	if !ok {
+		return nil, age, errors.New("Cookie Signature not valid")
+	}
+
+	var s *session.State
+	if p.SessionStore != nil {
+		s, err = p.loadStoredSession(val)
+	} else {
+		s, err = session.SessionFromCookie(val, p.CookieCipher)
+	}
+	if err != nil {
+		return nil, age, err
+	}
+
+	age = time.Now().Truncate(time.Second).Sub(timestamp)
+	return s, age, nil
+}
+
+func (p *LdapProxy) loadStoredSession(val string) (*session.State, error) {
+	ticket, ok := session.TicketFromCookie(val)
+	if !ok {
+		return nil, errors.New("Cookie does not hold a session ticket")
+	}
+	return p.SessionStore.Load(ticket)
+}
+
+func (p *LdapProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *session.State) error {
+	value, err := p.sessionCookieValue(s)
+	if err != nil {
+		return err
+	}
+
+	p.SetSessionCookie(rw, req, value)
+	return nil
+}
+
+// sessionCookieValue serializes s, or stores it and returns its ticket if
+// sessions are kept in a SessionStore
+func (p *LdapProxy) sessionCookieValue(s *session.State) (string, error) {
+	if p.SessionStore != nil {
+		ticket, err := p.SessionStore.Save(s)
+		return session.TicketCookie(ticket), err
+	}
+	return session.CookieForSession(s, p.CookieCipher)
+}
+
+func (p *LdapProxy) RefreshSessionIfNeeded(s *session.State) (bool, error) {
+	// TODO: RefreshSessionIfNeeded
+	return false, nil
+}
+
+func (p *LdapProxy) ValidateSessionState(s *session.State) bool {
+	// TODO: ValidateSessionState
+	return true
+}
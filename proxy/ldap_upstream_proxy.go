@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/18F/hmacauth"
+)
+
+type UpstreamProxy struct {
+	upstream string
+	handler  http.Handler
+	auth     hmacauth.HmacAuth
+	// credentials of the upstream itself, replacing any Authorization of
+	// the request, e.g. from pass-basic-auth
+	credentials *url.Userinfo
+}
+
+func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(upstreamAddressHeader, u.upstream)
+	if u.credentials != nil {
+		password, _ := u.credentials.Password()
+		r.SetBasicAuth(u.credentials.Username(), password)
+	}
+	if u.auth != nil {
+		r.Header.Set(authInfoHeader, w.Header().Get(authInfoHeader))
+		u.auth.SignRequest(r)
+	}
+	u.handler.ServeHTTP(w, r)
+}
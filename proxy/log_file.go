@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// logFile is a log file which can be reopened, after logrotate has moved it
+// aside, without losing or interleaving writes
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+var (
+	logFilesMu sync.Mutex
+	// logFiles are the open log files by path, so logs sharing a file share
+	// one handle
+	logFiles = map[string]*logFile{}
+)
+
+// openLogFile opens path for appending, returning the already open logFile
+// if another log uses it
+func openLogFile(path string) (*logFile, error) {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	if l, ok := logFiles[path]; ok {
+		return l, nil
+	}
+	l := &logFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	logFiles[path] = l
+	return l, nil
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(b)
+}
+
+// Reopen opens the file at path again, closing the previous handle
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// ReopenLogFiles reopens every open log file. Failures are logged and leave
+// the previous handle in use.
+func ReopenLogFiles() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	for path, l := range logFiles {
+		if err := l.Reopen(); err != nil {
+			log.Printf("reopening log file %s: %v", path, err)
+			continue
+		}
+		log.Printf("reopened log file %s", path)
+	}
+}
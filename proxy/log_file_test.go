@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReopenLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if other, _ := openLogFile(path); other != l {
+		t.Error("expected logs sharing a file to share its handle")
+	}
+	l.Write([]byte("before\n"))
+
+	// as logrotate does without copytruncate
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("still rotated\n"))
+	ReopenLogFiles()
+	l.Write([]byte("after\n"))
+
+	for file, expected := range map[string]string{path + ".1": "before\nstill rotated\n", path: "after\n"} {
+		if b, _ := ioutil.ReadFile(file); string(b) != expected {
+			t.Errorf("%s: expected %q got %q", file, expected, b)
+		}
+	}
+}
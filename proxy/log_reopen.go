@@ -0,0 +1,22 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package proxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReopenLogsOnSignal reopens the log files whenever the process receives
+// SIGUSR1, e.g. from a logrotate postrotate script
+func ReopenLogsOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			ReopenLogFiles()
+		}
+	}()
+}
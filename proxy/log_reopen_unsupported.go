@@ -0,0 +1,7 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package proxy
+
+// ReopenLogsOnSignal does nothing on platforms without SIGUSR1
+func ReopenLogsOnSignal() {}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+)
+
+// logTarget is where a log is written, parsed from -log-target,
+// -audit-log-target or -access-log-target
+type logTarget struct {
+	stdout bool
+	// file is the path of a log file, reopened on SIGUSR1
+	file   string
+	syslog bool
+	// network and addr of a remote syslog server, empty for the local daemon
+	network string
+	addr    string
+}
+
+// parseLogTarget parses stderr (the default), stdout, a file path or file://
+// URL, syslog:// for the local syslog daemon, or syslog://host[:port] and
+// syslog+tcp://host[:port] for a remote one
+func parseLogTarget(target string) (*logTarget, error) {
+	switch target {
+	case "", "stderr":
+		return &logTarget{}, nil
+	case "stdout":
+		return &logTarget{stdout: true}, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	t := &logTarget{syslog: true}
+	switch u.Scheme {
+	case "":
+		return &logTarget{file: target}, nil
+	case "file":
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("file target must be an absolute file:/// URL")
+		}
+		return &logTarget{file: u.Path}, nil
+	case "syslog", "syslog+udp":
+		t.network = "udp"
+	case "syslog+tcp":
+		t.network = "tcp"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q (must be file, syslog, syslog+udp or syslog+tcp)", u.Scheme)
+	}
+	if u.Path != "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("unexpected path %q", u.Path+u.RawQuery)
+	}
+	switch {
+	case u.Host == "" && u.Scheme == "syslog":
+		t.network = ""
+	case u.Host == "":
+		return nil, fmt.Errorf("%s requires a host", u.Scheme)
+	case u.Port() == "":
+		t.addr = net.JoinHostPort(u.Hostname(), "514")
+	default:
+		t.addr = u.Host
+	}
+	return t, nil
+}
+
+// open returns a writer for t, logging to syslog at the audit priority when
+// audit is set
+func (t *logTarget) open(audit bool) (io.Writer, error) {
+	switch {
+	case t.syslog:
+		return dialSyslog(t, audit)
+	case t.file != "":
+		return openLogFile(t.file)
+	case t.stdout:
+		return os.Stdout, nil
+	}
+	return os.Stderr, nil
+}
+
+func validateLogTarget(o *Options, msgs []string) []string {
+	for _, target := range []struct {
+		name  string
+		value string
+		dest  **logTarget
+	}{
+		{"log-target", o.LogTarget, &o.logTarget},
+		{"audit-log-target", o.AuditLogTarget, &o.auditLogTarget},
+		{"access-log-target", o.AccessLogTarget, &o.accessLogTarget},
+	} {
+		t, err := parseLogTarget(target.value)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q: %v", target.name, target.value, err))
+			continue
+		}
+		*target.dest = t
+	}
+	if o.AuditLogTarget == "" {
+		o.auditLogTarget = o.logTarget
+	}
+	return msgs
+}
+
+// ConfigureLogging sends the operational log to the -log-target in opts. It
+// is called before New so that New logs there too.
+func ConfigureLogging(opts *Options) error {
+	t, err := parseLogTarget(opts.LogTarget)
+	if err != nil {
+		return fmt.Errorf("invalid log-target %q: %v", opts.LogTarget, err)
+	}
+	w, err := t.open(false)
+	if err != nil {
+		return fmt.Errorf("opening log-target %s: %v", opts.LogTarget, err)
+	}
+	if t.syslog {
+		// syslog timestamps the messages itself
+		log.SetFlags(log.Lshortfile)
+	}
+	log.SetOutput(w)
+	return nil
+}
+
+// newTargetAuditLogger returns the audit logger writing to the
+// -audit-log-target in opts
+func newTargetAuditLogger(opts *Options) (*log.Logger, error) {
+	t := opts.auditLogTarget
+	if t == nil || (!t.syslog && t.file == "" && !t.stdout) {
+		return NewAuditLogger(), nil
+	}
+	w, err := t.open(true)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit-log-target: %v", err)
+	}
+	if t.syslog {
+		return log.New(w, "[audit] ", 0), nil
+	}
+	return log.New(w, "[audit] ", log.Ldate|log.Ltime|log.LUTC), nil
+}
+
+// OpenAccessLog returns the writer for the request log at the
+// -access-log-target in opts, which must have been validated
+func OpenAccessLog(opts *Options) (io.Writer, error) {
+	if opts.accessLogTarget == nil {
+		return os.Stdout, nil
+	}
+	w, err := opts.accessLogTarget.open(false)
+	if err != nil {
+		return nil, fmt.Errorf("opening access-log-target %s: %v", opts.AccessLogTarget, err)
+	}
+	return w, nil
+}
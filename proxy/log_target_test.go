@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestParseLogTarget(t *testing.T) {
+	testCases := map[string]logTarget{
+		"":                           {},
+		"stderr":                     {},
+		"stdout":                     {stdout: true},
+		"/var/log/ldap_proxy.log":    {file: "/var/log/ldap_proxy.log"},
+		"file:///var/log/audit.log":  {file: "/var/log/audit.log"},
+		"syslog://":                  {syslog: true},
+		"syslog://loghost":           {syslog: true, network: "udp", addr: "loghost:514"},
+		"syslog+udp://10.0.0.1:1514": {syslog: true, network: "udp", addr: "10.0.0.1:1514"},
+		"syslog+tcp://loghost:6514":  {syslog: true, network: "tcp", addr: "loghost:6514"},
+		"syslog+tcp://[2001:db8::1]": {syslog: true, network: "tcp", addr: "[2001:db8::1]:514"},
+	}
+	for target, expected := range testCases {
+		got, err := parseLogTarget(target)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %+v", target, err)
+			continue
+		}
+		if *got != expected {
+			t.Errorf("%q: expected %+v got %+v", target, expected, *got)
+		}
+	}
+
+	for _, target := range []string{"file://loghost/audit.log", "ftp://loghost/", "syslog+tcp://", "syslog://loghost/path"} {
+		if _, err := parseLogTarget(target); err == nil {
+			t.Errorf("expected error parsing %q", target)
+		}
+	}
+}
@@ -1,9 +1,10 @@
 // largely adapted from https://github.com/gorilla/handlers/blob/master/handlers.go
 // to add logging of request duration as last value (and drop referrer)
 
-package main
+package proxy
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
@@ -20,22 +21,35 @@ type responseLogger struct {
 	size     int
 	upstream string
 	authInfo string
+	rule     string // the skip-auth-rule letting the request through
 }
 
+// Response headers carrying what the access log records from the handlers
+// serving a request, removed before the response is sent. They are in
+// canonical form, which setting and getting them then needn't allocate.
+const (
+	upstreamAddressHeader = "Lap-Upstream-Address"
+	authInfoHeader        = "Lap-Auth"
+)
+
 func (l *responseLogger) Header() http.Header {
 	return l.w.Header()
 }
 
 func (l *responseLogger) ExtractLAPMetadata() {
-	upstream := l.w.Header().Get("LAP-Upstream-Address")
+	upstream := l.w.Header().Get(upstreamAddressHeader)
 	if upstream != "" {
 		l.upstream = upstream
-		l.w.Header().Del("LAP-Upstream-Address")
+		l.w.Header().Del(upstreamAddressHeader)
 	}
-	authInfo := l.w.Header().Get("LAP-Auth")
+	authInfo := l.w.Header().Get(authInfoHeader)
 	if authInfo != "" {
 		l.authInfo = authInfo
-		l.w.Header().Del("LAP-Auth")
+		l.w.Header().Del(authInfoHeader)
+	}
+	if rule := l.w.Header().Get(skipAuthRuleHeader); rule != "" {
+		l.rule = rule
+		l.w.Header().Del(skipAuthRuleHeader)
 	}
 }
 
@@ -56,6 +70,30 @@ func (l *responseLogger) WriteHeader(s int) {
 	l.status = s
 }
 
+// Flush implements http.Flusher, so upstream responses can be streamed
+func (l *responseLogger) Flush() {
+	l.ExtractLAPMetadata()
+	if f, ok := l.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets upstreams switch protocols, e.g. to websockets. The response
+// headers are sent by the caller, so the access log's are removed first.
+func (l *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	l.ExtractLAPMetadata()
+	conn, rw, err := http.NewResponseController(l.w).Hijack()
+	if err == nil {
+		l.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for http.ResponseController
+func (l *responseLogger) Unwrap() http.ResponseWriter {
+	return l.w
+}
+
 func (l *responseLogger) Status() int {
 	return l.status
 }
@@ -69,10 +107,11 @@ type loggingHandler struct {
 	writer  io.Writer
 	handler http.Handler
 	enabled bool
+	policy  *accessLogPolicy
 }
 
 func LoggingHandler(out io.Writer, h http.Handler, v bool) http.Handler {
-	return loggingHandler{out, h, v}
+	return loggingHandler{out, h, v, nil}
 }
 
 func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -80,17 +119,19 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	url := *req.URL
 	logger := &responseLogger{w: w}
 	h.handler.ServeHTTP(logger, req)
-	if !h.enabled {
+	if !h.enabled || !h.policy.sampled(logger.Status()) {
 		return
 	}
-	logLine := buildLogLine(logger.authInfo, logger.upstream, req, url, t, logger.Status(), logger.Size())
+	logLine := buildLogLine(logger.authInfo, logger.upstream, req, h.policy.redactURL(url), t, logger.Status(), logger.Size(), h.policy.country(req), logger.rule)
 	h.writer.Write(logLine)
 }
 
 // Log entry for req similar to Apache Common Log Format.
 // ts is the timestamp with which the entry should be logged.
 // status, size are used to provide the response HTTP status and size.
-func buildLogLine(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) []byte {
+// country, when not empty, is appended as a last field, followed by the
+// skip-auth-rule which let the request through, if any, as rule=<name>.
+func buildLogLine(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int, country, rule string) []byte {
 	if username == "" {
 		username = "-"
 	}
@@ -103,22 +144,23 @@ func buildLogLine(username, upstream string, req *http.Request, url url.URL, ts
 		}
 	}
 
-	client := req.Header.Get("X-Real-IP")
-	if client == "" {
-		client = req.RemoteAddr
-	}
+	client := logClient(req)
 	proxyIP := req.Header.Get("X-Forwarded-For")
 	if proxyIP == "" {
 		proxyIP = "-"
 	}
 
-	if c, _, err := net.SplitHostPort(client); err == nil {
-		client = c
-	}
-
 	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
 
-	logLine := fmt.Sprintf("%s %s %s [%s] %s %s %s %q %s %q %d %d %0.3f\n",
+	var extra string
+	if country != "" {
+		extra = " " + country
+	}
+	if rule != "" {
+		extra += " rule=" + rule
+	}
+
+	logLine := fmt.Sprintf("%s %s %s [%s] %s %s %s %q %s %q %d %d %0.3f%s\n",
 		client,
 		proxyIP,
 		username,
@@ -132,6 +174,19 @@ func buildLogLine(username, upstream string, req *http.Request, url url.URL, ts
 		status,
 		size,
 		duration,
+		extra,
 	)
 	return []byte(logLine)
 }
+
+// logClient returns the client address logged for req
+func logClient(req *http.Request) string {
+	client := req.Header.Get("X-Real-IP")
+	if client == "" {
+		client = req.RemoteAddr
+	}
+	if c, _, err := net.SplitHostPort(client); err == nil {
+		client = c
+	}
+	return client
+}
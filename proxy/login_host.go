@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// onLoginHost reports whether req may be given the sign-in page: always,
+// unless a login-host serves it for every host
+func (p *LdapProxy) onLoginHost(req *http.Request) bool {
+	return p.LoginHost == "" || strings.EqualFold(requestHost(req, p.TrustedProxies), p.LoginHost)
+}
+
+// redirectToLoginHost sends a client which must sign in on another host to
+// the sign-in page of the login-host, with a signed rd token of the absolute
+// URL to return to, as it would otherwise have been returned to its path
+func (p *LdapProxy) redirectToLoginHost(rw http.ResponseWriter, req *http.Request) {
+	target := req.URL.RequestURI()
+	if p.endpointPath(req.URL.Path) == p.SignInPath {
+		target, _ = p.GetRedirect(req)
+	}
+	if h := req.Header.Get("X-Auth-Request-Redirect"); h != "" {
+		target = p.localRedirect(req, h)
+	}
+	scheme := requestScheme(req, p.TrustedProxies)
+	if isLocalRedirect(target) {
+		target = scheme + "://" + requestHost(req, p.TrustedProxies) + target
+	}
+	login := scheme + "://" + p.LoginHost + p.SignInPath + "?rd=" + url.QueryEscape(p.signRedirect(target, time.Now()))
+	code := http.StatusFound
+	if req.Method != "GET" && req.Method != "HEAD" {
+		code = http.StatusSeeOther
+	}
+	http.Redirect(rw, req, login, code)
+}
+
+// loginHostReturn reports whether uri, from an rd token, is an absolute URL
+// of a host the login-host's session cookie is sent to, which users signing
+// in on the login-host are returned to
+func (p *LdapProxy) loginHostReturn(uri string) bool {
+	if p.LoginHost == "" || isLocalRedirect(uri) {
+		return false
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	return inCookieDomain(u.Hostname(), p.cookieDomain(stripPort(p.LoginHost)))
+}
+
+// inCookieDomain reports whether a cookie scoped to domain is sent to host
+func inCookieDomain(host, domain string) bool {
+	host, domain = strings.ToLower(host), strings.TrimPrefix(strings.ToLower(domain), ".")
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// stripPort returns host without its port, if it has one
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func validateLoginHost(o *Options, msgs []string) []string {
+	if o.LoginHost == "" {
+		return msgs
+	}
+	if u, err := url.Parse("//" + o.LoginHost); err != nil || u.Host != o.LoginHost || u.Hostname() == "" {
+		return append(msgs, fmt.Sprintf("invalid login-host %q (expected a host name, with an optional port)", o.LoginHost))
+	}
+	switch {
+	case o.CookieDomain != "":
+		if !inCookieDomain(stripPort(o.LoginHost), o.CookieDomain) {
+			msgs = append(msgs, fmt.Sprintf("login-host %q must be within cookie-domain %q", o.LoginHost, o.CookieDomain))
+		}
+	case o.CookieDomainAuto:
+		if o.publicSuffixes != nil {
+			if _, ok := o.publicSuffixes.registrableDomain(stripPort(o.LoginHost)); !ok {
+				msgs = append(msgs, fmt.Sprintf("login-host %q has no registrable domain for cookie-domain-auto to scope cookies to", o.LoginHost))
+			}
+		}
+	default:
+		msgs = append(msgs, "login-host requires cookie-domain or cookie-domain-auto, so its session cookie is sent to the other hosts")
+	}
+	for _, r := range o.realms {
+		msgs = append(msgs, fmt.Sprintf("login-host can't be combined with the hosts of ldap-realm %q, which the sign-in page would no longer be served on", r.name))
+	}
+	return msgs
+}
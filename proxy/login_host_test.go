@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginHost(t *testing.T) {
+	o := testOptions()
+	o.CookieDomain = ".example.com"
+	o.LoginHost = "login.example.com"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	a := &countingAuthenticator{staticAuthenticator: staticAuthenticator{user: "michael", password: "secret"}}
+	p.Authenticators = []Authenticator{a}
+
+	// protected hosts send the client to the login host to sign in
+	req := httptest.NewRequest("GET", "http://app.example.com/reports/?year=2018", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	login, err := url.Parse(rw.Header().Get("Location"))
+	if rw.Code != http.StatusFound || err != nil || login.Host != "login.example.com" || login.Path != "/ldap/sign_in" {
+		t.Fatalf("expected a redirect to the login host, got %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+	rd := login.Query().Get("rd")
+	if uri, ok := p.verifyRedirect(rd); !ok || uri != "http://app.example.com/reports/?year=2018" {
+		t.Errorf("expected a signed rd token of the page asked for, got %q", uri)
+	}
+
+	// which serves the form, keeping the URL to return to
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", login.String(), nil))
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `name="password"`) {
+		t.Fatalf("expected the sign-in form on the login host, got %d", rw.Code)
+	}
+
+	signIn := func(host, rd string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"michael"}, "password": {"secret"}, "rd": {rd}}
+		req := httptest.NewRequest("POST", "http://"+host+"/ldap/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+	rw = signIn("login.example.com", rd)
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "http://app.example.com/reports/?year=2018" {
+		t.Errorf("expected to be returned to the protected host, got %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+	if c := rw.Result().Cookies(); len(c) == 0 || c[0].Domain != "example.com" {
+		t.Errorf("expected the session cookie to be shared with the protected host, got %+v", c)
+	}
+
+	// only signed URLs of hosts sharing the cookie are returned to
+	for _, rd := range []string{"http://app.example.com/", p.signRedirect("https://evil.example.org/", time.Now()), p.signRedirect("https://michael@app.example.com/", time.Now())} {
+		if rw := signIn("login.example.com", rd); rw.Header().Get("Location") != "/" {
+			t.Errorf("%q: expected to be returned to /, got %q", rd, rw.Header().Get("Location"))
+		}
+	}
+
+	// and passwords aren't checked on the protected hosts
+	calls := a.calls
+	rw = signIn("app.example.com", "/reports/")
+	if rw.Code != http.StatusSeeOther || !strings.HasPrefix(rw.Header().Get("Location"), "http://login.example.com/ldap/sign_in?rd=") || a.calls != calls {
+		t.Errorf("expected a sign-in on the protected host to be sent to the login host, got %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestValidateLoginHost(t *testing.T) {
+	for _, tC := range []struct {
+		host, domain string
+		realm        string
+		err          string
+	}{
+		{"login.example.com", "", "", "requires cookie-domain"},
+		{"login.example.org", ".example.com", "", "must be within cookie-domain"},
+		{"https://login.example.com", ".example.com", "", "invalid login-host"},
+		{"login.example.com/sign_in", ".example.com", "", "invalid login-host"},
+		{"login.example.com", ".example.com", "acme hosts=wiki.example.com", "can't be combined with the hosts of ldap-realm"},
+		{"login.example.com:8443", "example.com", "", ""},
+	} {
+		o := testOptions()
+		o.LoginHost, o.CookieDomain = tC.host, tC.domain
+		if tC.realm != "" {
+			o.LdapRealms = []string{tC.realm}
+		}
+		err := o.Validate()
+		if tC.err == "" && err != nil || tC.err != "" && (err == nil || !strings.Contains(err.Error(), tC.err)) {
+			t.Errorf("%s %s: expected %q, got %v", tC.host, tC.domain, tC.err, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Login normalization rules, which rewrite the username typed at sign-in
+// into the login the directory knows
+const (
+	// LoginNetBIOSDomain strips a DOMAIN\ prefix
+	LoginNetBIOSDomain = "netbios-domain"
+	// LoginUPNSuffix strips an @domain suffix, as in a user principal name
+	LoginUPNSuffix = "upn-suffix"
+	// LoginLowercase lowercases the login
+	LoginLowercase = "lowercase"
+)
+
+// loginAttribute is the attribute of directory users UserFilter finds them
+// by
+const loginAttribute = "uid"
+
+// loginRule is a parsed login-normalize rule. The domain rules only strip
+// the listed domains, compared case-insensitively, or any domain if none
+// are listed.
+type loginRule struct {
+	kind    string
+	domains []string
+}
+
+// parseLoginRule parses a login-normalize spec, "rule[=domain,...]"
+func parseLoginRule(spec string) (*loginRule, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	r := &loginRule{kind: parts[0]}
+	switch r.kind {
+	case LoginNetBIOSDomain, LoginUPNSuffix:
+		if len(parts) == 2 {
+			for _, d := range strings.Split(parts[1], ",") {
+				if d == "" {
+					return nil, fmt.Errorf("invalid login-normalize %q (empty domain)", spec)
+				}
+				r.domains = append(r.domains, d)
+			}
+		}
+	case LoginLowercase:
+		if len(parts) == 2 {
+			return nil, fmt.Errorf("invalid login-normalize %q (%s takes no domains)", spec, LoginLowercase)
+		}
+	default:
+		return nil, fmt.Errorf("invalid login-normalize %q (rule must be one of %s, %s, %s)", spec, LoginNetBIOSDomain, LoginUPNSuffix, LoginLowercase)
+	}
+	return r, nil
+}
+
+func parseLoginRules(specs []string) ([]*loginRule, error) {
+	var rules []*loginRule
+	for _, spec := range specs {
+		r, err := parseLoginRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matchesDomain reports whether r strips domain
+func (r *loginRule) matchesDomain(domain string) bool {
+	if len(r.domains) == 0 {
+		return true
+	}
+	for _, d := range r.domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *loginRule) apply(login string) string {
+	switch r.kind {
+	case LoginNetBIOSDomain:
+		if i := strings.Index(login, `\`); i >= 0 && r.matchesDomain(login[:i]) {
+			return login[i+1:]
+		}
+	case LoginUPNSuffix:
+		if i := strings.LastIndex(login, "@"); i >= 0 && r.matchesDomain(login[i+1:]) {
+			return login[:i]
+		}
+	case LoginLowercase:
+		return strings.ToLower(login)
+	}
+	return login
+}
+
+// normalizeLogin applies rules to username in order
+func normalizeLogin(rules []*loginRule, username string) string {
+	login := username
+	for _, r := range rules {
+		login = r.apply(login)
+	}
+	return login
+}
+
+// normalizeLogin returns the canonical login for username, as typed at
+// sign-in or in Basic credentials
+func (p *LdapProxy) normalizeLogin(username string) string {
+	login := normalizeLogin(p.loginRules, username)
+	if login != username {
+		log.Printf("normalized login %q to %q", username, login)
+	}
+	return login
+}
+
+// ldapLoginAttribute returns the attribute whose value directory users'
+// sessions get as their username, "" to keep the username they signed in
+// with
+func ldapLoginAttribute(opts *Options) string {
+	if opts.LdapCanonicalUsername {
+		return loginAttribute
+	}
+	return ""
+}
+
+func validateLoginNormalize(o *Options, msgs []string) []string {
+	rules, err := parseLoginRules(o.LoginNormalize)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.loginRules = rules
+	return msgs
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLogin(t *testing.T) {
+	rules, err := parseLoginRules([]string{"netbios-domain=CORP", "upn-suffix=corp.example,emea.corp.example", "lowercase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		`CORP\Alice`:              "alice",
+		`corp\alice`:              "alice",
+		`OTHER\alice`:             `other\alice`,
+		"Alice@Corp.Example":      "alice",
+		"alice@emea.corp.example": "alice",
+		"alice@example.com":       "alice@example.com",
+		"alice":                   "alice",
+		`CORP\`:                   "",
+	}
+	for username, expected := range tests {
+		if got := normalizeLogin(rules, username); got != expected {
+			t.Errorf("normalizeLogin(%q) = %q, expected %q", username, got, expected)
+		}
+	}
+
+	anyDomain, _ := parseLoginRules([]string{"netbios-domain", "upn-suffix"})
+	if got := normalizeLogin(anyDomain, `EMEA\alice@example.com`); got != "alice" {
+		t.Errorf("unexpected login %q", got)
+	}
+}
+
+func TestParseLoginRuleErrors(t *testing.T) {
+	for _, spec := range []string{"strip", "lowercase=CORP", "upn-suffix="} {
+		if _, err := parseLoginRule(spec); err == nil || !strings.Contains(err.Error(), spec) {
+			t.Errorf("%q: unexpected error %v", spec, err)
+		}
+	}
+}
+
+func TestSignInNormalizesLogin(t *testing.T) {
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "alice", password: "secret"})
+	p.loginRules, _ = parseLoginRules([]string{"netbios-domain", "lowercase"})
+
+	rw, resp := signInJSON(p, `{"username": "CORP\\Alice", "password": "secret"}`)
+	if resp.User != "alice" {
+		t.Fatalf("unexpected response %d %+v", rw.Code, resp)
+	}
+	s, _, err := p.LoadCookiedSession(cookieRequest(rw))
+	if err != nil || s.User != "alice" {
+		t.Errorf("unexpected session %+v %v", s, err)
+	}
+
+	p.AuthEndpointBasic = true
+	req := httptest.NewRequest("GET", "/ldap/auth", nil)
+	req.SetBasicAuth(`CORP\alice`, "secret")
+	if status, s := p.authenticateBasic(httptest.NewRecorder(), req); s == nil || s.User != "alice" {
+		t.Errorf("unexpected basic auth %d %+v", status, s)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Limits of request mirroring. Requests with larger bodies, or arriving while
+// mirrorMaxInFlight mirrored requests are outstanding, aren't mirrored.
+const (
+	mirrorMaxBody     = 1 << 20
+	mirrorMaxInFlight = 64
+	mirrorTimeout     = 30 * time.Second
+)
+
+var mirrorMetrics = expvar.NewMap("mirror")
+
+// mirror sends a copy of a percentage of the authenticated requests served by
+// handler to a shadow upstream, discarding its responses
+type mirror struct {
+	handler  http.Handler
+	target   *url.URL
+	percent  float64
+	client   *http.Client
+	inFlight chan struct{}
+	// skipBodies leaves requests with a body unmirrored rather than buffer
+	// it, for upstreams with request_buffering=false
+	skipBodies bool
+}
+
+func newMirror(target *url.URL, percent float64, h http.Handler) *mirror {
+	return &mirror{
+		handler:  h,
+		target:   target,
+		percent:  percent,
+		client:   &http.Client{Timeout: mirrorTimeout},
+		inFlight: make(chan struct{}, mirrorMaxInFlight),
+	}
+}
+
+func (m *mirror) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// LAP-Auth is only set for requests made with a session
+	if rw.Header().Get(authInfoHeader) == "" || rand.Float64()*100 >= m.percent {
+		m.handler.ServeHTTP(rw, req)
+		return
+	}
+	shadow, ok := m.shadowRequest(req)
+	if !ok {
+		m.handler.ServeHTTP(rw, req)
+		return
+	}
+	select {
+	case m.inFlight <- struct{}{}:
+		go m.send(shadow)
+	default:
+		mirrorMetrics.Add("dropped", 1)
+	}
+	m.handler.ServeHTTP(rw, req)
+}
+
+// shadowRequest copies req for the shadow upstream, buffering the body so
+// both upstreams can read it
+func (m *mirror) shadowRequest(req *http.Request) (*http.Request, bool) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if m.skipBodies {
+			mirrorMetrics.Add("skipped", 1)
+			return nil, false
+		}
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, mirrorMaxBody+1))
+		rest := req.Body
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rest), rest}
+		if err != nil || len(body) > mirrorMaxBody {
+			mirrorMetrics.Add("skipped", 1)
+			return nil, false
+		}
+	}
+
+	u := *m.target
+	u.Path = req.URL.Path
+	u.RawPath = req.URL.RawPath
+	u.RawQuery = req.URL.RawQuery
+	shadow, err := http.NewRequest(req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		mirrorMetrics.Add("skipped", 1)
+		return nil, false
+	}
+	for k, v := range req.Header {
+		shadow.Header[k] = v
+	}
+	shadow.Header.Set("X-Forwarded-Host", req.Host)
+	return shadow, true
+}
+
+func (m *mirror) send(req *http.Request) {
+	defer func() { <-m.inFlight }()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		mirrorMetrics.Add("errors", 1)
+		log.Printf("mirroring %s %s to %s: %v", req.Method, req.URL.Path, m.target.Host, err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	mirrorMetrics.Add("sent", 1)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	shadowed := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		shadowed <- req.Method + " " + req.URL.RequestURI() + " " + string(body) + " " + req.Header.Get("X-Forwarded-User")
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	_, opts, err := parseUpstream("http://127.0.0.1:8080/app/ mirror=" + shadow.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if opts.MirrorPercent != 100 {
+		t.Errorf("expected all requests to be mirrored by default, got %v%%", opts.MirrorPercent)
+	}
+
+	m := newMirror(opts.Mirror, opts.MirrorPercent, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Write(body)
+	}))
+	serve := func(authenticated bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/app/items?x=1", strings.NewReader("payload"))
+		req.Header.Set("X-Forwarded-User", "michael")
+		rw := httptest.NewRecorder()
+		if authenticated {
+			rw.Header().Set("LAP-Auth", "michael")
+		}
+		m.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := serve(true); rw.Body.String() != "payload" {
+		t.Errorf("expected the upstream to get the whole body, got %q", rw.Body)
+	}
+	select {
+	case got := <-shadowed:
+		if got != "POST /app/items?x=1 payload michael" {
+			t.Errorf("unexpected mirrored request %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to be mirrored")
+	}
+
+	serve(false)
+	m.percent = 0
+	serve(true)
+	select {
+	case got := <-shadowed:
+		t.Errorf("unexpected mirrored request %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorResponseLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(strings.Repeat("x", 2048)))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	_, o, err := parseUpstream(backend.URL + "/ max_response_size=1k mirror=" + backend.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	h := newUpstreamProxy(u, "/", NewOptions(), o, nil)
+	rw := httptest.NewRecorder()
+	rw.Header().Set("LAP-Auth", "michael")
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/large", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("expected the response size limit to apply to mirrored upstreams, got %d", rw.Code)
+	}
+}
+
+func TestParseUpstreamMirror(t *testing.T) {
+	_, opts, err := parseUpstream("http://a/ mirror=http://shadow:3000 mirror_percent=12.5")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if shadow, _ := url.Parse("http://shadow:3000"); *opts.Mirror != *shadow || opts.MirrorPercent != 12.5 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	for _, spec := range []string{"http://a/ mirror=shadow:3000", "http://a/ mirror=file:///tmp", "http://a/ mirror=http://s/ mirror_percent=101"} {
+		if _, _, err := parseUpstream(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// newDeviceTemplateName is the template of the new device email, which can
+// be replaced by a file of that name in the custom templates directory
+const newDeviceTemplateName = "new_device_email.html"
+
+const defaultNewDeviceTemplate = `{{define "new_device_email.html"}}<!DOCTYPE html>
+<html>
+<body style="font-family: Helvetica, Arial, sans-serif; font-size: 14px; color: #333;">
+	<p>Hello {{.User}},</p>
+	<p>Your account was used to sign in to {{.Host}} from a device it hasn't signed in from before:</p>
+	<table>
+		<tr><td>Time</td><td>{{.Time.Format "Mon, 02 Jan 2006 15:04:05 MST"}}</td></tr>
+		<tr><td>IP address</td><td>{{.IP}}</td></tr>
+		<tr><td>Browser</td><td>{{.UserAgent}}</td></tr>
+	</table>
+	<p>If this was you there is nothing to do. If it wasn't, change your password and tell your administrator.</p>
+</body>
+</html>
+{{end}}`
+
+// newDeviceEmail is the data of the new device email template
+type newDeviceEmail struct {
+	User      string
+	Host      string
+	IP        string
+	UserAgent string
+	Time      time.Time
+}
+
+// NewDeviceNotifier emails users signing in from an IP address and browser
+// they haven't signed in from before. A user's first sign-in only records
+// the device. The devices are remembered in KnownDevicesFile, if set, else
+// until the process exits.
+type NewDeviceNotifier struct {
+	SMTPAddress      string
+	From             string
+	Auth             smtp.Auth
+	Template         *template.Template
+	KnownDevicesFile string
+
+	mu    sync.Mutex
+	known map[string][]string // device hashes by user
+	send  func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// newDeviceNotifier returns the NewDeviceNotifier configured in opts, or
+// nil if new device notifications are off
+func newDeviceNotifier(opts *Options) *NewDeviceNotifier {
+	if !opts.NotifyNewDevice {
+		return nil
+	}
+	n := &NewDeviceNotifier{
+		SMTPAddress:      opts.SMTPAddress,
+		From:             opts.SMTPFrom,
+		Template:         opts.newDeviceTemplate,
+		KnownDevicesFile: opts.NotifyKnownDevicesFile,
+	}
+	if opts.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(opts.SMTPAddress)
+		n.Auth = smtp.PlainAuth("", opts.SMTPUsername, opts.SMTPPassword, host)
+	}
+	if err := n.load(); err != nil {
+		log.Printf("failed to read known devices from %s: %v", n.KnownDevicesFile, err)
+	}
+	return n
+}
+
+// parseNewDeviceTemplate parses the new device email template in dir, or the
+// default template if dir doesn't have one
+func parseNewDeviceTemplate(dir string) (*template.Template, error) {
+	if dir != "" {
+		filename := path.Join(dir, newDeviceTemplateName)
+		if _, err := os.Stat(filename); err == nil {
+			return template.ParseFiles(filename)
+		}
+	}
+	return template.New("").Parse(defaultNewDeviceTemplate)
+}
+
+func (n *NewDeviceNotifier) load() error {
+	n.known = make(map[string][]string)
+	if n.KnownDevicesFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(n.KnownDevicesFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &n.known)
+}
+
+// save writes the known devices to KnownDevicesFile, replacing it
+// atomically. n.mu must be held.
+func (n *NewDeviceNotifier) save() error {
+	if n.KnownDevicesFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(n.known)
+	if err != nil {
+		return err
+	}
+	tmp := n.KnownDevicesFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.KnownDevicesFile)
+}
+
+func deviceHash(ip, userAgent string) string {
+	h := sha256.Sum256([]byte(ip + "\x00" + userAgent))
+	return base64.RawURLEncoding.EncodeToString(h[:16])
+}
+
+// seen records that user signed in from ip with userAgent, reporting whether
+// it is a new device for a user who signed in before
+func (n *NewDeviceNotifier) seen(user, ip, userAgent string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	device := deviceHash(ip, userAgent)
+	devices := n.known[user]
+	if sliceContains(devices, device) {
+		return false
+	}
+	n.known[user] = append(devices, device)
+	if err := n.save(); err != nil {
+		log.Printf("failed to save known devices to %s: %v", n.KnownDevicesFile, err)
+	}
+	return len(devices) > 0
+}
+
+// message renders the email telling to of the sign-in described by e
+func (n *NewDeviceNotifier) message(to string, e *newDeviceEmail) ([]byte, error) {
+	var body bytes.Buffer
+	if err := n.Template.ExecuteTemplate(&body, newDeviceTemplateName, e); err != nil {
+		return nil, err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "New sign-in to "+e.Host))
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// notifyNewDevice emails the user of identity, in the background, if req
+// comes from a new device for them
+func (p *LdapProxy) notifyNewDevice(req *http.Request, identity *Identity) {
+	n := p.NewDevices
+	if n == nil {
+		return
+	}
+	e := &newDeviceEmail{User: identity.User, Host: requestHost(req, p.TrustedProxies), UserAgent: req.UserAgent(), Time: time.Now()}
+	if ip := p.clientIP(req); ip != nil {
+		e.IP = ip.String()
+	}
+	if !n.seen(identity.User, e.IP, e.UserAgent) {
+		return
+	}
+
+	to := identity.Email
+	if to == "" {
+		to = identity.Mail
+	}
+	if _, err := mail.ParseAddress(to); err != nil {
+		p.Auditf(req, "user %q signed in from a new device (%s, %q); not notified: no valid email address", identity.User, e.IP, e.UserAgent)
+		return
+	}
+	p.Auditf(req, "user %q signed in from a new device (%s, %q); notifying %s", identity.User, e.IP, e.UserAgent, to)
+
+	msg, err := n.message(to, e)
+	if err != nil {
+		log.Printf("failed to render the new device email for %s: %v", identity.User, err)
+		return
+	}
+	send := n.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+	go func() {
+		if err := send(n.SMTPAddress, n.Auth, n.From, []string{to}, msg); err != nil {
+			log.Printf("failed to send the new device email to %s: %v", to, err)
+		}
+	}()
+}
+
+func validateNotifyNewDevice(o *Options, msgs []string) []string {
+	if !o.NotifyNewDevice {
+		return msgs
+	}
+	if _, _, err := net.SplitHostPort(o.SMTPAddress); err != nil {
+		msgs = append(msgs, fmt.Sprintf("notify-new-device requires smtp-address as host:port (got %q)", o.SMTPAddress))
+	}
+	if _, err := mail.ParseAddress(o.SMTPFrom); err != nil {
+		msgs = append(msgs, fmt.Sprintf("notify-new-device requires a valid smtp-from address: %v", err))
+	}
+	t, err := parseNewDeviceTemplate(o.CustomTemplatesDir)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid %s: %v", newDeviceTemplateName, err))
+	}
+	o.newDeviceTemplate = t
+	return msgs
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sentMail struct {
+	to  []string
+	msg string
+}
+
+func testNewDeviceProxy(t *testing.T, audit *bytes.Buffer, knownDevicesFile string) (*LdapProxy, chan *sentMail) {
+	o := testOptions()
+	o.NotifyNewDevice = true
+	o.SMTPAddress = "smtp.example.com:25"
+	o.SMTPFrom = "ldap_proxy <noreply@example.com>"
+	o.NotifyKnownDevicesFile = knownDevicesFile
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan *sentMail, 1)
+	p := testSignInProxy(audit)
+	p.NewDevices = newDeviceNotifier(o)
+	p.NewDevices.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent <- &sentMail{to, string(msg)}
+		return nil
+	}
+	return p, sent
+}
+
+func signInFrom(p *LdapProxy, ip, userAgent string) {
+	req := httptest.NewRequest("POST", "/ldap/sign_in", nil)
+	req.RemoteAddr = ip + ":1234"
+	req.Header.Set("User-Agent", userAgent)
+	p.notifyNewDevice(req, &Identity{User: "michael", Mail: "michael@example.com"})
+}
+
+func TestNotifyNewDevice(t *testing.T) {
+	audit := &bytes.Buffer{}
+	p, sent := testNewDeviceProxy(t, audit, "")
+
+	signInFrom(p, "10.0.0.1", "Firefox")
+	signInFrom(p, "10.0.0.1", "Firefox")
+	if audit.Len() != 0 || len(sent) != 0 {
+		t.Fatalf("notified of a known device: %q", audit)
+	}
+
+	signInFrom(p, "10.0.0.2", "Firefox")
+	select {
+	case m := <-sent:
+		if len(m.to) != 1 || m.to[0] != "michael@example.com" {
+			t.Errorf("unexpected recipients %v", m.to)
+		}
+		for _, s := range []string{"To: michael@example.com\r\n", "Content-Type: text/html", "Hello michael", "10.0.0.2", "Firefox"} {
+			if !strings.Contains(m.msg, s) {
+				t.Errorf("expected %q in %q", s, m.msg)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no email sent")
+	}
+	if !strings.Contains(audit.String(), `user "michael" signed in from a new device (10.0.0.2, "Firefox"); notifying michael@example.com`) {
+		t.Errorf("unexpected audit log %q", audit)
+	}
+}
+
+func TestNotifyNewDeviceSpoofedAddress(t *testing.T) {
+	audit := &bytes.Buffer{}
+	p, sent := testNewDeviceProxy(t, audit, "")
+	p.RealIPHeader = "X-Real-IP"
+	signInFrom(p, "10.0.0.1", "Firefox")
+
+	// only believed from a -trusted-proxy
+	req := httptest.NewRequest("POST", "/ldap/sign_in", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "Firefox")
+	req.Header.Set("X-Real-IP", "203.0.113.9")
+	p.notifyNewDevice(req, &Identity{User: "michael", Mail: "michael@example.com"})
+	if audit.Len() != 0 || len(sent) != 0 {
+		t.Errorf("expected the device to be known by its peer address, got %q", audit)
+	}
+}
+
+func TestNotifyNewDeviceWithoutAddress(t *testing.T) {
+	audit := &bytes.Buffer{}
+	p, sent := testNewDeviceProxy(t, audit, "")
+	req := httptest.NewRequest("POST", "/ldap/sign_in", nil)
+	p.notifyNewDevice(req, &Identity{User: "michael"})
+	req.Header.Set("User-Agent", "Chrome")
+	p.notifyNewDevice(req, &Identity{User: "michael"})
+
+	if !strings.Contains(audit.String(), "not notified: no valid email address") {
+		t.Errorf("unexpected audit log %q", audit)
+	}
+	if len(sent) != 0 {
+		t.Error("sent an email without an address")
+	}
+}
+
+func TestKnownDevicesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "known_devices.json")
+
+	p, _ := testNewDeviceProxy(t, &bytes.Buffer{}, file)
+	signInFrom(p, "10.0.0.1", "Firefox")
+
+	audit := &bytes.Buffer{}
+	p, sent := testNewDeviceProxy(t, audit, file)
+	signInFrom(p, "10.0.0.1", "Firefox")
+	if audit.Len() != 0 || len(sent) != 0 {
+		t.Errorf("device not remembered across restarts: %q", audit)
+	}
+	signInFrom(p, "10.0.0.1", "Chrome")
+	if audit.Len() == 0 {
+		t.Error("not notified of a new device after a restart")
+	}
+}
+
+func TestCustomNewDeviceTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, newDeviceTemplateName), []byte("<p>{{.User}} from {{.IP}}</p>"), 0600)
+
+	tmpl, err := parseNewDeviceTemplate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &NewDeviceNotifier{From: "noreply@example.com", Template: tmpl}
+	msg, err := n.message("michael@example.com", &newDeviceEmail{User: "michael", IP: "10.0.0.1", Time: time.Now()})
+	if err != nil || !strings.HasSuffix(string(msg), "\r\n\r\n<p>michael from 10.0.0.1</p>") {
+		t.Errorf("unexpected message %q %v", msg, err)
+	}
+}
+
+func TestValidateNotifyNewDevice(t *testing.T) {
+	o := testOptions()
+	o.NotifyNewDevice = true
+	o.SMTPAddress = "smtp.example.com"
+	o.SMTPFrom = "not an address"
+	err := o.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, s := range []string{"notify-new-device requires smtp-address as host:port", "notify-new-device requires a valid smtp-from address"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected %q in %q", s, err)
+		}
+	}
+}
@@ -0,0 +1,785 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/18F/hmacauth"
+	"github.com/skybet/ldap_proxy/cookie"
+	"github.com/skybet/ldap_proxy/geoip"
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// Configuration Options that can be set by Command Line Flag, or Config File
+type Options struct {
+	ProxyPrefix  string `flag:"proxy-prefix" cfg:"proxy-prefix"`
+	HTTPAddress  string `flag:"http-address" cfg:"http_address"`
+	HTTPSAddress string `flag:"https-address" cfg:"https_address"`
+
+	ProxyPrefixAliases     []string `flag:"proxy-prefix-alias" cfg:"proxy_prefix_aliases"`
+	ProxyPrefixPassthrough bool     `flag:"proxy-prefix-passthrough" cfg:"proxy_prefix_passthrough"`
+
+	TLSCertFile   string `flag:"tls-cert" cfg:"tls_cert_file"`
+	TLSKeyFile    string `flag:"tls-key" cfg:"tls_key_file"`
+	CiphersSuites string `flag:"cipher-suites" cfg:"cipher_suites"`
+
+	TLSMinVersion       string `flag:"tls-min-version" cfg:"tls_min_version"`
+	TLSMaxVersion       string `flag:"tls-max-version" cfg:"tls_max_version"`
+	TLSCurvePreferences string `flag:"tls-curve-preferences" cfg:"tls_curve_preferences"`
+
+	DisableHTTP2     bool     `flag:"disable-http2" cfg:"disable_http2"`
+	HTTP1OnlyClients []string `flag:"http1-only-client" cfg:"http1_only_clients"`
+
+	MaxHeaderSize     string        `flag:"max-header-size" cfg:"max_header_size"`
+	ReadHeaderTimeout time.Duration `flag:"read-header-timeout" cfg:"read_header_timeout"`
+	MaxRequestCookies int           `flag:"max-request-cookies" cfg:"max_request_cookies"`
+
+	EmailDomains            []string `flag:"email-domain" cfg:"email_domains"`
+	AuthenticatedEmailsFile string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
+	HtpasswdFile            string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
+	BreakGlassFile          string   `flag:"break-glass-file" cfg:"break_glass_file"`
+	CustomTemplatesDir      string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
+	Footer                  string   `flag:"footer" cfg:"footer"`
+	SignInBanner            string   `flag:"sign-in-banner" cfg:"sign_in_banner"`
+	LandingPage             bool     `flag:"landing-page" cfg:"landing_page"`
+
+	SignInLoopLimit  int           `flag:"sign-in-loop-limit" cfg:"sign_in_loop_limit"`
+	SignInLoopWindow time.Duration `flag:"sign-in-loop-window" cfg:"sign_in_loop_window"`
+
+	SignInDenyUserAgents    []string `flag:"sign-in-deny-user-agent" cfg:"sign_in_deny_user_agents"`
+	SignInKnownUserAgents   []string `flag:"sign-in-known-user-agent" cfg:"sign_in_known_user_agents"`
+	SignInUnknownAgentLimit int      `flag:"sign-in-unknown-agent-limit" cfg:"sign_in_unknown_agent_limit"`
+
+	ReauthHeader string `flag:"reauth-header" cfg:"reauth_header"`
+
+	Authenticators       []string      `flag:"authenticator" cfg:"authenticators"`
+	AuthExecCommand      string        `flag:"auth-exec-command" cfg:"auth_exec_command"`
+	AuthWebhookURL       string        `flag:"auth-webhook-url" cfg:"auth_webhook_url"`
+	AuthenticatorTimeout time.Duration `flag:"authenticator-timeout" cfg:"authenticator_timeout"`
+	LoginNormalize       []string      `flag:"login-normalize" cfg:"login_normalize"`
+
+	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"LDAP_PROXY_COOKIE_NAME"`
+	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"LDAP_PROXY_COOKIE_SECRET" secret:"true"`
+	CookieDomain   string        `flag:"cookie-domain" cfg:"cookie_domain" env:"LDAP_PROXY_COOKIE_DOMAIN"`
+	CookiePath     string        `flag:"cookie-path" cfg:"cookie_path" env:"LDAP_PROXY_COOKIE_PATH"`
+	CookieExpire   time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"LDAP_PROXY_COOKIE_EXPIRE"`
+	CookieRefresh  time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"LDAP_PROXY_COOKIE_REFRESH"`
+	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure"`
+	CookieHTTPOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+
+	CookieDomainAuto bool   `flag:"cookie-domain-auto" cfg:"cookie_domain_auto"`
+	PublicSuffixList string `flag:"public-suffix-list" cfg:"public_suffix_list"`
+
+	LoginHost string `flag:"login-host" cfg:"login_host"`
+
+	CookieSignatureHash string `flag:"cookie-signature-hash" cfg:"cookie_signature_hash"`
+	CookieAcceptSHA1    bool   `flag:"cookie-accept-sha1" cfg:"cookie_accept_sha1"`
+
+	CookieClockSkew time.Duration `flag:"cookie-clock-skew" cfg:"cookie_clock_skew"`
+
+	SessionStore           string `flag:"session-store" cfg:"session_store"`
+	SessionStoreMaxEntries int    `flag:"session-store-max-entries" cfg:"session_store_max_entries"`
+	MaxSessionsPerUser     int    `flag:"max-sessions-per-user" cfg:"max_sessions_per_user"`
+	SessionBearer          bool   `flag:"session-bearer" cfg:"session_bearer"`
+
+	SessionExpireGroups    []string `flag:"session-expire-group" cfg:"session_expire_groups"`
+	SessionExpireAttribute string   `flag:"session-expire-attribute" cfg:"session_expire_attribute"`
+
+	StreamingExpiryPolicy string        `flag:"streaming-expiry-policy" cfg:"streaming_expiry_policy"`
+	StreamingExpiryGrace  time.Duration `flag:"streaming-expiry-grace" cfg:"streaming_expiry_grace"`
+
+	ShareLinkMaxTTL time.Duration `flag:"share-link-max-ttl" cfg:"share_link_max_ttl"`
+
+	BypassTokenMaxTTL time.Duration `flag:"bypass-token-max-ttl" cfg:"bypass_token_max_ttl"`
+
+	NotifyNewDevice        bool   `flag:"notify-new-device" cfg:"notify_new_device"`
+	NotifyKnownDevicesFile string `flag:"notify-known-devices-file" cfg:"notify_known_devices_file"`
+	SMTPAddress            string `flag:"smtp-address" cfg:"smtp_address"`
+	SMTPFrom               string `flag:"smtp-from" cfg:"smtp_from"`
+	SMTPUsername           string `flag:"smtp-username" cfg:"smtp_username"`
+	SMTPPassword           string `flag:"smtp-password" cfg:"smtp_password" secret:"true"`
+
+	RecordLastSignIn  bool   `flag:"record-last-sign-in" cfg:"record_last_sign_in"`
+	LastSignInFile    string `flag:"last-sign-in-file" cfg:"last_sign_in_file"`
+	WarnFailedSignIns bool   `flag:"warn-failed-sign-ins" cfg:"warn_failed_sign_ins"`
+
+	EventWebhookURL    string `flag:"event-webhook-url" cfg:"event_webhook_url"`
+	EventWebhookSecret string `flag:"event-webhook-secret" cfg:"event_webhook_secret" secret:"true"`
+
+	AuthzWebhookURL      string        `flag:"authz-webhook-url" cfg:"authz_webhook_url"`
+	AuthzWebhookSecret   string        `flag:"authz-webhook-secret" cfg:"authz_webhook_secret" secret:"true"`
+	AuthzWebhookTimeout  time.Duration `flag:"authz-webhook-timeout" cfg:"authz_webhook_timeout"`
+	AuthzWebhookCacheTTL time.Duration `flag:"authz-webhook-cache-ttl" cfg:"authz_webhook_cache_ttl"`
+	AuthzWebhookFailOpen bool          `flag:"authz-webhook-fail-open" cfg:"authz_webhook_fail_open"`
+	AuthzWebhookFormat   string        `flag:"authz-webhook-format" cfg:"authz_webhook_format"`
+	AuthzWebhookAttrs    []string      `flag:"authz-webhook-attribute" cfg:"authz_webhook_attributes"`
+	AuthzRegoDir         string        `flag:"authz-rego-dir" cfg:"authz_rego_dir"`
+	AuthzRegoQuery       string        `flag:"authz-rego-query" cfg:"authz_rego_query"`
+
+	LargeResponseSize string `flag:"large-response-size" cfg:"large_response_size"`
+
+	AuthEndpointBasic         bool          `flag:"auth-endpoint-basic" cfg:"auth_endpoint_basic"`
+	AuthEndpointBasicCacheTTL time.Duration `flag:"auth-endpoint-basic-cache-ttl" cfg:"auth_endpoint_basic_cache_ttl"`
+	AuthEndpointCacheTTL      time.Duration `flag:"auth-endpoint-cache-ttl" cfg:"auth_endpoint_cache_ttl"`
+
+	AdminUsers         []string `flag:"admin-user" cfg:"admin_users"`
+	AdminPersistConfig bool     `flag:"admin-persist-config" cfg:"admin_persist_config"`
+
+	UpstreamsFile        string `flag:"upstreams-file" cfg:"upstreams_file"`
+	UpstreamsConsulURL   string `flag:"upstreams-consul-url" cfg:"upstreams_consul_url"`
+	UpstreamsConsulToken string `flag:"upstreams-consul-token" cfg:"upstreams_consul_token" secret:"true"`
+
+	Upstreams             []string `flag:"upstream" cfg:"upstreams"`
+	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
+	SkipAuthRules         []string `flag:"skip-auth-rule" cfg:"skip_auth_rules"`
+	SkipAuthIPs           []string `flag:"skip-auth-ips" cfg:"skip_auth_ips"`
+	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
+	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password" secret:"true"`
+	PassHostHeader        bool     `flag:"pass-host-header" cfg:"pass_host_header"`
+	PassUserHeaders       bool     `flag:"pass-user-headers" cfg:"pass_user_headers"`
+	UserHeaderName        string   `flag:"user-header-name" cfg:"user_header_name"`
+	EmailHeaderName       string   `flag:"email-header-name" cfg:"email_header_name"`
+	GroupsHeaderName      string   `flag:"groups-header-name" cfg:"groups_header_name"`
+	DNHeaderName          string   `flag:"dn-header-name" cfg:"dn_header_name"`
+	IdentityHeaderMode    string   `flag:"identity-header-mode" cfg:"identity_header_mode"`
+	IdentityHeaderKey     string   `flag:"identity-header-key" cfg:"identity_header_key" secret:"true"`
+	InstanceName          string   `flag:"instance-name" cfg:"instance_name"`
+	InstanceHeader        string   `flag:"instance-header" cfg:"instance_header"`
+	InstanceHeaderMode    string   `flag:"instance-header-mode" cfg:"instance_header_mode"`
+	InstanceQueryParam    string   `flag:"instance-query-param" cfg:"instance_query_param"`
+	PassAccessToken       bool     `flag:"pass-access-token" cfg:"pass_access_token"`
+	SSLInsecureSkipVerify bool     `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify"`
+	SetXAuthRequest       bool     `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
+	AuthResponseHeaders   []string `flag:"auth-response-header" cfg:"auth_response_headers"`
+	SkipAuthPreflight     bool     `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	SkipAuthOptions       bool     `flag:"skip-auth-options" cfg:"skip_auth_options"`
+	ACLFile               string   `flag:"acl-file" cfg:"acl_file"`
+	GeoIPDatabase         string   `flag:"geoip-database" cfg:"geoip_database"`
+	RealIPHeader          string   `flag:"real-ip-header" cfg:"real_ip_header"`
+	ProxyIPHeader         string   `flag:"proxy-ip-header" cfg:"proxy_ip_header"`
+	TrustedProxies        []string `flag:"trusted-proxy" cfg:"trusted_proxies"`
+	CookieSecureAuto      bool     `flag:"cookie-secure-auto" cfg:"cookie_secure_auto"`
+
+	CORSAllowedOrigins   []string      `flag:"cors-allowed-origin" cfg:"cors_allowed_origins"`
+	CORSAllowedMethods   []string      `flag:"cors-allowed-method" cfg:"cors_allowed_methods"`
+	CORSAllowedHeaders   []string      `flag:"cors-allowed-header" cfg:"cors_allowed_headers"`
+	CORSAllowCredentials bool          `flag:"cors-allow-credentials" cfg:"cors_allow_credentials"`
+	CORSMaxAge           time.Duration `flag:"cors-max-age" cfg:"cors_max_age"`
+
+	RequestLogging  bool   `flag:"request-logging" cfg:"request_logging"`
+	LogTarget       string `flag:"log-target" cfg:"log_target"`
+	AuditLogTarget  string `flag:"audit-log-target" cfg:"audit_log_target"`
+	AccessLogTarget string `flag:"access-log-target" cfg:"access_log_target"`
+
+	AccessLogSampleRate   float64  `flag:"access-log-sample-rate" cfg:"access_log_sample_rate"`
+	AccessLogRedactQuery  bool     `flag:"access-log-redact-query" cfg:"access_log_redact_query"`
+	AccessLogRedactParams []string `flag:"access-log-redact-param" cfg:"access_log_redact_params"`
+
+	DebugAddress string `flag:"debug-address" cfg:"debug_address"`
+
+	GracefulUpgrade     bool          `flag:"graceful-upgrade" cfg:"graceful_upgrade"`
+	UpgradeDrainTimeout time.Duration `flag:"upgrade-drain-timeout" cfg:"upgrade_drain_timeout"`
+
+	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"LDAP_PROXY_SIGNATURE_KEY" secret:"true"`
+
+	LdapServerHost         string   `flag:"ldap-server-host" cfg:"ldap_server_host"`
+	LdapServerPort         int      `flag:"ldap-server-port" cfg:"ldap_server_port"`
+	LdapTLS                bool     `flag:"ldap-tls" cfg:"ldap_tls"`
+	LdapScopeName          string   `flag:"ldap-scope-name" cfg:"ldap_scope_name"`
+	LdapBaseDn             string   `flag:"ldap-base-dn" cfg:"ldap_base_dn"`
+	LdapBindDn             string   `flag:"ldap-bind-dn" cfg:"ldap_bind_dn"`
+	LdapBindDnPassword     string   `flag:"ldap-bind-dn-password" cfg:"ldap_bind_dn_password" secret:"true"`
+	LdapBindDnPasswordFile string   `flag:"ldap-bind-dn-password-file" cfg:"ldap_bind_dn_password_file"`
+	LdapGroups             []string `flag:"ldap-groups" cfg:"ldap_groups"`
+	LdapGroupMatch         string   `flag:"ldap-group-match" cfg:"ldap_group_match"`
+
+	LdapGroupCacheRefresh time.Duration `flag:"ldap-group-cache-refresh" cfg:"ldap_group_cache_refresh"`
+
+	LdapGroupMemberAttr string `flag:"ldap-group-member-attribute" cfg:"ldap_group_member_attribute"`
+
+	LdapRetries      int           `flag:"ldap-retries" cfg:"ldap_retries"`
+	LdapRetryBackoff time.Duration `flag:"ldap-retry-backoff" cfg:"ldap_retry_backoff"`
+
+	LdapSlowQueryThreshold time.Duration `flag:"ldap-slow-query-threshold" cfg:"ldap_slow_query_threshold"`
+
+	LdapServerDiscovery        string        `flag:"ldap-server-discovery" cfg:"ldap_server_discovery"`
+	LdapServerDiscoveryRefresh time.Duration `flag:"ldap-server-discovery-refresh" cfg:"ldap_server_discovery_refresh"`
+
+	LdapRealms []string `flag:"ldap-realm" cfg:"ldap_realms"`
+
+	LdapMaxConcurrentBinds int           `flag:"ldap-max-concurrent-binds" cfg:"ldap_max_concurrent_binds"`
+	LdapBindQueueTimeout   time.Duration `flag:"ldap-bind-queue-timeout" cfg:"ldap_bind_queue_timeout"`
+
+	LdapDeferGroups        bool     `flag:"ldap-defer-groups" cfg:"ldap_defer_groups"`
+	LdapDeferGroupsRequire []string `flag:"ldap-defer-groups-require-regex" cfg:"ldap_defer_groups_require_regex"`
+
+	LdapCanonicalUsername bool `flag:"ldap-canonical-username" cfg:"ldap_canonical_username"`
+
+	// internal values that are set after config validation
+	proxyURLs         []*url.URL
+	upstreamOptions   []*UpstreamOptions
+	CompiledPathRegex []*regexp.Regexp
+	skipAuthRules     []*SkipAuthRule
+	skipIPs           []*net.IPNet
+	groupsRequired    []*regexp.Regexp
+	signInDenyAgents  []*regexp.Regexp
+	signInKnownAgents []*regexp.Regexp
+	trustedProxies    []*net.IPNet
+	signatureData     *SignatureData
+	identitySealer    *identitySealer
+	authHeaders       []*authResponseHeader
+	identityHeaders   *identityHeaders
+	instance          *instanceIdentity
+	newDeviceTemplate *template.Template
+	ciphersSuites     []uint16
+	tlsMinVersion     uint16
+	tlsMaxVersion     uint16
+	curvePreferences  []tls.CurveID
+	http1OnlyClients  []*net.IPNet
+	groupMatcher      *ldapauth.GroupMatcher
+	realms            []*realmOptions
+	loginRules        []*loginRule
+	expireRules       []*sessionExpireRule
+	publicSuffixes    *publicSuffixList
+	acl               *ACL
+	regoPolicy        *RegoPolicy
+	geoIP             *geoip.Reader
+	logTarget         *logTarget
+	auditLogTarget    *logTarget
+	accessLogTarget   *logTarget
+	largeResponseSize int64
+	maxHeaderBytes    int
+}
+
+type SignatureData struct {
+	hash crypto.Hash
+	key  string
+}
+
+func NewOptions() *Options {
+	return &Options{
+		ProxyPrefix:       "/ldap",
+		HTTPAddress:       "127.0.0.1:4180",
+		HTTPSAddress:      ":443",
+		CookieName:        "_ldap_proxy",
+		CookiePath:        "/",
+		CookieSecure:      true,
+		CookieHTTPOnly:    true,
+		SignInLoopWindow:  time.Minute,
+		CookieExpire:      time.Duration(168) * time.Hour,
+		CookieRefresh:     time.Duration(0),
+		SetXAuthRequest:   false,
+		SkipAuthPreflight: false,
+		PassBasicAuth:     true,
+		PassUserHeaders:   true,
+		UserHeaderName:    "X-Forwarded-User",
+		EmailHeaderName:   "X-Forwarded-Email",
+		PassHostHeader:    true,
+		RequestLogging:    true,
+		AccessLogTarget:   "stdout",
+
+		StreamingExpiryPolicy: StreamingExpiryIgnore,
+		LdapGroupMatch:        ldapauth.GroupMatchCN,
+		AuthenticatorTimeout:  10 * time.Second,
+
+		LdapServerDiscoveryRefresh: 5 * time.Minute,
+
+		LdapRetries:      2,
+		LdapRetryBackoff: 250 * time.Millisecond,
+
+		AuthEndpointBasicCacheTTL: 5 * time.Minute,
+
+		AuthzWebhookTimeout:  2 * time.Second,
+		AuthzWebhookCacheTTL: 30 * time.Second,
+		AuthzWebhookFormat:   AuthzFormatProxy,
+		AuthzRegoQuery:       "data.ldap_proxy.allow",
+
+		SessionStore:           SessionStoreCookie,
+		SessionStoreMaxEntries: 10000,
+
+		CookieSignatureHash: string(cookie.SHA256),
+		CookieAcceptSHA1:    true,
+		CookieClockSkew:     cookie.DefaultClockSkew,
+
+		PublicSuffixList: DefaultPublicSuffixList,
+
+		IdentityHeaderMode: IdentityHeaderPlain,
+		InstanceHeaderMode: InstanceHeaderBoth,
+
+		MaxHeaderSize:     "1M",
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxRequestCookies: 180,
+
+		LdapBindQueueTimeout: 5 * time.Second,
+
+		AccessLogSampleRate: 1,
+
+		UpgradeDrainTimeout: time.Hour,
+
+		TLSMinVersion: "1.2",
+		TLSMaxVersion: "1.3",
+	}
+}
+
+func parseURL(to_parse string, urltype string, msgs []string) (*url.URL, []string) {
+	parsed, err := url.Parse(to_parse)
+	if err != nil {
+		return nil, append(msgs, fmt.Sprintf(
+			"error parsing %s-url=%q %s", urltype, to_parse, err))
+	}
+	return parsed, msgs
+}
+
+func (o *Options) Validate() error {
+	return configError(o.validate())
+}
+
+func configError(msgs []string) error {
+	if len(msgs) != 0 {
+		return fmt.Errorf("Invalid configuration:\n  %s",
+			strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+func (o *Options) validate() []string {
+	// TODO Validate Ldap
+
+	msgs := make([]string, 0)
+	if len(o.Upstreams) < 1 && o.UpstreamsFile == "" && o.UpstreamsConsulURL == "" {
+		msgs = append(msgs, "missing setting: upstream")
+	}
+	if o.CookieSecret == "" {
+		msgs = append(msgs, "missing setting: cookie-secret")
+	}
+
+	o.proxyURLs, o.upstreamOptions, msgs = parseUpstreams(o.Upstreams, msgs)
+
+	for _, u := range o.SkipAuthRegex {
+		CompiledRegex, err := regexp.Compile(u)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling regex=%q %s", u, err))
+		}
+		o.CompiledPathRegex = append(o.CompiledPathRegex, CompiledRegex)
+	}
+	msgs = validateSkipAuthRules(o, msgs)
+	o.skipIPs, msgs = parseCIDRs(o.SkipAuthIPs, msgs)
+	o.trustedProxies, msgs = parseCIDRs(o.TrustedProxies, msgs)
+
+	if o.CookieRefresh != time.Duration(0) {
+		valid_cookie_secret_size := false
+		for _, i := range []int{16, 24, 32} {
+			if len(secretBytes(o.CookieSecret)) == i {
+				valid_cookie_secret_size = true
+			}
+		}
+		var decoded bool
+		if string(secretBytes(o.CookieSecret)) != o.CookieSecret {
+			decoded = true
+		}
+		if valid_cookie_secret_size == false {
+			var suffix string
+			if decoded {
+				suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", o.CookieSecret)
+			}
+			msgs = append(msgs, fmt.Sprintf(
+				"cookie_secret must be 16, 24, or 32 bytes "+
+					"to create an AES cipher when "+
+					"cookie_refresh != 0, but is %d bytes.%s",
+				len(secretBytes(o.CookieSecret)), suffix))
+		}
+	}
+
+	if o.CookieRefresh >= o.CookieExpire {
+		msgs = append(msgs, fmt.Sprintf(
+			"cookie_refresh (%s) must be less than "+
+				"cookie_expire (%s)",
+			o.CookieRefresh.String(),
+			o.CookieExpire.String()))
+	}
+
+	msgs = validateStreamingExpiry(o, msgs)
+	msgs = validateCORS(o, msgs)
+	msgs = validateSessionStore(o, msgs)
+	msgs = validatePrefixAliases(o, msgs)
+	msgs = validateDebugAddress(o, msgs)
+	if o.GracefulUpgrade && o.UpgradeDrainTimeout <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upgrade_drain_timeout (%s) must be positive", o.UpgradeDrainTimeout))
+	}
+	msgs = validateLogTarget(o, msgs)
+	if o.ShareLinkMaxTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("share_link_max_ttl (%s) must not be negative", o.ShareLinkMaxTTL))
+	}
+	if o.BypassTokenMaxTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("bypass_token_max_ttl (%s) must not be negative", o.BypassTokenMaxTTL))
+	} else if o.BypassTokenMaxTTL > 0 && len(o.AdminUsers) == 0 {
+		msgs = append(msgs, "bypass-token-max-ttl requires admin-user")
+	}
+	msgs = validateAuthenticators(o, msgs)
+	msgs = validateLoginNormalize(o, msgs)
+	msgs = validateSessionExpire(o, msgs)
+	msgs = validateBreakGlass(o, msgs)
+	msgs = validateAuthResponseHeaders(o, msgs)
+	msgs = validateIdentityHeaders(o, msgs)
+	msgs = validateIdentityHeaderMode(o, msgs)
+	msgs = validateInstance(o, msgs)
+	msgs = validateHeaderLimits(o, msgs)
+	msgs = validateNotifyNewDevice(o, msgs)
+	if o.LastSignInFile != "" && !o.RecordLastSignIn {
+		msgs = append(msgs, "last-sign-in-file requires record-last-sign-in")
+	}
+	if o.WarnFailedSignIns && !o.RecordLastSignIn {
+		msgs = append(msgs, "warn-failed-sign-ins requires record-last-sign-in")
+	}
+	msgs = validateEventWebhook(o, msgs)
+	msgs = validateAuthzWebhook(o, msgs)
+	msgs = validateAuthzRego(o, msgs)
+	if o.LargeResponseSize != "" {
+		size, err := parseSize(o.LargeResponseSize)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid large-response-size: %v", err))
+		}
+		o.largeResponseSize = size
+	}
+	if o.AdminPersistConfig && len(o.AdminUsers) == 0 {
+		msgs = append(msgs, "admin-persist-config requires admin-user")
+	}
+	if o.AuthEndpointBasicCacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("auth_endpoint_basic_cache_ttl (%s) must not be negative", o.AuthEndpointBasicCacheTTL))
+	}
+	if o.AuthEndpointCacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("auth_endpoint_cache_ttl (%s) must not be negative", o.AuthEndpointCacheTTL))
+	}
+	if o.LdapBindDnPassword != "" && o.LdapBindDnPasswordFile != "" {
+		msgs = append(msgs, "only one of ldap-bind-dn-password and ldap-bind-dn-password-file may be set")
+	}
+
+	switch o.LdapServerDiscovery {
+	case "":
+	case ldapauth.ServerDiscoverySRV:
+		if o.LdapServerDiscoveryRefresh <= 0 {
+			msgs = append(msgs, fmt.Sprintf("ldap_server_discovery_refresh (%s) must be positive", o.LdapServerDiscoveryRefresh))
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid ldap-server-discovery %q (must be %s or empty)", o.LdapServerDiscovery, ldapauth.ServerDiscoverySRV))
+	}
+	if o.LdapRetries < 0 {
+		msgs = append(msgs, fmt.Sprintf("ldap_retries (%d) must not be negative", o.LdapRetries))
+	}
+	if o.LdapRetryBackoff < 0 {
+		msgs = append(msgs, fmt.Sprintf("ldap_retry_backoff (%s) must not be negative", o.LdapRetryBackoff))
+	}
+	if o.LdapSlowQueryThreshold < 0 {
+		msgs = append(msgs, fmt.Sprintf("ldap_slow_query_threshold (%s) must not be negative", o.LdapSlowQueryThreshold))
+	}
+	if o.LdapGroupCacheRefresh < 0 {
+		msgs = append(msgs, fmt.Sprintf("ldap_group_cache_refresh (%s) must not be negative", o.LdapGroupCacheRefresh))
+	}
+	if o.LdapGroupCacheRefresh > 0 && o.LdapGroupMatch == ldapauth.GroupMatchRegex {
+		msgs = append(msgs, "ldap-group-cache-refresh is not supported with ldap-group-match=regex")
+	}
+	if m, err := ldapauth.NewGroupMatcher(o.LdapGroupMatch, o.LdapGroups); err != nil {
+		msgs = append(msgs, err.Error())
+	} else {
+		o.groupMatcher = m
+		msgs = validateGeoIP(o, msgs)
+		msgs = validateACL(o, msgs)
+		msgs = validateCanaries(o, msgs)
+	}
+	msgs = validateRealms(o, msgs)
+	msgs = parseSignatureKey(o, msgs)
+	msgs = validateCookieName(o, msgs)
+	msgs = validateCookieSignature(o, msgs)
+	msgs = validateCookieDomainAuto(o, msgs)
+	msgs = validateLoginHost(o, msgs)
+	msgs = validateDynamicUpstreams(o, msgs)
+	msgs = validateBindLimit(o, msgs)
+	msgs = validateDeferredGroups(o, msgs)
+	msgs = validateAccessLog(o, msgs)
+	msgs = validateSignInLoops(o, msgs)
+	msgs = validateSignInAgents(o, msgs)
+	if !strings.HasPrefix(o.CookiePath, "/") {
+		msgs = append(msgs, fmt.Sprintf("cookie_path (%q) must start with /", o.CookiePath))
+	}
+
+	if o.SSLInsecureSkipVerify {
+		insecureTransport := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		http.DefaultClient = &http.Client{Transport: insecureTransport}
+	}
+
+	msgs = parseCipherSuites(o, msgs)
+	msgs = validateTLS(o, msgs)
+	return msgs
+}
+
+// parseUpstreams parses and validates upstream specs
+func parseUpstreams(specs []string, msgs []string) ([]*url.URL, []*UpstreamOptions, []string) {
+	var urls []*url.URL
+	var options []*UpstreamOptions
+	for _, u := range specs {
+		rawURL, upstreamOptions, err := parseUpstream(u)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error parsing upstream=%q %s", u, err))
+			continue
+		}
+		upstreamURL, err := url.Parse(rawURL)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error parsing upstream=%q %s",
+				upstreamURL, err))
+			continue
+		}
+		scheme, ok := upstreamSchemes[upstreamURL.Scheme]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf(
+				"unsupported upstream=%q scheme %q (must be one of %s)",
+				rawURL, upstreamURL.Scheme, strings.Join(upstreamSchemeNames(), ", ")))
+			continue
+		}
+		if upstreamURL.Path == "" {
+			upstreamURL.Path = "/"
+		}
+		if upstreamURL.User != nil && (upstreamURL.Scheme == "http" || upstreamURL.Scheme == "https") {
+			upstreamOptions.Credentials, upstreamURL.User = upstreamURL.User, nil
+		}
+		if upstreamOptions.StripPath && upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream=%q: strip_path is only supported for http and https upstreams", rawURL))
+			continue
+		}
+		if scheme.Validate != nil {
+			if err := scheme.Validate(upstreamURL, upstreamOptions); err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid upstream=%q: %v", rawURL, err))
+				continue
+			}
+		}
+		urls = append(urls, upstreamURL)
+		options = append(options, upstreamOptions)
+	}
+	return urls, options, msgs
+}
+
+func parseSignatureKey(o *Options, msgs []string) []string {
+	if o.SignatureKey == "" {
+		return msgs
+	}
+
+	components := strings.Split(o.SignatureKey, ":")
+	if len(components) != 2 {
+		return append(msgs, "invalid signature hash:key spec: "+
+			o.SignatureKey)
+	}
+
+	algorithm, secretKey := components[0], components[1]
+	if hash, err := hmacauth.DigestNameToCryptoHash(algorithm); err != nil {
+		return append(msgs, "unsupported signature hash algorithm: "+
+			o.SignatureKey)
+	} else {
+		o.signatureData = &SignatureData{hash, secretKey}
+	}
+	return msgs
+}
+
+func parseCipherSuites(o *Options, msgs []string) []string {
+	if o.CiphersSuites == "" {
+		return msgs
+	}
+
+	if ciphers, err := cipherSuites(o.CiphersSuites); err != nil {
+		return append(msgs, err.Error())
+	} else {
+		o.ciphersSuites = ciphers
+	}
+	return msgs
+}
+
+// parseCIDRs parses a list of IP addresses and CIDR ranges
+func parseCIDRs(ips []string, msgs []string) ([]*net.IPNet, []string) {
+	var cidrs []*net.IPNet
+	for _, u := range ips {
+		if !strings.ContainsAny(u, "/") {
+			// This is a raw IP not a range, lets make it one
+			if strings.ContainsAny(u, ":") {
+				// IPv6
+				u = u + "/128"
+			} else {
+				// IPv4
+				u = u + "/32"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(u)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error parsing cidr %q: %v", u, err))
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, msgs
+}
+
+func validateStreamingExpiry(o *Options, msgs []string) []string {
+	valid := false
+	for _, p := range streamingExpiryPolicies {
+		if o.StreamingExpiryPolicy == p {
+			valid = true
+		}
+	}
+	if !valid {
+		msgs = append(msgs, fmt.Sprintf("invalid streaming_expiry_policy %q (must be one of %s)",
+			o.StreamingExpiryPolicy, strings.Join(streamingExpiryPolicies, ", ")))
+	}
+	if o.StreamingExpiryGrace < 0 {
+		msgs = append(msgs, fmt.Sprintf("streaming_expiry_grace (%s) must not be negative", o.StreamingExpiryGrace))
+	}
+	return msgs
+}
+
+func validateCORS(o *Options, msgs []string) []string {
+	for _, origin := range o.CORSAllowedOrigins {
+		if origin == "*" {
+			if o.CORSAllowCredentials {
+				msgs = append(msgs, "cors-allow-credentials can't be combined with cors-allowed-origin=*, which would let any site make requests with the user's session")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			msgs = append(msgs, fmt.Sprintf("invalid cors origin %q (expected scheme://host[:port] or *)", origin))
+		}
+	}
+	if o.CORSMaxAge < 0 {
+		msgs = append(msgs, fmt.Sprintf("cors_max_age (%s) must not be negative", o.CORSMaxAge))
+	}
+	return msgs
+}
+
+func validatePrefixAliases(o *Options, msgs []string) []string {
+	for i, alias := range o.ProxyPrefixAliases {
+		alias = strings.TrimSuffix(alias, "/")
+		if !strings.HasPrefix(alias, "/") || alias == o.ProxyPrefix {
+			msgs = append(msgs, fmt.Sprintf("invalid proxy_prefix_alias %q (must start with / and differ from proxy-prefix)", o.ProxyPrefixAliases[i]))
+		}
+		o.ProxyPrefixAliases[i] = alias
+	}
+	return msgs
+}
+
+func validateSessionStore(o *Options, msgs []string) []string {
+	switch o.SessionStore {
+	case SessionStoreCookie:
+	case SessionStoreMemory:
+		if o.SessionStoreMaxEntries < 1 {
+			msgs = append(msgs, fmt.Sprintf("session_store_max_entries (%d) must be positive", o.SessionStoreMaxEntries))
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid session_store %q (must be one of %s)",
+			o.SessionStore, strings.Join(sessionStores, ", ")))
+	}
+	if o.MaxSessionsPerUser < 0 {
+		msgs = append(msgs, fmt.Sprintf("max_sessions_per_user (%d) must not be negative", o.MaxSessionsPerUser))
+	}
+	if o.MaxSessionsPerUser > 0 && o.SessionStore == SessionStoreCookie {
+		msgs = append(msgs, "max-sessions-per-user requires a server side session-store")
+	}
+	return msgs
+}
+
+func validateCookieName(o *Options, msgs []string) []string {
+	cookie := &http.Cookie{Name: o.CookieName}
+	if cookie.String() == "" {
+		return append(msgs, fmt.Sprintf("invalid cookie name: %q", o.CookieName))
+	}
+	return msgs
+}
+
+func validateCookieSignature(o *Options, msgs []string) []string {
+	if o.CookieClockSkew < 0 {
+		msgs = append(msgs, fmt.Sprintf("cookie_clock_skew (%s) must not be negative", o.CookieClockSkew))
+	}
+	h := cookie.Hash(o.CookieSignatureHash)
+	switch {
+	case h != cookie.SHA1 && h != cookie.SHA256:
+		return append(msgs, fmt.Sprintf("invalid cookie_signature_hash %q (must be %s or %s)", o.CookieSignatureHash, cookie.SHA256, cookie.SHA1))
+	case h == cookie.SHA1 && !o.CookieAcceptSHA1:
+		return append(msgs, "cookie_signature_hash sha1 requires cookie_accept_sha1")
+	}
+	return msgs
+}
+
+func addPadding(secret string) string {
+	padding := len(secret) % 4
+	switch padding {
+	case 1:
+		return secret + "==="
+	case 2:
+		return secret + "=="
+	case 3:
+		return secret + "="
+	default:
+		return secret
+	}
+}
+
+// secretBytes attempts to base64 decode the secret, if that fails it treats the secret as binary
+func secretBytes(secret string) []byte {
+	b, err := base64.URLEncoding.DecodeString(addPadding(secret))
+	if err == nil {
+		return []byte(addPadding(string(b)))
+	}
+	return []byte(secret)
+}
+
+// parse user supplied cipher list
+func cipherSuites(cipherStr string) ([]uint16, error) {
+	// https://golang.org/src/crypto/tls/cipher_suites.go
+
+	cipherMap := map[string]uint16{
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+		"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	}
+
+	userCiphers := strings.Split(cipherStr, ",")
+	suites := []uint16{}
+
+	for _, cipher := range userCiphers {
+		if v, ok := cipherMap[cipher]; ok {
+			suites = append(suites, v)
+		} else {
+			return suites, fmt.Errorf("unsupported cipher %q", cipher)
+		}
+	}
+
+	return suites, nil
+}
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"crypto"
@@ -252,3 +252,144 @@ func TestValidateCipher(t *testing.T) {
 		t.Errorf("unexpected cipher: %+v", o.ciphersSuites[1])
 	}
 }
+
+func TestValidateCipher3DES(t *testing.T) {
+	o := testOptions()
+	o.CiphersSuites = "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA"
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA != o.ciphersSuites[0] {
+		t.Errorf("unexpected cipher: %s", tls.CipherSuiteName(o.ciphersSuites[0]))
+	}
+}
+
+func TestValidateCookiePath(t *testing.T) {
+	o := testOptions()
+	o.CookiePath = "/app/"
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	o = testOptions()
+	o.CookiePath = "app"
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  cookie_path (\"app\") must start with /" {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestValidateCORSOrigins(t *testing.T) {
+	o := testOptions()
+	o.CORSAllowedOrigins = []string{"*", "https://app.example.com", "http://localhost:3000"}
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	o = testOptions()
+	o.CORSAllowedOrigins = []string{"app.example.com"}
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  invalid cors origin \"app.example.com\" (expected scheme://host[:port] or *)" {
+		t.Error("unexpected error", err)
+	}
+
+	o = testOptions()
+	o.CORSAllowedOrigins = []string{"https://app.example.com", "*"}
+	o.CORSAllowCredentials = true
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "cors-allow-credentials can't be combined") {
+		t.Error("expected credentials to be refused for any origin, got", err)
+	}
+}
+
+func TestValidateAuthenticators(t *testing.T) {
+	o := testOptions()
+	o.Authenticators = []string{"ldap", "exec"}
+	o.AuthExecCommand = "/usr/local/bin/check-password"
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	o = testOptions()
+	o.Authenticators = []string{"webhook", "kerberos"}
+	err := o.Validate()
+	expected := errorMsg([]string{
+		"authenticator webhook requires auth-webhook-url",
+		"invalid authenticator \"kerberos\" (must be one of htpasswd, ldap, exec, webhook)"})
+	if err == nil || err.Error() != expected {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestValidateSessionStore(t *testing.T) {
+	o := testOptions()
+	o.SessionStore = "memory"
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	o = testOptions()
+	o.SessionStore = "redis"
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  invalid session_store \"redis\" (must be one of cookie, memory)" {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestValidateCookieSignature(t *testing.T) {
+	o := testOptions()
+	o.CookieSignatureHash = "md5"
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  invalid cookie_signature_hash \"md5\" (must be sha256 or sha1)" {
+		t.Error("unexpected error", err)
+	}
+
+	o = testOptions()
+	o.CookieSignatureHash = "sha1"
+	o.CookieAcceptSHA1 = false
+	err = o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  cookie_signature_hash sha1 requires cookie_accept_sha1" {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestValidateLdapServerDiscovery(t *testing.T) {
+	o := testOptions()
+	o.LdapServerDiscovery = "srv"
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	o = testOptions()
+	o.LdapServerDiscovery = "dns"
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  invalid ldap-server-discovery \"dns\" (must be srv or empty)" {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestValidateProxyPrefixAliases(t *testing.T) {
+	o := testOptions()
+	o.ProxyPrefixAliases = []string{"/oauth2/"}
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if o.ProxyPrefixAliases[0] != "/oauth2" {
+		t.Errorf("expected trailing slash to be removed, got %q", o.ProxyPrefixAliases[0])
+	}
+
+	o = testOptions()
+	o.ProxyPrefixAliases = []string{"oauth2"}
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  invalid proxy_prefix_alias \"oauth2\" (must start with / and differ from proxy-prefix)" {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestUnsupportedUpstreamScheme(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"ftp://127.0.0.1/"}
+	err := o.Validate()
+	if err == nil || err.Error() != "Invalid configuration:\n  unsupported upstream=\"ftp://127.0.0.1/\" scheme \"ftp\" (must be one of file, http, https, redirect, static)" {
+		t.Error("unexpected error", err)
+	}
+}
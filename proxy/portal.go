@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// portalApp is an upstream listed on the landing page
+type portalApp struct {
+	Title string
+	Path  string
+}
+
+// portalApps returns the upstreams the user of s may make req for, in the
+// order they are configured. Upstreams mounted at /, which the landing page
+// replaces, and static:// upstreams without a title, such as health checks,
+// aren't listed.
+func (p *LdapProxy) portalApps(req *http.Request, s *session.State) []*portalApp {
+	urls, uos := p.upstreamsWithOptions()
+	apps := []*portalApp{}
+	for i, u := range urls {
+		path, title := upstreamPath(u), ""
+		if i < len(uos) {
+			title = uos[i].Title
+		}
+		if path == "/" || u.Scheme == "static" && title == "" {
+			continue
+		}
+		r, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			continue
+		}
+		r.Host, r.RemoteAddr, r.Header = req.Host, req.RemoteAddr, req.Header
+		h, _ := p.upstreamHandler(r)
+		if decision, _, _ := p.decideSignedIn(r, h, s); decision == ACLDeny {
+			continue
+		}
+		if title == "" {
+			title = path
+		}
+		apps = append(apps, &portalApp{Title: title, Path: path})
+	}
+	return apps
+}
+
+// Portal is the landing page served at / with LandingPage set, linking to
+// the upstreams the signed in user may use
+func (p *LdapProxy) Portal(rw http.ResponseWriter, req *http.Request) {
+	s := sessionFromContext(req.Context())
+	t := struct {
+		Title       string
+		User        string
+		Email       string
+		Apps        []*portalApp
+		ProxyPrefix string
+	}{
+		Title:       "Applications",
+		User:        s.User,
+		Email:       s.Email,
+		Apps:        p.portalApps(req, s),
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, portalTemplateName, t)
+}
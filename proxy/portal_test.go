@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func testPortalProxy(t *testing.T) *LdapProxy {
+	f, err := ioutil.TempFile("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("deny group=contractors path=^/docs/\nallow\n")
+	f.Close()
+
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://127.0.0.1:3000/grafana/ title=Grafana",
+		"static://200/healthz",
+		"file:///srv/docs#/docs/",
+		"static://200/reports/ groups=finance title=Sales%20Reports",
+		"http://127.0.0.1:8080/",
+	}
+	o.ACLFile = f.Name()
+	o.LandingPage = true
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewLdapProxy(o, func(string) bool { return true })
+}
+
+func TestPortalApps(t *testing.T) {
+	p := testPortalProxy(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, tc := range []struct {
+		groups   []string
+		expected string
+	}{
+		{[]string{"staff"}, "Grafana /grafana/, /docs/ /docs/"},
+		{[]string{"staff", "finance"}, "Grafana /grafana/, /docs/ /docs/, Sales Reports /reports/"},
+		{[]string{"contractors"}, "Grafana /grafana/"},
+	} {
+		var got []string
+		for _, app := range p.portalApps(req, &session.State{User: "alice", Groups: tc.groups}) {
+			got = append(got, app.Title+" "+app.Path)
+		}
+		if strings.Join(got, ", ") != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.groups, tc.expected, strings.Join(got, ", "))
+		}
+	}
+}
+
+func TestPortal(t *testing.T) {
+	p := testPortalProxy(t)
+	get := func(path string, s *session.State) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if s != nil {
+			rw := httptest.NewRecorder()
+			p.SaveSession(rw, req, s)
+			req.AddCookie(rw.Result().Cookies()[0])
+		}
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := get("/", &session.State{User: "michael", Groups: []string{"finance"}})
+	body := rw.Body.String()
+	if rw.Code != http.StatusOK || !strings.Contains(body, `<a href="/reports/">Sales Reports</a>`) || !strings.Contains(body, "<b>michael</b>") {
+		t.Errorf("expected the landing page, got %d %s", rw.Code, body)
+	}
+	if rw.Header().Get("Cache-control") != "no-store" {
+		t.Errorf("expected the landing page not to be cached, got %q", rw.Header())
+	}
+	if rw := get("/", nil); rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "Sign In") {
+		t.Errorf("expected the sign-in page before signing in, got %d", rw.Code)
+	}
+
+	p.LandingPage = false
+	if rw := get("/", &session.State{User: "michael"}); strings.Contains(rw.Body.String(), "Applications") {
+		t.Error("expected / to be proxied without the landing page")
+	}
+}
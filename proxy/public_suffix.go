@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultPublicSuffixList is where Debian's publicsuffix package installs
+// the list from https://publicsuffix.org/
+const DefaultPublicSuffixList = "/usr/share/publicsuffix/public_suffix_list.dat"
+
+// publicSuffixList holds the rules of the public suffix list: domains under
+// which anyone can register names, which cookies must never be scoped to
+type publicSuffixList struct {
+	rules      map[string]bool
+	wildcards  map[string]bool // *.ck is kept as ck
+	exceptions map[string]bool // !www.ck is kept as www.ck
+}
+
+func loadPublicSuffixList(path string) (*publicSuffixList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePublicSuffixList(f)
+}
+
+// parsePublicSuffixList reads the list format: a rule per line, the rest of
+// the line after whitespace and // comments being ignored
+func parsePublicSuffixList(r io.Reader) (*publicSuffixList, error) {
+	l := &publicSuffixList{rules: make(map[string]bool), wildcards: make(map[string]bool), exceptions: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			l.exceptions[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			l.wildcards[rule[2:]] = true
+		default:
+			l.rules[rule] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.rules) == 0 {
+		return nil, fmt.Errorf("no rules found")
+	}
+	return l, nil
+}
+
+// publicSuffix returns the public suffix of domain, given by the longest
+// matching rule, or its last label if none match
+func (l *publicSuffixList) publicSuffix(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if l.exceptions[candidate] {
+			return strings.Join(labels[i+1:], ".")
+		}
+		if l.rules[candidate] {
+			return candidate
+		}
+		if i+1 < len(labels) && l.wildcards[strings.Join(labels[i+1:], ".")] {
+			return candidate
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// registrableDomain returns the public suffix of host with one more label,
+// the widest domain a cookie for host may be scoped to. ok is false for IP
+// addresses, public suffixes themselves and internationalized names, which
+// the list only holds in their Unicode form.
+func (l *publicSuffixList) registrableDomain(host string) (domain string, ok bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || net.ParseIP(host) != nil || strings.Contains(host, "xn--") {
+		return "", false
+	}
+	suffix := l.publicSuffix(host)
+	if suffix == "" || host == suffix {
+		return "", false
+	}
+	rest := strings.TrimSuffix(host, "."+suffix)
+	return rest[strings.LastIndex(rest, ".")+1:] + "." + suffix, true
+}
+
+// cookieDomain returns the domain of cookies for host: CookieDomain if it is
+// set, otherwise the registrable domain of host with CookieDomainAuto, or
+// else host itself
+func (p *LdapProxy) cookieDomain(host string) string {
+	if p.CookieDomain != "" {
+		return p.CookieDomain
+	}
+	if p.publicSuffixes != nil {
+		if d, ok := p.publicSuffixes.registrableDomain(host); ok {
+			return d
+		}
+	}
+	return host
+}
+
+func validateCookieDomainAuto(o *Options, msgs []string) []string {
+	if !o.CookieDomainAuto {
+		return msgs
+	}
+	if o.CookieDomain != "" {
+		return append(msgs, "only one of cookie-domain and cookie-domain-auto may be set")
+	}
+	l, err := loadPublicSuffixList(o.PublicSuffixList)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("cookie-domain-auto: unable to load public-suffix-list %s: %v", o.PublicSuffixList, err))
+	}
+	o.publicSuffixes = l
+	return msgs
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPublicSuffixes = `// ===BEGIN ICANN DOMAINS===
+com
+uk
+co.uk
+*.ck
+!www.ck
+
+// ===BEGIN PRIVATE DOMAINS===
+github.io // GitHub Pages
+`
+
+func TestRegistrableDomain(t *testing.T) {
+	l, err := parsePublicSuffixList(strings.NewReader(testPublicSuffixes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, expected string
+	}{
+		{"wiki.example.com", "example.com"},
+		{"a.b.Example.COM.", "example.com"},
+		{"example.com", "example.com"},
+		{"git.example.co.uk", "example.co.uk"},
+		{"co.uk", ""},
+		{"michael.github.io", "michael.github.io"},
+		{"github.io", ""},
+		{"a.b.ck", "a.b.ck"},
+		{"b.ck", ""},
+		{"a.www.ck", "www.ck"},
+		{"wiki.example.internal", "example.internal"},
+		{"localhost", ""},
+		{"10.0.0.1", ""},
+		{"::1", ""},
+		{"wiki.xn--bcher-kva.com", ""},
+	}
+	for _, test := range tests {
+		got, ok := l.registrableDomain(test.host)
+		if got != test.expected || ok != (test.expected != "") {
+			t.Errorf("registrableDomain(%q) = %q, %v; expected %q", test.host, got, ok, test.expected)
+		}
+	}
+}
+
+func TestCookieDomainAuto(t *testing.T) {
+	l, _ := parsePublicSuffixList(strings.NewReader(testPublicSuffixes))
+	p := &LdapProxy{CookieName: "_ldap_proxy", publicSuffixes: l}
+	for host, expected := range map[string]string{
+		"wiki.example.com:8443": "example.com",
+		"github.io":             "github.io",
+		"127.0.0.1:4180":        "127.0.0.1",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		if c := p.MakeSessionCookie(req, "", time.Hour, time.Now()); c.Domain != expected {
+			t.Errorf("%s: expected cookie domain %q, got %q", host, expected, c.Domain)
+		}
+	}
+
+	p.CookieDomain = "example.org"
+	req := httptest.NewRequest("GET", "/", nil)
+	if c := p.MakeSessionCookie(req, "", time.Hour, time.Now()); c.Domain != "example.org" {
+		t.Errorf("expected the configured cookie domain, got %q", c.Domain)
+	}
+}
+
+func TestValidateCookieDomainAuto(t *testing.T) {
+	o := testOptions()
+	o.CookieDomainAuto = true
+	o.CookieDomain = "example.com"
+	o.PublicSuffixList = "/nonexistent/public_suffix_list.dat"
+	err := o.Validate()
+	if err == nil || !strings.Contains(err.Error(), "only one of cookie-domain and cookie-domain-auto may be set") {
+		t.Errorf("unexpected error %v", err)
+	}
+	o = testOptions()
+	o.CookieDomainAuto = true
+	o.PublicSuffixList = "/nonexistent/public_suffix_list.dat"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "unable to load public-suffix-list") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// Realm is a directory users may sign in against besides the default one,
+// selected by the Host of the request or on the sign-in page. Sessions
+// remember their realm, so a Host selecting a realm only accepts sessions
+// signed in against it, and other hosts only those of the default directory.
+type Realm struct {
+	Name          string
+	Label         string
+	Hosts         []string
+	LdapGroups    []string
+	GroupMatcher  *ldapauth.GroupMatcher
+	Authenticator Authenticator // replaces the LDAP authenticator of the chain
+}
+
+// realmOptions are the options of a parsed ldap-realm: a copy of the global
+// options with the LDAP settings of the spec
+type realmOptions struct {
+	name  string
+	label string
+	hosts []string
+	opts  *Options
+}
+
+// parseRealm parses a ldap-realm spec, "name key=value ...", with keys
+// overriding the LDAP settings of o
+func parseRealm(o *Options, spec string) (*realmOptions, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, errors.New("missing realm name")
+	}
+	c := *o
+	r := &realmOptions{name: fields[0], label: fields[0], opts: &c}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid realm option %q (expected key=value)", f)
+		}
+		if err := r.set(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *realmOptions) set(key, value string) error {
+	var err error
+	switch key {
+	case "hosts":
+		r.hosts = strings.Split(strings.ToLower(value), ",")
+	case "label":
+		// labels can't contain spaces in a spec, so _ stands for one
+		r.label = strings.Replace(value, "_", " ", -1)
+	case "server_host":
+		r.opts.LdapServerHost = value
+	case "server_port":
+		r.opts.LdapServerPort, err = strconv.Atoi(value)
+	case "tls":
+		r.opts.LdapTLS, err = strconv.ParseBool(value)
+	case "base_dn":
+		r.opts.LdapBaseDn = value
+	case "bind_dn":
+		r.opts.LdapBindDn = value
+	case "bind_dn_password_file":
+		r.opts.LdapBindDnPassword, r.opts.LdapBindDnPasswordFile = "", value
+	case "groups":
+		// an empty list requires no group
+		r.opts.LdapGroups = nil
+		if value != "" {
+			r.opts.LdapGroups = strings.Split(value, ",")
+		}
+	case "group_match":
+		r.opts.LdapGroupMatch = value
+	default:
+		return fmt.Errorf("unknown realm option %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid realm option %s=%q", key, value)
+	}
+	return nil
+}
+
+func validateRealms(o *Options, msgs []string) []string {
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	for _, spec := range o.LdapRealms {
+		r, err := parseRealm(o, spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid ldap-realm %q: %v", spec, err))
+			continue
+		}
+		if names[r.name] {
+			msgs = append(msgs, fmt.Sprintf("duplicate ldap-realm %q", r.name))
+		}
+		names[r.name] = true
+		if len(r.hosts) == 0 {
+			msgs = append(msgs, fmt.Sprintf("ldap-realm %q requires hosts, the only hosts its sessions are accepted on", r.name))
+		}
+		for _, h := range r.hosts {
+			if other, ok := hosts[h]; ok {
+				msgs = append(msgs, fmt.Sprintf("host %q selects both ldap-realm %q and %q", h, other, r.name))
+			}
+			hosts[h] = r.name
+		}
+		if r.opts.LdapGroupCacheRefresh > 0 && r.opts.LdapGroupMatch == ldapauth.GroupMatchRegex {
+			msgs = append(msgs, fmt.Sprintf("ldap-realm %q: ldap-group-cache-refresh is not supported with group_match=regex", r.name))
+		}
+		m, err := ldapauth.NewGroupMatcher(r.opts.LdapGroupMatch, r.opts.LdapGroups)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("ldap-realm %q: %v", r.name, err))
+			continue
+		}
+		r.opts.groupMatcher = m
+		o.realms = append(o.realms, r)
+	}
+	return msgs
+}
+
+// newRealms returns the realms of opts with their directory configurations
+func newRealms(opts *Options) []*Realm {
+	var realms []*Realm
+	for _, r := range opts.realms {
+		realms = append(realms, &Realm{
+			Name:          r.name,
+			Label:         r.label,
+			Hosts:         r.hosts,
+			LdapGroups:    r.opts.LdapGroups,
+			GroupMatcher:  r.opts.groupMatcher,
+			Authenticator: &LDAPAuthenticator{Config: newLdapConfig(r.opts), Groups: r.opts.groupMatcher, ExpireAttribute: r.opts.SessionExpireAttribute, LoginAttribute: ldapLoginAttribute(r.opts)},
+		})
+	}
+	return realms
+}
+
+// hostRealm returns the realm selected by the Host of req, if any
+func (p *LdapProxy) hostRealm(req *http.Request) *Realm {
+	if len(p.Realms) == 0 {
+		return nil
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, r := range p.Realms {
+		for _, h := range r.Hosts {
+			if h == host {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// signInRealm returns the realm a sign-in made with req is checked against:
+// the one its Host selects, else the one named by the user, or nil for the
+// default directory. ok is false if the named realm doesn't exist.
+func (p *LdapProxy) signInRealm(req *http.Request, name string) (r *Realm, ok bool) {
+	if r := p.hostRealm(req); r != nil {
+		return r, true
+	}
+	if name == "" {
+		return nil, true
+	}
+	for _, r := range p.Realms {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// realmName is the name sessions of r record, empty for the default
+// directory
+func realmName(r *Realm) string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
+// realmAuthenticators returns the authenticator chain for sign-ins against
+// r, the configured chain with its LDAP authenticator checking r's directory
+func (p *LdapProxy) realmAuthenticators(r *Realm) []Authenticator {
+	chain := p.authenticators()
+	if r == nil {
+		return chain
+	}
+	realmChain := make([]Authenticator, len(chain))
+	for i, a := range chain {
+		if _, ok := a.(*LDAPAuthenticator); ok {
+			a = r.Authenticator
+		}
+		realmChain[i] = a
+	}
+	return realmChain
+}
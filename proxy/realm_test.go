@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func testRealmProxy() *LdapProxy {
+	// the LDAP authenticator of the default directory is never reached
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "local", password: "local"}, &LDAPAuthenticator{})
+	groups, _ := ldapauth.NewGroupMatcher(ldapauth.GroupMatchCN, []string{"staff"})
+	p.Realms = []*Realm{{
+		Name:          "acme",
+		Label:         "ACME Corp",
+		Hosts:         []string{"wiki.acme.example"},
+		LdapGroups:    []string{"staff"},
+		GroupMatcher:  groups,
+		Authenticator: &staticAuthenticator{user: "michael", password: "acme", groups: []string{"staff"}},
+	}}
+	return p
+}
+
+func TestParseRealm(t *testing.T) {
+	o := testOptions()
+	o.LdapServerHost = "dc1.example.com"
+	o.LdapBaseDn = "dc=example,dc=com"
+	o.LdapGroups = []string{"engineers"}
+	o.LdapRealms = []string{"acme hosts=Wiki.Acme.Example,git.acme.example server_host=dc1.acme.example tls=true groups= label=ACME_Corp"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r := o.realms[0]
+	if r.name != "acme" || r.label != "ACME Corp" || len(r.hosts) != 2 || r.hosts[0] != "wiki.acme.example" {
+		t.Errorf("unexpected realm %+v", r)
+	}
+	if r.opts.LdapServerHost != "dc1.acme.example" || !r.opts.LdapTLS || r.opts.LdapBaseDn != "dc=example,dc=com" || r.opts.LdapGroups != nil {
+		t.Errorf("unexpected realm options %+v", r.opts)
+	}
+	if o.LdapServerHost != "dc1.example.com" || len(o.LdapGroups) != 1 {
+		t.Errorf("realm changed the global options %+v", o)
+	}
+}
+
+func TestValidateRealms(t *testing.T) {
+	o := testOptions()
+	o.LdapRealms = []string{
+		"acme hosts=wiki.acme.example",
+		"acme hosts=wiki.acme.example",
+		"other server_port=ldap",
+		"regex hosts=regex.example group_match=sometimes",
+		"nohosts server_host=dc1.acme.example",
+	}
+	err := o.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, s := range []string{
+		`duplicate ldap-realm "acme"`,
+		`host "wiki.acme.example" selects both ldap-realm "acme" and "acme"`,
+		`invalid ldap-realm "other server_port=ldap": invalid realm option server_port="ldap"`,
+		`ldap-realm "regex":`,
+		`ldap-realm "nohosts" requires hosts`,
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected %q in %q", s, err)
+		}
+	}
+}
+
+func TestSignInRealm(t *testing.T) {
+	p := testRealmProxy()
+	req := httptest.NewRequest("POST", "/ldap/sign_in", nil)
+	req.Host = "WIKI.acme.example:443"
+	if r, ok := p.signInRealm(req, ""); !ok || r == nil || r.Name != "acme" {
+		t.Errorf("expected the host's realm, got %+v", r)
+	}
+
+	req.Host = "portal.example.com"
+	if r, ok := p.signInRealm(req, ""); !ok || r != nil {
+		t.Errorf("expected the default directory, got %+v", r)
+	}
+	if r, ok := p.signInRealm(req, "acme"); !ok || r == nil {
+		t.Errorf("expected the named realm, got %+v", r)
+	}
+	if _, ok := p.signInRealm(req, "nope"); ok {
+		t.Error("accepted an unknown realm")
+	}
+}
+
+func TestSignInJSONRealm(t *testing.T) {
+	p := testRealmProxy()
+	if _, resp := signInJSON(p, `{"username": "michael", "password": "wrong", "realm": "acme"}`); resp.Error != SignInInvalidCredentials {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if _, resp := signInJSON(p, `{"username": "michael", "password": "acme", "realm": "nope"}`); resp.Error != SignInInvalidRequest {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	// authenticators besides LDAP are shared by the realms
+	if _, resp := signInJSON(p, `{"username": "local", "password": "local", "realm": "acme"}`); resp.User != "local" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	rw, resp := signInJSON(p, `{"username": "michael", "password": "acme", "realm": "acme"}`)
+	if resp.User != "michael" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	s, _, err := p.LoadCookiedSession(cookieRequest(rw))
+	if err != nil || s.Realm != "acme" {
+		t.Errorf("unexpected session %+v %v", s, err)
+	}
+
+	p.Realms[0].LdapGroups = []string{"admins"}
+	p.Realms[0].GroupMatcher, _ = ldapauth.NewGroupMatcher(ldapauth.GroupMatchCN, []string{"admins"})
+	if _, resp := signInJSON(p, `{"username": "michael", "password": "acme", "realm": "acme"}`); resp.Error != SignInNotInGroup {
+		t.Errorf("expected the realm's groups to be required, got %+v", resp)
+	}
+}
+
+func TestHostRealmSession(t *testing.T) {
+	p := testRealmProxy()
+	authenticate := func(host, realm string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, req, &session.State{User: "michael", Realm: realm})
+		req = cookieRequest(rw)
+		req.Host = host
+		status, _ := p.authenticate(httptest.NewRecorder(), req)
+		return status
+	}
+	tests := []struct {
+		host, realm string
+		expected    int
+	}{
+		{"wiki.acme.example", "acme", http.StatusAccepted},
+		{"wiki.acme.example", "", http.StatusForbidden},
+		{"portal.example.com", "", http.StatusAccepted},
+		// a realm's session never passed the default ldap-groups
+		{"portal.example.com", "acme", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if got := authenticate(test.host, test.realm); got != test.expected {
+			t.Errorf("session of realm %q on %s: expected %d, got %d", test.realm, test.host, test.expected, got)
+		}
+	}
+}
+
+func TestSignInPageRealms(t *testing.T) {
+	p := testRealmProxy()
+	p.LdapScopeName = "Example"
+	page := func(host string) string {
+		req := httptest.NewRequest("GET", "/ldap/sign_in", nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		p.SignIn(rw, req)
+		return rw.Body.String()
+	}
+	if body := page("portal.example.com"); !strings.Contains(body, `<select name="realm"`) || !strings.Contains(body, `<option value="acme">ACME Corp</option>`) {
+		t.Errorf("expected a realm choice in %s", body)
+	}
+	if body := page("wiki.acme.example"); strings.Contains(body, "<select") || !strings.Contains(body, "Sign in with a ACME Corp Account") {
+		t.Errorf("unexpected page %s", body)
+	}
+}
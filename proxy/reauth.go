@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// reauthResponseWriter watches an upstream's response for the reauth-header.
+// When it is set to true the response is replaced: the session is cleared and
+// a browser loading a page is redirected to sign in again, coming back to
+// the page afterwards, while other requests get 401 Unauthorized.
+type reauthResponseWriter struct {
+	http.ResponseWriter
+	p        *LdapProxy
+	req      *http.Request
+	user     string
+	wrote    bool
+	replaced bool
+}
+
+// reauthWriter returns rw, watched for the reauth-header if one is configured
+func (p *LdapProxy) reauthWriter(rw http.ResponseWriter, req *http.Request, user string) http.ResponseWriter {
+	if p.reauthHeader == "" {
+		return rw
+	}
+	return &reauthResponseWriter{ResponseWriter: rw, p: p, req: req, user: user}
+}
+
+func (w *reauthResponseWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// informational responses are followed by the final one
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wrote = true
+	h := w.Header()
+	v := h.Get(w.p.reauthHeader)
+	if v == "" {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h.Del(w.p.reauthHeader)
+	if !strings.EqualFold(v, "true") {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.replaced = true
+	// the upstream's cookies are kept, e.g. to clear its own session
+	for _, k := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Range", "ETag", "Last-Modified", "Location"} {
+		h.Del(k)
+	}
+	h.Set("Cache-Control", "no-store")
+	w.p.Auditf(w.req, "user %q signed out by the upstream's %s response to %s %s", w.user, w.p.reauthHeader, w.req.Method, w.req.URL.Path)
+	w.p.ClearSessionCookie(w.ResponseWriter, w.req)
+	if !isNavigation(w.req) {
+		http.Error(w.ResponseWriter, "reauthentication required", http.StatusUnauthorized)
+		return
+	}
+	rd := w.p.SignInPath + "?rd=" + url.QueryEscape(w.req.URL.RequestURI())
+	http.Redirect(w.ResponseWriter, w.req, w.p.redirectURL(w.req, rd), http.StatusFound)
+}
+
+func (w *reauthResponseWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		// the upstream's body is discarded
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *reauthResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, so protocol switches can
+// hijack the connection
+func (w *reauthResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestReauthHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fine" {
+			rw.Header().Set("X-LAP-Reauth", "false")
+		} else {
+			rw.Header().Set("X-LAP-Reauth", "true")
+			http.SetCookie(rw, &http.Cookie{Name: "app_session", MaxAge: -1})
+		}
+		rw.Write([]byte("upstream body"))
+	}))
+	defer upstream.Close()
+
+	for _, header := range []string{"X-LAP-Reauth", ""} {
+		o := testOptions()
+		o.Upstreams = []string{upstream.URL + "/"}
+		o.ReauthHeader = header
+		if err := o.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		p := NewLdapProxy(o, func(string) bool { return true })
+		get := func(path, accept string) *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			p.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &session.State{User: "michael"})
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Accept", accept)
+			req.AddCookie(rw.Result().Cookies()[0])
+			rw = httptest.NewRecorder()
+			p.Proxy(rw, req)
+			return rw
+		}
+
+		if header == "" {
+			if rw := get("/account?tab=1", "text/html"); rw.Code != http.StatusOK || rw.Header().Get("X-LAP-Reauth") != "true" {
+				t.Errorf("expected the header passed on without reauth-header, got %d %v", rw.Code, rw.Header())
+			}
+			continue
+		}
+
+		rw := get("/account?tab=1", "text/html")
+		if rw.Code != http.StatusFound || rw.Header().Get("Location") != "/ldap/sign_in?rd=%2Faccount%3Ftab%3D1" {
+			t.Errorf("expected a redirect to sign in, got %d %v", rw.Code, rw.Header())
+		}
+		cookies := strings.Join(rw.Header()["Set-Cookie"], "\n")
+		if !strings.Contains(cookies, "_ldap_proxy=;") || !strings.Contains(cookies, "app_session=") {
+			t.Errorf("expected the session cleared and the upstream's cookie kept, got %q", cookies)
+		}
+		if strings.Contains(rw.Body.String(), "upstream body") || rw.Header().Get("X-LAP-Reauth") != "" {
+			t.Errorf("expected the upstream's response replaced, got %v %q", rw.Header(), rw.Body)
+		}
+
+		if rw = get("/api/items", "application/json"); rw.Code != http.StatusUnauthorized {
+			t.Errorf("expected API calls to get 401, got %d", rw.Code)
+		}
+		if rw = get("/fine", "text/html"); rw.Code != http.StatusOK || rw.Body.String() != "upstream body" || rw.Header().Get("X-LAP-Reauth") != "" {
+			t.Errorf("expected the response passed on without the header, got %d %v %q", rw.Code, rw.Header(), rw.Body)
+		}
+	}
+}
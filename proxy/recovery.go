@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanic logs a panic raised while serving req, with its stack, and
+// serves the error page in place of dropping the connection. It must be
+// deferred.
+func (p *LdapProxy) recoverPanic(rw http.ResponseWriter, req *http.Request) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	if err == http.ErrAbortHandler {
+		// raised by httputil.ReverseProxy to abort a response on purpose
+		panic(err)
+	}
+	log.Printf("%s panic serving %s %s: %v\n%s", p.getRemoteAddrStr(req), req.Method, req.URL.RequestURI(), err, debug.Stack())
+	p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+}
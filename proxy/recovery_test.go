@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	p := &LdapProxy{
+		templates: getTemplates(),
+		serveMux: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			panic("boom")
+		}),
+		skipAuthOptions: true,
+	}
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("OPTIONS", "/", nil))
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rw.Code)
+	}
+}
+
+func TestRecoverPanicRepanicsAbortHandler(t *testing.T) {
+	p := &LdapProxy{
+		serveMux: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			panic(http.ErrAbortHandler)
+		}),
+		skipAuthOptions: true,
+	}
+
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler, got %v", err)
+		}
+	}()
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/", nil))
+}
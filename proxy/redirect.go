@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// redirectTokenName is the key rd tokens are signed under, keeping them apart
+// from cookie values signed with the same secret
+const redirectTokenName = "rd"
+
+// redirectTokenExpiry is how long a sign-in page may be left open before its
+// rd token is no longer honoured
+const redirectTokenExpiry = 24 * time.Hour
+
+// signRedirect returns a signed rd token for uri, so the path and query
+// string the user asked for survive the sign-in form intact
+func (p *LdapProxy) signRedirect(uri string, now time.Time) string {
+	return p.signCookieValue(redirectTokenName, uri, now, redirectTokenExpiry)
+}
+
+// verifyRedirect returns the uri of a token made by signRedirect. The
+// sign-in page appends the URL fragment to the token, which is kept.
+func (p *LdapProxy) verifyRedirect(token string) (string, bool) {
+	fragment := ""
+	if i := strings.Index(token, "#"); i >= 0 {
+		token, fragment = token[:i], token[i:]
+	}
+	uri, _, ok := p.validateCookie(&http.Cookie{Name: redirectTokenName, Value: token}, redirectTokenExpiry)
+	if !ok {
+		return "", false
+	}
+	return uri + fragment, true
+}
+
+// landingPath returns the landing_path of the upstreams for sign-ins on the
+// host of req, preferring the first given for the host over the first given
+// without one, or "" if there is none
+func (p *LdapProxy) landingPath(req *http.Request) string {
+	_, uos := p.upstreamsWithOptions()
+	host, landing := requestHost(req, p.TrustedProxies), ""
+	for _, o := range uos {
+		switch {
+		case o.LandingPath == "":
+		case o.LandingHost == "":
+			if landing == "" {
+				landing = o.LandingPath
+			}
+		case strings.EqualFold(o.LandingHost, host):
+			return o.LandingPath
+		}
+	}
+	return landing
+}
+
+// isLocalRedirect reports whether uri is a path on this host. "//host" and
+// "/\host" are taken by browsers as URLs of another host.
+func isLocalRedirect(uri string) bool {
+	return strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//") && !strings.HasPrefix(uri, "/\\")
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var rdInputRegex = regexp.MustCompile(`name="rd" value="([^"]*)"`)
+
+func signInPageRedirect(t *testing.T, rw *httptest.ResponseRecorder) string {
+	m := rdInputRegex.FindStringSubmatch(rw.Body.String())
+	if m == nil {
+		t.Fatalf("no rd input in %s", rw.Body.String())
+	}
+	return html.UnescapeString(m[1])
+}
+
+func postSignIn(p *LdapProxy, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	p.SignIn(rw, req)
+	return rw
+}
+
+func TestSignInDeepLink(t *testing.T) {
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "michael", password: "secret"})
+	const deepLink = "/reports/view?year=2018&q=a%26b"
+
+	rw := httptest.NewRecorder()
+	p.SignInPage(rw, httptest.NewRequest("GET", deepLink, nil), http.StatusForbidden, false)
+	token := signInPageRedirect(t, rw)
+	if strings.Contains(token, "reports") {
+		t.Errorf("expected an opaque token, got %q", token)
+	}
+
+	// a failed attempt renders the page again with the same destination
+	rw = postSignIn(p, url.Values{"username": {"michael"}, "password": {"wrong"}, "rd": {token}})
+	if uri, ok := p.verifyRedirect(signInPageRedirect(t, rw)); !ok || uri != deepLink {
+		t.Errorf("expected the retry to keep %s, got %q %v", deepLink, uri, ok)
+	}
+
+	// the sign-in page appends the URL fragment
+	rw = postSignIn(p, url.Values{"username": {"michael"}, "password": {"secret"}, "rd": {token + "#row-3"}})
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != deepLink+"#row-3" {
+		t.Errorf("expected a redirect to %s#row-3, got %d %q", deepLink, rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestGetRedirect(t *testing.T) {
+	p := &LdapProxy{CookieSeed: "secret"}
+	expired := p.signRedirect("/reports/", time.Now().Add(-2*redirectTokenExpiry))
+	other := (&LdapProxy{CookieSeed: "other"}).signRedirect("/reports/", time.Now())
+
+	for rd, expected := range map[string]string{
+		p.signRedirect("/reports/?a=1&b=2", time.Now()): "/reports/?a=1&b=2",
+		expired:               "/",
+		other:                 "/",
+		"/plain/path?x=1":     "/plain/path?x=1",
+		"//evil.example.com":  "/",
+		"/\\evil.example.com": "/",
+		"https://example.com": "/",
+		"":                    "/",
+	} {
+		req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(url.Values{"rd": {rd}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if got, err := p.GetRedirect(req); err != nil || got != expected {
+			t.Errorf("%q: expected %q got %q %v", rd, expected, got, err)
+		}
+	}
+}
+
+func TestLandingPath(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://127.0.0.1:3000/grafana/ landing_path=/grafana/d/home",
+		"http://127.0.0.1:3001/reports/ landing_path=reports.example.com/reports/weekly",
+		"http://127.0.0.1:8080/ landing_path=/welcome",
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	for target, expected := range map[string]string{
+		"http://proxy.example.com/ldap/sign_in":                    "/grafana/d/home",
+		"http://REPORTS.example.com/ldap/sign_in":                  "/reports/weekly",
+		"http://reports.example.com/ldap/sign_in?rd=%2Freports%2F": "/reports/",
+	} {
+		req := httptest.NewRequest("GET", target, nil)
+		if got, err := p.GetRedirect(req); err != nil || got != expected {
+			t.Errorf("%s: expected %q got %q %v", target, expected, got, err)
+		}
+	}
+
+	for _, spec := range []string{"http://a/ landing_path=home", "http://a/ landing_path=//evil.example.com/", "http://a/ landing_path=a.example.com/\\evil"} {
+		if _, _, err := parseUpstream(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// refreshGrace is how long the cookie minted by a refresh is handed to other
+// requests still carrying the cookie it replaced, e.g. parallel XHRs sent
+// before the browser saw the new cookie
+const refreshGrace = 30 * time.Second
+
+// refreshGroup makes concurrent refreshes of the same session cookie share a
+// single refreshed cookie, so parallel responses don't each set a different
+// one
+type refreshGroup struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done   chan struct{}
+	cookie *http.Cookie
+	err    error
+	at     time.Time
+}
+
+func newRefreshGroup() *refreshGroup {
+	return &refreshGroup{calls: make(map[string]*refreshCall)}
+}
+
+// do calls fn to refresh the cookie with value key, unless a refresh of it is
+// in flight or finished within refreshGrace, in which case its result is
+// returned instead
+func (g *refreshGroup) do(key string, fn func() (*http.Cookie, error)) (*http.Cookie, error) {
+	if g == nil || key == "" {
+		return fn()
+	}
+
+	g.mu.Lock()
+	now := time.Now()
+	for k, c := range g.calls {
+		if !c.at.IsZero() && now.Sub(c.at) > refreshGrace {
+			delete(g.calls, k)
+		}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.cookie, c.err
+	}
+	c := &refreshCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.cookie, c.err = fn()
+
+	g.mu.Lock()
+	c.at = time.Now()
+	if c.err != nil {
+		// let the next request try again
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	close(c.done)
+	return c.cookie, c.err
+}
+
+// refreshSession saves the refreshed session s, sharing the new cookie with
+// concurrent requests refreshing the same cookie
+func (p *LdapProxy) refreshSession(rw http.ResponseWriter, req *http.Request, s *session.State) error {
+	var key string
+	if c, err := p.sessionCookie(req); err == nil {
+		key = c.Value
+	}
+	c, err := p.refreshes.do(key, func() (*http.Cookie, error) {
+		value, err := p.sessionCookieValue(s)
+		if err != nil {
+			return nil, err
+		}
+		return p.MakeSessionCookie(req, value, p.CookieExpire, time.Now()), nil
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(rw, c)
+	return nil
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestRefreshGroupSharesResult(t *testing.T) {
+	g := newRefreshGroup()
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (*http.Cookie, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &http.Cookie{Name: "_ldap_proxy", Value: "refreshed"}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*http.Cookie, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do("old", fn)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected 1 refresh, got %d", calls)
+	}
+	for _, c := range results {
+		if c == nil || c.Value != "refreshed" {
+			t.Errorf("expected shared cookie, got %+v", c)
+		}
+	}
+
+	// requests arriving shortly after with the old cookie get the same one
+	if c, _ := g.do("old", fn); c.Value != "refreshed" || calls != 1 {
+		t.Errorf("expected cookie within grace period, got %+v after %d refreshes", c, calls)
+	}
+}
+
+func TestRefreshGroupRetriesErrors(t *testing.T) {
+	g := newRefreshGroup()
+	if _, err := g.do("old", func() (*http.Cookie, error) { return nil, errors.New("boom") }); err == nil {
+		t.Error("expected error")
+	}
+	c, err := g.do("old", func() (*http.Cookie, error) { return &http.Cookie{Value: "ok"}, nil })
+	if err != nil || c.Value != "ok" {
+		t.Errorf("expected refresh to be retried, got %+v %v", c, err)
+	}
+}
+
+func TestRefreshSessionSetsSameCookie(t *testing.T) {
+	p := &LdapProxy{CookieName: "_ldap_proxy", CookieSeed: "secret", CookieExpire: time.Hour, refreshes: newRefreshGroup()}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "_ldap_proxy", Value: "old"})
+
+	var values []string
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		if err := p.refreshSession(rw, req, &session.State{User: "michael"}); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		values = append(values, rw.Header().Get("Set-Cookie"))
+		time.Sleep(time.Millisecond)
+	}
+	if values[0] == "" || values[0] != values[1] {
+		t.Errorf("expected the same Set-Cookie, got %q", values)
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reloadProbeTimeout bounds the health check of each new upstream of a
+// reloaded configuration
+const reloadProbeTimeout = 5 * time.Second
+
+// reloadResult is the JSON returned by AdminReload: the changed options and,
+// if the running configuration was kept, why
+type reloadResult struct {
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// AdminReload reloads the configuration on POST, returning a reloadResult,
+// with 409 Conflict if the running configuration was kept. Only AdminUsers
+// may use it.
+func (p *LdapProxy) AdminReload(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if !p.isAdmin(session.User) {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// as for AdminSkipAuth, so another site can't make a signed in admin's
+	// browser reload
+	if !isJSONRequest(req) {
+		http.Error(rw, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	result := &reloadResult{Changes: []string{}}
+	var err error
+	if p.Reload == nil {
+		err = errors.New("reloading the configuration requires graceful-upgrade")
+	} else {
+		var changes []string
+		if changes, err = p.Reload(); changes != nil {
+			result.Changes = changes
+		}
+	}
+	code := http.StatusOK
+	if err != nil {
+		p.Auditf(req, "user %q reloading the configuration failed: %s", session.User, err)
+		result.Error = err.Error()
+		code = http.StatusConflict
+	} else if len(result.Changes) > 0 {
+		p.Auditf(req, "user %q reloaded the configuration, changing %s", session.User, strings.Join(result.Changes, ", "))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(result)
+}
+
+// Reload reads the configuration again with LoadOptions and, if it changed,
+// logs the changes, checks it as check-config does, which includes binding
+// to the directories, and checks each new upstream answers. Only then is the
+// process upgraded to one started with it, as on SIGUSR2; if any check
+// fails, the running configuration is kept. Sessions of the memory store
+// would be lost with the process, so it refuses to reload with one. It
+// returns the changes.
+func (s *Server) Reload() ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if !s.Opts.GracefulUpgrade || s.LoadOptions == nil {
+		return nil, errors.New("reloading the configuration requires graceful-upgrade")
+	}
+	opts, err := s.LoadOptions()
+	if err != nil {
+		log.Printf("reload: keeping the running configuration: %s", err)
+		return nil, err
+	}
+	changes := diffOptions(s.Opts, opts)
+	if len(changes) == 0 {
+		log.Printf("reload: the configuration hasn't changed")
+		return changes, nil
+	}
+	for _, c := range changes {
+		log.Printf("reload: %s", c)
+	}
+	if s.Opts.SessionStore == SessionStoreMemory {
+		err := errors.New("reloading the configuration would sign everyone out of session-store=memory, restart the proxy instead")
+		log.Printf("reload: keeping the running configuration: %s", err)
+		return changes, err
+	}
+	if err := CheckConfig(opts); err != nil {
+		log.Printf("reload: keeping the running configuration: %s", err)
+		return changes, err
+	}
+	if err := probeNewUpstreams(s.Opts, opts); err != nil {
+		log.Printf("reload: keeping the running configuration: %s", err)
+		return changes, err
+	}
+	if err := s.handOver(); err != nil {
+		log.Printf("ERROR: reload failed, serving on with the running configuration - %s", err)
+		return changes, err
+	}
+	return changes, nil
+}
+
+// diffOptions describes the options set in the config file, by its keys,
+// whose values differ between current and next, hiding those of secrets
+func diffOptions(current, next *Options) []string {
+	var changes []string
+	cv, nv := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	t := cv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("cfg")
+		if key == "" {
+			continue
+		}
+		a, b := cv.Field(i).Interface(), nv.Field(i).Interface()
+		switch {
+		case reflect.DeepEqual(a, b):
+		case f.Tag.Get("secret") == "true":
+			changes = append(changes, key+" changed")
+		default:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, formatOption(a), formatOption(b)))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func formatOption(v interface{}) string {
+	switch v.(type) {
+	case string, []string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// probeNewUpstreams requests the URL of each http and https upstream of
+// next which current doesn't have, failing if one can't be reached or
+// answers with a server error
+func probeNewUpstreams(current, next *Options) error {
+	running := make(map[string]bool)
+	for _, u := range current.proxyURLs {
+		running[u.String()] = true
+	}
+	var msgs []string
+	for i, u := range next.proxyURLs {
+		if running[u.String()] || u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		}
+		client := &http.Client{
+			Transport: newUpstreamTransport(next.upstreamOptions[i]),
+			Timeout:   reloadProbeTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get(u.String())
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %s unreachable: %s", u.Redacted(), err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			msgs = append(msgs, fmt.Sprintf("upstream %s answered %s", u.Redacted(), resp.Status))
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestDiffOptions(t *testing.T) {
+	current, next := testOptions(), testOptions()
+	if changes := diffOptions(current, next); len(changes) != 0 {
+		t.Errorf("expected no changes, got %q", changes)
+	}
+	next.Upstreams = []string{"http://127.0.0.1:8081/"}
+	next.LdapServerPort = 636
+	next.CookieSecret = "bazquux"
+	expected := []string{
+		"cookie_secret changed",
+		"ldap_server_port: 0 -> 636",
+		`upstreams: ["http://127.0.0.1:8080/"] -> ["http://127.0.0.1:8081/"]`,
+	}
+	if changes := diffOptions(current, next); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %q, got %q", expected, changes)
+	}
+}
+
+// reloadTestOptions returns options which check-config passes without a
+// directory, with upstreams
+func reloadTestOptions(upstreams ...string) *Options {
+	o := testOptions()
+	o.Authenticators = []string{"exec"}
+	o.AuthExecCommand = "/bin/true"
+	o.GracefulUpgrade = true
+	o.Upstreams = upstreams
+	return o
+}
+
+func TestReload(t *testing.T) {
+	up := httptest.NewServer(http.NotFoundHandler())
+	defer up.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	current := reloadTestOptions(failing.URL + "/running/")
+	if err := current.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// upstreams kept from the running configuration aren't checked again,
+	// and any answer but a server error will do for new ones
+	next := reloadTestOptions(failing.URL+"/running/", up.URL+"/new/")
+	if err := next.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := probeNewUpstreams(current, next); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, tC := range []struct {
+		upstreams []string
+		err       string
+	}{
+		{[]string{failing.URL + "/running/", failing.URL + "/new/"}, "503 Service Unavailable"},
+		{[]string{down.URL + "/new/"}, "unreachable"},
+		{[]string{"not a url/"}, "Invalid configuration"},
+	} {
+		s := &Server{Opts: current, LoadOptions: func() (*Options, error) { return reloadTestOptions(tC.upstreams...), nil }}
+		changes, err := s.Reload()
+		if err == nil || !strings.Contains(err.Error(), tC.err) {
+			t.Errorf("%q: expected %q, got %v", tC.upstreams, tC.err, err)
+		}
+		if len(changes) != 1 || s.handedOver() {
+			t.Errorf("%q: expected the running configuration to be kept, got %q", tC.upstreams, changes)
+		}
+	}
+
+	s := &Server{Opts: current, LoadOptions: func() (*Options, error) { return reloadTestOptions(failing.URL + "/running/"), nil }}
+	if changes, err := s.Reload(); err != nil || len(changes) != 0 {
+		t.Errorf("expected nothing to reload, got %q %v", changes, err)
+	}
+	s.Opts = reloadTestOptions(failing.URL + "/running/")
+	s.Opts.SessionStore = SessionStoreMemory
+	s.LoadOptions = func() (*Options, error) {
+		o := reloadTestOptions(failing.URL + "/running/")
+		o.SessionStore = SessionStoreMemory
+		o.LdapServerPort = 636
+		return o, nil
+	}
+	if changes, err := s.Reload(); err == nil || !strings.Contains(err.Error(), "session-store=memory") || len(changes) != 1 || s.handedOver() {
+		t.Errorf("expected reloads to be refused with the memory session store, got %q %v", changes, err)
+	}
+	s.Opts = reloadTestOptions()
+	s.Opts.GracefulUpgrade = false
+	if _, err := s.Reload(); err == nil || !strings.Contains(err.Error(), "requires graceful-upgrade") {
+		t.Errorf("expected reloads to require graceful-upgrade, got %v", err)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	o := testOptions()
+	o.AdminUsers = []string{"admin"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	call := func(user, method, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/ldap/admin/reload", nil)
+		req.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, req, &session.State{User: user})
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := call("alice", "POST", "application/json"); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non admin, got %d", rw.Code)
+	}
+	if rw := call("admin", "GET", ""); rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rw.Code)
+	}
+	if rw := call("admin", "POST", "application/x-www-form-urlencoded"); rw.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for a form post, got %d", rw.Code)
+	}
+	if rw := call("admin", "POST", "application/json; charset=utf-8"); rw.Code != http.StatusConflict || !strings.Contains(rw.Body.String(), "requires graceful-upgrade") {
+		t.Errorf("expected 409 without Reload, got %d %s", rw.Code, rw.Body)
+	}
+
+	var err error
+	p.Reload = func() ([]string, error) { return []string{"ldap_server_port: 389 -> 636"}, err }
+	for code, e := range map[int]error{http.StatusOK: nil, http.StatusConflict: errors.New("ldap bind failed")} {
+		err = e
+		rw := call("admin", "POST", "application/json")
+		result := &reloadResult{}
+		json.NewDecoder(rw.Body).Decode(result)
+		if rw.Code != code || len(result.Changes) != 1 || e != nil && result.Error != e.Error() {
+			t.Errorf("%v: unexpected response %d %+v", e, rw.Code, result)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var responseMetrics = expvar.NewMap("upstream_responses")
+
+var errResponseTooLarge = errors.New("upstream response too large")
+
+// responseLimiter watches the size of the responses of an upstream, cutting
+// off those larger than max and reporting those larger than large. A zero
+// max or large disables that check.
+type responseLimiter struct {
+	handler  http.Handler
+	upstream string
+	max      int64
+	large    int64
+}
+
+func (l *responseLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w := &limitedResponseWriter{ResponseWriter: rw, max: l.max}
+	defer func() {
+		responseMetrics.Add("bytes", w.written)
+		if l.large > 0 && w.written > l.large {
+			responseMetrics.Add("large", 1)
+			log.Printf("large response of %d bytes from upstream %s for %s", w.written, l.upstream, req.URL.RequestURI())
+		}
+		if w.limited {
+			responseMetrics.Add("limited", 1)
+			log.Printf("cut off response from upstream %s for %s: larger than max_response_size (%d bytes)", l.upstream, req.URL.RequestURI(), l.max)
+		}
+	}()
+	l.handler.ServeHTTP(w, req)
+}
+
+// limitedResponseWriter fails writes beyond max bytes, which makes
+// httputil.ReverseProxy abort the response. Responses declaring a larger
+// Content-Length are replaced by 502 Bad Gateway before anything is sent.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	max     int64
+	written int64
+	limited bool
+}
+
+func (w *limitedResponseWriter) WriteHeader(code int) {
+	if w.max > 0 {
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && n > w.max {
+			w.limited = true
+			// keeping what the access log reads, by its canonical key
+			for k := range w.Header() {
+				if k != upstreamAddressHeader && k != authInfoHeader && k != skipAuthRuleHeader {
+					w.Header().Del(k)
+				}
+			}
+			http.Error(w.ResponseWriter, "upstream response too large", http.StatusBadGateway)
+			// sent before the failed Write aborts the connection
+			w.Flush()
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitedResponseWriter) Write(b []byte) (int, error) {
+	if w.limited {
+		return 0, errResponseTooLarge
+	}
+	if w.max > 0 && w.written+int64(len(b)) > w.max {
+		w.limited = true
+		n, _ := w.ResponseWriter.Write(b[:w.max-w.written])
+		w.written += int64(n)
+		return n, errResponseTooLarge
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *limitedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, so protocol switches can
+// hijack the connection; what is sent after one isn't limited
+func (w *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// parseSize parses a number of bytes with an optional K, M or G suffix for
+// binary multiples, e.g. 512M
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(value), "B")
+	s = strings.TrimSuffix(s, "I")
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
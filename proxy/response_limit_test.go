@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"1024": 1024,
+		"4k":   4 << 10,
+		"512M": 512 << 20,
+		"2GiB": 2 << 30,
+		"10MB": 10 << 20,
+	} {
+		if got, err := parseSize(value); err != nil || got != expected {
+			t.Errorf("%s: expected %d got %d %v", value, expected, got, err)
+		}
+	}
+	for _, value := range []string{"", "M", "-1", "1T", "lots"} {
+		if _, err := parseSize(value); err == nil {
+			t.Errorf("expected error parsing %q", value)
+		}
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 2048)
+		if r.URL.Path == "/chunked" {
+			// no Content-Length, so the limit is only found while copying
+			w.Write([]byte(body[:1024]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(body[1024:]))
+			return
+		}
+		if r.URL.Path == "/small" {
+			body = body[:100]
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	_, o, err := parseUpstream(backend.URL + "/ max_response_size=1k buffering=false")
+	if err != nil || o.MaxResponseSize != 1024 || !o.NoBuffering {
+		t.Fatalf("unexpected options %+v %v", o, err)
+	}
+	h := newUpstreamProxy(u, "/", NewOptions(), o, nil)
+
+	for path, expected := range map[string]int{"/small": http.StatusOK, "/large": http.StatusBadGateway} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != expected {
+			t.Errorf("%s: expected %d got %d", path, expected, rw.Code)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/chunked", nil))
+	if rw.Body.Len() != 1024 {
+		t.Errorf("expected the response to be cut off at 1024 bytes, got %d", rw.Body.Len())
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// secretExecTimeout bounds how long an exec: secret reference may run
+const secretExecTimeout = 30 * time.Second
+
+// ResolveSecrets replaces the values of the string fields of options tagged
+// `secret:"true"` which are references to a secret held elsewhere:
+//
+//	file:/path/to/file  the contents of the file
+//	env:NAME            the value of the environment variable NAME
+//	exec:command args   the output of the command
+//
+// Trailing newlines are removed from file contents and command output.
+// Values that aren't references are left as they are.
+func ResolveSecrets(options interface{}) error {
+	val := reflect.ValueOf(options).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Tag.Get("secret") != "true" || field.Type.Kind() != reflect.String {
+			continue
+		}
+		v, err := resolveSecret(val.Field(i).String())
+		if err != nil {
+			name := field.Tag.Get("flag")
+			if name == "" {
+				name = field.Name
+			}
+			return fmt.Errorf("resolving %s: %v", name, err)
+		}
+		val.Field(i).SetString(v)
+	}
+	return nil
+}
+
+func resolveSecret(v string) (string, error) {
+	kv := strings.SplitN(v, ":", 2)
+	if len(kv) != 2 {
+		return v, nil
+	}
+	ref := kv[1]
+	switch kv[0] {
+	case "file":
+		b, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case "env":
+		s, ok := os.LookupEnv(ref)
+		if !ok || s == "" {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return s, nil
+	case "exec":
+		args := strings.Fields(ref)
+		if len(args) == 0 {
+			return "", fmt.Errorf("no command given")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("running %s: %v", args[0], err)
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	}
+	return v, nil
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	f, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+	os.Setenv("LDAP_PROXY_TEST_SECRET", "from-env")
+	defer os.Unsetenv("LDAP_PROXY_TEST_SECRET")
+
+	o := testOptions()
+	o.CookieSecret = "file:" + f.Name()
+	o.LdapBindDnPassword = "env:LDAP_PROXY_TEST_SECRET"
+	o.BasicAuthPassword = "exec:echo from-exec"
+	o.SignatureKey = "sha1:secret"
+	o.LdapBindDn = "file:not-a-secret"
+	if err := ResolveSecrets(o); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	for got, expected := range map[string]string{
+		o.CookieSecret:       "from-file",
+		o.LdapBindDnPassword: "from-env",
+		o.BasicAuthPassword:  "from-exec",
+		o.SignatureKey:       "sha1:secret",
+		o.LdapBindDn:         "file:not-a-secret",
+	} {
+		if got != expected {
+			t.Errorf("expected %q got %q", expected, got)
+		}
+	}
+}
+
+func TestResolveSecretsErrors(t *testing.T) {
+	for _, ref := range []string{
+		"file:/nonexistent/secret",
+		"env:LDAP_PROXY_TEST_UNSET",
+		"exec:false",
+		"exec:",
+	} {
+		o := testOptions()
+		o.CookieSecret = ref
+		err := ResolveSecrets(o)
+		if err == nil || !strings.HasPrefix(err.Error(), "resolving cookie-secret:") {
+			t.Errorf("%s: unexpected error %v", ref, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// bearerToken returns the token of the Authorization: Bearer header of req
+func bearerToken(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+	return token, token != ""
+}
+
+// sessionCookie returns the session cookie of req or, with SessionBearer,
+// a cookie holding its bearer token if it has no session cookie
+func (p *LdapProxy) sessionCookie(req *http.Request) (*http.Cookie, error) {
+	c, err := req.Cookie(p.CookieName)
+	if err == nil || !p.SessionBearer {
+		return c, err
+	}
+	if token, ok := bearerToken(req); ok {
+		return &http.Cookie{Name: p.CookieName, Value: token}, nil
+	}
+	return nil, err
+}
+
+// sessionFromBearer reports whether the session of req is read from its
+// Authorization header rather than a cookie
+func (p *LdapProxy) sessionFromBearer(req *http.Request) bool {
+	if !p.SessionBearer {
+		return false
+	}
+	if _, err := req.Cookie(p.CookieName); err == nil {
+		return false
+	}
+	_, ok := bearerToken(req)
+	return ok
+}
+
+// sessionToken returns the value of the session cookie set on rw, which
+// clients without cookies send as a bearer token instead
+func (p *LdapProxy) sessionToken(rw http.ResponseWriter) string {
+	var token string
+	for _, c := range (&http.Response{Header: rw.Header()}).Cookies() {
+		if c.Name == p.CookieName {
+			token = c.Value
+		}
+	}
+	return token
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionBearer(t *testing.T) {
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "michael", password: "secret"})
+	p.SessionBearer = true
+	rw, resp := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	if rw.Code != http.StatusOK || resp.Token == "" {
+		t.Fatalf("expected a session token, got %d %+v", rw.Code, resp)
+	}
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	status, s := p.authenticate(httptest.NewRecorder(), req)
+	if status != http.StatusAccepted || s == nil || s.User != "michael" {
+		t.Fatalf("expected the bearer session to authenticate, got %d %+v", status, s)
+	}
+	if h := req.Header.Get("Authorization"); h != "" {
+		t.Errorf("expected the session token to be removed from the upstream request, got %q", h)
+	}
+
+	req = httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token+"x")
+	if status, _ := p.authenticate(httptest.NewRecorder(), req); status != http.StatusForbidden {
+		t.Errorf("expected an altered token to be rejected, got %d", status)
+	}
+
+	p.SessionBearer = false
+	req = httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	if status, _ := p.authenticate(httptest.NewRecorder(), req); status != http.StatusForbidden {
+		t.Errorf("expected bearer tokens to be ignored without session-bearer, got %d", status)
+	}
+	if _, resp := signInJSON(p, `{"username": "michael", "password": "secret"}`); resp.Token != "" {
+		t.Errorf("expected no token without session-bearer, got %q", resp.Token)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for header, expected := range map[string]string{
+		"Bearer abc|123|sig": "abc|123|sig",
+		"bearer abc":         "abc",
+		"Bearer ":            "",
+		"Basic YTpi":         "",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", header)
+		if token, _ := bearerToken(req); token != expected {
+			t.Errorf("%q: expected %q got %q", header, expected, token)
+		}
+	}
+}
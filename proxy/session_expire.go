@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// sessionExpireRule is a parsed session-expire-group, "group=duration": the
+// sessions of the group's members last duration instead of cookie-expire
+type sessionExpireRule struct {
+	group   string
+	matcher *ldapauth.GroupMatcher
+	expire  time.Duration
+}
+
+// parseSessionExpire parses the lifetime of a session, as a duration such as
+// 8h or a number of seconds, as directory attributes tend to hold
+func parseSessionExpire(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, serr := strconv.ParseInt(value, 10, 64)
+		if serr != nil {
+			return 0, err
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q is not positive", value)
+	}
+	return d, nil
+}
+
+// parseSessionExpireRule parses spec, comparing its group as groupMatch
+// compares ldap-groups. The group is everything before the last =, so it may
+// be a DN.
+func parseSessionExpireRule(groupMatch, spec string) (*sessionExpireRule, error) {
+	i := strings.LastIndex(spec, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid session-expire-group %q (expected group=duration)", spec)
+	}
+	r := &sessionExpireRule{group: spec[:i]}
+	var err error
+	if r.expire, err = parseSessionExpire(spec[i+1:]); err != nil {
+		return nil, fmt.Errorf("invalid session-expire-group %q: %v", spec, err)
+	}
+	if r.matcher, err = ldapauth.NewGroupMatcher(groupMatch, []string{r.group}); err != nil {
+		return nil, fmt.Errorf("invalid session-expire-group %q: %v", spec, err)
+	}
+	return r, nil
+}
+
+func validateSessionExpire(o *Options, msgs []string) []string {
+	for _, spec := range o.SessionExpireGroups {
+		r, err := parseSessionExpireRule(o.LdapGroupMatch, spec)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		if r.expire > o.CookieExpire {
+			msgs = append(msgs, fmt.Sprintf("session-expire-group %q must not be longer than cookie-expire (%s)", spec, o.CookieExpire))
+			continue
+		}
+		o.expireRules = append(o.expireRules, r)
+	}
+	return msgs
+}
+
+// sessionExpire returns how long the session of identity, signed in with
+// groups, may last: its session-expire-attribute if the directory has one
+// for the user, else the shortest of the session-expire-groups the user is
+// in. It is zero when neither applies and cookie-expire alone decides.
+func (p *LdapProxy) sessionExpire(identity *Identity, groups []string) time.Duration {
+	if identity.SessionExpire > 0 {
+		return identity.SessionExpire
+	}
+	var expire time.Duration
+	for _, r := range p.sessionExpireRules {
+		if _, ok := r.matcher.Match(groups); ok && (expire == 0 || r.expire < expire) {
+			expire = r.expire
+		}
+	}
+	return expire
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseSessionExpire(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"8h": 8 * time.Hour, "90m": 90 * time.Minute, "3600": time.Hour} {
+		if d, err := parseSessionExpire(value); err != nil || d != expected {
+			t.Errorf("%q: expected %s, got %s %v", value, expected, d, err)
+		}
+	}
+	for _, value := range []string{"", "soon", "0", "-1h"} {
+		if _, err := parseSessionExpire(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestValidateSessionExpire(t *testing.T) {
+	o := testOptions()
+	o.SessionExpireGroups = []string{"contractors=1h", "cn=staff,ou=groups,dc=example,dc=com=12h"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.expireRules) != 2 || o.expireRules[1].group != "cn=staff,ou=groups,dc=example,dc=com" {
+		t.Errorf("unexpected rules %+v", o.expireRules)
+	}
+	if _, ok := o.expireRules[1].matcher.Match([]string{"staff"}); !ok {
+		t.Error("expected the DN to be compared by its cn")
+	}
+
+	for _, spec := range []string{"contractors", "=1h", "contractors=never", "contractors=200h"} {
+		o := testOptions()
+		o.SessionExpireGroups = []string{spec}
+		if err := o.Validate(); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	contractors, _ := parseSessionExpireRule("cn", "contractors=1h")
+	staff, _ := parseSessionExpireRule("cn", "staff=12h")
+	p := &LdapProxy{sessionExpireRules: []*sessionExpireRule{staff, contractors}}
+	for _, tc := range []struct {
+		identity *Identity
+		groups   []string
+		expected time.Duration
+	}{
+		{&Identity{User: "michael"}, []string{"staff"}, 12 * time.Hour},
+		{&Identity{User: "anna"}, []string{"staff", "contractors"}, time.Hour},
+		{&Identity{User: "bob"}, []string{"sales"}, 0},
+		{&Identity{User: "bob"}, nil, 0},
+		{&Identity{User: "carol", SessionExpire: 30 * time.Minute}, []string{"staff"}, 30 * time.Minute},
+	} {
+		if d := p.sessionExpire(tc.identity, tc.groups); d != tc.expected {
+			t.Errorf("%s in %v: expected %s, got %s", tc.identity.User, tc.groups, tc.expected, d)
+		}
+	}
+}
+
+func TestIntegrationSessionExpire(t *testing.T) {
+	p, done := testIntegration(t, func(o *Options) {
+		o.LdapGroups = nil
+		o.SessionExpireGroups = []string{"ops=12h"}
+		o.SessionExpireAttribute = "sessionTimeout"
+	})
+	defer done()
+
+	expiresOn := func(username, password string) time.Duration {
+		rw := integrationSignIn(p, username, password)
+		if rw.Code != http.StatusFound {
+			t.Fatalf("expected %s to sign in, got %d", username, rw.Code)
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(rw.Result().Cookies()[0])
+		s, _, err := p.LoadCookiedSession(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Until(s.ExpiresOn)
+	}
+	if d := expiresOn("michael", "secret"); d < 11*time.Hour || d > 12*time.Hour {
+		t.Errorf("expected michael's session to last 12h as a member of ops, got %s", d)
+	}
+	if d := expiresOn("anna", "hunter2"); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected anna's session to last her sessionTimeout, got %s", d)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// sessionInfo is the JSON form of a session listed at SessionsPath. The
+// ticket itself is never shown, only its session.TicketID.
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+// sessionLister returns the SessionStore if it can list sessions
+func (p *LdapProxy) sessionLister() session.Lister {
+	l, _ := p.SessionStore.(session.Lister)
+	return l
+}
+
+// Sessions lists the signed in user's sessions on GET and revokes the one
+// whose id is given in the query on DELETE. AdminUsers may pass user in the
+// query to do the same for another user.
+func (p *LdapProxy) Sessions(rw http.ResponseWriter, req *http.Request) {
+	status, current := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	user := current.User
+	if u := req.URL.Query().Get("user"); u != "" && u != user {
+		if !p.isAdmin(current.User) {
+			http.Error(rw, "forbidden request", http.StatusForbidden)
+			return
+		}
+		user = u
+	}
+
+	sessions, err := p.sessionLister().Sessions(user)
+	if err != nil {
+		http.Error(rw, "failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+	case "DELETE":
+		p.revokeSession(rw, req, current.User, sessions)
+		return
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := []*sessionInfo{}
+	for _, s := range sessions {
+		infos = append(infos, &sessionInfo{
+			ID:         session.TicketID(s.Ticket),
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			Current:    s.Ticket == current.Ticket,
+		})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(infos)
+}
+
+// revokeSession clears the session of sessions whose TicketID is the id in
+// the query, on behalf of the signed in user by
+func (p *LdapProxy) revokeSession(rw http.ResponseWriter, req *http.Request, by string, sessions []*session.State) {
+	id := req.URL.Query().Get("id")
+	for _, s := range sessions {
+		if id == "" || session.TicketID(s.Ticket) != id {
+			continue
+		}
+		if err := p.SessionStore.Clear(s.Ticket); err != nil {
+			http.Error(rw, "failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+		p.Auditf(req, "user %q revoked session %s of user %q", by, id, s.User)
+		p.sendEvent(req, &authEvent{Event: EventRevoked, User: s.User, By: by})
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(rw, "no such session", http.StatusNotFound)
+}
+
+// limitSessions signs out the oldest sessions of the user of current, just
+// signed in, in the same realm beyond sessionLimit
+func (p *LdapProxy) limitSessions(req *http.Request, current *session.State) {
+	l := p.sessionLister()
+	if p.sessionLimit <= 0 || l == nil {
+		return
+	}
+	sessions, err := l.Sessions(current.User)
+	if err != nil {
+		log.Printf("failed to list the sessions of %q: %v", current.User, err)
+		return
+	}
+	var others []*session.State
+	for _, s := range sessions {
+		if s.Ticket != current.Ticket && s.Realm == current.Realm {
+			others = append(others, s)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].CreatedAt.Before(others[j].CreatedAt) })
+	for len(others) > p.sessionLimit-1 {
+		s := others[0]
+		others = others[1:]
+		if err := p.SessionStore.Clear(s.Ticket); err != nil {
+			log.Printf("failed to sign out session %s of %q: %v", session.TicketID(s.Ticket), s.User, err)
+			continue
+		}
+		p.Auditf(req, "user %q signed out of session %s, signed in from %s at %s: max-sessions-per-user %d reached", s.User, session.TicketID(s.Ticket), s.IP, s.CreatedAt.UTC().Format(time.RFC3339), p.sessionLimit)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestSessions(t *testing.T) {
+	audit := &bytes.Buffer{}
+	p := testSignInProxy(audit, &staticAuthenticator{user: "michael", password: "secret"})
+	p.SessionStore = session.NewMemoryStore(10, time.Hour)
+	p.SessionsPath = "/ldap/sessions"
+	p.AdminUsers = []string{"admin"}
+	p.CookieExpire = time.Hour
+
+	signIn := func(userAgent string) *http.Cookie {
+		req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader("username=michael&password=secret"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw.Result().Cookies()[0]
+	}
+	laptop := signIn("laptop")
+	phone := signIn("phone")
+
+	call := func(c *http.Cookie, method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := call(phone, "GET", "/ldap/sessions")
+	var infos []*sessionInfo
+	if err := json.NewDecoder(rw.Body).Decode(&infos); err != nil || len(infos) != 2 {
+		t.Fatalf("expected 2 sessions, got %d %s %v", rw.Code, rw.Body, err)
+	}
+	if !infos[0].Current || infos[0].UserAgent != "phone" || infos[0].IP != "10.0.0.1" || infos[0].CreatedAt.IsZero() {
+		t.Errorf("expected the current phone session first, got %+v", infos[0])
+	}
+	if infos[1].Current || infos[1].UserAgent != "laptop" {
+		t.Errorf("expected the laptop session second, got %+v", infos[1])
+	}
+
+	if rw := call(phone, "GET", "/ldap/sessions?user=admin"); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 listing another user's sessions, got %d", rw.Code)
+	}
+	if rw := call(nil, "GET", "/ldap/sessions"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", rw.Code)
+	}
+	if rw := call(phone, "DELETE", "/ldap/sessions?id=unknown"); rw.Code != http.StatusNotFound {
+		t.Errorf("expected 404 revoking an unknown session, got %d", rw.Code)
+	}
+
+	if rw := call(phone, "DELETE", "/ldap/sessions?id="+infos[1].ID); rw.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 revoking the laptop session, got %d %s", rw.Code, rw.Body)
+	}
+	if rw := call(laptop, "GET", "/ldap/sessions"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected the revoked session to be signed out, got %d", rw.Code)
+	}
+	if !strings.Contains(audit.String(), `user "michael" revoked session `+infos[1].ID+` of user "michael"`) {
+		t.Errorf("expected the revocation to be audited, got %q", audit)
+	}
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	audit := &bytes.Buffer{}
+	p := testSignInProxy(audit, &staticAuthenticator{user: "michael", password: "secret"})
+	store := session.NewMemoryStore(10, time.Hour)
+	p.SessionStore = store
+	p.CookieExpire = time.Hour
+	p.sessionLimit = 2
+
+	var cookies []*http.Cookie
+	for _, device := range []string{"laptop", "phone", "tablet"} {
+		req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader("username=michael&password=secret"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", device)
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		cookies = append(cookies, rw.Result().Cookies()[0])
+	}
+	sessions, _ := store.Sessions("michael")
+	if len(sessions) != 2 || sessions[0].UserAgent != "tablet" || sessions[1].UserAgent != "phone" {
+		t.Fatalf("expected the 2 newest sessions kept, got %+v", sessions)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	if _, _, err := p.LoadCookiedSession(req); err == nil {
+		t.Error("expected the oldest session signed out")
+	}
+	if lines := strings.Count(audit.String(), "max-sessions-per-user 2 reached"); lines != 1 {
+		t.Errorf("expected the sign-out audited once, got %q", audit)
+	}
+
+	o := testOptions()
+	o.MaxSessionsPerUser = 5
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "requires a server side session-store") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	o.SessionStore = SessionStoreMemory
+	if err := o.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters carrying a share link signature
+const (
+	shareExpiresParam   = "lap_share_expires"
+	shareUserParam      = "lap_share_user"
+	shareSignatureParam = "lap_share_sig"
+)
+
+// shareSignature is the HMAC of a shared path, the host it was shared on,
+// the user who shared it and the expiry of the link
+func shareSignature(secret, host, path, user string, expires int64) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s\n%s\n%s\n%d", strings.ToLower(host), path, user, expires)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// signedSharePath returns path with the query parameters granting access to
+// it on host without a session until expires
+func (p *LdapProxy) signedSharePath(host, path, user string, expires time.Time) string {
+	q := url.Values{}
+	q.Set(shareExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(shareUserParam, user)
+	q.Set(shareSignatureParam, shareSignature(p.CookieSeed, host, path, user, expires.Unix()))
+	return path + "?" + q.Encode()
+}
+
+// ShareLink mints a share link for the path given in the "path" parameter,
+// valid for the "ttl" parameter (at most ShareLinkMaxTTL), if the user may
+// open the path themselves
+func (p *LdapProxy) ShareLink(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path := req.Form.Get("path")
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, p.ProxyPrefix+"/") {
+		http.Error(rw, "path must be an upstream path", http.StatusBadRequest)
+		return
+	}
+	r, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
+	r.Host, r.RemoteAddr = req.Host, req.RemoteAddr
+	for name, values := range req.Header {
+		r.Header[name] = values
+	}
+	// requests made with the link have no session to check the groups of
+	if h, _ := p.upstreamHandler(r); isGroupGate(h) {
+		http.Error(rw, "paths of upstreams restricted to groups can't be shared", http.StatusBadRequest)
+		return
+	}
+	if !p.allowedByACL(r, session) || !p.authorizedByWebhook(rw, r, session) {
+		http.Error(rw, "forbidden path", http.StatusForbidden)
+		return
+	}
+	ttl := p.ShareLinkMaxTTL
+	if v := req.Form.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(rw, fmt.Sprintf("invalid ttl %q", v), http.StatusBadRequest)
+			return
+		}
+		if d < ttl {
+			ttl = d
+		}
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	link := p.redirectURL(req, p.signedSharePath(requestHost(req, p.TrustedProxies), path, session.User, expires))
+	p.Auditf(req, "user %q shared %s until %s", session.User, path, expires.UTC().Format(time.RFC3339))
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]string{
+		"url":     link,
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// shareLinkUser returns the user who shared req's path if req carries a valid,
+// unexpired share link for its host
+func (p *LdapProxy) shareLinkUser(req *http.Request) (string, bool) {
+	if p.ShareLinkMaxTTL <= 0 || (req.Method != "GET" && req.Method != "HEAD") {
+		return "", false
+	}
+	q := req.URL.Query()
+	sig := q.Get(shareSignatureParam)
+	if sig == "" {
+		return "", false
+	}
+	user := q.Get(shareUserParam)
+	expires, err := strconv.ParseInt(q.Get(shareExpiresParam), 10, 64)
+	if err != nil || time.Unix(expires, 0).Before(time.Now()) {
+		return "", false
+	}
+	expected := shareSignature(p.CookieSeed, requestHost(req, p.TrustedProxies), req.URL.Path, user, expires)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "", false
+	}
+	return user, true
+}
+
+// stripShareParams removes the share link parameters so they aren't passed
+// upstream
+func stripShareParams(req *http.Request) {
+	q := req.URL.Query()
+	q.Del(shareExpiresParam)
+	q.Del(shareUserParam)
+	q.Del(shareSignatureParam)
+	req.URL.RawQuery = q.Encode()
+	req.RequestURI = req.URL.RequestURI()
+}
+
+// sharedAllowedByACL reports whether the ACL lets a request made with a
+// share link from user through. The request has no session, so the first
+// rule with a group condition matching it ends the search, as the user was
+// checked against those rules when the link was minted; a deny rule before
+// it, e.g. of the client address, denies the request.
+func (p *LdapProxy) sharedAllowedByACL(req *http.Request, user string) bool {
+	r, ok := p.ACL.decide(p.aclRequest(req))
+	if !ok || r.Action != ACLDeny {
+		return true
+	}
+	p.Auditf(req, "share link of user %q denied %s %s by acl-file rule %s", user, req.Method, req.URL.Path, r)
+	return false
+}
+
+// proxyShared proxies a request authorized by a share link from user
+func (p *LdapProxy) proxyShared(rw http.ResponseWriter, req *http.Request, user string) {
+	stripShareParams(req)
+	p.setIdentityHeaders(req, "", "", "", nil)
+	if p.PassUserHeaders || p.PassBasicAuth {
+		p.setIdentityHeaders(req, user, "", "", nil)
+	}
+	p.serveMux.ServeHTTP(rw, req)
+}
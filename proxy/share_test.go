@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestShareLinkUser(t *testing.T) {
+	p := &LdapProxy{CookieSeed: "secret", ShareLinkMaxTTL: time.Hour}
+	link := p.signedSharePath("example.com", "/dashboards/1", "michael", time.Now().Add(time.Minute))
+
+	testCases := []struct {
+		desc   string
+		method string
+		url    string
+		ok     bool
+	}{
+		{"valid", "GET", link, true},
+		{"head", "HEAD", link, true},
+		{"post", "POST", link, false},
+		{"other path", "GET", strings.Replace(link, "/dashboards/1", "/dashboards/2", 1), false},
+		{"other user", "GET", strings.Replace(link, "michael", "admin", 1), false},
+		{"expired", "GET", p.signedSharePath("example.com", "/dashboards/1", "michael", time.Now().Add(-time.Minute)), false},
+		{"unsigned", "GET", "/dashboards/1", false},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			user, ok := p.shareLinkUser(httptest.NewRequest(tC.method, tC.url, nil))
+			if ok != tC.ok {
+				t.Fatalf("expected %v, got %v", tC.ok, ok)
+			}
+			if ok && user != "michael" {
+				t.Errorf("expected user michael, got %q", user)
+			}
+		})
+	}
+
+	replayed := httptest.NewRequest("GET", link, nil)
+	replayed.Host = "other.example.com"
+	if _, ok := p.shareLinkUser(replayed); ok {
+		t.Error("expected the link to be rejected on another host")
+	}
+
+	p.ShareLinkMaxTTL = 0
+	if _, ok := p.shareLinkUser(httptest.NewRequest("GET", link, nil)); ok {
+		t.Error("expected share links to be rejected when disabled")
+	}
+}
+
+func TestProxySharedStripsShareParams(t *testing.T) {
+	var upstreamReq *http.Request
+	p := &LdapProxy{
+		CookieName:      "_ldap_proxy",
+		CookieSeed:      "secret",
+		ShareLinkMaxTTL: time.Hour,
+		PassUserHeaders: true,
+		serveMux: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			upstreamReq = req
+		}),
+	}
+	link := p.signedSharePath("example.com", "/dashboards/1", "michael", time.Now().Add(time.Minute))
+	req := httptest.NewRequest("GET", strings.Replace(link, "?", "?orgId=1&", 1), nil)
+	p.Proxy(httptest.NewRecorder(), req)
+
+	if upstreamReq == nil {
+		t.Fatal("expected shared request to be proxied")
+	}
+	if upstreamReq.RequestURI != "/dashboards/1?orgId=1" {
+		t.Errorf("expected share parameters to be removed, got %q", upstreamReq.RequestURI)
+	}
+	if u := upstreamReq.Header.Get("X-Forwarded-User"); u != "michael" {
+		t.Errorf("expected X-Forwarded-User michael, got %q", u)
+	}
+}
+
+func TestShareLinkRequiresSession(t *testing.T) {
+	p := &LdapProxy{CookieName: "_ldap_proxy", ShareLinkMaxTTL: time.Hour}
+	rw := httptest.NewRecorder()
+	p.ShareLink(rw, httptest.NewRequest("GET", "/ldap/share?path=/dashboards/1", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rw.Code)
+	}
+}
+
+func TestShareLinkACL(t *testing.T) {
+	f, err := ioutil.TempFile("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("deny cidr=198.51.100.0/24\ndeny group=contractors path=^/admin/\nallow group=staff\ndeny\n")
+	f.Close()
+	var proxied []string
+	o := testOptions()
+	o.ACLFile = f.Name()
+	o.ShareLinkMaxTTL = time.Hour
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	p.serveMux = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.Path)
+	})
+	share := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/ldap/share?path="+path, nil)
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, req, &session.State{User: "michael", Groups: []string{"staff", "contractors"}})
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		p.ShareLink(rw, req)
+		return rw
+	}
+
+	if rw := share("/admin/users"); rw.Code != http.StatusForbidden {
+		t.Errorf("expected a path the user is denied not to be shared, got %d %s", rw.Code, rw.Body)
+	}
+	rw := share("/wiki/")
+	var minted map[string]string
+	if err := json.NewDecoder(rw.Body).Decode(&minted); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %v", rw.Code, err)
+	}
+	link := strings.TrimPrefix(minted["url"], "http://example.com")
+	p.Proxy(httptest.NewRecorder(), httptest.NewRequest("GET", link, nil))
+	denied := httptest.NewRequest("GET", link, nil)
+	denied.RemoteAddr = "198.51.100.7:1234"
+	p.Proxy(httptest.NewRecorder(), denied)
+	if strings.Join(proxied, " ") != "/wiki/" {
+		t.Errorf("expected only the link used from an allowed address to be proxied, got %v", proxied)
+	}
+}
+
+func TestShareLinkUpstreamGroups(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:3000/reports/ groups=finance", "http://127.0.0.1:3001/dashboards/"}
+	o.ShareLinkMaxTTL = time.Hour
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	for path, expected := range map[string]int{"/reports/q3": http.StatusBadRequest, "/dashboards/1": http.StatusOK} {
+		req := httptest.NewRequest("GET", "/ldap/share?path="+path, nil)
+		rw := httptest.NewRecorder()
+		p.SaveSession(rw, req, &session.State{User: "michael", Groups: []string{"finance"}})
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		p.ShareLink(rw, req)
+		if rw.Code != expected {
+			t.Errorf("%s: expected %d, got %d %s", path, expected, rw.Code, rw.Body)
+		}
+	}
+}
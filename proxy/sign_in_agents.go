@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// unknownAgentWindow is the window of sign-in-unknown-agent-limit
+const unknownAgentWindow = time.Minute
+
+// unknownAgentMaxClients bounds the clients signInAgents counts; when they
+// are exceeded the counts of past windows are forgotten
+const unknownAgentMaxClients = 10000
+
+// defaultKnownAgent is the User-Agent of browsers, which are known when no
+// sign-in-known-user-agent is given
+var defaultKnownAgent = regexp.MustCompile(`^Mozilla/`)
+
+var signInAgentMetrics = expvar.NewMap("sign_in_user_agents")
+
+// signInAgents keeps scanners and bots away from the sign-in page: clients
+// whose User-Agent matches a deny pattern are refused it, and those matching
+// none of the known patterns may only get it limit times a minute each, told
+// apart by their address
+type signInAgents struct {
+	deny  []*regexp.Regexp
+	known []*regexp.Regexp
+	limit int
+
+	mu      sync.Mutex
+	clients map[string]*agentCount
+}
+
+// agentCount is the requests of a client with an unknown User-Agent since
+// the start of its window
+type agentCount struct {
+	start time.Time
+	n     int
+}
+
+// newSignInAgents returns nil, letting every User-Agent through, if opts
+// neither denies nor limits any
+func newSignInAgents(opts *Options) *signInAgents {
+	if len(opts.signInDenyAgents) == 0 && opts.SignInUnknownAgentLimit == 0 {
+		return nil
+	}
+	known := opts.signInKnownAgents
+	if len(known) == 0 {
+		known = []*regexp.Regexp{defaultKnownAgent}
+	}
+	return &signInAgents{deny: opts.signInDenyAgents, known: known, limit: opts.SignInUnknownAgentLimit, clients: make(map[string]*agentCount)}
+}
+
+// allow returns 0 if a client at addr with agent may get the sign-in page
+// or sign in at now, or the status it is refused with, and for
+// 429 Too Many Requests when it may try again
+func (a *signInAgents) allow(addr, agent string, now time.Time) (int, time.Duration) {
+	if a == nil {
+		return 0, 0
+	}
+	for _, re := range a.deny {
+		if re.MatchString(agent) {
+			signInAgentMetrics.Add("denied", 1)
+			return http.StatusForbidden, 0
+		}
+	}
+	if a.limit == 0 {
+		return 0, 0
+	}
+	for _, re := range a.known {
+		if re.MatchString(agent) {
+			return 0, 0
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.clients) >= unknownAgentMaxClients {
+		for c, count := range a.clients {
+			if now.Sub(count.start) >= unknownAgentWindow {
+				delete(a.clients, c)
+			}
+		}
+	}
+	count, ok := a.clients[addr]
+	if !ok || now.Sub(count.start) >= unknownAgentWindow {
+		count = &agentCount{start: now}
+		a.clients[addr] = count
+	}
+	if count.n >= a.limit {
+		signInAgentMetrics.Add("limited", 1)
+		return http.StatusTooManyRequests, count.start.Add(unknownAgentWindow).Sub(now)
+	}
+	count.n++
+	return 0, 0
+}
+
+// rejectSignInAgent responds to req and reports true if its User-Agent may
+// not get the sign-in page or sign in
+func (p *LdapProxy) rejectSignInAgent(rw http.ResponseWriter, req *http.Request) bool {
+	code, retry := p.signInAgents.allow(p.clientIP(req).String(), req.UserAgent(), time.Now())
+	if code == 0 {
+		return false
+	}
+	if code == http.StatusTooManyRequests {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)+1))
+	}
+	http.Error(rw, http.StatusText(code), code)
+	return true
+}
+
+func validateSignInAgents(o *Options, msgs []string) []string {
+	compile := func(name string, patterns []string) []*regexp.Regexp {
+		var compiled []*regexp.Regexp
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("error compiling %s %q %s", name, p, err))
+				continue
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled
+	}
+	o.signInDenyAgents = compile("sign-in-deny-user-agent", o.SignInDenyUserAgents)
+	o.signInKnownAgents = compile("sign-in-known-user-agent", o.SignInKnownUserAgents)
+	if o.SignInUnknownAgentLimit < 0 {
+		msgs = append(msgs, fmt.Sprintf("sign_in_unknown_agent_limit (%d) must not be negative", o.SignInUnknownAgentLimit))
+	}
+	if len(o.SignInKnownUserAgents) > 0 && o.SignInUnknownAgentLimit == 0 {
+		msgs = append(msgs, "sign-in-known-user-agent requires sign-in-unknown-agent-limit")
+	}
+	return msgs
+}
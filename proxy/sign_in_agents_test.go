@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignInAgentsAllow(t *testing.T) {
+	o := testOptions()
+	o.SignInDenyUserAgents = []string{"(?i)sqlmap|nikto", "^$"}
+	o.SignInKnownUserAgents = []string{"^Mozilla/", "^ldap-cli/"}
+	o.SignInUnknownAgentLimit = 2
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	a := newSignInAgents(o)
+	now := time.Now()
+
+	for _, agent := range []string{"sqlmap/1.7", "Mozilla/5.0 Nikto", ""} {
+		if code, _ := a.allow("192.0.2.1", agent, now); code != http.StatusForbidden {
+			t.Errorf("%q: expected the agent denied, got %d", agent, code)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if code, _ := a.allow("192.0.2.1", "ldap-cli/2.0", now); code != 0 {
+			t.Errorf("expected known agents not to be limited, got %d", code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if code, _ := a.allow("192.0.2.1", "python-requests/2.31", now); code != 0 {
+			t.Errorf("request %d: expected unknown agents allowed up to the limit, got %d", i, code)
+		}
+	}
+	code, retry := a.allow("192.0.2.1", "Go-http-client/1.1", now.Add(15*time.Second))
+	if code != http.StatusTooManyRequests || retry != 45*time.Second {
+		t.Errorf("expected the client limited for the rest of the minute, got %d %s", code, retry)
+	}
+	if code, _ := a.allow("192.0.2.2", "Go-http-client/1.1", now); code != 0 {
+		t.Errorf("expected other clients to be counted apart, got %d", code)
+	}
+	if code, _ := a.allow("192.0.2.1", "Go-http-client/1.1", now.Add(time.Minute)); code != 0 {
+		t.Errorf("expected the count to start over after a minute, got %d", code)
+	}
+
+	if newSignInAgents(testOptions()) != nil {
+		t.Errorf("expected every agent let through by default")
+	}
+}
+
+func TestSignInAgents(t *testing.T) {
+	o := testOptions()
+	o.SignInDenyUserAgents = []string{"(?i)scanner"}
+	o.SignInUnknownAgentLimit = 1
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	a := &countingAuthenticator{staticAuthenticator: staticAuthenticator{user: "michael", password: "secret"}}
+	p.Authenticators = []Authenticator{a}
+
+	get := func(path, agent string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", agent)
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+	if rw := get("/app", "Mozilla/5.0 (X11; Linux x86_64)"); rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "password") {
+		t.Errorf("expected browsers to get the sign-in page, got %d", rw.Code)
+	}
+	if rw := get("/app", "Mozilla/5.0 Scanner"); rw.Code != http.StatusForbidden || strings.Contains(rw.Body.String(), "password") {
+		t.Errorf("expected denied agents not to get the sign-in page, got %d %q", rw.Code, rw.Body)
+	}
+	if rw := get("/ldap/sign_in", "curl/8.0"); rw.Code != http.StatusOK {
+		t.Errorf("expected an unknown agent's first request to get the sign-in page, got %d", rw.Code)
+	}
+	if rw := get("/ldap/sign_in", "curl/8.0"); rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("expected an unknown agent's second request to be limited, got %d %v", rw.Code, rw.Header())
+	}
+
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(url.Values{"username": {"michael"}, "password": {"secret"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "vuln-scanner")
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	if rw.Code != http.StatusForbidden || a.calls != 0 {
+		t.Errorf("expected the sign-in refused before authenticating, got %d", rw.Code)
+	}
+}
+
+func TestValidateSignInAgents(t *testing.T) {
+	for _, configure := range []func(*Options){
+		func(o *Options) { o.SignInDenyUserAgents = []string{"("} },
+		func(o *Options) { o.SignInUnknownAgentLimit = -1 },
+		func(o *Options) { o.SignInKnownUserAgents = []string{"^Mozilla/"} },
+	} {
+		o := testOptions()
+		configure(o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+	}
+}
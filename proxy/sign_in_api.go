@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// Reasons a sign-in failed, as reported by the JSON sign-in API. A directory
+// rejecting the user because of the state of their account reports one of
+// the ldapauth Bind reasons instead, e.g. account_locked.
+const (
+	SignInInvalidCredentials = ldapauth.BindInvalidCredentials
+	SignInNotInGroup         = "not_in_group"
+	SignInBannerNotAccepted  = "banner_not_accepted"
+	SignInInvalidRequest     = "invalid_request"
+	SignInInternalError      = "internal_error"
+	// SignInDirectoryUnavailable is a sign-in which failed because the
+	// directory couldn't be reached, even after retrying
+	SignInDirectoryUnavailable = "directory_unavailable"
+	// SignInBusy is a sign-in turned away because too many others were
+	// being checked against the directory
+	SignInBusy = "busy"
+)
+
+// accountFailureMessages explain sign-ins rejected because of the state of
+// the user's account
+var accountFailureMessages = map[string]string{
+	ldapauth.BindAccountLocked:      "Your account is locked out. Try again later or contact your administrator.",
+	ldapauth.BindAccountDisabled:    "Your account is disabled.",
+	ldapauth.BindAccountExpired:     "Your account has expired.",
+	ldapauth.BindPasswordExpired:    "Your password has expired and must be changed before you can sign in.",
+	ldapauth.BindPasswordMustChange: "Your password must be changed before you can sign in.",
+	ldapauth.BindLogonRestricted:    "Your account is not permitted to sign in at this time or from here.",
+}
+
+// failureMessage returns the explanation of reason shown to the user, if
+// there is one beyond the generic failure message
+func failureMessage(reason string) string {
+	if reason == SignInDirectoryUnavailable || reason == SignInBusy {
+		return signInFailureMessages[reason]
+	}
+	return accountFailureMessages[reason]
+}
+
+// signInRequest is the body of a JSON sign-in
+type signInRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	AcceptBanner bool   `json:"accept_banner"`
+	Realm        string `json:"realm"`
+}
+
+// signInResponse is the result of a JSON sign-in: the user signed in, or the
+// reason the sign-in failed
+type signInResponse struct {
+	User    string `json:"user,omitempty"`
+	Email   string `json:"email,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Token is the session cookie's value, for clients to send as an
+	// Authorization: Bearer header with SessionBearer
+	Token string `json:"token,omitempty"`
+}
+
+func isJSONRequest(req *http.Request) bool {
+	t, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// signInFailure returns the reason for err, the failed sign-in of username,
+// auditing rejections because of the state of the user's account and
+// counting the failure against the user's next sign-in
+func (p *LdapProxy) signInFailure(req *http.Request, username string, err error) string {
+	reason := SignInInvalidCredentials
+	if be, ok := err.(*ldapauth.BindError); ok && be.Account() {
+		p.Auditf(req, "user %q sign-in rejected: %s", username, be.Reason)
+		reason = be.Reason
+	} else if err == ErrDirectoryUnavailable {
+		reason = SignInDirectoryUnavailable
+	} else if err == ErrSignInBusy {
+		reason = SignInBusy
+	}
+	p.recordSignInFailure(username, reason)
+	return reason
+}
+
+// signInJSON signs in with the credentials of a JSON signInRequest, setting
+// the session cookie and responding with a signInResponse instead of
+// redirecting
+func (p *LdapProxy) signInJSON(rw http.ResponseWriter, req *http.Request) {
+	r := &signInRequest{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<16)).Decode(r); err != nil {
+		writeSignInResponse(rw, http.StatusBadRequest, SignInInvalidRequest)
+		return
+	}
+
+	var bannerAcceptedAt time.Time
+	if p.SignInBanner != "" {
+		if !r.AcceptBanner {
+			writeSignInResponse(rw, http.StatusBadRequest, SignInBannerNotAccepted)
+			return
+		}
+		bannerAcceptedAt = time.Now()
+	}
+
+	realm, ok := p.signInRealm(req, r.Realm)
+	if !ok {
+		writeSignInResponse(rw, http.StatusBadRequest, SignInInvalidRequest)
+		return
+	}
+	session, reason, err := p.signInSession(req, realm, r.Username, r.Password, bannerAcceptedAt)
+	if err != nil {
+		log.Printf("failed to sign in %q: %v", r.Username, err)
+		writeSignInResponse(rw, http.StatusInternalServerError, SignInInternalError)
+		return
+	}
+	if reason == SignInDirectoryUnavailable || reason == SignInBusy {
+		writeSignInResponse(rw, http.StatusServiceUnavailable, reason)
+		return
+	}
+	if reason != "" {
+		writeSignInResponse(rw, http.StatusUnauthorized, reason)
+		return
+	}
+	p.startSession(rw, req, session)
+	resp := &signInResponse{User: session.User, Email: session.Email}
+	if p.SessionBearer {
+		resp.Token = p.sessionToken(rw)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
+
+func writeSignInResponse(rw http.ResponseWriter, code int, reason string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(&signInResponse{Error: reason, Message: failureMessage(reason)})
+}
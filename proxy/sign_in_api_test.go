@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// lockedAuthenticator rejects every user as locked out, like Active Directory
+type lockedAuthenticator struct{}
+
+func (lockedAuthenticator) Authenticate(username, password string) (*Identity, []string, error) {
+	return nil, nil, &ldapauth.BindError{Reason: ldapauth.BindAccountLocked, Err: fmt.Errorf("data 775")}
+}
+
+func testSignInProxy(audit *bytes.Buffer, authenticators ...Authenticator) *LdapProxy {
+	return &LdapProxy{
+		CookieName:     "_ldap_proxy",
+		CookieSeed:     "secret",
+		CookieExpire:   time.Hour,
+		ProxyPrefix:    "/ldap",
+		SignInPath:     "/ldap/sign_in",
+		Validator:      func(string) bool { return true },
+		Authenticators: authenticators,
+		AuditLogger:    log.New(audit, "", 0),
+		templates:      getTemplates(),
+	}
+}
+
+func signInJSON(p *LdapProxy, body string) (*httptest.ResponseRecorder, *signInResponse) {
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rw := httptest.NewRecorder()
+	p.SignIn(rw, req)
+	resp := &signInResponse{}
+	json.NewDecoder(rw.Body).Decode(resp)
+	return rw, resp
+}
+
+func TestSignInJSON(t *testing.T) {
+	audit := &bytes.Buffer{}
+	p := testSignInProxy(audit, &staticAuthenticator{user: "michael", password: "secret"})
+
+	rw, resp := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	if rw.Code != http.StatusOK || resp.User != "michael" || resp.Error != "" {
+		t.Fatalf("unexpected response %d %+v", rw.Code, resp)
+	}
+	if len(rw.Result().Cookies()) != 1 || rw.Result().Cookies()[0].Name != "_ldap_proxy" {
+		t.Errorf("expected a session cookie, got %v", rw.Result().Cookies())
+	}
+
+	for body, expected := range map[string]string{
+		`{"username": "michael", "password": "wrong"}`: SignInInvalidCredentials,
+		`{"username": "michael"`:                       SignInInvalidRequest,
+	} {
+		rw, resp := signInJSON(p, body)
+		if rw.Code == http.StatusOK || resp.Error != expected {
+			t.Errorf("%s: expected %s, got %d %+v", body, expected, rw.Code, resp)
+		}
+	}
+
+	p.SignInBanner = "Authorised use only"
+	if _, resp := signInJSON(p, `{"username": "michael", "password": "secret"}`); resp.Error != SignInBannerNotAccepted {
+		t.Errorf("expected %s, got %+v", SignInBannerNotAccepted, resp)
+	}
+	if _, resp := signInJSON(p, `{"username": "michael", "password": "secret", "accept_banner": true}`); resp.User != "michael" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestSignInAccountLocked(t *testing.T) {
+	audit := &bytes.Buffer{}
+	// the locked out account ends the search, so the other source isn't tried
+	p := testSignInProxy(audit, lockedAuthenticator{}, &staticAuthenticator{user: "michael", password: "secret"})
+
+	rw, resp := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	if rw.Code != http.StatusUnauthorized || resp.Error != ldapauth.BindAccountLocked || resp.Message == "" {
+		t.Errorf("unexpected response %d %+v", rw.Code, resp)
+	}
+	if !strings.Contains(audit.String(), `user "michael" sign-in rejected: account_locked`) {
+		t.Errorf("expected the rejection to be audited, got %q", audit.String())
+	}
+
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader(url.Values{"username": {"michael"}, "password": {"secret"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw = httptest.NewRecorder()
+	p.SignIn(rw, req)
+	if !strings.Contains(rw.Body.String(), "Your account is locked out") {
+		t.Errorf("expected the sign-in page to explain the lockout, got %s", rw.Body.String())
+	}
+}
+
+func TestSignInDirectoryUnavailable(t *testing.T) {
+	// nothing listens on the port once the listener is closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	ldap := &LDAPAuthenticator{Config: &ldapauth.Config{Host: "127.0.0.1", Port: addr.Port, Retries: 1}}
+	if _, _, err := ldap.Authenticate("michael", "secret"); err != ErrDirectoryUnavailable {
+		t.Fatalf("expected ErrDirectoryUnavailable, got %v", err)
+	}
+
+	p := testSignInProxy(&bytes.Buffer{}, &staticAuthenticator{user: "alice", password: "secret"}, ldap)
+	rw, resp := signInJSON(p, `{"username": "michael", "password": "secret"}`)
+	if rw.Code != http.StatusServiceUnavailable || resp.Error != SignInDirectoryUnavailable || resp.Message == "" {
+		t.Errorf("unexpected response %d %+v", rw.Code, resp)
+	}
+
+	req := httptest.NewRequest("POST", "/ldap/sign_in", strings.NewReader("username=michael&password=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw = httptest.NewRecorder()
+	p.SignIn(rw, req)
+	if rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), "temporarily unavailable") {
+		t.Errorf("expected the directory unavailable page, got %d", rw.Code)
+	}
+
+	// other authenticators still sign users in
+	if rw, _ := signInJSON(p, `{"username": "alice", "password": "secret"}`); rw.Code != http.StatusOK {
+		t.Errorf("expected alice to sign in, got %d", rw.Code)
+	}
+}
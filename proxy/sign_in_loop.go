@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signInLoopMaxClients bounds the clients signInLoops tracks; when they are
+// exceeded those not seen within the window are forgotten
+const signInLoopMaxClients = 10000
+
+// signInLoops counts the sign-in pages each client, told apart by the
+// session cookie it sends or else by its address and User-Agent, is sent to
+// within a window, to catch clients
+// which keep coming back to it, e.g. because their browser drops the session
+// cookie or an upstream redirects to a path they may not see
+type signInLoops struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	clients map[string][]time.Time
+}
+
+// newSignInLoops returns nil, detecting no loops, if limit is 0
+func newSignInLoops(limit int, window time.Duration) *signInLoops {
+	if limit <= 0 {
+		return nil
+	}
+	return &signInLoops{limit: limit, window: window, clients: make(map[string][]time.Time)}
+}
+
+// record counts a sign-in page for client, reporting whether it is the
+// limit-th within the window, in which case its count starts over
+func (l *signInLoops) record(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.clients) >= signInLoopMaxClients {
+		for c, times := range l.clients {
+			if now.Sub(times[len(times)-1]) >= l.window {
+				delete(l.clients, c)
+			}
+		}
+	}
+	times := l.clients[client]
+	for len(times) > 0 && now.Sub(times[0]) >= l.window {
+		times = times[1:]
+	}
+	times = append(times, now)
+	if len(times) >= l.limit {
+		delete(l.clients, client)
+		return true
+	}
+	l.clients[client] = times
+	return false
+}
+
+// isNavigation reports whether req is a browser loading a page, rather than
+// the assets or API calls of one, which may all be sent to sign in at once
+func isNavigation(req *http.Request) bool {
+	return req.Method == "GET" && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+func validateSignInLoops(o *Options, msgs []string) []string {
+	if o.SignInLoopLimit < 0 {
+		msgs = append(msgs, fmt.Sprintf("sign_in_loop_limit (%d) must not be negative", o.SignInLoopLimit))
+	}
+	if o.SignInLoopLimit > 0 && o.SignInLoopWindow <= 0 {
+		msgs = append(msgs, "sign-in-loop-limit requires a positive sign-in-loop-window")
+	}
+	return msgs
+}
+
+// signInLoopClient identifies the client of req to signInLoops: by the
+// session cookie it sends, so clients behind a shared address aren't counted
+// together, else by its address and User-Agent
+func (p *LdapProxy) signInLoopClient(req *http.Request) string {
+	if c, err := req.Cookie(p.CookieName); err == nil && c.Value != "" {
+		h := sha256.Sum256([]byte(c.Value))
+		return "cookie " + hex.EncodeToString(h[:])
+	}
+	return "ip " + p.clientIP(req).String() + " " + req.UserAgent()
+}
+
+// signInPrompt shows the sign-in page to a client which asked for a page it
+// must sign in for, or a page explaining why signing in doesn't seem to work
+// if it has been sent to sign in too often
+func (p *LdapProxy) signInPrompt(rw http.ResponseWriter, req *http.Request, code int) {
+	if p.rejectSignInAgent(rw, req) {
+		return
+	}
+	if p.signInLoops == nil || !isNavigation(req) {
+		p.SignInPage(rw, req, code, false)
+		return
+	}
+	if !p.signInLoops.record(p.signInLoopClient(req), time.Now()) {
+		p.SignInPage(rw, req, code, false)
+		return
+	}
+
+	cause := "The browser didn't send a session cookie, so it may be refusing the ones the proxy sets: check the cookie domain, and that cookies aren't marked secure on a site served over HTTP."
+	if _, err := req.Cookie(p.CookieName); err == nil {
+		cause = "The browser sent a session cookie which isn't valid, e.g. from another proxy or from before the cookie secret changed, or whose session has expired. Clearing the site's cookies may help."
+	}
+	p.Auditf(req, "sign-in loop: sent to sign in %d times within %s requesting %s", p.signInLoops.limit, p.signInLoops.window, req.URL.RequestURI())
+	p.ErrorPage(rw, http.StatusLoopDetected, "Sign-in Loop",
+		fmt.Sprintf("You have been sent to sign in %d times within %s. %s If you did sign in, the page you asked for may also be redirecting to one you may not see. Ask your administrator, quoting the time and the address %s.",
+			p.signInLoops.limit, p.signInLoops.window, cause, req.URL.RequestURI()))
+}
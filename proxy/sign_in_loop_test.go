@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignInLoopsRecord(t *testing.T) {
+	if newSignInLoops(0, time.Minute) != nil {
+		t.Error("expected no loop detection without a limit")
+	}
+	l := newSignInLoops(3, time.Minute)
+	now := time.Now()
+	for i, expected := range []bool{false, false, true, false} {
+		if loop := l.record("10.0.0.1 Firefox", now.Add(time.Duration(i)*time.Second)); loop != expected {
+			t.Errorf("sign-in page %d: expected %v", i+1, expected)
+		}
+	}
+	// the count starts over after a loop, and older pages fall out of the window
+	if l.record("10.0.0.1 Firefox", now.Add(2*time.Minute)) {
+		t.Error("expected the pages before the window to be forgotten")
+	}
+	if l.record("10.0.0.2 Firefox", now) {
+		t.Error("expected clients to be counted apart")
+	}
+}
+
+func TestSignInLoopPage(t *testing.T) {
+	o := testOptions()
+	o.SignInLoopLimit = 3
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	get := func(accept string, cookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/reports/", nil)
+		req.Header.Set("Accept", accept)
+		if cookie {
+			req.AddCookie(&http.Cookie{Name: p.CookieName, Value: "stale"})
+		}
+		rw := httptest.NewRecorder()
+		p.Proxy(rw, req)
+		return rw
+	}
+	for i := 0; i < 5; i++ {
+		if rw := get("image/png", false); rw.Code != http.StatusForbidden {
+			t.Fatalf("expected assets to keep getting the sign-in page, got %d", rw.Code)
+		}
+	}
+	get("text/html", false)
+	get("text/html", false)
+	rw := get("text/html,application/xhtml+xml", false)
+	if rw.Code != http.StatusLoopDetected || !strings.Contains(rw.Body.String(), "didn&#39;t send a session cookie") {
+		t.Errorf("expected the loop page, got %d %s", rw.Code, rw.Body)
+	}
+	if rw := get("text/html", true); rw.Code != http.StatusForbidden {
+		t.Errorf("expected the count to start over, got %d", rw.Code)
+	}
+	get("text/html", true)
+	if rw := get("text/html", true); !strings.Contains(rw.Body.String(), "sent a session cookie which isn&#39;t valid") {
+		t.Errorf("expected the loop page to blame the cookie, got %s", rw.Body)
+	}
+
+	o.SignInLoopWindow = 0
+	if err := o.Validate(); err == nil {
+		t.Error("expected an error without a window")
+	}
+}
+
+func TestSignInLoopClient(t *testing.T) {
+	p := &LdapProxy{CookieName: "_ldap_proxy"}
+	client := func(cookie string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: p.CookieName, Value: cookie})
+		}
+		return p.signInLoopClient(req)
+	}
+	// browsers behind the same address are told apart by their cookies
+	if a, b := client("stale-a"), client("stale-b"); a == b || strings.Contains(a, "stale") {
+		t.Errorf("expected distinct clients without the cookie value, got %q %q", a, b)
+	}
+	if c := client(""); c != "ip 10.0.0.1 " {
+		t.Errorf("expected the address without a cookie, got %q", c)
+	}
+}
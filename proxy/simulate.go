@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// Sources of simulated decisions besides those of access exports
+const (
+	simulateSourceACL       = "acl-file"
+	simulateSourcePreflight = "skip-auth-preflight"
+	simulateSourceOptions   = "skip-auth-options"
+	simulateSourceAuthz     = "authz-webhook"
+)
+
+// simulation is the decision SimulatePath returns for a hypothetical
+// request: its action (allow, deny or public), what decided it and the rule
+// which did
+type simulation struct {
+	User     string   `json:"user"`
+	Groups   []string `json:"groups"`
+	Method   string   `json:"method"`
+	Path     string   `json:"path"`
+	IP       string   `json:"ip,omitempty"`
+	Country  string   `json:"country,omitempty"`
+	Realm    string   `json:"realm,omitempty"`
+	Upstream string   `json:"upstream,omitempty"`
+	Decision string   `json:"decision"`
+	Source   string   `json:"source"`
+	Rule     string   `json:"rule,omitempty"`
+}
+
+// userGroups looks up the groups of user in the directory of realm, or the
+// default one if realm is nil, named as its ldap-groups are compared
+func (p *LdapProxy) userGroups(realm *Realm, user string) ([]string, error) {
+	if p.groupsOf != nil {
+		return p.groupsOf(user)
+	}
+	cfg, m := p.LdapConfiguration, p.groupMatcher()
+	if realm != nil {
+		a, ok := realm.Authenticator.(*LDAPAuthenticator)
+		if !ok {
+			return nil, fmt.Errorf("the groups of realm %q aren't in a directory", realm.Name)
+		}
+		cfg, m = a.Config, a.Groups
+	}
+	return cfg.UserGroups(m, user)
+}
+
+// skipAuthRule returns the skip-auth rule letting req through without
+// signing in, if any
+func (p *LdapProxy) skipAuthRule(req *http.Request) (source, rule string, ok bool) {
+	if p.skipAuthOptions && req.Method == "OPTIONS" {
+		return simulateSourceOptions, "", true
+	}
+	if p.skipAuthPreflight && isPreflightRequest(req) {
+		return simulateSourcePreflight, "", true
+	}
+	ip := p.clientIP(req)
+	p.skipAuthMu.RLock()
+	defer p.skipAuthMu.RUnlock()
+	for _, re := range p.compiledPathRegex {
+		if re.MatchString(req.URL.Path) {
+			return accessSourceSkipAuth, re.String(), true
+		}
+	}
+	if r := p.matchingSkipAuthRule(req); r != nil {
+		return accessSourceSkipAuthRule, r.String(), true
+	}
+	for _, n := range p.skipAuthIPs {
+		if ip != nil && n.Contains(ip) {
+			return accessSourceSkipAuthIP, n.String(), true
+		}
+	}
+	return "", "", false
+}
+
+// upstreamHandler returns the handler of the upstream serving req and the
+// path it is mounted at, which is empty when no upstream serves it
+func (p *LdapProxy) upstreamHandler(req *http.Request) (http.Handler, string) {
+	mux := p.serveMux
+	if p.dynamic != nil {
+		p.dynamic.mu.RLock()
+		mux = p.dynamic.mux
+		p.dynamic.mu.RUnlock()
+	}
+	if m, ok := mux.(*http.ServeMux); ok {
+		return m.Handler(req)
+	}
+	return mux, ""
+}
+
+// simulate decides req for user, signed in with groups against realm, in
+// the order the proxy does: skip-auth rules and public ACL rules, then
+// ldap-groups, the ACL, the authorization webhook and the groups of the
+// upstream
+func (p *LdapProxy) simulate(req *http.Request, user string, groups []string, realm *Realm) *simulation {
+	sim := &simulation{User: user, Groups: groups, Method: req.Method, Path: req.URL.Path}
+	if ip := p.clientIP(req); ip != nil {
+		sim.IP = ip.String()
+	}
+	sim.Country = p.country(req)
+	if realm != nil {
+		sim.Realm = realm.Name
+	}
+	h, upstream := p.upstreamHandler(req)
+	sim.Upstream = upstream
+
+	if source, rule, ok := p.skipAuthRule(req); ok {
+		sim.Decision, sim.Source, sim.Rule = ACLPublic, source, rule
+		return sim
+	}
+	if r, ok := p.ACL.decide(p.aclRequest(req)); ok && r.Action == ACLPublic {
+		sim.Decision, sim.Source, sim.Rule = ACLPublic, simulateSourceACL, r.String()
+		return sim
+	}
+
+	if !p.inRequiredGroups(realm, user, groups) {
+		required := p.LdapGroups
+		if realm != nil {
+			required = realm.LdapGroups
+		}
+		sim.Decision, sim.Source, sim.Rule = ACLDeny, accessSourceLdapGroups, strings.Join(required, ",")
+		return sim
+	}
+	sim.Decision, sim.Source, sim.Rule = p.decideSignedIn(req, h, &session.State{User: user, Groups: groups})
+	return sim
+}
+
+// decideSignedIn decides req, served by the upstream handler h, for the
+// user of s: by the ACL, then the authorization webhook, which is asked as
+// for the user's own requests, then the groups of the upstream
+func (p *LdapProxy) decideSignedIn(req *http.Request, h http.Handler, s *session.State) (decision, source, rule string) {
+	decision, source = ACLAllow, accessSourceLdapGroups
+	ar := p.aclRequest(req)
+	ar.groups = s.Groups
+	ar.authenticated = true
+	if r, ok := p.ACL.decide(ar); ok {
+		decision, source, rule = ACLAllow, simulateSourceACL, r.String()
+		if r.Action == ACLDeny {
+			return ACLDeny, source, rule
+		}
+	}
+
+	if p.Authz != nil {
+		d, err := p.askAuthzWebhook(req, s)
+		switch {
+		case err != nil && !p.Authz.FailOpen:
+			return ACLDeny, simulateSourceAuthz, fmt.Sprintf("failed: %v", err)
+		case err == nil && !d.Allow:
+			return ACLDeny, simulateSourceAuthz, d.Reason
+		}
+	}
+
+	if g, ok := h.(*groupGate); ok {
+		if _, ok := g.matcher.Match(s.Groups); !ok {
+			return ACLDeny, accessSourceUpstreamGroups, strings.Join(g.groups, ",")
+		}
+	}
+	return decision, source, rule
+}
+
+// AdminSimulate evaluates the authorization rules for the user and path in
+// the query, as if the user had signed in and requested the path, so policy
+// changes can be checked before they are rolled out. Only AdminUsers may use
+// it.
+func (p *LdapProxy) AdminSimulate(rw http.ResponseWriter, req *http.Request) {
+	status, session := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if !p.isAdmin(session.User) {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := req.URL.Query()
+	user, path := q.Get("user"), q.Get("path")
+	if user == "" || !strings.HasPrefix(path, "/") {
+		http.Error(rw, "user and an absolute path are required", http.StatusBadRequest)
+		return
+	}
+	method := q.Get("method")
+	if method == "" {
+		method = "GET"
+	}
+	r, err := http.NewRequest(strings.ToUpper(method), path, nil)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	r.Host = req.Host
+	if host := q.Get("host"); host != "" {
+		r.Host = host
+	}
+	r.RemoteAddr = q.Get("ip")
+	realm := p.hostRealm(r)
+
+	var groups []string
+	if _, ok := q["groups"]; ok {
+		groups = []string{}
+		for _, g := range strings.Split(q.Get("groups"), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	} else if groups, err = p.userGroups(realm, user); err != nil {
+		http.Error(rw, fmt.Sprintf("looking up the groups of %q: %v", user, err), http.StatusBadGateway)
+		return
+	}
+
+	sim := p.simulate(r, user, groups, realm)
+	p.Auditf(req, "user %q simulated %s %s as %q: %s", session.User, r.Method, r.URL.Path, user, sim.Decision)
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(sim)
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func testSimulateProxy(t *testing.T) *LdapProxy {
+	f, err := ioutil.TempFile("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("deny group=contractors path=^/grafana/admin\npublic path=^/status$\nallow\n")
+	f.Close()
+
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:3000/grafana/", "static://200/reports/ groups=finance"}
+	o.LdapGroups = []string{"engineers", "finance"}
+	o.ACLFile = f.Name()
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	p.groupsOf = func(user string) ([]string, error) {
+		switch user {
+		case "alice":
+			return []string{"engineers"}, nil
+		case "carol":
+			return []string{"engineers", "contractors"}, nil
+		}
+		return nil, errors.New("User does not exist")
+	}
+	return p
+}
+
+func TestSimulate(t *testing.T) {
+	p := testSimulateProxy(t)
+	testCases := []struct {
+		user     string
+		groups   []string
+		method   string
+		path     string
+		decision string
+		source   string
+		rule     string
+	}{
+		{"alice", []string{"engineers"}, "GET", "/grafana/", ACLAllow, simulateSourceACL, "line 3 (allow)"},
+		{"carol", []string{"engineers", "contractors"}, "GET", "/grafana/admin/users", ACLDeny, simulateSourceACL, "line 1 (deny group=contractors path=^/grafana/admin)"},
+		{"bob", []string{"sales"}, "GET", "/grafana/", ACLDeny, accessSourceLdapGroups, "engineers,finance"},
+		{"bob", []string{"sales"}, "GET", "/status", ACLPublic, simulateSourceACL, "line 2 (public path=^/status$)"},
+		{"alice", []string{"engineers"}, "GET", "/reports/q3", ACLDeny, accessSourceUpstreamGroups, "finance"},
+		{"dave", []string{"finance"}, "POST", "/reports/q3", ACLAllow, simulateSourceACL, "line 3 (allow)"},
+	}
+	for _, tC := range testCases {
+		req, _ := http.NewRequest(tC.method, tC.path, nil)
+		sim := p.simulate(req, tC.user, tC.groups, nil)
+		if sim.Decision != tC.decision || sim.Source != tC.source || sim.Rule != tC.rule {
+			t.Errorf("%s %s as %s: expected %s by %s %q, got %+v", tC.method, tC.path, tC.user, tC.decision, tC.source, tC.rule, sim)
+		}
+	}
+}
+
+func TestSimulateAuthzWebhook(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ar := &authzRequest{}
+		json.NewDecoder(req.Body).Decode(ar)
+		json.NewEncoder(rw).Encode(&authzDecision{Allow: ar.User != "alice" || ar.Path != "/grafana/private", Reason: "private dashboard"})
+	}))
+	p := testSimulateProxy(t)
+	o := testOptions()
+	o.AuthzWebhookURL = webhook.URL
+	o.AuthzWebhookSecret = "hook-secret"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p.Authz = newAuthzWebhook(o)
+
+	simulate := func(user, path string) *simulation {
+		req, _ := http.NewRequest("GET", path, nil)
+		return p.simulate(req, user, []string{"engineers"}, nil)
+	}
+	if sim := simulate("alice", "/grafana/private"); sim.Decision != ACLDeny || sim.Source != simulateSourceAuthz || sim.Rule != "private dashboard" {
+		t.Errorf("expected the webhook to deny, got %+v", sim)
+	}
+	if sim := simulate("bob", "/grafana/private"); sim.Decision != ACLAllow || sim.Source != simulateSourceACL {
+		t.Errorf("expected the ACL to allow, got %+v", sim)
+	}
+	webhook.Close()
+	if sim := simulate("bob", "/grafana/"); sim.Decision != ACLDeny || sim.Source != simulateSourceAuthz || !strings.HasPrefix(sim.Rule, "failed: ") {
+		t.Errorf("expected the failing webhook to deny, got %+v", sim)
+	}
+}
+
+func TestSimulateSkipAuth(t *testing.T) {
+	o := testOptions()
+	o.SkipAuthRegex = []string{"^/public/"}
+	o.SkipAuthIPs = []string{"10.0.0.0/8"}
+	o.RealIPHeader = "X-Real-IP"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/public/logo.png", nil)
+	if sim := p.simulate(req, "bob", []string{}, nil); sim.Decision != ACLPublic || sim.Source != accessSourceSkipAuth || sim.Rule != "^/public/" {
+		t.Errorf("expected the skip-auth-regex to let the request through, got %+v", sim)
+	}
+	req, _ = http.NewRequest("GET", "/app/", nil)
+	req.RemoteAddr = "10.1.2.3"
+	if sim := p.simulate(req, "bob", []string{}, nil); sim.Decision != ACLPublic || sim.Source != accessSourceSkipAuthIP || sim.Rule != "10.0.0.0/8" {
+		t.Errorf("expected the skip-auth-ips to let the request through, got %+v", sim)
+	}
+	req.RemoteAddr = "192.0.2.1"
+	if sim := p.simulate(req, "bob", []string{}, nil); sim.Decision != ACLAllow || sim.Source != accessSourceLdapGroups {
+		t.Errorf("expected the request to need signing in, got %+v", sim)
+	}
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	if sim := p.simulate(req, "bob", []string{}, nil); sim.Decision != ACLAllow || sim.Source != accessSourceLdapGroups {
+		t.Errorf("expected the X-Real-IP of an untrusted client not to match skip-auth-ips, got %+v", sim)
+	}
+}
+
+func TestSimulateUpstream(t *testing.T) {
+	p := testSimulateProxy(t)
+	req, _ := http.NewRequest("GET", "/reports/q3", nil)
+	if sim := p.simulate(req, "dave", []string{"finance"}, nil); sim.Upstream != "/reports/" {
+		t.Errorf("expected the /reports/ upstream, got %q", sim.Upstream)
+	}
+	req, _ = http.NewRequest("GET", "/nowhere", nil)
+	if sim := p.simulate(req, "dave", []string{"finance"}, nil); sim.Upstream != "" {
+		t.Errorf("expected no upstream, got %q", sim.Upstream)
+	}
+}
+
+func TestAdminSimulate(t *testing.T) {
+	p := testSimulateProxy(t)
+	p.AdminUsers = []string{"admin"}
+	call := func(user, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if user != "" {
+			rw := httptest.NewRecorder()
+			p.SaveSession(rw, req, &session.State{User: user, Groups: []string{"engineers"}})
+			req.AddCookie(rw.Result().Cookies()[0])
+		}
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := call("alice", "/ldap/admin/simulate?user=alice&path=/grafana/"); rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non admin, got %d", rw.Code)
+	}
+	rw := call("admin", "/ldap/admin/simulate?user=carol&path=/grafana/admin/")
+	sim := &simulation{}
+	if err := json.NewDecoder(rw.Body).Decode(sim); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %v", rw.Code, err)
+	}
+	if sim.Decision != ACLDeny || len(sim.Groups) != 2 || sim.Rule != "line 1 (deny group=contractors path=^/grafana/admin)" {
+		t.Errorf("expected carol's groups to be looked up and denied, got %+v", sim)
+	}
+
+	rw = call("admin", "/ldap/admin/simulate?user=carol&path=/grafana/admin/&groups=engineers&method=post&ip=10.0.0.1")
+	sim = &simulation{}
+	json.NewDecoder(rw.Body).Decode(sim)
+	if sim.Decision != ACLAllow || sim.Method != "POST" || sim.IP != "10.0.0.1" || len(sim.Groups) != 1 {
+		t.Errorf("expected the given groups to be allowed, got %+v", sim)
+	}
+	if rw := call("admin", "/ldap/admin/simulate?user=nobody&path=/grafana/"); rw.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 when the groups can't be looked up, got %d", rw.Code)
+	}
+	if rw := call("admin", "/ldap/admin/simulate?user=alice"); rw.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a path, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// accessSourceSkipAuthRule is the source of decisions and grants of
+// skip-auth-rule rules
+const accessSourceSkipAuthRule = "skip-auth-rule"
+
+// skipAuthRuleHeader carries the name of the skip-auth-rule a request was
+// let through by to the access log, which removes it from the response
+const skipAuthRuleHeader = "Lap-Skip-Auth-Rule"
+
+// SkipAuthRule is a named skip-auth-rule: requests with a path matching
+// Path, and one of Methods if any are given, are let through without
+// signing in
+type SkipAuthRule struct {
+	Name        string
+	Description string
+	Path        *regexp.Regexp
+	Methods     []string
+}
+
+func (r *SkipAuthRule) String() string {
+	if r.Description == "" {
+		return r.Name
+	}
+	return fmt.Sprintf("%s (%s)", r.Name, r.Description)
+}
+
+// parseSkipAuthRule parses "<name> <path regex> [methods=GET,HEAD]
+// [description=<URL encoded text>]"
+func parseSkipAuthRule(spec string) (*SkipAuthRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return nil, errors.New("expected a name and a path regex")
+	}
+	re, err := regexp.Compile(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	r := &SkipAuthRule{Name: fields[0], Path: re}
+	for _, f := range fields[2:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid option %q (expected key=value)", f)
+		}
+		switch kv[0] {
+		case "methods":
+			for _, m := range strings.Split(kv[1], ",") {
+				if m == "" {
+					return nil, errors.New("empty method")
+				}
+				r.Methods = append(r.Methods, strings.ToUpper(m))
+			}
+		case "description":
+			if r.Description, err = url.QueryUnescape(kv[1]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", kv[0])
+		}
+	}
+	return r, nil
+}
+
+// matches reports whether r lets req through
+func (r *SkipAuthRule) matches(req *http.Request) bool {
+	if !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingSkipAuthRule returns the first skip-auth-rule letting req through,
+// or nil
+func (p *LdapProxy) matchingSkipAuthRule(req *http.Request) *SkipAuthRule {
+	for _, r := range p.skipAuthNamed {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+func validateSkipAuthRules(o *Options, msgs []string) []string {
+	o.skipAuthRules = nil
+	names := make(map[string]bool)
+	for _, spec := range o.SkipAuthRules {
+		r, err := parseSkipAuthRule(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid skip-auth-rule %q: %s", spec, err))
+			continue
+		}
+		if names[r.Name] {
+			msgs = append(msgs, fmt.Sprintf("skip-auth-rule %q defined twice", r.Name))
+			continue
+		}
+		names[r.Name] = true
+		o.skipAuthRules = append(o.skipAuthRules, r)
+	}
+	return msgs
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSkipAuthRule(t *testing.T) {
+	r, err := parseSkipAuthRule("healthz ^/healthz$ methods=get,HEAD description=Load%20balancer%20checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "healthz" || r.Path.String() != "^/healthz$" || strings.Join(r.Methods, ",") != "GET,HEAD" || r.String() != "healthz (Load balancer checks)" {
+		t.Errorf("unexpected rule %+v", r)
+	}
+	for _, spec := range []string{"healthz", "healthz ^/(", "healthz ^/ methods=", "healthz ^/ methods=GET,", "healthz ^/ groups=ops", "healthz ^/ description"} {
+		if _, err := parseSkipAuthRule(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+
+	o := testOptions()
+	o.SkipAuthRules = []string{"healthz ^/healthz$", "healthz ^/ping$"}
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), `skip-auth-rule "healthz" defined twice`) {
+		t.Errorf("expected duplicate names to be rejected, got %v", err)
+	}
+}
+
+func TestSkipAuthRules(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"static://200/"}
+	o.SkipAuthRules = []string{"healthz ^/healthz$ methods=GET,HEAD description=Load%20balancer%20checks", "hooks ^/hooks/"}
+	o.RequestLogging = true
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	out := &bytes.Buffer{}
+	h := AccessLogHandler(out, p, o)
+
+	for _, tC := range []struct {
+		method, path string
+		code         int
+		rule         string
+	}{
+		{"GET", "/healthz", http.StatusOK, "healthz"},
+		{"POST", "/healthz", http.StatusForbidden, ""},
+		{"POST", "/hooks/github", http.StatusOK, "hooks"},
+		{"GET", "/app", http.StatusForbidden, ""},
+	} {
+		out.Reset()
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(tC.method, tC.path, nil))
+		if rw.Code != tC.code {
+			t.Errorf("%s %s: expected %d, got %d", tC.method, tC.path, tC.code, rw.Code)
+		}
+		if rw.Header().Get(skipAuthRuleHeader) != "" {
+			t.Errorf("%s %s: expected the rule kept out of the response", tC.method, tC.path)
+		}
+		logged := strings.HasSuffix(strings.TrimSpace(out.String()), " rule="+tC.rule)
+		if tC.rule != "" && !logged || tC.rule == "" && strings.Contains(out.String(), "rule=") {
+			t.Errorf("%s %s: expected rule %q to be logged, got %q", tC.method, tC.path, tC.rule, out)
+		}
+	}
+
+	req := httptest.NewRequest("HEAD", "/healthz", nil)
+	if sim := p.simulate(req, "bob", []string{}, nil); sim.Decision != ACLPublic || sim.Source != accessSourceSkipAuthRule || sim.Rule != "healthz (Load balancer checks)" {
+		t.Errorf("expected the named rule to let the request through, got %+v", sim)
+	}
+
+	o.ACLFile = "/nonexistent/acl"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "can't be combined with acl-file") {
+		t.Errorf("expected skip-auth-rule to be rejected with an acl-file, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+// Policies applied to proxied requests which are still in flight when the
+// session that authorized them expires (websockets, server-sent events,
+// long-polling).
+const (
+	StreamingExpiryIgnore    = "ignore"
+	StreamingExpiryTerminate = "terminate"
+	StreamingExpiryGrace     = "grace"
+)
+
+var streamingExpiryPolicies = []string{
+	StreamingExpiryIgnore,
+	StreamingExpiryTerminate,
+	StreamingExpiryGrace,
+}
+
+// withSessionExpiry ties the lifetime of req to the expiry of session
+// according to the configured streaming expiry policy. The returned cancel
+// func must be called once the request has been served.
+func (p *LdapProxy) withSessionExpiry(req *http.Request, session *session.State) (*http.Request, func()) {
+	if session == nil || session.CookieExpiresOn.IsZero() {
+		return req, func() {}
+	}
+	switch p.StreamingExpiryPolicy {
+	case StreamingExpiryTerminate, StreamingExpiryGrace:
+	default:
+		return req, func() {}
+	}
+
+	expiry := sessionExpiry(session)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	remoteAddr := p.getRemoteAddrStr(req)
+	uri := req.URL.RequestURI()
+	terminate := func() {
+		log.Printf("%s terminating connection to %s: session expired for %s", remoteAddr, uri, session.User)
+		cancel()
+	}
+
+	var mu sync.Mutex
+	var grace *time.Timer
+	timer := time.AfterFunc(time.Until(expiry), func() {
+		if p.StreamingExpiryPolicy == StreamingExpiryGrace && p.StreamingExpiryGrace > 0 {
+			mu.Lock()
+			defer mu.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("%s session expired for %s, allowing connection to %s to continue for %s", remoteAddr, session.User, uri, p.StreamingExpiryGrace)
+			grace = time.AfterFunc(p.StreamingExpiryGrace, func() {
+				if ctx.Err() == nil {
+					terminate()
+				}
+			})
+			return
+		}
+		terminate()
+	})
+
+	return req.WithContext(ctx), func() {
+		timer.Stop()
+		mu.Lock()
+		cancel()
+		if grace != nil {
+			grace.Stop()
+		}
+		mu.Unlock()
+	}
+}
+
+// sessionExpiry returns when s expires, the earlier of the expiry of its
+// cookie and of its own, or zero if it doesn't record the former
+func sessionExpiry(s *session.State) time.Time {
+	expiry := s.CookieExpiresOn
+	if !s.ExpiresOn.IsZero() && s.ExpiresOn.Before(expiry) {
+		expiry = s.ExpiresOn
+	}
+	return expiry
+}
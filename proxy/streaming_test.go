@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestWithSessionExpiry(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		policy   string
+		grace    time.Duration
+		wait     time.Duration
+		canceled bool
+	}{
+		{
+			desc:     "ignore leaves the connection open",
+			policy:   StreamingExpiryIgnore,
+			wait:     100 * time.Millisecond,
+			canceled: false,
+		},
+		{
+			desc:     "terminate closes the connection on expiry",
+			policy:   StreamingExpiryTerminate,
+			wait:     100 * time.Millisecond,
+			canceled: true,
+		},
+		{
+			desc:     "grace keeps the connection open during the grace period",
+			policy:   StreamingExpiryGrace,
+			grace:    time.Second,
+			wait:     100 * time.Millisecond,
+			canceled: false,
+		},
+		{
+			desc:     "grace closes the connection after the grace period",
+			policy:   StreamingExpiryGrace,
+			grace:    50 * time.Millisecond,
+			wait:     200 * time.Millisecond,
+			canceled: true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			p := &LdapProxy{StreamingExpiryPolicy: tC.policy, StreamingExpiryGrace: tC.grace}
+			session := &session.State{User: "michael", CookieExpiresOn: time.Now().Add(20 * time.Millisecond)}
+			req, cancel := p.withSessionExpiry(httptest.NewRequest("GET", "/events", nil), session)
+			defer cancel()
+
+			select {
+			case <-req.Context().Done():
+				if !tC.canceled {
+					t.Errorf("expected request to stay open")
+				}
+			case <-time.After(tC.wait):
+				if tC.canceled {
+					t.Errorf("expected request to be canceled within %s", tC.wait)
+				}
+			}
+		})
+	}
+}
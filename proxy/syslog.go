@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package proxy
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to the syslog daemon of t. Audit events are logged to
+// the authpriv facility, which syslog daemons usually keep apart from the
+// daemon facility used for the operational log.
+func dialSyslog(t *logTarget, audit bool) (io.Writer, error) {
+	priority := syslog.LOG_DAEMON | syslog.LOG_INFO
+	if audit {
+		priority = syslog.LOG_AUTHPRIV | syslog.LOG_NOTICE
+	}
+	return syslog.Dial(t.network, t.addr, priority, "ldap_proxy")
+}
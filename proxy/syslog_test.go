@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogAuditLogger(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	o := testOptions()
+	o.LogTarget = "syslog://" + conn.LocalAddr().String()
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	logger, err := newTargetAuditLogger(o)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	logger.Print(`user "michael" signed in`)
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// <85> is the authpriv facility at notice severity
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<85>") || !strings.Contains(msg, `ldap_proxy[`) || !strings.HasSuffix(msg, `[audit] user "michael" signed in`+"\n") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
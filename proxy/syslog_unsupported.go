@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package proxy
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(t *logTarget, audit bool) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
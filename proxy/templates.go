@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// signInFailureMessages explain the sign-in failures not caused by the state
+// of the user's account
+var signInFailureMessages = map[string]string{
+	SignInInvalidCredentials: "Invalid username or password.",
+	SignInNotInGroup:         "You are not in a group allowed to sign in.",
+	SignInBannerNotAccepted:  "You must accept the usage policy to sign in.",
+
+	SignInDirectoryUnavailable: "The directory is temporarily unavailable. Please try again in a moment.",
+	SignInBusy:                 "Too many sign-ins are in progress. Please try again in a moment.",
+}
+
+// templateFuncs are the functions available to custom templates:
+//
+//	year                  the current year, e.g. for a copyright notice
+//	asset "css/site.css"  the URL of a file in the assets directory of the
+//	                      custom templates directory
+//	isMobile .UserAgent   whether a User-Agent is a phone's or tablet's
+//	message .FailureCode  the explanation of a sign-in failure code
+func templateFuncs(proxyPrefix string) template.FuncMap {
+	return template.FuncMap{
+		"year": func() int { return time.Now().Year() },
+		"asset": func(name string) string {
+			return proxyPrefix + "/assets/" + strings.TrimPrefix(name, "/")
+		},
+		"isMobile": func(userAgent string) bool {
+			return strings.Contains(userAgent, "Mobi") || strings.Contains(userAgent, "Android")
+		},
+		"message": func(code string) string {
+			if m, ok := accountFailureMessages[code]; ok {
+				return m
+			}
+			return signInFailureMessages[code]
+		},
+	}
+}
+
+// accessDeniedTemplateName is the page of signed in users who may not make
+// a request. Unlike sign_in.html and error.html a custom templates directory
+// doesn't need one.
+const accessDeniedTemplateName = "access_denied.html"
+
+const defaultAccessDeniedTemplate = `{{define "access_denied.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<h2>{{.Title}}</h2>
+	<p>You are signed in as <b>{{.User}}</b>, but you don't have access to this page.</p>
+	{{if .Groups}}<p>It is available to members of {{range $i, $g := .Groups}}{{if $i}}, {{end}}<b>{{$g}}</b>{{end}}. Request access to one of these groups to use it.</p>{{end}}
+	<hr>
+	<p><a href="{{.ProxyPrefix}}/sign_out">Sign in as a different user</a></p>
+</body>
+</html>{{end}}`
+
+// portalTemplateName is the landing page listing the upstreams a user may
+// use. Like access_denied.html it is optional in custom templates directories.
+const portalTemplateName = "portal.html"
+
+const defaultPortalTemplate = `{{define "portal.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<h2>{{.Title}}</h2>
+	<p>You are signed in as <b>{{.User}}</b>.</p>
+	{{if .Apps}}<ul>
+	{{range .Apps}}<li><a href="{{.Path}}">{{.Title}}</a></li>
+	{{end}}</ul>{{else}}<p>There are no applications you have access to.</p>{{end}}
+	<hr>
+	<p><a href="{{.ProxyPrefix}}/sign_out">Sign out</a></p>
+</body>
+</html>{{end}}`
+
+// failedSignInsTemplateName is shown after signing in with warn-failed-sign-ins
+// when sign-ins with the user's name failed since their previous one
+const failedSignInsTemplateName = "failed_sign_ins.html"
+
+const defaultFailedSignInsTemplate = `{{define "failed_sign_ins.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<h2>{{.Title}}</h2>
+	<p>{{.FailedSignIns}} failed sign-in attempt{{if gt .FailedSignIns 1}}s{{end}} with the username <b>{{.User}}</b> since your last sign-in on {{.PreviousSignInAt.Format "2 Jan 2006 15:04 MST"}}{{if .PreviousSignInIP}} from {{.PreviousSignInIP}}{{end}}.</p>
+	<p>If they weren't yours, change your password and tell your administrator.</p>
+	<hr>
+	<p><a href="{{.Redirect}}">Continue</a></p>
+</body>
+</html>{{end}}`
+
+// optionalTemplates are the pages a custom templates directory may replace,
+// with the built in ones used for those it doesn't have
+var optionalTemplates = []struct{ name, text string }{
+	{accessDeniedTemplateName, defaultAccessDeniedTemplate},
+	{portalTemplateName, defaultPortalTemplate},
+	{failedSignInsTemplateName, defaultFailedSignInsTemplate},
+}
+
+// parseTemplates parses the sign_in.html and error.html of a custom
+// templates directory, and those of its optionalTemplates it has
+func parseTemplates(dir string, proxyPrefix string) (*template.Template, error) {
+	t, err := template.New("").Funcs(templateFuncs(proxyPrefix)).ParseFiles(path.Join(dir, "sign_in.html"), path.Join(dir, "error.html"))
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range optionalTemplates {
+		filename := path.Join(dir, o.name)
+		if _, err := os.Stat(filename); err == nil {
+			t, err = t.ParseFiles(filename)
+		} else {
+			t, err = t.Parse(o.text)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// newAssetServer serves the assets directory of the custom templates
+// directory, if there is one, at <proxy-prefix>/assets/ without signing in
+func newAssetServer(opts *Options) http.Handler {
+	if opts.CustomTemplatesDir == "" {
+		return nil
+	}
+	dir := path.Join(opts.CustomTemplatesDir, "assets")
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil
+	}
+	return newFileServer(opts.ProxyPrefix+"/assets/", dir, &UpstreamOptions{NoListing: true, HideDotfiles: true})
+}
+
+func loadTemplates(dir string, proxyPrefix string) *template.Template {
+	if dir == "" {
+		return getTemplates()
+	}
+	log.Printf("using custom template directory %q", dir)
+	t, err := parseTemplates(dir, proxyPrefix)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+	return t
+}
+
+func getTemplates() *template.Template {
+	t, err := template.New("foo").Parse(`{{define "sign_in.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Sign In</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<style>
+	body {
+		font-family: "Helvetica Neue",Helvetica,Arial,sans-serif;
+		font-size: 14px;
+		line-height: 1.42857143;
+		color: #333;
+		background: #f0f0f0;
+	}
+	.signin {
+		display:block;
+		margin:20px auto;
+		max-width:400px;
+		background: #fff;
+		border:1px solid #ccc;
+		border-radius: 10px;
+		padding: 20px;
+	}
+	.failed {
+		color: red;
+		display: inherit;
+		margin: inherit;
+		border-radius: inherit;
+		background: #f0f0f0;
+		padding: inherit;
+	}
+	.banner {
+		text-align: left;
+		white-space: pre-wrap;
+		border: 1px solid #ccc;
+		border-radius: 4px;
+		background: #f9f9f9;
+		padding: 10px;
+		margin-bottom: 10px;
+	}
+	.banner input {
+		display: inline;
+		width: auto;
+		height: auto;
+		box-shadow: none;
+	}
+	.btn {
+		color: #fff;
+		background-color: #428bca;
+		border: 1px solid #357ebd;
+		-webkit-border-radius: 4;
+		-moz-border-radius: 4;
+		border-radius: 4px;
+		font-size: 14px;
+		padding: 6px 12px;
+		text-decoration: none;
+		cursor: pointer;
+	}
+	.btn:hover {
+		background-color: #3071a9;
+		border-color: #285e8e;
+		ext-decoration: none;
+	}
+	label {
+		display: inline-block;
+		max-width: 100%;
+		margin-bottom: 5px;
+		font-weight: 700;
+	}
+	input {
+		display: block;
+		width: 100%;
+		height: 34px;
+		padding: 6px 12px;
+		font-size: 14px;
+		line-height: 1.42857143;
+		color: #555;
+		background-color: #fff;
+		background-image: none;
+		border: 1px solid #ccc;
+		border-radius: 4px;
+		-webkit-box-shadow: inset 0 1px 1px rgba(0,0,0,.075);
+		box-shadow: inset 0 1px 1px rgba(0,0,0,.075);
+		-webkit-transition: border-color ease-in-out .15s,-webkit-box-shadow ease-in-out .15s;
+		-o-transition: border-color ease-in-out .15s,box-shadow ease-in-out .15s;
+		transition: border-color ease-in-out .15s,box-shadow ease-in-out .15s;
+		margin:0;
+		box-sizing: border-box;
+	}
+	footer {
+		display:block;
+		font-size:10px;
+		color:#aaa;
+		text-align:center;
+		margin-bottom:10px;
+	}
+	footer a {
+		display:inline-block;
+		height:25px;
+		line-height:25px;
+		color:#aaa;
+		text-decoration:underline;
+	}
+	footer a:hover {
+		color:#aaa;
+	}
+	</style>
+</head>
+<body>
+	<div class="signin" style="text-align:center;">
+	<div>
+	{{ if .SignInMessage }}
+	<p>{{.SignInMessage}}</p>
+	{{ end}}
+	<h1>Sign in with a {{.LdapScopeName}} Account<br/></h1>
+	</div>
+
+	{{ if .FailureMessage }}
+	<p class="failed">{{.FailureMessage}}</p>
+	{{ else if .Failed }}
+	<p class="failed">Invalid Credentials Or Not In Correct Group!</p>
+	{{ end}}
+	{{ if .BannerRejected }}
+	<p class="failed">You must accept the usage policy to sign in.</p>
+	{{ end}}
+	<form method="POST" action="{{.ProxyPrefix}}/sign_in">
+		<input type="hidden" name="rd" value="{{.Redirect}}">
+		<label for="username">Username:</label><input type="text" name="username" id="username" size="10"><br/>
+		<label for="password">Password:</label><input type="password" name="password" id="password" size="10" autocomplete="off"><br/>
+		{{ if .Realms }}
+		<label for="realm">Directory:</label><select name="realm" id="realm">
+			<option value="">{{.LdapScopeName}}</option>
+			{{ range .Realms }}
+			<option value="{{.Name}}"{{ if eq .Name $.Realm }} selected{{ end }}>{{.Label}}</option>
+			{{ end }}
+		</select><br/>
+		{{ end }}
+		{{ if .Banner }}
+		<div class="banner">
+			<p>{{.Banner}}</p>
+			<input type="checkbox" name="accept_banner" id="accept_banner" value="yes" required><label for="accept_banner">I agree</label>
+		</div>
+		{{ end }}
+		<button type="submit" class="btn">Sign In</button>
+	</form>
+	</div>
+	<script>
+		if (window.location.hash) {
+			(function() {
+				var inputs = document.getElementsByName('rd');
+				for (var i = 0; i < inputs.length; i++) {
+					inputs[i].value += window.location.hash;
+				}
+			})();
+		}
+	</script>
+	<footer>
+	{{ if eq .Footer "-" }}
+	{{ else if eq .Footer ""}}
+	Secured with <a href="https://github.com/skybet/ldap_proxy">LDAP Proxy</a> version {{.Version}}
+	{{ else }}
+	{{.Footer}}
+	{{ end }}
+	</footer>
+</body>
+</html>
+{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "error.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<h2>{{.Title}}</h2>
+	<p>{{.Message}}</p>
+	<hr>
+	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In</a></p>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	for _, o := range optionalTemplates {
+		if t, err = t.Parse(o.text); err != nil {
+			log.Fatalf("failed parsing template %s", err)
+		}
+	}
+	return t
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestTemplatesCompile(t *testing.T) {
+	if tmpl := getTemplates(); tmpl == nil {
+		t.Error("expected templates")
+	}
+}
+
+func TestCustomTemplateFuncs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "sign_in.html"), []byte(`{{define "sign_in.html"}}`+
+		`<link href="{{asset "site.css"}}">`+
+		`{{if isMobile .UserAgent}}mobile{{else}}desktop{{end}} `+
+		`{{if .FailureCode}}{{message .FailureCode}}{{end}} &copy; {{year}}`+
+		`{{end}}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "error.html"), []byte(`{{define "error.html"}}{{.Title}}{{end}}`), 0644)
+	os.Mkdir(path.Join(dir, "assets"), 0755)
+	ioutil.WriteFile(path.Join(dir, "assets", "site.css"), []byte("body {}"), 0644)
+
+	o := testOptions()
+	o.CustomTemplatesDir = dir
+	o.ProxyPrefix = "/ldap"
+	if err := CheckConfig(o); err != nil && strings.Contains(err.Error(), "template") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p := testSignInProxy(&bytes.Buffer{})
+	p.templates = loadTemplates(dir, "/ldap")
+	p.AssetsPath = "/ldap/assets/"
+	p.assets = newAssetServer(o)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 12_0 like Mac OS X) Mobile/15E148")
+	rw := httptest.NewRecorder()
+	p.signInPage(rw, req, http.StatusOK, SignInNotInGroup)
+	expected := `<link href="/ldap/assets/site.css">mobile You are not in a group allowed to sign in. &copy; ` + strconv.Itoa(time.Now().Year())
+	if rw.Body.String() != expected {
+		t.Errorf("expected %q got %q", expected, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/ldap/assets/site.css", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != "body {}" {
+		t.Errorf("expected the asset without signing in, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestCustomAccessDeniedTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "sign_in.html"), []byte(`{{define "sign_in.html"}}sign in{{end}}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "error.html"), []byte(`{{define "error.html"}}{{.Title}}{{end}}`), 0644)
+	p := testSignInProxy(&bytes.Buffer{})
+	s := &session.State{User: "michael"}
+
+	// directories from before access_denied.html get the built in page
+	p.templates = loadTemplates(dir, "/ldap")
+	rw := httptest.NewRecorder()
+	p.AccessDeniedPage(rw, s, []string{"admins"})
+	if rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "members of <b>admins</b>") {
+		t.Errorf("expected the built in page, got %d %s", rw.Code, rw.Body)
+	}
+
+	ioutil.WriteFile(path.Join(dir, "access_denied.html"), []byte(`{{define "access_denied.html"}}{{.User}} needs {{index .Groups 0}}{{end}}`), 0644)
+	p.templates = loadTemplates(dir, "/ldap")
+	rw = httptest.NewRecorder()
+	p.AccessDeniedPage(rw, s, []string{"admins"})
+	if rw.Body.String() != "michael needs admins" {
+		t.Errorf("expected the custom page, got %q", rw.Body)
+	}
+}
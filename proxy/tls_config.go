@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// tlsVersions are the protocol versions tls-min-version and tls-max-version
+// accept
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the key exchange curves tls-curve-preferences accepts
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+func validateTLS(o *Options, msgs []string) []string {
+	var ok bool
+	if o.tlsMinVersion, ok = tlsVersions[o.TLSMinVersion]; !ok {
+		msgs = append(msgs, fmt.Sprintf("invalid tls-min-version %q (must be 1.2 or 1.3)", o.TLSMinVersion))
+	}
+	if o.tlsMaxVersion, ok = tlsVersions[o.TLSMaxVersion]; !ok {
+		msgs = append(msgs, fmt.Sprintf("invalid tls-max-version %q (must be 1.2 or 1.3)", o.TLSMaxVersion))
+	}
+	if o.tlsMinVersion > o.tlsMaxVersion && o.tlsMaxVersion != 0 {
+		msgs = append(msgs, fmt.Sprintf("tls-min-version (%s) must not be above tls-max-version (%s)", o.TLSMinVersion, o.TLSMaxVersion))
+	}
+	if o.CiphersSuites != "" && o.tlsMinVersion == tls.VersionTLS13 {
+		msgs = append(msgs, "cipher-suites only apply to TLS 1.2, which tls-min-version=1.3 disables")
+	}
+	o.http1OnlyClients, msgs = parseCIDRs(o.HTTP1OnlyClients, msgs)
+	if len(o.http1OnlyClients) > 0 && o.DisableHTTP2 {
+		msgs = append(msgs, "http1-only-client has no effect with disable-http2")
+	}
+
+	o.curvePreferences = nil
+	if o.TLSCurvePreferences == "" {
+		return msgs
+	}
+	for _, name := range strings.Split(o.TLSCurvePreferences, ",") {
+		curve, ok := tlsCurves[strings.TrimSpace(name)]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("unsupported tls curve %q (must be one of X25519, P256, P384, P521)", name))
+			continue
+		}
+		o.curvePreferences = append(o.curvePreferences, curve)
+	}
+	return msgs
+}
+
+// tlsServerConfig returns the configuration of the HTTPS listener, without
+// its certificate
+func tlsServerConfig(opts *Options) *tls.Config {
+	config := &tls.Config{
+		MinVersion:               opts.tlsMinVersion,
+		MaxVersion:               opts.tlsMaxVersion,
+		CipherSuites:             opts.ciphersSuites,
+		CurvePreferences:         opts.curvePreferences,
+		PreferServerCipherSuites: true,
+		NextProtos:               []string{"h2", "http/1.1"},
+	}
+	if opts.DisableHTTP2 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if len(opts.http1OnlyClients) > 0 {
+		nets := opts.http1OnlyClients
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if !containsIP(nets, addrIP(hello.Conn.RemoteAddr())) {
+				return nil, nil
+			}
+			// the clone copies the certificate set after this returns
+			c := config.Clone()
+			c.NextProtos = []string{"http/1.1"}
+			c.GetConfigForClient = nil
+			return c, nil
+		}
+	}
+	return config
+}
+
+// addrIP returns the IP of a TCP address, or nil for other addresses
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
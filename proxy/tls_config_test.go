@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSServerConfig(t *testing.T) {
+	o := testOptions()
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := tlsServerConfig(o)
+	if c.MinVersion != tls.VersionTLS12 || c.MaxVersion != tls.VersionTLS13 || c.CurvePreferences != nil {
+		t.Errorf("unexpected default config %+v", c)
+	}
+
+	o = testOptions()
+	o.TLSMinVersion = "1.3"
+	o.TLSCurvePreferences = "X25519, P384"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c = tlsServerConfig(o)
+	if c.MinVersion != tls.VersionTLS13 || len(c.CurvePreferences) != 2 || c.CurvePreferences[0] != tls.X25519 || c.CurvePreferences[1] != tls.CurveP384 {
+		t.Errorf("unexpected config %+v", c)
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	for _, c := range []struct{ min, max, ciphers, curves string }{
+		{"1.1", "1.3", "", ""},
+		{"1.2", "1.4", "", ""},
+		{"1.3", "1.2", "", ""},
+		{"1.3", "1.3", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", ""},
+		{"1.2", "1.3", "", "X25519,P224"},
+	} {
+		o := testOptions()
+		o.TLSMinVersion, o.TLSMaxVersion, o.CiphersSuites, o.TLSCurvePreferences = c.min, c.max, c.ciphers, c.curves
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables a process upgrading hands its listeners over with:
+// the URL encoded network:address of each, comma separated, in the order of
+// the file descriptors following stderr, and the descriptor of the pipe the
+// new process reports it is serving on
+const (
+	upgradeListenersEnv = "LDAP_PROXY_UPGRADE_LISTENERS"
+	upgradeReadyEnv     = "LDAP_PROXY_UPGRADE_READY_FD"
+)
+
+// upgradeReadyTimeout bounds how long the new process may take to start
+// serving before the upgrade is abandoned
+const upgradeReadyTimeout = time.Minute
+
+// upgradeOnSignal starts the executable again on SIGUSR2, handing it the
+// listeners, and once it is serving stops accepting connections and drains.
+// SIGHUP does the same once Reload has checked the changed configuration.
+func (s *Server) upgradeOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	if s.LoadOptions != nil {
+		signal.Notify(c, syscall.SIGHUP)
+	}
+	go func() {
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				// Reload logs why it kept the running configuration
+				s.Reload()
+			} else if err := s.handOver(); err != nil {
+				log.Printf("ERROR: upgrade failed, serving on - %s", err)
+			}
+			if s.handedOver() {
+				signal.Stop(c)
+				return
+			}
+		}
+	}()
+}
+
+// handOver upgrades to a new process, then drains in the background
+func (s *Server) handOver() error {
+	s.upgradeMu.Lock()
+	defer s.upgradeMu.Unlock()
+	if s.upgraded {
+		return errors.New("already upgraded, draining")
+	}
+	if err := s.upgrade(); err != nil {
+		return err
+	}
+	s.upgraded = true
+	go s.drain(s.Opts.UpgradeDrainTimeout)
+	return nil
+}
+
+func (s *Server) handedOver() bool {
+	s.upgradeMu.Lock()
+	defer s.upgradeMu.Unlock()
+	return s.upgraded
+}
+
+// upgrade starts the executable with the arguments and listeners of this
+// process and waits for it to serve
+func (s *Server) upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files, listeners, err := s.listenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, upgradeListenersEnv+"=") && !strings.HasPrefix(e, upgradeReadyEnv+"=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeListenersEnv+"="+listeners, fmt.Sprintf("%s=%d", upgradeReadyEnv, 3+len(files)))
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("upgrade: started %s as pid %d", exe, cmd.Process.Pid)
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			ready <- errors.New("the new process exited before serving")
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			return err
+		}
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("the new process didn't serve within %s", upgradeReadyTimeout)
+	}
+	log.Printf("upgrade: pid %d is serving, draining", cmd.Process.Pid)
+	return nil
+}
+
+// listenerFiles returns duplicates of the listeners of s and the value of
+// upgradeListenersEnv naming them
+func (s *Server) listenerFiles() ([]*os.File, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []*os.File
+	var keys []string
+	for _, l := range s.listeners {
+		fl, ok := l.Listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, "", err
+		}
+		files = append(files, f)
+		keys = append(keys, url.QueryEscape(l.network+":"+l.addr))
+	}
+	return files, strings.Join(keys, ","), nil
+}
+
+// inheritedListeners returns the listeners handed over by the process
+// upgraded from, by network:address
+func inheritedListeners() (map[string]net.Listener, error) {
+	spec := os.Getenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeListenersEnv)
+	if spec == "" {
+		return nil, nil
+	}
+	keys := strings.Split(spec, ",")
+	files := make([]*os.File, len(keys))
+	for i := range keys {
+		files[i] = os.NewFile(uintptr(3+i), "inherited listener")
+	}
+	return listenersFrom(keys, files)
+}
+
+// listenersFrom returns the listeners of files, by the network:address of
+// each in keys, closing the files
+func listenersFrom(keys []string, files []*os.File) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	for i, key := range keys {
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		f := files[i]
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		listeners[key] = ln
+	}
+	return listeners, nil
+}
+
+// ready tells the process upgraded from, if any, that this one is serving,
+// closing the listeners it handed over which aren't configured any more
+func (s *Server) ready() {
+	s.mu.Lock()
+	for key, ln := range s.inherited {
+		log.Printf("closing inherited listener %s, which isn't configured", key)
+		ln.Close()
+		delete(s.inherited, key)
+	}
+	s.mu.Unlock()
+
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	os.Unsetenv(upgradeReadyEnv)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("upgrade: failed to report serving - %s", err)
+	}
+}
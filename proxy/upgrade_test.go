@@ -0,0 +1,94 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUpgradeListeners(t *testing.T) {
+	old := &Server{Opts: testOptions()}
+	ln, err := old.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	files, spec, err := old.listenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec != "tcp%3A127.0.0.1%3A0" || len(files) != 1 {
+		t.Fatalf("unexpected listeners %q", spec)
+	}
+
+	inherited, err := listenersFrom(strings.Split(spec, ","), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Opts: testOptions(), inherited: inherited}
+	ln2, err := s.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	if ln2.Addr().String() != ln.Addr().String() {
+		t.Fatalf("expected the inherited listener on %s, got %s", ln.Addr(), ln2.Addr())
+	}
+
+	// connections queue for the new process once the old one stops
+	ln.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := ln2.Accept()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	c, err := net.Dial("tcp", ln2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeReady(t *testing.T) {
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Opts: testOptions(), inherited: map[string]net.Listener{"tcp:127.0.0.1:1": unused}}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	// ready closes the descriptor it's given, which w mustn't close again
+	// once another file has been opened with its number
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(upgradeReadyEnv, strconv.Itoa(fd))
+	s.ready()
+
+	if n, err := r.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("expected the old process to be told, got %d %v", n, err)
+	}
+	if os.Getenv(upgradeReadyEnv) != "" {
+		t.Errorf("expected the pipe to be reported only once")
+	}
+	if _, err := unused.Accept(); err == nil || len(s.inherited) != 0 {
+		t.Errorf("expected the unconfigured listener to be closed")
+	}
+}
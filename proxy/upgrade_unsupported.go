@@ -0,0 +1,24 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+)
+
+// upgradeOnSignal warns that graceful-upgrade isn't supported on platforms
+// without SIGUSR2 and inherited file descriptors
+func (s *Server) upgradeOnSignal() {
+	log.Printf("Warning: graceful-upgrade isn't supported on this platform")
+}
+
+func (s *Server) handOver() error {
+	return errors.New("upgrades aren't supported on this platform")
+}
+
+func inheritedListeners() (map[string]net.Listener, error) { return nil, nil }
+
+func (s *Server) ready() {}
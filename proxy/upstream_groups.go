@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// forbiddenFunc responds to a signed in user who isn't in any of the groups
+// an upstream is restricted to
+type forbiddenFunc func(rw http.ResponseWriter, req *http.Request, groups []string)
+
+// groupGate passes the requests of users in any of an upstream's groups to
+// it and rejects all others
+type groupGate struct {
+	groups    []string
+	matcher   *ldapauth.GroupMatcher
+	next      http.Handler
+	forbidden forbiddenFunc
+}
+
+// restrictGroups limits h to the users in the groups of o, if it has any.
+// forbidden renders the rejection, or a plain 403 if it is nil.
+func restrictGroups(o *UpstreamOptions, h http.Handler, forbidden forbiddenFunc) http.Handler {
+	if o.groupsMatcher == nil {
+		return h
+	}
+	return &groupGate{groups: o.Groups, matcher: o.groupsMatcher, next: h, forbidden: forbidden}
+}
+
+// isGroupGate reports whether h restricts an upstream to groups
+func isGroupGate(h http.Handler) bool {
+	_, ok := h.(*groupGate)
+	return ok
+}
+
+func (g *groupGate) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if s := sessionFromContext(req.Context()); s != nil {
+		if _, ok := g.matcher.Match(s.Groups); ok {
+			g.next.ServeHTTP(rw, req)
+			return
+		}
+	}
+	if g.forbidden == nil {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	g.forbidden(rw, req, g.groups)
+}
+
+// compileUpstreamGroups compiles the groups of the upstreams urls, whose
+// options are uos, with groupMatch
+func compileUpstreamGroups(groupMatch string, urls []*url.URL, uos []*UpstreamOptions, msgs []string) []string {
+	for i, uo := range uos {
+		if uo.Groups == nil {
+			continue
+		}
+		m, err := ldapauth.NewGroupMatcher(groupMatch, uo.Groups)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream=%q: invalid groups: %v", urls[i], err))
+			continue
+		}
+		uo.groupsMatcher = m
+	}
+	return msgs
+}
+
+// upstreamForbidden tells a user signed in but not allowed through to an
+// upstream restricted to groups which groups to request access to, rather
+// than sending them back to the sign-in page
+func (p *LdapProxy) upstreamForbidden(rw http.ResponseWriter, req *http.Request, groups []string) {
+	s := sessionFromContext(req.Context())
+	if s == nil {
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied",
+			fmt.Sprintf("This page is only available to members of %s.", strings.Join(groups, ", ")))
+		return
+	}
+	p.Auditf(req, "user %q denied %s: not in groups %v", s.User, req.URL.Path, groups)
+	p.AccessDeniedPage(rw, s, groups)
+}
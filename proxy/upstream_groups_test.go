@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestUpstreamGroups(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"static://200/reports/ groups=finance,Auditors"}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !o.routesByGroup() {
+		t.Error("expected sessions to keep groups for an upstream restricted to them")
+	}
+
+	audit := &bytes.Buffer{}
+	p := testSignInProxy(audit)
+	_, handler := upstreamSchemes["static"].Handler(o.proxyURLs[0], o, o.upstreamOptions[0])
+	gate := restrictGroups(o.upstreamOptions[0], handler, p.upstreamForbidden)
+
+	for _, tc := range []struct {
+		session *session.State
+		code    int
+	}{
+		{&session.State{User: "michael", Groups: []string{"staff", "auditors"}}, http.StatusOK},
+		{&session.State{User: "michael", Groups: []string{"staff"}}, http.StatusForbidden},
+		{&session.State{User: "michael"}, http.StatusForbidden},
+		{nil, http.StatusForbidden},
+	} {
+		rw := httptest.NewRecorder()
+		gate.ServeHTTP(rw, withSession(httptest.NewRequest("GET", "/reports/q3", nil), tc.session))
+		if rw.Code != tc.code {
+			t.Errorf("%+v: expected %d got %d", tc.session, tc.code, rw.Code)
+		}
+		if rw.Code == http.StatusForbidden && !strings.Contains(rw.Body.String(), "members of") {
+			t.Errorf("%+v: expected the groups page, got %s", tc.session, rw.Body)
+		}
+	}
+	if !strings.Contains(audit.String(), `user "michael" denied /reports/q3: not in groups [finance Auditors]`) {
+		t.Errorf("expected the denial to be audited, got %q", audit)
+	}
+}
+
+func TestUpstreamGroupsUnrestricted(t *testing.T) {
+	h := http.NewServeMux()
+	if restrictGroups(&UpstreamOptions{}, h, nil) != http.Handler(h) {
+		t.Error("expected upstreams without groups to be left alone")
+	}
+}
@@ -0,0 +1,395 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// UpstreamOptions are per-upstream settings, given as space separated
+// key=value pairs after the upstream URL, e.g.
+//
+//	http://127.0.0.1:3000/grafana/ rewrite_location=true
+type UpstreamOptions struct {
+	// RewriteLocation rewrites Location and Content-Location response
+	// headers pointing at the upstream so they resolve through the proxy
+	RewriteLocation bool
+	// RewriteHTML additionally rewrites <base href> in HTML responses
+	RewriteHTML bool
+	// Methods, when set, are the only request methods passed to the upstream;
+	// others are rejected with 405 Method Not Allowed
+	Methods []string
+	// Mirror is a shadow upstream receiving a copy of MirrorPercent percent
+	// of the authenticated requests, whose responses are discarded
+	Mirror        *url.URL
+	MirrorPercent float64
+	// Canary is an alternate upstream serving the same paths to users in
+	// any of CanaryGroups
+	Canary        *url.URL
+	CanaryGroups  []string
+	canaryMatcher *ldapauth.GroupMatcher
+	// Credentials from the user:password@ of the upstream URL are sent to
+	// it as Basic credentials, and likewise CanaryCredentials to Canary
+	Credentials       *url.Userinfo
+	CanaryCredentials *url.Userinfo
+	// MaxResponseSize cuts off responses larger than this many bytes, 0 for
+	// no limit
+	MaxResponseSize int64
+	// RedirectCode is the status of the redirects of redirect:// upstreams
+	RedirectCode int
+	// NoBuffering flushes every write of the response to the client, e.g.
+	// for large downloads or server-sent events
+	NoBuffering bool
+	// NoExpectContinue removes Expect: 100-continue from requests, so the
+	// proxy answers it and sends the body without waiting for the upstream,
+	// for upstreams which never answer it
+	NoExpectContinue bool
+	// ExpectContinueTimeout is how long requests with Expect: 100-continue
+	// wait for the upstream's 100 Continue before their body is sent anyway,
+	// 0 for the default of a second
+	ExpectContinueTimeout time.Duration
+	// ProxyURL is the outbound proxy, http, https or socks5, connections to
+	// the upstream are made through instead of that of the environment's
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY, and NoProxy connects directly
+	// whatever the environment says
+	ProxyURL *url.URL
+	NoProxy  bool
+	// NoRequestBuffering streams request bodies to the upstream as they
+	// arrive: requests with a body aren't mirrored, mirroring buffering it
+	NoRequestBuffering bool
+	// StripPath removes the path the upstream is mounted at from requests,
+	// so an app mounted at /grafana/ is requested at /
+	StripPath bool
+	// Groups, when set, restrict the upstream to users in any of them;
+	// others get a 403 page naming the groups
+	Groups        []string
+	groupsMatcher *ldapauth.GroupMatcher
+	// Title names the upstream on the landing page, which lists it by its
+	// path without one
+	Title string
+	// LandingPath is where users signing in without a page to return to
+	// are sent, when they sign in on LandingHost or LandingHost is empty
+	LandingPath string
+	LandingHost string
+
+	// Index is served for directories of file:// upstreams, in addition to
+	// index.html
+	Index string
+	// NoListing disables directory listings of file:// upstreams
+	NoListing bool
+	// HideDotfiles stops file:// upstreams serving or listing files and
+	// directories whose name starts with a dot
+	HideDotfiles bool
+	// ContentTypes overrides the Content-Type of files served by file://
+	// upstreams, by lowercase extension
+	ContentTypes map[string]string
+}
+
+// parseUpstream splits an upstream spec into its URL and options
+func parseUpstream(spec string) (string, *UpstreamOptions, error) {
+	fields := strings.Fields(spec)
+	opts := &UpstreamOptions{MirrorPercent: 100, RedirectCode: http.StatusFound}
+	if len(fields) == 0 {
+		return "", opts, nil
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return "", nil, fmt.Errorf("invalid upstream option %q (expected key=value)", f)
+		}
+		if err := opts.set(kv[0], kv[1]); err != nil {
+			return "", nil, err
+		}
+	}
+	if (opts.Canary == nil) != (opts.CanaryGroups == nil) {
+		return "", nil, errors.New("canary and canary_groups must be given together")
+	}
+	if opts.NoExpectContinue && opts.ExpectContinueTimeout > 0 {
+		return "", nil, errors.New("expect_continue_timeout requires expect_continue=true")
+	}
+	return fields[0], opts, nil
+}
+
+func (o *UpstreamOptions) set(key, value string) error {
+	var err error
+	switch key {
+	case "rewrite_location":
+		o.RewriteLocation, err = strconv.ParseBool(value)
+	case "rewrite_html":
+		o.RewriteHTML, err = strconv.ParseBool(value)
+	case "methods":
+		err = o.setMethods(value)
+	case "mirror":
+		o.Mirror, err = url.Parse(value)
+		if err == nil && (o.Mirror.Scheme != "http" && o.Mirror.Scheme != "https" || o.Mirror.Host == "") {
+			err = errors.New("invalid mirror URL")
+		}
+	case "canary":
+		o.Canary, err = url.Parse(value)
+		if err == nil && (o.Canary.Scheme != "http" && o.Canary.Scheme != "https" || o.Canary.Host == "" || strings.Trim(o.Canary.Path, "/") != "") {
+			err = errors.New("invalid canary URL")
+		}
+		if err == nil {
+			o.CanaryCredentials, o.Canary.User = o.Canary.User, nil
+		}
+	case "canary_groups":
+		o.CanaryGroups = strings.Split(value, ",")
+	case "groups":
+		o.Groups = strings.Split(value, ",")
+	case "title":
+		o.Title, err = url.QueryUnescape(value)
+		if err == nil && o.Title == "" {
+			err = errors.New("empty title")
+		}
+	case "landing_path":
+		err = o.setLandingPath(value)
+	case "max_response_size":
+		o.MaxResponseSize, err = parseSize(value)
+	case "strip_path":
+		o.StripPath, err = strconv.ParseBool(value)
+	case "buffering":
+		var buffering bool
+		buffering, err = strconv.ParseBool(value)
+		o.NoBuffering = !buffering
+	case "expect_continue":
+		var expect bool
+		expect, err = strconv.ParseBool(value)
+		o.NoExpectContinue = !expect
+	case "expect_continue_timeout":
+		o.ExpectContinueTimeout, err = time.ParseDuration(value)
+		if err == nil && o.ExpectContinueTimeout <= 0 {
+			err = errors.New("not positive")
+		}
+	case "proxy":
+		err = o.setProxy(value)
+	case "request_buffering":
+		var buffering bool
+		buffering, err = strconv.ParseBool(value)
+		o.NoRequestBuffering = !buffering
+	case "redirect_code":
+		o.RedirectCode, err = strconv.Atoi(value)
+		if err == nil && o.RedirectCode != http.StatusMovedPermanently && o.RedirectCode != http.StatusFound &&
+			o.RedirectCode != http.StatusTemporaryRedirect && o.RedirectCode != http.StatusPermanentRedirect {
+			err = errors.New("not a redirect status")
+		}
+	case "mirror_percent":
+		o.MirrorPercent, err = strconv.ParseFloat(value, 64)
+		if err == nil && (o.MirrorPercent < 0 || o.MirrorPercent > 100) {
+			err = errors.New("out of range")
+		}
+	case "index":
+		if value == "" || strings.Contains(value, "/") {
+			err = errors.New("invalid index file")
+		}
+		o.Index = value
+	case "listing":
+		var listing bool
+		listing, err = strconv.ParseBool(value)
+		o.NoListing = !listing
+	case "dotfiles":
+		var dotfiles bool
+		dotfiles, err = strconv.ParseBool(value)
+		o.HideDotfiles = !dotfiles
+	case "content_type":
+		err = o.setContentTypes(value)
+	default:
+		return fmt.Errorf("unknown upstream option %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for upstream option %s: %q", key, value)
+	}
+	return nil
+}
+
+// setProxy parses the outbound proxy URL of the upstream, or direct
+func (o *UpstreamOptions) setProxy(value string) error {
+	if value == "direct" {
+		o.NoProxy = true
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return errors.New("unsupported proxy scheme")
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return errors.New("invalid proxy URL")
+	}
+	o.ProxyURL = u
+	return nil
+}
+
+// setLandingPath parses a local path to land on after signing in, which may
+// be preceded by the host the sign-in is for, as in http.ServeMux patterns
+func (o *UpstreamOptions) setLandingPath(value string) error {
+	host, path := "", value
+	if i := strings.Index(value, "/"); i > 0 {
+		host, path = value[:i], value[i:]
+	}
+	if !isLocalRedirect(path) || strings.ContainsAny(value, "\\#") {
+		return errors.New("invalid landing path")
+	}
+	o.LandingHost, o.LandingPath = host, path
+	return nil
+}
+
+// setMethods parses a comma separated list of allowed request methods
+func (o *UpstreamOptions) setMethods(value string) error {
+	for _, m := range strings.Split(value, ",") {
+		if m == "" || strings.IndexFunc(m, func(r rune) bool { return r <= ' ' || r >= 0x7f }) >= 0 {
+			return errors.New("invalid method")
+		}
+		o.Methods = append(o.Methods, strings.ToUpper(m))
+	}
+	return nil
+}
+
+// allowMethods rejects requests to h whose method isn't one of methods. With
+// no methods every request is allowed.
+func allowMethods(methods []string, h http.Handler) http.Handler {
+	if len(methods) == 0 {
+		return h
+	}
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, m := range methods {
+			if req.Method == m {
+				h.ServeHTTP(rw, req)
+				return
+			}
+		}
+		rw.Header().Set("Allow", allow)
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+// stripPathPrefix removes path, the path an upstream is mounted at, from
+// the requests h serves, passing it in X-Forwarded-Prefix instead
+func stripPathPrefix(path string, h http.Handler) http.Handler {
+	prefix := strings.TrimSuffix(path, "/")
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		u := *req.URL
+		u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, prefix), "/")
+		if strings.HasPrefix(u.RawPath, prefix) {
+			u.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(u.RawPath, prefix), "/")
+		} else {
+			u.RawPath = ""
+		}
+		r := *req
+		r.URL = &u
+		r.RequestURI = u.RequestURI()
+		r.Header.Set("X-Forwarded-Prefix", prefix)
+		h.ServeHTTP(rw, &r)
+	})
+}
+
+// setContentTypes parses a comma separated list of .ext:type overrides
+func (o *UpstreamOptions) setContentTypes(value string) error {
+	if o.ContentTypes == nil {
+		o.ContentTypes = make(map[string]string)
+	}
+	for _, override := range strings.Split(value, ",") {
+		kv := strings.SplitN(override, ":", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], ".") || kv[1] == "" {
+			return errors.New("invalid content type override")
+		}
+		o.ContentTypes[strings.ToLower(kv[0])] = kv[1]
+	}
+	return nil
+}
+
+// locationRewriter rewrites responses from upstream, mounted at prefix, so
+// that the links they contain resolve through the proxy
+type locationRewriter struct {
+	upstream *url.URL
+	prefix   string
+	html     bool
+	strip    bool // the upstream doesn't know it is mounted at prefix
+}
+
+var baseHrefRegex = regexp.MustCompile(`(?i)(<base\s[^>]*href=["'])([^"']*)(["'])`)
+
+func (l *locationRewriter) rewriteURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return v
+	}
+	if u.IsAbs() || u.Host != "" {
+		if !strings.EqualFold(u.Host, l.upstream.Host) {
+			// a redirect to some other host
+			return v
+		}
+		u.Scheme = ""
+		u.Host = ""
+		u.User = nil
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		// relative references resolve against the proxied request URL
+		return u.String()
+	}
+	if l.strip || !strings.HasPrefix(u.Path, l.prefix) && u.Path+"/" != l.prefix {
+		u.Path = strings.TrimSuffix(l.prefix, "/") + u.Path
+	}
+	return u.String()
+}
+
+// ModifyResponse implements httputil.ReverseProxy.ModifyResponse
+func (l *locationRewriter) ModifyResponse(resp *http.Response) error {
+	for _, h := range []string{"Location", "Content-Location"} {
+		if v := resp.Header.Get(h); v != "" {
+			resp.Header.Set(h, l.rewriteURL(v))
+		}
+	}
+	if !l.html {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		// revalidating a rewritten page, whose ETag was weakened
+		if resp.Request != nil && strings.HasPrefix(resp.Request.Header.Get("If-None-Match"), "W/") {
+			weakenETag(resp.Header)
+		}
+		return nil
+	}
+	if resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = baseHrefRegex.ReplaceAllFunc(body, func(m []byte) []byte {
+		parts := baseHrefRegex.FindSubmatch(m)
+		return []byte(string(parts[1]) + l.rewriteURL(string(parts[2])) + string(parts[3]))
+	})
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	// the rewritten page is equivalent to the upstream's but not byte for
+	// byte, so ranges of it can't be requested from the upstream
+	weakenETag(resp.Header)
+	resp.Header.Set("Accept-Ranges", "none")
+	return nil
+}
+
+// weakenETag marks the ETag in h, if any, as a weak validator
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
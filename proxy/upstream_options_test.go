@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestParseUpstream(t *testing.T) {
+	rawURL, opts, err := parseUpstream("http://127.0.0.1:3000/grafana/ rewrite_location=true rewrite_html=1")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if rawURL != "http://127.0.0.1:3000/grafana/" || !opts.RewriteLocation || !opts.RewriteHTML {
+		t.Errorf("unexpected result %q %+v", rawURL, opts)
+	}
+
+	for _, spec := range []string{"http://a/ rewrite_location", "http://a/ rewrite_location=maybe", "http://a/ unknown=true"} {
+		if _, _, err := parseUpstream(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+}
+
+func TestLocationRewriter(t *testing.T) {
+	upstream, _ := url.Parse("http://127.0.0.1:3000")
+	l := &locationRewriter{upstream: upstream, prefix: "/grafana/"}
+
+	testCases := map[string]string{
+		"http://127.0.0.1:3000/grafana/login": "/grafana/login",
+		"http://127.0.0.1:3000/login?x=1":     "/grafana/login?x=1",
+		"/login":                              "/grafana/login",
+		"/grafana/d/abc":                      "/grafana/d/abc",
+		"/grafana":                            "/grafana",
+		"d/abc":                               "d/abc",
+		"https://accounts.example.com/auth":   "https://accounts.example.com/auth",
+	}
+	for in, expected := range testCases {
+		if got := l.rewriteURL(in); got != expected {
+			t.Errorf("rewriting %q: expected %q got %q", in, expected, got)
+		}
+	}
+}
+
+func TestLocationRewriterHTML(t *testing.T) {
+	upstream, _ := url.Parse("http://127.0.0.1:3000")
+	l := &locationRewriter{upstream: upstream, prefix: "/grafana/", html: true}
+
+	resp := &http.Response{
+		Header: http.Header{
+			"Content-Type": {"text/html; charset=utf-8"},
+			"Location":     {"http://127.0.0.1:3000/"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader(`<html><head><base href="/"></head></html>`)),
+	}
+	if err := l.ModifyResponse(resp); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != `<html><head><base href="/grafana/"></head></html>` {
+		t.Errorf("unexpected body %q", body)
+	}
+	if resp.Header.Get("Location") != "/grafana/" {
+		t.Errorf("unexpected Location %q", resp.Header.Get("Location"))
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("unexpected content length %d", resp.ContentLength)
+	}
+}
+
+func TestLocationRewriterHTMLValidators(t *testing.T) {
+	upstream, _ := url.Parse("http://127.0.0.1:3000")
+	l := &locationRewriter{upstream: upstream, prefix: "/grafana/", html: true}
+	response := func(code int, inm string) *http.Response {
+		return &http.Response{
+			StatusCode: code,
+			Header:     http.Header{"Content-Type": {"text/html"}, "Etag": {`"v1"`}, "Accept-Ranges": {"bytes"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`<base href="/">`)),
+			Request:    &http.Request{Header: http.Header{"If-None-Match": {inm}}},
+		}
+	}
+
+	resp := response(http.StatusOK, "")
+	l.ModifyResponse(resp)
+	if resp.Header.Get("ETag") != `W/"v1"` || resp.Header.Get("Accept-Ranges") != "none" {
+		t.Errorf("expected a weak ETag without ranges for a rewritten page, got %q", resp.Header)
+	}
+	resp = response(http.StatusPartialContent, "")
+	l.ModifyResponse(resp)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != `<base href="/">` || resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("expected a range to be passed unchanged, got %q %q", body, resp.Header)
+	}
+	resp = response(http.StatusNotModified, `W/"v1"`)
+	l.ModifyResponse(resp)
+	if resp.Header.Get("ETag") != `W/"v1"` {
+		t.Errorf("expected revalidating a rewritten page to keep its weak ETag, got %q", resp.Header.Get("ETag"))
+	}
+	resp = response(http.StatusNotModified, `"v1"`)
+	l.ModifyResponse(resp)
+	if resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("expected revalidating other resources to keep their ETag, got %q", resp.Header.Get("ETag"))
+	}
+}
+
+func TestConditionalRequestsPassThrough(t *testing.T) {
+	modified := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"artifact-1"`)
+		http.ServeContent(w, r, "artifact.bin", modified, strings.NewReader("0123456789"))
+	}))
+	defer backend.Close()
+
+	for _, spec := range []string{backend.URL + "/artifacts/", backend.URL + "/artifacts/ strip_path=true"} {
+		o := testOptions()
+		o.Upstreams = []string{spec}
+		if err := o.Validate(); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		p := NewLdapProxy(o, func(string) bool { return true })
+		get := func(header ...string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/artifacts/build.bin", nil)
+			rw := httptest.NewRecorder()
+			p.SaveSession(rw, req, &session.State{User: "michael"})
+			req.AddCookie(rw.Result().Cookies()[0])
+			for i := 0; i < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			rw = httptest.NewRecorder()
+			p.ServeHTTP(rw, req)
+			return rw
+		}
+
+		if rw := get("Range", "bytes=2-4"); rw.Code != http.StatusPartialContent || rw.Body.String() != "234" || rw.Header().Get("Content-Range") != "bytes 2-4/10" {
+			t.Errorf("%s: expected the range, got %d %q %q", spec, rw.Code, rw.Body, rw.Header())
+		}
+		if rw := get("Range", "bytes=2-4", "If-Range", `"artifact-0"`); rw.Code != http.StatusOK || rw.Body.String() != "0123456789" {
+			t.Errorf("%s: expected the whole artifact for a stale If-Range, got %d %q", spec, rw.Code, rw.Body)
+		}
+		if rw := get("If-None-Match", `"artifact-1"`); rw.Code != http.StatusNotModified || rw.Header().Get("ETag") != `"artifact-1"` {
+			t.Errorf("%s: expected 304 for a matching If-None-Match, got %d %q", spec, rw.Code, rw.Header())
+		}
+		if rw := get("If-Modified-Since", modified.Format(http.TimeFormat)); rw.Code != http.StatusNotModified {
+			t.Errorf("%s: expected 304 for If-Modified-Since, got %d", spec, rw.Code)
+		}
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	_, opts, err := parseUpstream("http://127.0.0.1:3000/reports/ methods=get,HEAD")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	h := allowMethods(opts.Methods, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	for method, expected := range map[string]int{"GET": 200, "HEAD": 200, "POST": 405, "DELETE": 405} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(method, "/reports/", nil))
+		if rw.Code != expected {
+			t.Errorf("%s: expected %d got %d", method, expected, rw.Code)
+		}
+		if expected == 405 && rw.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s: unexpected Allow %q", method, rw.Header().Get("Allow"))
+		}
+	}
+
+	if _, _, err := parseUpstream("http://a/ methods=GET,,POST"); err == nil {
+		t.Error("expected error for an empty method")
+	}
+}
+
+func TestUpstreamCredentials(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		w.Write([]byte(user + ":" + password))
+	}))
+	defer backend.Close()
+
+	o := testOptions()
+	o.Upstreams = []string{strings.Replace(backend.URL, "://", "://svc:s%3Acret@", 1) + "/ canary=http://canary:pw@127.0.0.1:1 canary_groups=qa"}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	u, uo := o.proxyURLs[0], o.upstreamOptions[0]
+	if u.User != nil || uo.Canary.User != nil {
+		t.Errorf("expected the credentials to be removed from the URLs, got %q and %q", u, uo.Canary)
+	}
+	if uo.CanaryCredentials.Username() != "canary" {
+		t.Errorf("expected the canary credentials to be kept, got %v", uo.CanaryCredentials)
+	}
+
+	h := newUpstreamProxy(u, "/", o, uo, nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	// e.g. set by pass-basic-auth
+	req.SetBasicAuth("michael", "")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Body.String() != "svc:s:cret" {
+		t.Errorf("expected the upstream's own credentials, got %q", rw.Body)
+	}
+}
+
+func TestStripPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.RequestURI + " " + r.Header.Get("X-Forwarded-Prefix")))
+	}))
+	defer backend.Close()
+
+	o := testOptions()
+	o.Upstreams = []string{backend.URL + "/grafana/ strip_path=true rewrite_location=true"}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	_, h := httpUpstream(o.proxyURLs[0], o, o.upstreamOptions[0])
+	testCases := map[string]string{
+		"/grafana/d/abc?orgId=1": "/d/abc?orgId=1 /grafana",
+		"/grafana/":              "/ /grafana",
+		"/grafana/a%2Fb":         "/a%2Fb /grafana",
+	}
+	for in, expected := range testCases {
+		req := httptest.NewRequest("GET", in, nil)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Body.String() != expected {
+			t.Errorf("%s: expected %q got %q", in, expected, rw.Body)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/grafana/old", nil))
+	if l := rw.Header().Get("Location"); l != "/grafana/login" {
+		t.Errorf("expected the redirect to stay under the prefix, got %q", l)
+	}
+
+	o = testOptions()
+	o.Upstreams = []string{"file:///var/www/#/static/ strip_path=true"}
+	if err := o.Validate(); err == nil {
+		t.Error("expected an error for strip_path on a file upstream")
+	}
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/18F/hmacauth"
+)
+
+// UpstreamScheme serves the upstreams whose URLs have the scheme it is
+// registered for
+type UpstreamScheme struct {
+	// Validate, if set, checks an upstream URL and its options when the
+	// Options are validated
+	Validate func(u *url.URL, o *UpstreamOptions) error
+	// Handler returns the path the upstream is mounted at and the handler
+	// serving the requests under it
+	Handler func(u *url.URL, opts *Options, o *UpstreamOptions) (string, http.Handler)
+	// Path, if set, returns the path Handler mounts the upstream at, when it
+	// isn't the path of u
+	Path func(u *url.URL) string
+}
+
+var upstreamSchemes = map[string]*UpstreamScheme{}
+
+// RegisterUpstreamScheme adds a type of upstream, served for upstream URLs
+// with scheme. It is not safe to call concurrently with validating Options,
+// so should be called from an init function.
+func RegisterUpstreamScheme(scheme string, s *UpstreamScheme) {
+	if _, ok := upstreamSchemes[scheme]; ok {
+		panic("upstream scheme " + scheme + " registered twice")
+	}
+	upstreamSchemes[scheme] = s
+}
+
+func upstreamSchemeNames() []string {
+	var names []string
+	for name := range upstreamSchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	web := &UpstreamScheme{Handler: httpUpstream}
+	RegisterUpstreamScheme("http", web)
+	RegisterUpstreamScheme("https", web)
+	RegisterUpstreamScheme("file", &UpstreamScheme{Handler: fileUpstream, Path: fragmentPath})
+	RegisterUpstreamScheme("static", &UpstreamScheme{Validate: validateStaticUpstream, Handler: staticUpstream})
+	RegisterUpstreamScheme("redirect", &UpstreamScheme{Validate: validateRedirectUpstream, Handler: redirectUpstream, Path: fragmentPath})
+}
+
+// upstreamPath returns the path the upstream u is mounted at
+func upstreamPath(u *url.URL) string {
+	if s := upstreamSchemes[u.Scheme]; s.Path != nil {
+		return s.Path(u)
+	}
+	return u.Path
+}
+
+// fragmentPath returns the fragment of u, or its path if it has none
+func fragmentPath(u *url.URL) string {
+	if u.Fragment != "" {
+		return u.Fragment
+	}
+	return u.Path
+}
+
+func signatureAuth(opts *Options) hmacauth.HmacAuth {
+	sigData := opts.signatureData
+	if sigData == nil {
+		return nil
+	}
+	h := opts.identityHeaders
+	if h == nil {
+		h = defaultIdentityHeaders
+	}
+	return hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key), signatureHeader, h.signatureHeaders())
+}
+
+// httpUpstream proxies requests for the path of u to its host, or to its
+// canary for users in the canary groups
+func httpUpstream(u *url.URL, opts *Options, o *UpstreamOptions) (string, http.Handler) {
+	path := u.Path
+	target := *u
+	target.Path = ""
+	log.Printf("mapping path %q => upstream %q", path, &target)
+	if o.ProxyURL != nil {
+		log.Printf("connecting to upstream %q through proxy %q", &target, o.ProxyURL.Redacted())
+	}
+	auth := signatureAuth(opts)
+	handler := newUpstreamProxy(&target, path, opts, o, auth)
+	if c := o.Canary; c != nil && o.canaryMatcher != nil {
+		log.Printf("mapping path %q => canary upstream %q for groups %v", path, c, o.CanaryGroups)
+		canaryOptions := *o
+		canaryOptions.Mirror = nil
+		canaryOptions.Credentials = o.CanaryCredentials
+		handler = &canaryRouter{
+			groups: o.canaryMatcher,
+			canary: newUpstreamProxy(c, path, opts, &canaryOptions, auth),
+			stable: handler,
+		}
+	}
+	return path, handler
+}
+
+// fileUpstream serves the directory in the path of u at the path in its
+// fragment, or at the same path if there is no fragment
+func fileUpstream(u *url.URL, opts *Options, o *UpstreamOptions) (string, http.Handler) {
+	path := fragmentPath(u)
+	log.Printf("mapping path %q => file system %q", path, u.Path)
+	return path, &UpstreamProxy{path, newFileServer(path, u.Path, o), nil, nil}
+}
+
+// validateStaticUpstream checks static://<status>/<path>?body=<body> and
+// static://echo/<path> URLs
+func validateStaticUpstream(u *url.URL, o *UpstreamOptions) error {
+	if u.Host == "echo" {
+		return nil
+	}
+	if code, err := strconv.Atoi(u.Host); err != nil || code < 200 || code > 599 {
+		return errors.New("the host of a static upstream must be a status code from 200 to 599 or echo")
+	}
+	return nil
+}
+
+// staticUpstream responds to every request for the path of u with the
+// status code in its host and the body in its query, e.g. for maintenance
+// pages or health checks
+func staticUpstream(u *url.URL, opts *Options, o *UpstreamOptions) (string, http.Handler) {
+	if u.Host == "echo" {
+		return echoUpstream(u, opts, o)
+	}
+	code, _ := strconv.Atoi(u.Host)
+	body := u.Query().Get("body")
+	if body == "" {
+		body = http.StatusText(code)
+	}
+	log.Printf("mapping path %q => static response %d", u.Path, code)
+	return u.Path, &UpstreamProxy{u.Path, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.Header().Set("X-Content-Type-Options", "nosniff")
+		rw.WriteHeader(code)
+		rw.Write([]byte(body))
+	}), nil, nil}
+}
+
+// echoUpstream responds to every request for the path of u with the request
+// as an upstream would receive it, after the identity headers, credentials
+// and signature are added, to debug header passing.
+// The values of the session cookies are redacted, as the page is readable by
+// scripts which the HttpOnly cookies are not.
+func echoUpstream(u *url.URL, opts *Options, o *UpstreamOptions) (string, http.Handler) {
+	log.Printf("mapping path %q => echo of the request", u.Path)
+	return u.Path, &UpstreamProxy{"echo", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		h := req.Header.Clone()
+		if _, ok := h["Cookie"]; ok {
+			var cookies []string
+			for _, c := range req.Cookies() {
+				if c.Name == opts.CookieName || strings.HasPrefix(c.Name, opts.CookieName+"_") {
+					c.Value = "redacted"
+				}
+				cookies = append(cookies, c.Name+"="+c.Value)
+			}
+			h.Set("Cookie", strings.Join(cookies, "; "))
+		}
+		// the basic-auth-password, upstream credentials and the signature
+		// are for the upstream alone, so only whether they are sent shows
+		for _, name := range []string{"Authorization", "Proxy-Authorization", signatureHeader} {
+			if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+				h.Set(name, "redacted")
+			}
+		}
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.Header().Set("X-Content-Type-Options", "nosniff")
+		rw.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintf(rw, "%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Proto, req.Host)
+		h.Write(rw)
+	}), signatureAuth(opts), o.Credentials}
+}
+
+func validateRedirectUpstream(u *url.URL, o *UpstreamOptions) error {
+	if u.Host == "" {
+		return errors.New("a redirect upstream needs the host to redirect to")
+	}
+	if u.Fragment != "" && strings.HasSuffix(u.Fragment, "/") != strings.HasSuffix(u.Path, "/") {
+		return errors.New("the path and fragment of a redirect upstream must both end in / or neither")
+	}
+	return nil
+}
+
+// redirectUpstream redirects requests for the path in the fragment of u, or
+// the path of u if there is no fragment, to the same request path under the
+// path of u on its host over https, e.g. with redirect://new.example.com/#/app/
+// /app/x?y=z is redirected to https://new.example.com/x?y=z
+func redirectUpstream(u *url.URL, opts *Options, o *UpstreamOptions) (string, http.Handler) {
+	path := fragmentPath(u)
+	log.Printf("mapping path %q => redirect %d to https://%s%s", path, o.RedirectCode, u.Host, u.Path)
+	return path, &UpstreamProxy{u.Host, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		target := url.URL{
+			Scheme:   "https",
+			Host:     u.Host,
+			Path:     u.Path + strings.TrimPrefix(req.URL.Path, path),
+			RawQuery: req.URL.RawQuery,
+		}
+		http.Redirect(rw, req, target.String(), o.RedirectCode)
+	}), nil, nil}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/skybet/ldap_proxy/session"
+)
+
+func TestStaticUpstream(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"static://503/maintenance/?body=Back%20soon",
+		"static://200/healthz methods=GET,HEAD",
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	for target, expected := range map[string]string{
+		"/maintenance/app": "503 Back soon",
+		"/healthz":         "200 OK",
+	} {
+		rw := httptest.NewRecorder()
+		p.serveMux.ServeHTTP(rw, httptest.NewRequest("GET", target, nil))
+		if got := rw.Result().Status[:4] + rw.Body.String(); got != expected {
+			t.Errorf("%s: expected %q got %q", target, expected, got)
+		}
+	}
+	rw := httptest.NewRecorder()
+	p.serveMux.ServeHTTP(rw, httptest.NewRequest("POST", "/healthz", nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected upstream options to apply to static upstreams, got %d", rw.Code)
+	}
+
+	for _, u := range []string{"static://ok/", "static://99/", "static://600/"} {
+		o := testOptions()
+		o.Upstreams = []string{u}
+		if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "must be a status code") {
+			t.Errorf("%s: unexpected error %v", u, err)
+		}
+	}
+}
+
+func TestEchoUpstream(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"static://echo/debug/"}
+	o.PassBasicAuth, o.BasicAuthPassword = true, "upstream-secret"
+	o.SignatureKey = "sha256:signing-secret"
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	req := httptest.NewRequest("GET", "/debug/headers?x=1", nil)
+	rw := httptest.NewRecorder()
+	p.SaveSession(rw, req, &session.State{User: "michael", Email: "michael@example.com"})
+	req.AddCookie(rw.Result().Cookies()[0])
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	req.Header.Set("X-Forwarded-User", "spoofed")
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+
+	body := rw.Body.String()
+	if rw.Code != http.StatusOK || !strings.HasPrefix(body, "GET /debug/headers?x=1 HTTP/1.1\r\nHost: example.com\r\n") {
+		t.Fatalf("expected the request echoed, got %d %q", rw.Code, body)
+	}
+	for _, expected := range []string{"X-Forwarded-User: michael\r\n", "X-Forwarded-Email: michael@example.com\r\n", "Cookie: _ldap_proxy=redacted; theme=dark\r\n", "Authorization: redacted\r\n", "Lap-Signature: redacted\r\n"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in %q", expected, body)
+		}
+	}
+	if strings.Contains(body, "spoofed") || strings.Contains(body, "Basic ") || strings.Contains(body, "sha256 ") {
+		t.Errorf("expected the identity headers of the request replaced, got %q", body)
+	}
+}
+
+func TestRegisterUpstreamScheme(t *testing.T) {
+	RegisterUpstreamScheme("test-redirect", &UpstreamScheme{
+		Handler: func(u *url.URL, opts *Options, o *UpstreamOptions) (string, http.Handler) {
+			return u.Path, http.RedirectHandler("https://"+u.Host+"/", http.StatusFound)
+		},
+	})
+	defer delete(upstreamSchemes, "test-redirect")
+
+	o := testOptions()
+	o.Upstreams = []string{"test-redirect://example.com/old/"}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	p.serveMux.ServeHTTP(rw, httptest.NewRequest("GET", "/old/page", nil))
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://example.com/" {
+		t.Errorf("expected the registered scheme to serve the upstream, got %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a scheme twice to panic")
+		}
+	}()
+	RegisterUpstreamScheme("http", &UpstreamScheme{})
+}
+
+func TestRedirectUpstream(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"redirect://reports.example.com/#/reports/",
+		"redirect://grafana.example.com/new/#/old/ redirect_code=301",
+		"redirect://wiki.example.com/wiki/",
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	p := NewLdapProxy(o, func(string) bool { return true })
+
+	for _, tc := range []struct {
+		target   string
+		code     int
+		location string
+	}{
+		{"/reports/daily?date=2018-11-26", http.StatusFound, "https://reports.example.com/daily?date=2018-11-26"},
+		{"/old/d/abc", http.StatusMovedPermanently, "https://grafana.example.com/new/d/abc"},
+		{"/wiki/Home", http.StatusFound, "https://wiki.example.com/wiki/Home"},
+	} {
+		rw := httptest.NewRecorder()
+		p.serveMux.ServeHTTP(rw, httptest.NewRequest("GET", tc.target, nil))
+		if rw.Code != tc.code || rw.Header().Get("Location") != tc.location {
+			t.Errorf("%s: expected %d to %s, got %d to %s", tc.target, tc.code, tc.location, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+
+	for _, spec := range []string{
+		"redirect:///#/reports/",
+		"redirect://reports.example.com/new#/reports/",
+		"redirect://reports.example.com/ redirect_code=200",
+	} {
+		o := testOptions()
+		o.Upstreams = []string{spec}
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected error validating %q", spec)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// upstreamTransport makes the connections to an upstream. Both proxy
+// directors send the request URI as an opaque path, which net/http writes
+// as it is, while HTTP proxies need the absolute URL of plain http requests,
+// so it is made absolute for requests going through one.
+type upstreamTransport struct {
+	*http.Transport
+}
+
+// newUpstreamTransport returns the transport of an upstream with o: one
+// taking the outbound proxy from HTTPS_PROXY, HTTP_PROXY and NO_PROXY and
+// waiting a second for 100 Continue, as http.DefaultTransport does, unless
+// o says otherwise
+func newUpstreamTransport(o *UpstreamOptions) *upstreamTransport {
+	t := http.DefaultTransport.(*http.Transport)
+	if o.ProxyURL == nil && !o.NoProxy && o.ExpectContinueTimeout == 0 {
+		return &upstreamTransport{t}
+	}
+	t = t.Clone()
+	switch {
+	case o.NoProxy:
+		t.Proxy = nil
+	case o.ProxyURL != nil:
+		t.Proxy = http.ProxyURL(o.ProxyURL)
+	}
+	if o.ExpectContinueTimeout > 0 {
+		t.ExpectContinueTimeout = o.ExpectContinueTimeout
+	}
+	return &upstreamTransport{t}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && req.URL.Opaque != "" && !strings.HasPrefix(req.URL.Opaque, "//") && t.Proxy != nil {
+		if p, err := t.Proxy(req); err == nil && p != nil && (p.Scheme == "http" || p.Scheme == "https") {
+			r := new(http.Request)
+			*r = *req
+			u := *req.URL
+			u.Opaque = "//" + u.Host + u.Opaque
+			r.URL = &u
+			req = r
+		}
+	}
+	return t.Transport.RoundTrip(req)
+}
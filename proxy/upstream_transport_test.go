@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestUpstreamTransportProxy(t *testing.T) {
+	egress := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%s via egress as %s", req.RequestURI, req.Header.Get("Proxy-Authorization"))
+	}))
+	defer egress.Close()
+	proxyURL, _ := url.Parse(egress.URL)
+	proxyURL.User = url.UserPassword("svc", "secret")
+
+	_, o, err := parseUpstream("http://upstream.invalid/ proxy=" + proxyURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://upstream.invalid")
+	rw := httptest.NewRecorder()
+	newUpstreamProxy(u, "/", testOptions(), o, nil).ServeHTTP(rw, httptest.NewRequest("GET", "/reports/", nil))
+	if expected := "http://upstream.invalid/reports/ via egress as Basic c3ZjOnNlY3JldA=="; rw.Body.String() != expected {
+		t.Errorf("expected the request to go through the proxy, got %d %q", rw.Code, rw.Body)
+	}
+
+	if newUpstreamTransport(&UpstreamOptions{}).Transport != http.DefaultTransport {
+		t.Error("expected upstreams without options to share the default transport")
+	}
+	_, o, _ = parseUpstream("http://a/ proxy=direct")
+	if newUpstreamTransport(o).Proxy != nil {
+		t.Error("expected proxy=direct to ignore the environment")
+	}
+	for _, spec := range []string{"http://a/ proxy=ftp://egress:21", "http://a/ proxy=egress:3128", "http://a/ proxy=http://egress:3128/path", "http://a/ proxy=socks5://"} {
+		if _, _, err := parseUpstream(spec); err == nil {
+			t.Errorf("expected error parsing %q", spec)
+		}
+	}
+	if _, o, err := parseUpstream("http://a/ proxy=socks5h://127.0.0.1:1080"); err != nil || o.ProxyURL.Scheme != "socks5h" {
+		t.Errorf("expected a socks5 proxy, got %+v %v", o, err)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/skybet/ldap_proxy/ldapauth"
+)
+
+// UserReport is what the directory holds about a user, as used by the ldap
+// authenticator at sign-in
+type UserReport struct {
+	// Login is the username after login-normalize
+	Login       string
+	UserFilter  string
+	DN          string
+	Attributes  map[string]string
+	GroupFilter string
+	// Groups are the user's groups in the form they are compared with
+	// ldap-groups, by DN
+	Groups map[string]string
+
+	// PasswordChecked is false if no password was given
+	PasswordChecked bool
+	PasswordError   error
+
+	// MatchedGroup is the group which satisfied ldap-groups, if any
+	MatchedGroup string
+	Authorized   bool
+}
+
+// VerifyUser runs the searches made at sign-in for username, checking
+// password if it isn't empty, and reports the results
+func VerifyUser(opts *Options, username, password string) (*UserReport, error) {
+	matcher, err := ldapauth.NewGroupMatcher(opts.LdapGroupMatch, opts.LdapGroups)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseLoginRules(opts.LoginNormalize)
+	if err != nil {
+		return nil, err
+	}
+	username = normalizeLogin(rules, username)
+	cfg := newLdapConfig(opts)
+	if opts.LdapBindDnPasswordFile != "" {
+		if _, err := cfg.ReloadBindPassword(); err != nil {
+			return nil, fmt.Errorf("unable to read %s %s", opts.LdapBindDnPasswordFile, err)
+		}
+	}
+
+	client, err := ldapauth.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open LDAP Connection: %+v", err)
+	}
+	defer client.Close()
+
+	r := &UserReport{
+		Login:      username,
+		UserFilter: fmt.Sprintf(cfg.UserFilter, username),
+		Attributes: make(map[string]string),
+		Groups:     make(map[string]string),
+	}
+	entry, err := client.LookupUser(username)
+	if err != nil {
+		return r, fmt.Errorf("searching %s: %v", r.UserFilter, err)
+	}
+	r.DN = entry.DN
+	for _, attr := range cfg.Attributes {
+		r.Attributes[attr] = entry.GetAttributeValue(attr)
+	}
+
+	r.GroupFilter = fmt.Sprintf(cfg.GroupFilter, r.DN)
+	entries, err := client.GetGroupEntriesOfUser(r.DN)
+	if err != nil {
+		return r, fmt.Errorf("searching %s: %v", r.GroupFilter, err)
+	}
+	values := make([]string, 0, len(entries))
+	for _, e := range entries {
+		v := matcher.Value(e)
+		r.Groups[e.DN] = v
+		values = append(values, v)
+	}
+	if len(opts.LdapGroups) == 0 {
+		r.Authorized = true
+	} else {
+		r.MatchedGroup, r.Authorized = matcher.Match(values)
+	}
+
+	if password != "" {
+		r.PasswordChecked = true
+		if ok, _, err := client.Authenticate(username, password); !ok {
+			r.PasswordError = err
+			if err == nil {
+				r.PasswordError = ErrInvalidCredentials
+			}
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestVerifyUserConnectionError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	o := testOptions()
+	o.LdapServerHost = "127.0.0.1"
+	o.LdapServerPort = port
+	if _, err := VerifyUser(o, "michael", ""); err == nil {
+		t.Error("expected connection error")
+	}
+
+	o.LdapGroupMatch = "glob"
+	if _, err := VerifyUser(o, "michael", ""); err == nil || err.Error() != "invalid ldap-group-match \"glob\" (must be one of cn, dn, regex)" {
+		t.Error("unexpected error", err)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 // VERSION released
 const VERSION = "0.4.0"
@@ -0,0 +1,64 @@
+package session
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// compressedPrefix marks a zlib compressed cookie payload. Uncompressed
+// payloads are a username or email followed by | separated fields, so can
+// never start with a NUL byte.
+const compressedPrefix = "\x00"
+
+// compressThreshold is the payload size below which values are stored as is,
+// keeping small cookies readable by releases without compression support
+var compressThreshold = 256
+
+// maxDecompressedSize bounds the size of a decompressed payload
+const maxDecompressedSize = 64 << 10
+
+// compress returns v zlib compressed if it is large enough and compression
+// actually makes it shorter, otherwise v unchanged
+func compress(v string) (string, error) {
+	if len(v) < compressThreshold {
+		return v, nil
+	}
+	var b bytes.Buffer
+	b.WriteString(compressedPrefix)
+	w := zlib.NewWriter(&b)
+	if _, err := io.WriteString(w, v); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if b.Len() >= len(v) {
+		return v, nil
+	}
+	return b.String(), nil
+}
+
+// decompress reverses compress, passing through values which were never
+// compressed
+func decompress(v string) (string, error) {
+	if !strings.HasPrefix(v, compressedPrefix) {
+		return v, nil
+	}
+	r, err := zlib.NewReader(strings.NewReader(v[len(compressedPrefix):]))
+	if err != nil {
+		return "", fmt.Errorf("invalid compressed session: %v", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return "", fmt.Errorf("invalid compressed session: %v", err)
+	}
+	if len(b) > maxDecompressedSize {
+		return "", fmt.Errorf("compressed session exceeds %d bytes", maxDecompressedSize)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		value      string
+		compressed bool
+	}{
+		{
+			desc:  "small value",
+			value: "michael@example.com|1500000000",
+		},
+		{
+			desc:       "large value",
+			value:      "michael@example.com|1500000000|" + strings.Repeat("cn=admins,ou=groups,dc=example,dc=com;", 20),
+			compressed: true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			c, err := compress(tC.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if got := strings.HasPrefix(c, compressedPrefix); got != tC.compressed {
+				t.Errorf("expected compressed %v, got %v", tC.compressed, got)
+			}
+			if tC.compressed && len(c) >= len(tC.value) {
+				t.Errorf("expected compressed value shorter than %d, got %d", len(tC.value), len(c))
+			}
+			d, err := decompress(c)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if d != tC.value {
+				t.Errorf("expected %q, got %q", tC.value, d)
+			}
+		})
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	if _, err := decompress(compressedPrefix + "not zlib"); err == nil {
+		t.Error("expected error decompressing invalid data")
+	}
+}
+
+func TestSessionFromLegacyCookie(t *testing.T) {
+	// cookies written before compression support must still decode
+	for _, v := range []string{"michael", "michael@example.com|1500000000", "michael|1500000000|1500000001"} {
+		s, err := SessionFromCookie(v, nil)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %q: %+v", v, err)
+		}
+		if s.User != "michael" {
+			t.Errorf("unexpected session %+v from %q", s, v)
+		}
+	}
+}
+
+func TestCompressedSessionRoundTrip(t *testing.T) {
+	defer func(n int) { compressThreshold = n }(compressThreshold)
+	compressThreshold = 0
+
+	in := &State{User: strings.Repeat("michael", 50), ExpiresOn: time.Unix(1500000000, 0)}
+	v, err := CookieForSession(in, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !strings.HasPrefix(v, compressedPrefix) {
+		t.Fatalf("expected compressed cookie, got %q", v)
+	}
+	s, err := SessionFromCookie(v, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if s.User != in.User {
+		t.Errorf("expected user %q, got %q", in.User, s.User)
+	}
+}
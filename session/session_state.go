@@ -0,0 +1,236 @@
+// Package session holds the state of an authenticated user and its cookie
+// serialization.
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skybet/ldap_proxy/cookie"
+)
+
+// State is the session of an authenticated user
+type State struct {
+	ExpiresOn time.Time
+	Email     string
+	User      string
+
+	// BannerAcceptedAt is when the user acknowledged the sign-in banner
+	BannerAcceptedAt time.Time
+
+	// Groups are the user's groups at sign-in, kept when the access policy
+	// depends on them
+	Groups []string
+
+	// DN is the canonical DN of the user's directory entry, kept when it is
+	// passed to upstreams
+	DN string
+
+	// Attributes are the directory attributes of the user kept for the
+	// authorization webhook
+	Attributes map[string]string
+
+	// AccessToken is an opaque random token identifying the session to
+	// upstreams
+	AccessToken string
+
+	// Realm is the directory the user signed in against, empty for the
+	// default one
+	Realm string
+
+	// CookieExpiresOn is when the cookie carrying this session stops being
+	// accepted. It is derived from the cookie timestamp and never serialized.
+	CookieExpiresOn time.Time
+
+	// Ticket references the session in a Store, if it is kept in one
+	Ticket string
+
+	// PreviousSignInAt and PreviousSignInIP describe the user's sign-in
+	// before the one that started this session, if it was recorded
+	PreviousSignInAt time.Time
+	PreviousSignInIP string
+	// FailedSignIns counts the sign-ins with the user's name which failed
+	// between that sign-in and this one
+	FailedSignIns int
+	// Login is the name the user signed in with, if it isn't User. It is
+	// never serialized.
+	Login string
+
+	// CreatedAt, IP and UserAgent describe the sign-in and LastSeenAt the
+	// latest request made with the session. Only a Store keeps them; they
+	// are never serialized into the cookie.
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	IP         string
+	UserAgent  string
+
+	// GroupsPending is set while the groups of a sign-in made with
+	// -ldap-defer-groups are being looked up. Only a Store keeps it.
+	GroupsPending bool
+}
+
+const COOKIE_CHUNK_COUNT = 3
+
+// CookieForSession serializes a session state for storage in a cookie,
+// compressing large payloads
+func CookieForSession(s *State, c *cookie.Cipher) (string, error) {
+	v, err := s.EncodeState(c)
+	if err != nil {
+		return "", err
+	}
+	return compress(v)
+}
+
+// SessionFromCookie deserializes a session from a cookie value
+func SessionFromCookie(v string, c *cookie.Cipher) (s *State, err error) {
+	v, err = decompress(v)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeState(v, c)
+}
+
+// Cookie serialization versions. A version byte leads the serialized state,
+// except for cookies written before versioning was introduced, which are |
+// separated fields and are migrated as they are read. Bytes below 0x20 can't
+// start a legacy cookie so are reserved for versions and the compressed and
+// ticket prefixes.
+const (
+	versionJSON byte = 2
+
+	currentVersion = versionJSON
+)
+
+// stateJSON is the versionJSON serialization of a State. Fields may be added
+// freely; older releases ignore fields they don't know.
+type stateJSON struct {
+	User             string   `json:"u,omitempty"`
+	Email            string   `json:"e,omitempty"`
+	ExpiresOn        int64    `json:"x,omitempty"`
+	BannerAcceptedAt int64    `json:"b,omitempty"`
+	Groups           []string `json:"g,omitempty"`
+	DN               string   `json:"dn,omitempty"`
+	AccessToken      string   `json:"t,omitempty"`
+	Realm            string   `json:"r,omitempty"`
+	PreviousSignInAt int64    `json:"pa,omitempty"`
+	PreviousSignInIP string   `json:"pi,omitempty"`
+	FailedSignIns    int      `json:"fs,omitempty"`
+
+	Attributes map[string]string `json:"a,omitempty"`
+}
+
+func (s *State) EncodeState(c *cookie.Cipher) (string, error) {
+	return s.encode(currentVersion)
+}
+
+func (s *State) EncryptedString(c *cookie.Cipher) (string, error) {
+	if c == nil {
+		panic("error. missing cipher")
+	}
+	return s.encode(currentVersion)
+}
+
+func (s *State) encode(version byte) (string, error) {
+	switch version {
+	case versionJSON:
+		j := stateJSON{User: s.User, Email: s.Email, Groups: s.Groups, DN: s.DN, AccessToken: s.AccessToken, Realm: s.Realm, PreviousSignInIP: s.PreviousSignInIP, FailedSignIns: s.FailedSignIns, Attributes: s.Attributes}
+		if !s.ExpiresOn.IsZero() {
+			j.ExpiresOn = s.ExpiresOn.Unix()
+		}
+		if !s.BannerAcceptedAt.IsZero() {
+			j.BannerAcceptedAt = s.BannerAcceptedAt.Unix()
+		}
+		if !s.PreviousSignInAt.IsZero() {
+			j.PreviousSignInAt = s.PreviousSignInAt.Unix()
+		}
+		b, err := json.Marshal(j)
+		if err != nil {
+			return "", err
+		}
+		return string(version) + string(b), nil
+	}
+	return "", fmt.Errorf("unknown session version %d", version)
+}
+
+func DecodeState(v string, c *cookie.Cipher) (s *State, err error) {
+	if v == "" || v[0] >= 0x20 {
+		return decodeLegacyState(v)
+	}
+	switch v[0] {
+	case versionJSON:
+		j := stateJSON{}
+		if err := json.Unmarshal([]byte(v[1:]), &j); err != nil {
+			return nil, fmt.Errorf("invalid session: %v", err)
+		}
+		s = &State{User: j.User, Email: j.Email, Groups: j.Groups, DN: j.DN, AccessToken: j.AccessToken, Realm: j.Realm, PreviousSignInIP: j.PreviousSignInIP, FailedSignIns: j.FailedSignIns, Attributes: j.Attributes}
+		if j.ExpiresOn != 0 {
+			s.ExpiresOn = time.Unix(j.ExpiresOn, 0)
+		}
+		if j.BannerAcceptedAt != 0 {
+			s.BannerAcceptedAt = time.Unix(j.BannerAcceptedAt, 0)
+		}
+		if j.PreviousSignInAt != 0 {
+			s.PreviousSignInAt = time.Unix(j.PreviousSignInAt, 0)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported session version %d", v[0])
+}
+
+// decodeLegacyState reads the unversioned user[|expires[|bannerAccepted]]
+// format
+func decodeLegacyState(v string) (s *State, err error) {
+	chunks := strings.Split(v, "|")
+	if len(chunks) == 1 {
+		if strings.Contains(chunks[0], "@") {
+			u := strings.Split(v, "@")[0]
+			return &State{Email: v, User: u}, nil
+		}
+		return &State{User: v}, nil
+	}
+
+	if len(chunks) > COOKIE_CHUNK_COUNT {
+		err = fmt.Errorf("invalid number of fields (got %d expected at most %d)", len(chunks), COOKIE_CHUNK_COUNT)
+		return
+	}
+
+	s = &State{}
+	if u := chunks[0]; strings.Contains(u, "@") {
+		s.Email = u
+		s.User = strings.Split(u, "@")[0]
+	} else {
+		s.User = u
+	}
+	ts, _ := strconv.Atoi(chunks[1])
+	s.ExpiresOn = time.Unix(int64(ts), 0)
+	if len(chunks) > 2 {
+		ts, _ = strconv.Atoi(chunks[2])
+		s.BannerAcceptedAt = time.Unix(int64(ts), 0)
+	}
+	return
+}
+
+func (s *State) IsExpired() bool {
+	if !s.ExpiresOn.IsZero() && s.ExpiresOn.Before(time.Now()) {
+		return true
+	}
+	return false
+}
+
+// String describes s for logs, leaving out its tokens and ticket
+func (s *State) String() string {
+	o := fmt.Sprintf("Session{user:%s", s.User)
+	if s.Email != "" {
+		o += " email:" + s.Email
+	}
+	if s.Realm != "" {
+		o += " realm:" + s.Realm
+	}
+	if !s.ExpiresOn.IsZero() {
+		o += " expires:" + s.ExpiresOn.UTC().Format(time.RFC3339)
+	}
+	return o + "}"
+}
@@ -0,0 +1,181 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skybet/ldap_proxy/cookie"
+)
+
+func TestSessionStateRoundTrip(t *testing.T) {
+	c, err := cookie.NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	accepted := time.Unix(1500000000, 0)
+
+	testCases := []struct {
+		desc    string
+		cipher  *cookie.Cipher
+		session *State
+	}{
+		{
+			desc:    "plain user",
+			session: &State{User: "michael"},
+		},
+		{
+			desc:    "plain user with banner",
+			session: &State{User: "michael", BannerAcceptedAt: accepted},
+		},
+		{
+			desc:    "cipher email",
+			cipher:  c,
+			session: &State{User: "michael", Email: "michael@example.com", ExpiresOn: accepted},
+		},
+		{
+			desc:    "cipher with banner",
+			cipher:  c,
+			session: &State{User: "michael", BannerAcceptedAt: accepted},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			v, err := CookieForSession(tC.session, tC.cipher)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			s, err := SessionFromCookie(v, tC.cipher)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if s.User != tC.session.User || s.Email != tC.session.Email {
+				t.Errorf("expected %+v, got %+v", tC.session, s)
+			}
+			if !s.ExpiresOn.Equal(tC.session.ExpiresOn) {
+				t.Errorf("expected ExpiresOn %s, got %s", tC.session.ExpiresOn, s.ExpiresOn)
+			}
+			if !s.BannerAcceptedAt.Equal(tC.session.BannerAcceptedAt) {
+				t.Errorf("expected BannerAcceptedAt %s, got %s", tC.session.BannerAcceptedAt, s.BannerAcceptedAt)
+			}
+		})
+	}
+}
+
+func TestDecodeSessionStateLegacy(t *testing.T) {
+	s, err := DecodeState("michael@example.com|1500000000", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if s.User != "michael" || s.Email != "michael@example.com" {
+		t.Errorf("unexpected session %+v", s)
+	}
+	if !s.BannerAcceptedAt.IsZero() {
+		t.Errorf("expected no banner acceptance, got %s", s.BannerAcceptedAt)
+	}
+}
+
+func TestEncodeStateIsVersioned(t *testing.T) {
+	v, err := CookieForSession(&State{User: "michael", Email: "michael@example.com"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if v[0] != currentVersion {
+		t.Errorf("expected version %d, got %q", currentVersion, v)
+	}
+}
+
+func TestDecodeStateForwardCompatible(t *testing.T) {
+	// fields added by later releases are ignored
+	s, err := DecodeState("\x02"+`{"u":"michael","x":1500000000,"groups":["admins"]}`, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if s.User != "michael" || !s.ExpiresOn.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("unexpected session %+v", s)
+	}
+}
+
+func TestDecodeStateUnsupportedVersion(t *testing.T) {
+	if _, err := DecodeState("\x07{}", nil); err == nil || err.Error() != "unsupported session version 7" {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestSessionGroupsRoundTrip(t *testing.T) {
+	v, err := CookieForSession(&State{User: "michael", Groups: []string{"admins", "ops"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	s, err := SessionFromCookie(v, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(s.Groups) != 2 || s.Groups[0] != "admins" || s.Groups[1] != "ops" {
+		t.Errorf("unexpected groups %v", s.Groups)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	s := &State{User: "michael", Email: "michael@example.com", AccessToken: "secret", Ticket: "ticket", FailedSignIns: 2, ExpiresOn: time.Unix(1500000000, 0)}
+	if got := s.String(); got != "Session{user:michael email:michael@example.com expires:2017-07-14T02:40:00Z}" {
+		t.Errorf("unexpected description %q", got)
+	}
+}
+
+func TestSessionAttributesRoundTrip(t *testing.T) {
+	v, err := CookieForSession(&State{User: "michael", Attributes: map[string]string{"department": "Payments"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	s, err := SessionFromCookie(v, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(s.Attributes) != 1 || s.Attributes["department"] != "Payments" {
+		t.Errorf("unexpected attributes %v", s.Attributes)
+	}
+}
+
+func TestSessionRealmRoundTrip(t *testing.T) {
+	v, err := CookieForSession(&State{User: "michael", Realm: "acme"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	s, err := SessionFromCookie(v, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if s.Realm != "acme" {
+		t.Errorf("unexpected realm %q", s.Realm)
+	}
+}
+
+func TestSessionPreviousSignInRoundTrip(t *testing.T) {
+	at := time.Unix(1760257800, 0)
+	v, err := CookieForSession(&State{User: "michael", PreviousSignInAt: at, PreviousSignInIP: "10.1.2.3", FailedSignIns: 3}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	s, err := SessionFromCookie(v, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !s.PreviousSignInAt.Equal(at) || s.PreviousSignInIP != "10.1.2.3" || s.FailedSignIns != 3 {
+		t.Errorf("unexpected previous sign-in %s from %q after %d failures", s.PreviousSignInAt, s.PreviousSignInIP, s.FailedSignIns)
+	}
+}
+
+func TestSessionDNRoundTrip(t *testing.T) {
+	v, err := CookieForSession(&State{User: "michael", DN: "uid=michael,ou=people,dc=example,dc=com"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	s, err := SessionFromCookie(v, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if s.DN != "uid=michael,ou=people,dc=example,dc=com" {
+		t.Errorf("unexpected DN %q", s.DN)
+	}
+}
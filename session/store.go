@@ -0,0 +1,197 @@
+package session
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned by a Store for unknown, expired or revoked
+// tickets
+var ErrSessionNotFound = errors.New("session not found")
+
+// Store keeps sessions server side, so the cookie only carries a ticket
+// referencing them. Clearing a ticket revokes the session immediately.
+type Store interface {
+	// Save stores s, reusing s.Ticket if set, and returns its ticket
+	Save(s *State) (string, error)
+	Load(ticket string) (*State, error)
+	Clear(ticket string) error
+}
+
+// Lister is implemented by Stores which can list the sessions of a user
+type Lister interface {
+	// Sessions returns the unexpired sessions of user, most recently seen
+	// first
+	Sessions(user string) ([]*State, error)
+}
+
+// TicketID identifies the session of a ticket without revealing the ticket,
+// which would let whoever learns it use the session
+func TicketID(ticket string) string {
+	h := sha256.Sum256([]byte(ticket))
+	return base64.RawURLEncoding.EncodeToString(h[:12])
+}
+
+// ticketPrefix marks a cookie value holding a Store ticket rather than a
+// session. Like compressedPrefix it can't start a serialized session.
+const ticketPrefix = "\x01"
+
+// TicketCookie returns the cookie value for a Store ticket
+func TicketCookie(ticket string) string {
+	return ticketPrefix + ticket
+}
+
+// TicketFromCookie returns the Store ticket held in a cookie value
+func TicketFromCookie(v string) (string, bool) {
+	if !strings.HasPrefix(v, ticketPrefix) {
+		return "", false
+	}
+	return v[len(ticketPrefix):], true
+}
+
+var storeMetrics = expvar.NewMap("session_store")
+
+// MemoryStore is an in process Store holding at most MaxEntries sessions for
+// TTL after they were last saved, evicting the least recently used sessions
+// first. Sessions don't survive a restart and aren't shared between
+// instances.
+type MemoryStore struct {
+	MaxEntries int
+	TTL        time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	ticket    string
+	state     State
+	expiresOn time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore(maxEntries int, ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		MaxEntries: maxEntries,
+		TTL:        ttl,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func newTicket() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to create session ticket %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (m *MemoryStore) Save(s *State) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresOn := time.Now().Add(m.TTL)
+	if el, ok := m.entries[s.Ticket]; ok && s.Ticket != "" {
+		e := el.Value.(*memoryEntry)
+		e.state = *s
+		e.expiresOn = expiresOn
+		m.lru.MoveToFront(el)
+		return e.ticket, nil
+	}
+
+	ticket, err := newTicket()
+	if err != nil {
+		return "", err
+	}
+	s.Ticket = ticket
+	m.entries[ticket] = m.lru.PushFront(&memoryEntry{ticket: ticket, state: *s, expiresOn: expiresOn})
+	storeMetrics.Add("entries", 1)
+
+	for m.MaxEntries > 0 && m.lru.Len() > m.MaxEntries {
+		m.remove(m.lru.Back())
+		storeMetrics.Add("evictions", 1)
+	}
+	return ticket, nil
+}
+
+func (m *MemoryStore) Load(ticket string) (*State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[ticket]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	e := el.Value.(*memoryEntry)
+	if e.expiresOn.Before(time.Now()) {
+		m.remove(el)
+		storeMetrics.Add("expirations", 1)
+		return nil, ErrSessionNotFound
+	}
+	m.lru.MoveToFront(el)
+	e.state.LastSeenAt = time.Now()
+	s := e.state
+	return &s, nil
+}
+
+func (m *MemoryStore) Sessions(user string) ([]*State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var sessions []*State
+	for _, el := range m.entries {
+		e := el.Value.(*memoryEntry)
+		if e.state.User != user || e.expiresOn.Before(now) {
+			continue
+		}
+		s := e.state
+		sessions = append(sessions, &s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return lastSeen(sessions[i]).After(lastSeen(sessions[j]))
+	})
+	return sessions, nil
+}
+
+func lastSeen(s *State) time.Time {
+	if s.LastSeenAt.IsZero() {
+		return s.CreatedAt
+	}
+	return s.LastSeenAt
+}
+
+func (m *MemoryStore) Clear(ticket string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[ticket]; ok {
+		m.remove(el)
+	}
+	return nil
+}
+
+// Len returns the number of stored sessions, including expired sessions not
+// yet evicted
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+func (m *MemoryStore) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*memoryEntry).ticket)
+	storeMetrics.Add("entries", -1)
+}
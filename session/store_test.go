@@ -0,0 +1,106 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRoundTrip(t *testing.T) {
+	m := NewMemoryStore(10, time.Hour)
+	s := &State{User: "michael", Email: "michael@example.com"}
+	ticket, err := m.Save(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if s.Ticket != ticket {
+		t.Errorf("expected session ticket %q, got %q", ticket, s.Ticket)
+	}
+
+	loaded, err := m.Load(ticket)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if loaded.User != s.User || loaded.Email != s.Email || loaded.Ticket != ticket {
+		t.Errorf("expected %+v, got %+v", s, loaded)
+	}
+
+	// saving a loaded session keeps its ticket
+	if again, _ := m.Save(loaded); again != ticket {
+		t.Errorf("expected ticket %q to be reused, got %q", ticket, again)
+	}
+	if m.Len() != 1 {
+		t.Errorf("expected 1 session, got %d", m.Len())
+	}
+
+	m.Clear(ticket)
+	if _, err := m.Load(ticket); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound after Clear, got %v", err)
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	m := NewMemoryStore(2, time.Hour)
+	first, _ := m.Save(&State{User: "first"})
+	second, _ := m.Save(&State{User: "second"})
+	m.Load(first)
+	third, _ := m.Save(&State{User: "third"})
+
+	if m.Len() != 2 {
+		t.Errorf("expected 2 sessions, got %d", m.Len())
+	}
+	if _, err := m.Load(second); err != ErrSessionNotFound {
+		t.Errorf("expected least recently used session to be evicted, got %v", err)
+	}
+	for _, ticket := range []string{first, third} {
+		if _, err := m.Load(ticket); err != nil {
+			t.Errorf("unexpected error loading %q: %+v", ticket, err)
+		}
+	}
+}
+
+func TestMemoryStoreExpires(t *testing.T) {
+	m := NewMemoryStore(10, -time.Second)
+	ticket, _ := m.Save(&State{User: "michael"})
+	if _, err := m.Load(ticket); err != ErrSessionNotFound {
+		t.Errorf("expected expired session, got %v", err)
+	}
+	if m.Len() != 0 {
+		t.Errorf("expected expired session to be removed, got %d sessions", m.Len())
+	}
+}
+
+func TestTicketCookie(t *testing.T) {
+	if ticket, ok := TicketFromCookie(TicketCookie("abc")); !ok || ticket != "abc" {
+		t.Errorf("expected ticket abc, got %q %v", ticket, ok)
+	}
+	if _, ok := TicketFromCookie("michael|1500000000"); ok {
+		t.Error("expected serialized session not to be a ticket")
+	}
+}
+
+func TestMemoryStoreSessions(t *testing.T) {
+	m := NewMemoryStore(10, time.Hour)
+	now := time.Now()
+	older, _ := m.Save(&State{User: "michael", CreatedAt: now.Add(-time.Hour)})
+	newer, _ := m.Save(&State{User: "michael", CreatedAt: now.Add(-time.Minute)})
+	m.Save(&State{User: "alice", CreatedAt: now})
+
+	sessions, err := m.Sessions("michael")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(sessions) != 2 || sessions[0].Ticket != newer || sessions[1].Ticket != older {
+		t.Fatalf("expected michael's sessions most recent first, got %+v", sessions)
+	}
+
+	// using a session makes it the most recently seen
+	m.Load(older)
+	sessions, _ = m.Sessions("michael")
+	if sessions[0].Ticket != older || sessions[0].LastSeenAt.IsZero() {
+		t.Errorf("expected the loaded session first, got %+v", sessions)
+	}
+
+	if TicketID(older) == TicketID(newer) || TicketID(older) == older {
+		t.Error("expected distinct ids which aren't the tickets")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/skybet/ldap_proxy/proxy"
+)
+
+// verifyUser implements the verify-user subcommand, printing what the
+// directory returns for username and whether they would be allowed to sign in
+func verifyUser(opts *proxy.Options, username string) int {
+	if username == "" {
+		fmt.Fprintln(os.Stderr, "verify-user: -username is required")
+		return 2
+	}
+	password, err := readPassword(fmt.Sprintf("Password for %s (empty to skip): ", username))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-user: reading password: %s\n", err)
+		return 2
+	}
+
+	r, err := proxy.VerifyUser(opts, username, password)
+	if r != nil {
+		if r.Login != username {
+			fmt.Printf("login:        %s\n", r.Login)
+		}
+		fmt.Printf("user filter:  %s\n", r.UserFilter)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-user: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("dn:           %s\n", r.DN)
+	for _, attr := range sortedKeys(r.Attributes) {
+		fmt.Printf("%-13s %s\n", attr+":", r.Attributes[attr])
+	}
+	if r.PasswordChecked {
+		if r.PasswordError != nil {
+			fmt.Printf("password:     rejected (%s)\n", r.PasswordError)
+		} else {
+			fmt.Printf("password:     accepted\n")
+		}
+	}
+
+	fmt.Printf("group filter: %s\n", r.GroupFilter)
+	fmt.Printf("groups:       %d\n", len(r.Groups))
+	for _, dn := range sortedKeys(r.Groups) {
+		fmt.Printf("  %s (compared as %q)\n", dn, r.Groups[dn])
+	}
+
+	switch {
+	case len(opts.LdapGroups) == 0:
+		fmt.Println("ldap-groups:  none configured; any authenticated user is allowed")
+	case r.Authorized:
+		fmt.Printf("ldap-groups:  allowed by %q (ldap-group-match=%s)\n", r.MatchedGroup, opts.LdapGroupMatch)
+	default:
+		fmt.Printf("ldap-groups:  denied, not in any of %s (ldap-group-match=%s)\n", strings.Join(opts.LdapGroups, ", "), opts.LdapGroupMatch)
+	}
+
+	if !r.Authorized || r.PasswordError != nil {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}